@@ -0,0 +1,565 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// AggregateSpec is one aggregate of an aggregate request, e.g. {"func": "sum", "column": "amount", "as": "total"}.
+type AggregateSpec struct {
+	Func   string `json:"func"`
+	Column string `json:"column,omitempty"`
+	As     string `json:"as,omitempty"`
+}
+
+// aggregatePlan is the validated form of an aggregate request. Order and Having refer to
+// group columns and aggregate aliases.
+type aggregatePlan struct {
+	Table      string
+	GroupBy    []string
+	Aggregates []AggregateSpec
+	Having     *Filter
+	Order      []OrderTerm
+	Limit      int
+	Offset     int
+	output     *TableSchema
+	// SortKeys maps text group columns and the aliases of MIN and MAX over text to the
+	// partial column holding their collation sort key. Shards are merged on these keys, so
+	// groups and extremes come out as MySQL's collation decides them.
+	SortKeys map[string]string
+}
+
+var aggregateFuncs = map[string]bool{"COUNT": true, "SUM": true, "MIN": true, "MAX": true, "AVG": true}
+
+func buildAggregatePlan(req *crudRequest, schema *TableSchema) (*aggregatePlan, error) {
+	if len(req.Aggregates) == 0 {
+		return nil, fmt.Errorf("at least one aggregate is required")
+	}
+	if req.Limit < 0 || req.Offset < 0 {
+		return nil, fmt.Errorf("limit and offset must not be negative")
+	}
+	plan := &aggregatePlan{Table: schema.Table, Having: req.Having, Limit: req.Limit, Offset: req.Offset}
+
+	// The output of an aggregate query has its own columns: the group columns and the aliases.
+	output := &TableSchema{DBName: schema.DBName, Table: schema.Table, byName: make(map[string]int)}
+	addOutput := func(name string) error {
+		if _, dup := output.byName[strings.ToLower(name)]; dup {
+			return fmt.Errorf("duplicate output column '%s'", name)
+		}
+		output.byName[strings.ToLower(name)] = len(output.Columns)
+		output.Columns = append(output.Columns, ColumnInfo{Name: name})
+		return nil
+	}
+
+	for _, name := range req.GroupBy {
+		col, ok := schema.Column(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown column '%s' in groupBy for table '%s'", name, schema.Table)
+		}
+		if err := addOutput(col.Name); err != nil {
+			return nil, err
+		}
+		if isTextType(col.DataType) {
+			plan.addSortKey(col.Name, fmt.Sprintf("__group%d_sort", len(plan.GroupBy)))
+		}
+		plan.GroupBy = append(plan.GroupBy, col.Name)
+	}
+
+	for _, spec := range req.Aggregates {
+		spec.Func = strings.ToUpper(strings.TrimSpace(spec.Func))
+		if !aggregateFuncs[spec.Func] {
+			return nil, fmt.Errorf("unsupported aggregate function '%s'", spec.Func)
+		}
+		if spec.Column == "*" || spec.Column == "" {
+			if spec.Func != "COUNT" {
+				return nil, fmt.Errorf("%s requires a column", spec.Func)
+			}
+			spec.Column = ""
+		}
+		text := false
+		if spec.Column != "" {
+			col, ok := schema.Column(spec.Column)
+			if !ok {
+				return nil, fmt.Errorf("unknown column '%s' in aggregates for table '%s'", spec.Column, schema.Table)
+			}
+			spec.Column = col.Name
+			text = isTextType(col.DataType)
+		}
+		if spec.As == "" {
+			spec.As = spec.defaultAlias()
+		}
+		if !isValidIdentifier(spec.As) {
+			return nil, fmt.Errorf("invalid aggregate alias '%s'", spec.As)
+		}
+		if err := addOutput(spec.As); err != nil {
+			return nil, err
+		}
+		if text && (spec.Func == "MIN" || spec.Func == "MAX") {
+			plan.addSortKey(spec.As, partialColumn(len(plan.Aggregates), "sort"))
+		}
+		plan.Aggregates = append(plan.Aggregates, spec)
+	}
+
+	for _, term := range req.OrderBy {
+		col, ok := output.Column(term.Column)
+		if !ok {
+			return nil, fmt.Errorf("orderBy column '%s' must be a group column or aggregate alias", term.Column)
+		}
+		plan.Order = append(plan.Order, OrderTerm{Column: col.Name, Desc: term.Desc})
+	}
+	if len(plan.Order) == 0 {
+		for _, name := range plan.GroupBy {
+			plan.Order = append(plan.Order, OrderTerm{Column: name})
+		}
+	}
+
+	plan.output = output
+	return plan, nil
+}
+
+func (plan *aggregatePlan) addSortKey(name, alias string) {
+	if plan.SortKeys == nil {
+		plan.SortKeys = make(map[string]string)
+	}
+	plan.SortKeys[name] = alias
+}
+
+// defaultAlias names an aggregate that has no alias, e.g. "count" or "sum_amount".
+func (spec AggregateSpec) defaultAlias() string {
+	alias := strings.ToLower(spec.Func)
+	if spec.Column != "" && spec.Column != "*" {
+		alias += "_" + spec.Column
+	}
+	return alias
+}
+
+func (spec AggregateSpec) argSQL() string {
+	if spec.Column == "" {
+		return "*"
+	}
+	return quoteIdentifier(spec.Column)
+}
+
+func (plan *aggregatePlan) groupSQL() (selectCols []string, groupBy string) {
+	for _, name := range plan.GroupBy {
+		selectCols = append(selectCols, quoteIdentifier(name))
+	}
+	if len(selectCols) > 0 {
+		groupBy = " GROUP BY " + strings.Join(selectCols, ", ")
+	}
+	return selectCols, groupBy
+}
+
+// executeAggregate runs the whole aggregate in MySQL, for data that lives on one shard.
+func executeAggregate(dbConn sqlExecutor, plan *aggregatePlan, whereSQL string, whereArgs []interface{}) ([]map[string]interface{}, error) {
+	cols, groupBy := plan.groupSQL()
+	for _, spec := range plan.Aggregates {
+		cols = append(cols, fmt.Sprintf("%s(%s) AS %s", spec.Func, spec.argSQL(), quoteIdentifier(spec.As)))
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), quoteIdentifier(plan.Table))
+	args := append([]interface{}{}, whereArgs...)
+	if whereSQL != "" {
+		query += " WHERE " + whereSQL
+	}
+	query += groupBy
+
+	havingSQL, havingArgs, err := compileFilter(plan.Having, plan.output)
+	if err != nil {
+		return nil, fmt.Errorf("invalid having: %w", err)
+	}
+	if havingSQL != "" {
+		query += " HAVING " + havingSQL
+		args = append(args, havingArgs...)
+	}
+	if len(plan.Order) > 0 {
+		order := make([]string, len(plan.Order))
+		for i, term := range plan.Order {
+			order[i] = quoteIdentifier(term.Column)
+			if term.Desc {
+				order[i] += " DESC"
+			}
+		}
+		query += " ORDER BY " + strings.Join(order, ", ")
+	}
+	if plan.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", plan.Limit)
+	}
+	if plan.Offset > 0 {
+		if plan.Limit == 0 {
+			query += fmt.Sprintf(" LIMIT %d", maxReadLimit)
+		}
+		query += fmt.Sprintf(" OFFSET %d", plan.Offset)
+	}
+
+	log.Printf("Executing SQL: %s with values: %v", query, args)
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("executeAggregate query failed: %w", err)
+	}
+	defer rows.Close()
+	result, err := rowsToJSON(rows)
+	if err != nil {
+		return nil, fmt.Errorf("executeAggregate row scan failed: %w", err)
+	}
+	return plan.numberize(result), nil
+}
+
+// partialColumn names the per-shard partial state of aggregate i.
+func partialColumn(i int, kind string) string {
+	return fmt.Sprintf("__agg%d_%s", i, kind)
+}
+
+// executePartialAggregate computes the mergeable partial state of every aggregate for the rows
+// of one shard: COUNT and SUM as-is, MIN and MAX per shard, and AVG as a SUM and a COUNT.
+// Text group columns and MIN and MAX over text also select their sort keys, see SortKeys.
+func executePartialAggregate(dbConn sqlExecutor, plan *aggregatePlan, whereSQL string, whereArgs []interface{}) ([]map[string]interface{}, error) {
+	cols, groupBy := plan.groupSQL()
+	for _, name := range plan.GroupBy {
+		if alias, ok := plan.SortKeys[name]; ok {
+			cols = append(cols, fmt.Sprintf("HEX(WEIGHT_STRING(%s)) AS %s", quoteIdentifier(name), quoteIdentifier(alias)))
+		}
+	}
+	for i, spec := range plan.Aggregates {
+		switch spec.Func {
+		case "AVG":
+			cols = append(cols,
+				fmt.Sprintf("SUM(%s) AS %s", spec.argSQL(), quoteIdentifier(partialColumn(i, "sum"))),
+				fmt.Sprintf("COUNT(%s) AS %s", spec.argSQL(), quoteIdentifier(partialColumn(i, "count"))))
+		default:
+			expr := fmt.Sprintf("%s(%s)", spec.Func, spec.argSQL())
+			cols = append(cols, fmt.Sprintf("%s AS %s", expr, quoteIdentifier(partialColumn(i, strings.ToLower(spec.Func)))))
+			if alias, ok := plan.SortKeys[spec.As]; ok {
+				cols = append(cols, fmt.Sprintf("HEX(WEIGHT_STRING(%s)) AS %s", expr, quoteIdentifier(alias)))
+			}
+		}
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(cols, ", "), quoteIdentifier(plan.Table))
+	if whereSQL != "" {
+		query += " WHERE " + whereSQL
+	}
+	query += groupBy
+
+	log.Printf("Executing SQL: %s with values: %v", query, whereArgs)
+	rows, err := dbConn.Query(query, whereArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("executePartialAggregate query failed: %w", err)
+	}
+	defer rows.Close()
+	result, err := rowsToJSON(rows)
+	if err != nil {
+		return nil, fmt.Errorf("executePartialAggregate row scan failed: %w", err)
+	}
+	return result, nil
+}
+
+type aggregateGroup struct {
+	values   []interface{}
+	keys     []interface{}
+	counts   []int64
+	sums     []*big.Rat
+	scales   []int
+	picks    []interface{}
+	pickKeys []interface{}
+}
+
+func newAggregateGroup(plan *aggregatePlan) *aggregateGroup {
+	n := len(plan.Aggregates)
+	return &aggregateGroup{
+		counts:   make([]int64, n),
+		sums:     make([]*big.Rat, n),
+		scales:   make([]int, n),
+		picks:    make([]interface{}, n),
+		pickKeys: make([]interface{}, n),
+	}
+}
+
+// mergePartialAggregates combines the partial states returned by every shard into final rows.
+// The rows keep the sort keys of SortKeys for finishMergedAggregate to order by.
+func mergePartialAggregates(plan *aggregatePlan, partials [][]map[string]interface{}) ([]map[string]interface{}, error) {
+	n := len(plan.Aggregates)
+	groups := make(map[string]*aggregateGroup)
+	var order []string
+
+	for _, rows := range partials {
+		for _, row := range rows {
+			values := make([]interface{}, len(plan.GroupBy))
+			keys := make([]interface{}, len(plan.GroupBy))
+			for i, name := range plan.GroupBy {
+				values[i] = row[name]
+				keys[i] = groupKeyValue(row[name])
+				if alias, ok := plan.SortKeys[name]; ok {
+					keys[i] = row[alias]
+				}
+			}
+			keyBytes, err := json.Marshal(keys)
+			if err != nil {
+				return nil, err
+			}
+			key := string(keyBytes)
+			g, ok := groups[key]
+			if !ok {
+				g = newAggregateGroup(plan)
+				g.values, g.keys = values, keys
+				groups[key] = g
+				order = append(order, key)
+			}
+
+			for i, spec := range plan.Aggregates {
+				switch spec.Func {
+				case "COUNT", "AVG":
+					c, err := partialInt(row[partialColumn(i, "count")])
+					if err != nil {
+						return nil, fmt.Errorf("aggregate '%s': %w", spec.As, err)
+					}
+					g.counts[i] += c
+					if spec.Func == "COUNT" {
+						continue
+					}
+					fallthrough
+				case "SUM":
+					v := row[partialColumn(i, "sum")]
+					if v == nil {
+						continue
+					}
+					r, scale, err := partialRat(v)
+					if err != nil {
+						return nil, fmt.Errorf("aggregate '%s': %w", spec.As, err)
+					}
+					if g.sums[i] == nil {
+						g.sums[i] = new(big.Rat)
+					}
+					g.sums[i].Add(g.sums[i], r)
+					if scale > g.scales[i] {
+						g.scales[i] = scale
+					}
+				case "MIN", "MAX":
+					v := row[partialColumn(i, strings.ToLower(spec.Func))]
+					if v == nil {
+						continue
+					}
+					k := v
+					if alias, ok := plan.SortKeys[spec.As]; ok {
+						k = row[alias]
+					}
+					c := compareValues(k, g.pickKeys[i])
+					if g.picks[i] == nil || (spec.Func == "MIN" && c < 0) || (spec.Func == "MAX" && c > 0) {
+						g.picks[i], g.pickKeys[i] = v, k
+					}
+				}
+			}
+		}
+	}
+
+	// Without GROUP BY, SQL returns one row even when no rows match.
+	if len(plan.GroupBy) == 0 && len(order) == 0 {
+		groups[""] = newAggregateGroup(plan)
+		order = append(order, "")
+	}
+
+	result := make([]map[string]interface{}, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		row := make(map[string]interface{}, len(plan.GroupBy)+n+len(plan.SortKeys))
+		for i, name := range plan.GroupBy {
+			row[name] = g.values[i]
+			if alias, ok := plan.SortKeys[name]; ok {
+				row[alias] = g.keys[i]
+			}
+		}
+		for i, spec := range plan.Aggregates {
+			switch spec.Func {
+			case "COUNT":
+				row[spec.As] = g.counts[i]
+			case "SUM":
+				if g.sums[i] == nil {
+					row[spec.As] = nil
+				} else {
+					row[spec.As] = json.Number(g.sums[i].FloatString(g.scales[i]))
+				}
+			case "AVG":
+				if g.sums[i] == nil || g.counts[i] == 0 {
+					row[spec.As] = nil
+				} else {
+					avg := new(big.Rat).Quo(g.sums[i], new(big.Rat).SetInt64(g.counts[i]))
+					// MySQL returns AVG with four more decimals than its argument.
+					row[spec.As] = json.Number(avg.FloatString(g.scales[i] + 4))
+				}
+			default:
+				row[spec.As] = g.picks[i]
+				if alias, ok := plan.SortKeys[spec.As]; ok {
+					row[alias] = g.pickKeys[i]
+				}
+			}
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+// groupKeyValue makes numbers that MySQL groups together, such as 1 and 1.0, produce the same
+// group key.
+func groupKeyValue(v interface{}) interface{} {
+	if r, ok := numericValue(v); ok {
+		return r.RatString()
+	}
+	return v
+}
+
+// finishMergedAggregate applies HAVING, ordering, offset and limit to merged rows, ordering
+// text by its sort keys, and drops the sort keys.
+func finishMergedAggregate(plan *aggregatePlan, rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	if _, _, err := compileFilter(plan.Having, plan.output); err != nil {
+		return nil, fmt.Errorf("invalid having: %w", err)
+	}
+	kept := rows[:0]
+	for _, row := range rows {
+		ok, err := matchFilter(plan.Having, row)
+		if err != nil {
+			return nil, fmt.Errorf("invalid having: %w", err)
+		}
+		if ok {
+			kept = append(kept, row)
+		}
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool {
+		for _, term := range plan.Order {
+			col := term.Column
+			if alias, ok := plan.SortKeys[col]; ok {
+				col = alias
+			}
+			c := compareValues(kept[i][col], kept[j][col])
+			if c != 0 {
+				if term.Desc {
+					return c > 0
+				}
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	if plan.Offset > 0 {
+		if plan.Offset >= len(kept) {
+			kept = kept[:0]
+		} else {
+			kept = kept[plan.Offset:]
+		}
+	}
+	if plan.Limit > 0 && len(kept) > plan.Limit {
+		kept = kept[:plan.Limit]
+	}
+	for _, row := range kept {
+		for _, alias := range plan.SortKeys {
+			delete(row, alias)
+		}
+	}
+	return kept, nil
+}
+
+// numberize turns the COUNT, SUM and AVG values MySQL returns as text into JSON numbers, so
+// native and merged results look the same.
+func (plan *aggregatePlan) numberize(rows []map[string]interface{}) []map[string]interface{} {
+	for _, row := range rows {
+		for _, spec := range plan.Aggregates {
+			if spec.Func == "MIN" || spec.Func == "MAX" {
+				continue
+			}
+			if s, ok := row[spec.As].(string); ok {
+				if _, _, err := partialRat(s); err == nil {
+					row[spec.As] = json.Number(s)
+				}
+			}
+		}
+	}
+	return rows
+}
+
+func partialInt(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return n, nil
+	}
+	r, _, err := partialRat(v)
+	if err != nil {
+		return 0, err
+	}
+	if !r.IsInt() {
+		return 0, fmt.Errorf("partial count %v is not an integer", v)
+	}
+	return r.Num().Int64(), nil
+}
+
+// partialRat parses a partial sum exactly and reports how many decimals it was written with.
+func partialRat(v interface{}) (*big.Rat, int, error) {
+	var s string
+	switch n := v.(type) {
+	case string:
+		s = n
+	case json.Number:
+		s = n.String()
+	case []byte:
+		s = string(n)
+	default:
+		s = fmt.Sprint(n)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid numeric value '%s'", s)
+	}
+	scale := 0
+	if dot := strings.IndexByte(s, '.'); dot >= 0 && !strings.ContainsAny(s, "eE") {
+		scale = len(s) - dot - 1
+	}
+	return r, scale, nil
+}
+
+func runAggregate(dbConn *requestDB, req *crudRequest, plan *aggregatePlan, shardKey string, scatter bool, whereSQL string, whereArgs []interface{}) (interface{}, error) {
+	if req.ShardScope != nil {
+		predicate, predArgs := shardPredicateSQL(shardKey, *req.ShardScope)
+		cond, args := andSQL(whereSQL, whereArgs, predicate, predArgs)
+		return executePartialAggregate(dbConn, plan, cond, args)
+	}
+	if !scatter {
+		return executeAggregate(dbConn, plan, whereSQL, whereArgs)
+	}
+
+	local := func(shardID int) shardResult {
+		predicate, predArgs := shardPredicateSQL(shardKey, shardID)
+		cond, args := andSQL(whereSQL, whereArgs, predicate, predArgs)
+		res := shardResult{ShardID: shardID}
+		rows, err := executePartialAggregate(dbConn, plan, cond, args)
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		res.Rows, res.Err = normalizeRows(rows)
+		return res
+	}
+	remote := func(nodeURL string, shardID int) shardResult {
+		sub := *req
+		sub.ShardScope = &shardID
+		res := shardResult{ShardID: shardID}
+		res.Err = postShardRequest(dbConn.ctx, nodeURL, "/api/crud", sub, &res.Rows)
+		return res
+	}
+
+	var partials [][]map[string]interface{}
+	for _, res := range scatterShards(local, remote) {
+		if res.Err != nil {
+			return nil, fmt.Errorf("shard %d: %w", res.ShardID, res.Err)
+		}
+		partials = append(partials, res.Rows)
+	}
+	merged, err := mergePartialAggregates(plan, partials)
+	if err != nil {
+		return nil, err
+	}
+	return finishMergedAggregate(plan, merged)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func ordersSchema() *TableSchema {
+	return testSchema("orders",
+		ColumnInfo{Name: "id", DataType: "bigint", Key: "PRI"},
+		ColumnInfo{Name: "city", DataType: "varchar", ColumnType: "varchar(50)"},
+		ColumnInfo{Name: "amount", DataType: "decimal", ColumnType: "decimal(10,2)", Nullable: true},
+		ColumnInfo{Name: "qty", DataType: "int", Nullable: true},
+	)
+}
+
+func TestMergePartialAggregates(t *testing.T) {
+	all := []AggregateSpec{
+		{Func: "count"},
+		{Func: "sum", Column: "amount"},
+		{Func: "avg", Column: "qty"},
+		{Func: "min", Column: "qty"},
+		{Func: "max", Column: "city"},
+	}
+	// The sort keys stand in for HEX(WEIGHT_STRING(...)) of a case-insensitive collation.
+	tests := []struct {
+		name       string
+		groupBy    []string
+		aggregates []AggregateSpec
+		orderBy    []OrderTerm
+		partials   [][]map[string]interface{}
+		want       []map[string]interface{}
+	}{
+		{
+			name:       "ungrouped across shards",
+			aggregates: all,
+			partials: [][]map[string]interface{}{
+				{{"__agg0_count": int64(2), "__agg1_sum": "1.50", "__agg2_sum": "3", "__agg2_count": int64(2), "__agg3_min": int64(1), "__agg4_max": "Giza", "__agg4_sort": "GIZA"}},
+				{{"__agg0_count": int64(3), "__agg1_sum": "2.25", "__agg2_sum": "7", "__agg2_count": int64(2), "__agg3_min": int64(-4), "__agg4_max": "Aswan", "__agg4_sort": "ASWAN"}},
+			},
+			want: []map[string]interface{}{
+				{"count": int64(5), "sum_amount": json.Number("3.75"), "avg_qty": json.Number("2.5000"), "min_qty": int64(-4), "max_city": "Giza"},
+			},
+		},
+		{
+			name:       "groups ordered by sort key",
+			groupBy:    []string{"city"},
+			aggregates: []AggregateSpec{{Func: "count", As: "n"}, {Func: "sum", Column: "qty", As: "total"}},
+			partials: [][]map[string]interface{}{
+				{
+					{"city": "cairo", "__group0_sort": "CAIRO", "__agg0_count": int64(1), "__agg1_sum": "4"},
+					{"city": "Giza", "__group0_sort": "GIZA", "__agg0_count": int64(2), "__agg1_sum": nil},
+				},
+				{
+					{"city": "Giza", "__group0_sort": "GIZA", "__agg0_count": int64(1), "__agg1_sum": "5"},
+					{"city": "Alexandria", "__group0_sort": "ALEXANDRIA", "__agg0_count": int64(1), "__agg1_sum": "1"},
+				},
+			},
+			want: []map[string]interface{}{
+				{"city": "Alexandria", "n": int64(1), "total": json.Number("1")},
+				{"city": "cairo", "n": int64(1), "total": json.Number("4")},
+				{"city": "Giza", "n": int64(3), "total": json.Number("5")},
+			},
+		},
+		{
+			name:       "groups equal in the collation merge",
+			groupBy:    []string{"city"},
+			aggregates: []AggregateSpec{{Func: "count", As: "n"}},
+			partials: [][]map[string]interface{}{
+				{{"city": "Cairo", "__group0_sort": "CAIRO", "__agg0_count": int64(2)}},
+				{{"city": "cairo", "__group0_sort": "CAIRO", "__agg0_count": int64(3)}},
+			},
+			want: []map[string]interface{}{{"city": "Cairo", "n": int64(5)}},
+		},
+		{
+			name:       "numeric groups merge by value",
+			groupBy:    []string{"amount"},
+			aggregates: []AggregateSpec{{Func: "count", As: "n"}},
+			partials: [][]map[string]interface{}{
+				{{"amount": json.Number("1.50"), "__agg0_count": int64(2)}},
+				{{"amount": json.Number("1.5"), "__agg0_count": int64(1)}},
+			},
+			want: []map[string]interface{}{{"amount": json.Number("1.50"), "n": int64(3)}},
+		},
+		{
+			name:       "text extremes by sort key",
+			aggregates: []AggregateSpec{{Func: "min", Column: "city"}, {Func: "max", Column: "city"}},
+			partials: [][]map[string]interface{}{
+				{{"__agg0_min": "aswan", "__agg0_sort": "ASWAN", "__agg1_max": "aswan", "__agg1_sort": "ASWAN"}},
+				{{"__agg0_min": "Zagazig", "__agg0_sort": "ZAGAZIG", "__agg1_max": "Zagazig", "__agg1_sort": "ZAGAZIG"}},
+			},
+			want: []map[string]interface{}{{"min_city": "aswan", "max_city": "Zagazig"}},
+		},
+		{
+			name:       "exact numeric extremes",
+			aggregates: []AggregateSpec{{Func: "max", Column: "id"}, {Func: "min", Column: "amount"}},
+			partials: [][]map[string]interface{}{
+				{{"__agg0_max": json.Number("9007199254740992"), "__agg1_min": json.Number("12345678901234567.89")}},
+				{{"__agg0_max": int64(9007199254740993), "__agg1_min": json.Number("12345678901234567.88")}},
+			},
+			want: []map[string]interface{}{{"max_id": int64(9007199254740993), "min_amount": json.Number("12345678901234567.88")}},
+		},
+		{
+			name:       "ordered by text extreme",
+			groupBy:    []string{"qty"},
+			aggregates: []AggregateSpec{{Func: "max", Column: "city", As: "last"}},
+			orderBy:    []OrderTerm{{Column: "last"}},
+			partials: [][]map[string]interface{}{{
+				{"qty": int64(1), "__agg0_max": "giza", "__agg0_sort": "GIZA"},
+				{"qty": int64(2), "__agg0_max": "Luxor", "__agg0_sort": "LUXOR"},
+				{"qty": int64(3), "__agg0_max": "Aswan", "__agg0_sort": "ASWAN"},
+			}},
+			want: []map[string]interface{}{
+				{"qty": int64(3), "last": "Aswan"},
+				{"qty": int64(1), "last": "giza"},
+				{"qty": int64(2), "last": "Luxor"},
+			},
+		},
+		{
+			name:       "ungrouped without rows",
+			aggregates: all,
+			partials:   [][]map[string]interface{}{{}, {}},
+			want: []map[string]interface{}{
+				{"count": int64(0), "sum_amount": nil, "avg_qty": nil, "min_qty": nil, "max_city": nil},
+			},
+		},
+		{
+			name:       "grouped without rows",
+			groupBy:    []string{"city"},
+			aggregates: []AggregateSpec{{Func: "count"}},
+			partials:   [][]map[string]interface{}{{}},
+			want:       []map[string]interface{}{},
+		},
+		{
+			name:       "sums of nulls stay null",
+			aggregates: []AggregateSpec{{Func: "sum", Column: "qty"}, {Func: "avg", Column: "qty"}},
+			partials: [][]map[string]interface{}{
+				{{"__agg0_sum": nil, "__agg1_sum": nil, "__agg1_count": int64(0)}},
+				{{"__agg0_sum": nil, "__agg1_sum": nil, "__agg1_count": "0"}},
+			},
+			want: []map[string]interface{}{{"sum_qty": nil, "avg_qty": nil}},
+		},
+		{
+			name:       "exact beyond float precision",
+			aggregates: []AggregateSpec{{Func: "sum", Column: "amount"}},
+			partials: [][]map[string]interface{}{
+				{{"__agg0_sum": "9007199254740993.01"}},
+				{{"__agg0_sum": []byte("0.99")}},
+			},
+			want: []map[string]interface{}{{"sum_amount": json.Number("9007199254740994.00")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &crudRequest{GroupBy: tt.groupBy, Aggregates: tt.aggregates, OrderBy: tt.orderBy}
+			plan, err := buildAggregatePlan(req, ordersSchema())
+			if err != nil {
+				t.Fatalf("buildAggregatePlan: %v", err)
+			}
+			merged, err := mergePartialAggregates(plan, tt.partials)
+			if err != nil {
+				t.Fatalf("mergePartialAggregates: %v", err)
+			}
+			got, err := finishMergedAggregate(plan, merged)
+			if err != nil {
+				t.Fatalf("finishMergedAggregate: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rows = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergePartialAggregatesErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		aggregates []AggregateSpec
+		row        map[string]interface{}
+	}{
+		{"fractional count", []AggregateSpec{{Func: "count"}}, map[string]interface{}{"__agg0_count": "1.5"}},
+		{"non-numeric sum", []AggregateSpec{{Func: "sum", Column: "qty"}}, map[string]interface{}{"__agg0_sum": "lots"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := buildAggregatePlan(&crudRequest{Aggregates: tt.aggregates}, ordersSchema())
+			if err != nil {
+				t.Fatalf("buildAggregatePlan: %v", err)
+			}
+			if _, err := mergePartialAggregates(plan, [][]map[string]interface{}{{tt.row}}); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
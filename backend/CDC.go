@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change data capture records every row changed by a CRUD write, batch or transaction in
+// cluster.change_log, in the same transaction as the write. MySQL replication copies the log
+// to every node, so /api/cdc/stream can be served by any of them. Positions are the log's
+// auto-increment values: they only grow, but a transaction can commit after one that took a
+// later position, so readers wait for such gaps to fill before moving past them.
+
+const (
+	changeInsert = "insert"
+	changeUpdate = "update"
+	changeDelete = "delete"
+
+	changeStreamBatch = 500
+)
+
+// changeEvent is one changed row. Key holds the primary key columns; Before and After are the
+// row before and after the write, as far as they exist and could be read.
+type changeEvent struct {
+	Position    uint64          `json:"position"`
+	Operation   string          `json:"operation"`
+	DBName      string          `json:"dbName"`
+	Table       string          `json:"table"`
+	Key         json.RawMessage `json:"key,omitempty"`
+	Before      json.RawMessage `json:"before,omitempty"`
+	After       json.RawMessage `json:"after,omitempty"`
+	CommittedAt time.Time       `json:"committedAt"`
+}
+
+// rowChange is a captured change before it is written to the log.
+type rowChange struct {
+	Operation string
+	DBName    string
+	Table     string
+	Key       map[string]interface{}
+	Before    map[string]interface{}
+	After     map[string]interface{}
+}
+
+// changeSpec describes a write well enough to read the rows it touches before and after it.
+type changeSpec struct {
+	Operation       string
+	Data            map[string]interface{}
+	WhereSQL        string
+	WhereArgs       []interface{}
+	ConflictColumns []string
+}
+
+var (
+	// changeLogWritten is closed and replaced whenever this node commits changes, waking the
+	// streams it serves without waiting for their next poll.
+	changeLogWritten      = make(chan struct{})
+	changeLogWrittenMutex sync.Mutex
+)
+
+func notifyChangeLog() {
+	changeLogWrittenMutex.Lock()
+	close(changeLogWritten)
+	changeLogWritten = make(chan struct{})
+	changeLogWrittenMutex.Unlock()
+}
+
+func changeLogWaiter() <-chan struct{} {
+	changeLogWrittenMutex.Lock()
+	defer changeLogWrittenMutex.Unlock()
+	return changeLogWritten
+}
+
+// writeWithCapture runs a single write. With change data capture enabled, an idempotency key
+// on the request, or webhooks matching signal, the replication signal of the write, it runs
+// in a transaction together with the log rows of the changes it made, the key and the webhook
+// deliveries. The deliveries are queued after run, which may still complete the signal.
+func writeWithCapture(dbConn *requestDB, schema *TableSchema, spec changeSpec, signal map[string]interface{}, run func(sqlExecutor) (interface{}, error)) (interface{}, error) {
+	hooks, err := matchingWebhooks(signal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load webhooks: %w", err)
+	}
+	if !config.CDC.Enabled && !hasIdempotencyKey(dbConn.ctx) && len(hooks) == 0 {
+		return run(dbConn)
+	}
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	exec := withContext(dbConn.ctx, tx)
+
+	result, changes, err := captureWrite(exec, schema, spec, run)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordChanges(exec, changes); err != nil {
+		return nil, err
+	}
+	if err := recordIdempotencyKey(dbConn.ctx, exec, nil); err != nil {
+		return nil, err
+	}
+	if err := queueWebhooks(exec, signal); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit failed: %w", err)
+	}
+	if len(changes) > 0 {
+		notifyChangeLog()
+	}
+	return result, nil
+}
+
+// captureWrite runs a write through run inside the transaction exec and returns the rows it
+// changed. Rows are read with FOR UPDATE before the write, so the before images are the rows
+// the write actually changed. Without change data capture it only runs the write.
+func captureWrite(exec sqlExecutor, schema *TableSchema, spec changeSpec, run func(sqlExecutor) (interface{}, error)) (interface{}, []rowChange, error) {
+	if !config.CDC.Enabled {
+		result, err := run(exec)
+		return result, nil, err
+	}
+	pk := schema.PrimaryKey()
+
+	var before []map[string]interface{}
+	var err error
+	switch spec.Operation {
+	case "update", "delete":
+		before, err = lockRows(exec, schema, spec.WhereSQL, spec.WhereArgs)
+	case "upsert":
+		where, args := keyCondition(spec.ConflictColumns, []map[string]interface{}{spec.Data})
+		before, err = lockRows(exec, schema, where, args)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to capture rows before %s: %w", spec.Operation, err)
+	}
+
+	result, err := run(exec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var after []map[string]interface{}
+	switch spec.Operation {
+	case "create":
+		if key := insertedKey(pk, spec.Data, result); key != nil {
+			after, err = readRowsByKeys(exec, schema, pk, []map[string]interface{}{key})
+		} else {
+			after = []map[string]interface{}{spec.Data}
+		}
+	case "upsert":
+		where, args := keyCondition(spec.ConflictColumns, []map[string]interface{}{spec.Data})
+		after, err = lockRows(exec, schema, where, args)
+	case "update":
+		if len(pk) > 0 && len(before) > 0 {
+			after, err = readRowsByKeys(exec, schema, pk, updatedKeys(pk, before, spec.Data))
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to capture rows after %s: %w", spec.Operation, err)
+	}
+	return result, pairChanges(schema, pk, spec.Operation, before, after, spec.Data), nil
+}
+
+// captureInserts returns the changes of rows inserted with the given keys, as a multi-row
+// batch insert reports them.
+func captureInserts(exec sqlExecutor, schema *TableSchema, rows []map[string]interface{}, ids []int64) ([]rowChange, error) {
+	if !config.CDC.Enabled {
+		return nil, nil
+	}
+	pk := schema.PrimaryKey()
+	var keys []map[string]interface{}
+	var unkeyed []map[string]interface{}
+	for n, row := range rows {
+		var result interface{}
+		if ids[n] > 0 {
+			result = map[string]interface{}{"id": ids[n]}
+		}
+		if key := insertedKey(pk, row, result); key != nil {
+			keys = append(keys, key)
+		} else {
+			unkeyed = append(unkeyed, row)
+		}
+	}
+	after := unkeyed
+	if len(keys) > 0 {
+		read, err := readRowsByKeys(exec, schema, pk, keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to capture inserted rows: %w", err)
+		}
+		after = append(read, after...)
+	}
+	return pairChanges(schema, pk, "create", nil, after, nil), nil
+}
+
+// lockRows reads the full rows matching a condition and locks them for the transaction.
+func lockRows(exec sqlExecutor, schema *TableSchema, whereSQL string, whereArgs []interface{}) ([]map[string]interface{}, error) {
+	query := fmt.Sprintf("SELECT * FROM %s", quoteIdentifier(schema.Table))
+	if whereSQL != "" {
+		query += " WHERE " + whereSQL
+	}
+	query += " FOR UPDATE"
+	rows, err := exec.Query(query, whereArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	scanner, err := newRowScanner(rows)
+	if err != nil {
+		return nil, err
+	}
+	var result []map[string]interface{}
+	for rows.Next() {
+		entry, err := scanner.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+func readRowsByKeys(exec sqlExecutor, schema *TableSchema, pk []string, keys []map[string]interface{}) ([]map[string]interface{}, error) {
+	where, args := keyCondition(pk, keys)
+	return lockRows(exec, schema, where, args)
+}
+
+// keyCondition matches the rows whose columns equal one of the given value sets.
+func keyCondition(columns []string, values []map[string]interface{}) (string, []interface{}) {
+	var terms []string
+	var args []interface{}
+	if len(columns) == 0 {
+		return "FALSE", nil
+	}
+	for _, v := range values {
+		parts := make([]string, len(columns))
+		for i, col := range columns {
+			parts[i] = quoteIdentifier(col) + " <=> ?"
+			args = append(args, lookupFold(v, col))
+		}
+		terms = append(terms, "("+strings.Join(parts, " AND ")+")")
+	}
+	if len(terms) == 0 {
+		return "FALSE", nil
+	}
+	return strings.Join(terms, " OR "), args
+}
+
+// insertedKey returns the primary key of an inserted row: taken from the data, or from the
+// auto-increment id of a single-column key. It returns nil if the key is not known.
+func insertedKey(pk []string, data map[string]interface{}, result interface{}) map[string]interface{} {
+	if len(pk) == 0 {
+		return nil
+	}
+	key := make(map[string]interface{}, len(pk))
+	for _, col := range pk {
+		if v := lookupFold(data, col); v != nil {
+			key[col] = v
+		}
+	}
+	if len(key) == len(pk) {
+		return key
+	}
+	if res, ok := result.(map[string]interface{}); ok && len(pk) == 1 {
+		if id, ok := res["id"].(int64); ok && id > 0 {
+			return map[string]interface{}{pk[0]: id}
+		}
+	}
+	return nil
+}
+
+// updatedKeys returns the keys the rows have after an update, which may set key columns.
+func updatedKeys(pk []string, before []map[string]interface{}, data map[string]interface{}) []map[string]interface{} {
+	keys := make([]map[string]interface{}, len(before))
+	for n, row := range before {
+		key := make(map[string]interface{}, len(pk))
+		for _, col := range pk {
+			key[col] = row[col]
+			if v, ok := lookupFoldOK(data, col); ok {
+				key[col] = v
+			}
+		}
+		keys[n] = key
+	}
+	return keys
+}
+
+// pairChanges matches before and after images by primary key and turns them into changes.
+// Updates that left a row as it was are dropped.
+func pairChanges(schema *TableSchema, pk []string, operation string, before, after []map[string]interface{}, data map[string]interface{}) []rowChange {
+	keyOf := func(row map[string]interface{}) map[string]interface{} {
+		if len(pk) == 0 {
+			return nil
+		}
+		key := make(map[string]interface{}, len(pk))
+		for _, col := range pk {
+			key[col] = row[col]
+		}
+		return key
+	}
+	change := func(op string, key, b, a map[string]interface{}) rowChange {
+		return rowChange{Operation: op, DBName: schema.DBName, Table: schema.Table, Key: key, Before: b, After: a}
+	}
+
+	var changes []rowChange
+	switch operation {
+	case "create":
+		for _, a := range after {
+			changes = append(changes, change(changeInsert, keyOf(a), nil, a))
+		}
+	case "delete":
+		for _, b := range before {
+			changes = append(changes, change(changeDelete, keyOf(b), b, nil))
+		}
+	case "update", "upsert":
+		if len(pk) == 0 {
+			// Without a key the rows cannot be matched up; report what is known.
+			for _, b := range before {
+				changes = append(changes, change(changeUpdate, nil, b, nil))
+			}
+			if operation == "upsert" && len(before) == 0 {
+				for _, a := range after {
+					changes = append(changes, change(changeInsert, nil, nil, a))
+				}
+			}
+			return changes
+		}
+		afterByKey := make(map[string]map[string]interface{}, len(after))
+		for _, a := range after {
+			afterByKey[keyString(keyOf(a))] = a
+		}
+		for _, b := range before {
+			afterKey := keyString(keyOf(b))
+			if operation == "update" {
+				// The update may have set key columns.
+				afterKey = keyString(updatedKeys(pk, []map[string]interface{}{b}, data)[0])
+			}
+			a := afterByKey[afterKey]
+			delete(afterByKey, afterKey)
+			if a != nil && rowsEqual(a, b) {
+				continue
+			}
+			changes = append(changes, change(changeUpdate, keyOf(b), b, a))
+		}
+		if operation == "upsert" {
+			for _, a := range after {
+				if _, ok := afterByKey[keyString(keyOf(a))]; ok {
+					changes = append(changes, change(changeInsert, keyOf(a), nil, a))
+				}
+			}
+		}
+	}
+	return changes
+}
+
+func keyString(key map[string]interface{}) string {
+	b, _ := json.Marshal(key)
+	return string(b)
+}
+
+func rowsEqual(a, b map[string]interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+func lookupFold(m map[string]interface{}, name string) interface{} {
+	v, _ := lookupFoldOK(m, name)
+	return v
+}
+
+func lookupFoldOK(m map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := m[name]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// recordChanges writes changes to cluster.change_log through exec, so they commit with the
+// write that made them.
+func recordChanges(exec sqlExecutor, changes []rowChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	placeholders := make([]string, len(changes))
+	args := make([]interface{}, 0, len(changes)*7)
+	for n, c := range changes {
+		placeholders[n] = "(?, ?, ?, ?, ?, ?, ?)"
+		args = append(args, c.DBName, c.Table, c.Operation, jsonOrNil(c.Key), jsonOrNil(c.Before), jsonOrNil(c.After), now)
+	}
+	query := "INSERT INTO cluster.change_log (db_name, table_name, operation, row_key, before_image, after_image, created_at) VALUES " +
+		strings.Join(placeholders, ", ")
+	if _, err := exec.Exec(query, args...); err != nil {
+		return fmt.Errorf("failed to record changes: %w", err)
+	}
+	return nil
+}
+
+func jsonOrNil(m map[string]interface{}) interface{} {
+	if m == nil {
+		return nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	return string(b)
+}
+
+// changeLogReader reads the log in position order on behalf of one stream. A missing position
+// is waited for for up to gap_wait_ms after it was first seen, in case the transaction that
+// took it has not committed yet; after that it is assumed to have been rolled back.
+type changeLogReader struct {
+	position  uint64
+	dbName    string
+	table     string
+	gapAt     uint64
+	gapSeenAt time.Time
+}
+
+// next returns the events after the reader's position that match its filter, and advances the
+// position past every row it read, including those filtered out.
+func (c *changeLogReader) next() ([]changeEvent, error) {
+	rows, err := db.Query(`
+		SELECT position, operation, db_name, table_name, row_key, before_image, after_image, created_at
+		FROM cluster.change_log WHERE position > ? ORDER BY position LIMIT ?`, c.position, changeStreamBatch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read change log: %w", err)
+	}
+	defer rows.Close()
+
+	var events []changeEvent
+	for rows.Next() {
+		var e changeEvent
+		var key, before, after []byte
+		if err := rows.Scan(&e.Position, &e.Operation, &e.DBName, &e.Table, &key, &before, &after, &e.CommittedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan change log: %w", err)
+		}
+		if e.Position != c.position+1 {
+			if c.gapAt != c.position+1 {
+				c.gapAt, c.gapSeenAt = c.position+1, time.Now()
+			}
+			if time.Since(c.gapSeenAt) < time.Duration(config.CDC.GapWaitMillis)*time.Millisecond {
+				break
+			}
+		}
+		c.position = e.Position
+		if (c.dbName != "" && e.DBName != c.dbName) || (c.table != "" && e.Table != c.table) {
+			continue
+		}
+		e.Key, e.Before, e.After = key, before, after
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func changeLogHead() (uint64, error) {
+	var head uint64
+	err := db.QueryRow("SELECT COALESCE(MAX(position), 0) FROM cluster.change_log").Scan(&head)
+	return head, err
+}
+
+// changeLogPurgedThrough returns the last position removed by retention; streams cannot
+// resume from before it.
+func changeLogPurgedThrough() (uint64, error) {
+	var purged uint64
+	err := db.QueryRow("SELECT purged_through FROM cluster.change_log_state WHERE id = 1").Scan(&purged)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return purged, err
+}
+
+// cdcStreamHandler streams change events as Server-Sent Events. The stream starts after the
+// position given by ?from= or the Last-Event-ID header, or at the end of the log when neither
+// is given; ?db= and ?table= filter it. Every event carries its position as its id.
+func cdcStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	reader := &changeLogReader{dbName: SanitizeIdentifier(q.Get("db")), table: SanitizeIdentifier(q.Get("table"))}
+	from := q.Get("from")
+	if from == "" {
+		from = r.Header.Get("Last-Event-ID")
+	}
+	if from == "" {
+		head, err := changeLogHead()
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error reading change log: " + err.Error()})
+			return
+		}
+		reader.position = head
+	} else {
+		position, err := strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid position: " + from})
+			return
+		}
+		purged, err := changeLogPurgedThrough()
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error reading change log: " + err.Error()})
+			return
+		}
+		if position < purged {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: fmt.Sprintf("Position %d is no longer retained; the change log starts after position %d", position, purged),
+			})
+			return
+		}
+		reader.position = position
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": change stream from position %d\n\n", reader.position)
+	flusher.Flush()
+	log.Printf("CDC stream opened from position %d (db=%q, table=%q)", reader.position, reader.dbName, reader.table)
+
+	ctx := r.Context()
+	poll := time.NewTicker(time.Duration(config.CDC.PollMillis) * time.Millisecond)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		wake := changeLogWaiter()
+		start := reader.position
+		events, err := reader.next()
+		if err != nil {
+			log.Printf("CDC stream at position %d failed: %v", reader.position, err)
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", strconv.Quote(err.Error()))
+			flusher.Flush()
+			return
+		}
+		for _, e := range events {
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: change\ndata: %s\n\n", e.Position, data); err != nil {
+				return
+			}
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+		if reader.position-start >= changeStreamBatch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("CDC stream closed at position %d", reader.position)
+			return
+		case <-wake:
+		case <-poll.C:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprintf(w, ": keep-alive %d\n\n", reader.position); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// purgeChangeLog removes change events older than the retention period on the master, and
+// records the last removed position so that streams asking for it can be refused.
+func purgeChangeLog() {
+	for {
+		time.Sleep(10 * time.Minute)
+		if currentRole != RoleMaster || db == nil || !config.CDC.Enabled {
+			continue
+		}
+		cutoff := time.Now().UTC().Add(-time.Duration(config.CDC.RetentionHours) * time.Hour)
+		var through sql.NullInt64
+		if err := db.QueryRow("SELECT MAX(position) FROM cluster.change_log WHERE created_at < ?", cutoff).Scan(&through); err != nil {
+			log.Printf("Error finding expired change events: %v", err)
+			continue
+		}
+		if !through.Valid {
+			continue
+		}
+		_, err := db.Exec(`
+			INSERT INTO cluster.change_log_state (id, purged_through) VALUES (1, ?)
+			ON DUPLICATE KEY UPDATE purged_through = GREATEST(purged_through, VALUES(purged_through))`, through.Int64)
+		if err != nil {
+			log.Printf("Error recording change log watermark: %v", err)
+			continue
+		}
+		var purged int64
+		for {
+			res, err := db.Exec("DELETE FROM cluster.change_log WHERE position <= ? ORDER BY position LIMIT 10000", through.Int64)
+			if err != nil {
+				log.Printf("Error purging change log: %v", err)
+				break
+			}
+			n, _ := res.RowsAffected()
+			purged += n
+			if n < 10000 {
+				break
+			}
+		}
+		if purged > 0 {
+			log.Printf("Purged %d change events through position %d", purged, through.Int64)
+		}
+	}
+}
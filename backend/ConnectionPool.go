@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dbPool is the connection pool of one database. Pools are opened on first use and shared by
+// every request for that database; callers must not close them. refs counts the handles
+// given out by getDBConn and not yet released: a pool is only closed for the connection
+// limit or the idle timeout when no request holds it, and a pool removed while held is
+// closed by its last release.
+type dbPool struct {
+	dbName    string
+	conn      *sql.DB
+	openedAt  time.Time
+	lastUsed  time.Time
+	lastCheck time.Time
+	acquired  int64
+	refs      int
+	removed   bool
+}
+
+// Node-wide pool counters, reported by connectionPoolsHandler. Guarded by dbPoolsMutex.
+type poolCounters struct {
+	Opened               int64  `json:"opened"`
+	ClosedIdle           int64  `json:"closedIdle"`
+	ClosedForLimit       int64  `json:"closedForLimit"`
+	ClosedUnhealthy      int64  `json:"closedUnhealthy"`
+	RejectedAtLimit      int64  `json:"rejectedAtLimit"`
+	FailedHealthChecks   int64  `json:"failedHealthChecks"`
+	LastHealthCheckError string `json:"lastHealthCheckError,omitempty"`
+}
+
+var (
+	dbPools       = make(map[string]*dbPool)
+	dbPoolsMutex  sync.Mutex
+	dbPoolCounter poolCounters
+)
+
+// getDBConn returns the pool of a database, opening it if needed, and the function that
+// releases it; the caller must call release once it has run its last statement on the pool.
+// The database must exist: a new pool is pinged before it is registered. When the node is at
+// its connection limit, the least recently used pool that no request holds is closed to
+// make room.
+func getDBConn(dbName string) (*sql.DB, func(), error) {
+	if dbName == "" {
+		return nil, nil, fmt.Errorf("database name is required")
+	}
+	dbPoolsMutex.Lock()
+	if p, ok := dbPools[dbName]; ok {
+		release := p.acquire()
+		dbPoolsMutex.Unlock()
+		return p.conn, release, nil
+	}
+	dbPoolsMutex.Unlock()
+
+	conn, err := openMySQL(fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+		config.MySQL.User, config.MySQL.Password, config.MySQL.Host, config.MySQL.Port, dbName))
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetMaxOpenConns(config.Pool.MaxOpenPerDB)
+	conn.SetMaxIdleConns(config.Pool.MaxIdlePerDB)
+	conn.SetConnMaxLifetime(time.Duration(config.Pool.ConnMaxLifetimeSecs) * time.Second)
+	conn.SetConnMaxIdleTime(time.Duration(config.Pool.IdleTimeoutSeconds) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	dbPoolsMutex.Lock()
+	defer dbPoolsMutex.Unlock()
+	if p, ok := dbPools[dbName]; ok {
+		// Another request opened the pool first.
+		conn.Close()
+		return p.conn, p.acquire(), nil
+	}
+	for (len(dbPools)+1)*config.Pool.MaxOpenPerDB > config.Pool.MaxOpenTotal {
+		if !evictLeastRecentlyUsedPool() {
+			dbPoolCounter.RejectedAtLimit++
+			conn.Close()
+			return nil, nil, fmt.Errorf("connection limit of %d reached: all %d database pools are in use",
+				config.Pool.MaxOpenTotal, len(dbPools))
+		}
+	}
+	now := time.Now()
+	p := &dbPool{dbName: dbName, conn: conn, openedAt: now, lastUsed: now, lastCheck: now}
+	dbPools[dbName] = p
+	dbPoolCounter.Opened++
+	log.Printf("Opened connection pool for database '%s' (%d pools open)", dbName, len(dbPools))
+	return conn, p.acquire(), nil
+}
+
+// acquire takes a reference on p and returns the function that drops it. dbPoolsMutex must
+// be held.
+func (p *dbPool) acquire() func() {
+	p.refs++
+	p.acquired++
+	p.lastUsed = time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			dbPoolsMutex.Lock()
+			defer dbPoolsMutex.Unlock()
+			p.refs--
+			p.lastUsed = time.Now()
+			if p.removed && p.refs == 0 {
+				purgePoolStatements(p.conn)
+				p.conn.Close()
+			}
+		})
+	}
+}
+
+// evictLeastRecentlyUsedPool closes the least recently used pool that no request holds.
+// dbPoolsMutex must be held.
+func evictLeastRecentlyUsedPool() bool {
+	var victim *dbPool
+	for _, p := range dbPools {
+		if p.refs > 0 || p.conn.Stats().InUse > 0 {
+			continue
+		}
+		if victim == nil || p.lastUsed.Before(victim.lastUsed) {
+			victim = p
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	removeDBPool(victim)
+	dbPoolCounter.ClosedForLimit++
+	log.Printf("Closed connection pool for database '%s' to stay within the node connection limit", victim.dbName)
+	return true
+}
+
+// closeDBConn closes the pool of a database, as when the database is dropped. Requests
+// still holding it finish first.
+func closeDBConn(dbName string) {
+	dbPoolsMutex.Lock()
+	defer dbPoolsMutex.Unlock()
+	if p, ok := dbPools[dbName]; ok {
+		removeDBPool(p)
+		log.Printf("Closed connection pool for database '%s'", dbName)
+	}
+}
+
+// removeDBPool unregisters p if it is still the registered pool of its database, so the next
+// request opens a new one. p is closed now if no request holds it, otherwise by its last
+// release. dbPoolsMutex must be held.
+func removeDBPool(p *dbPool) bool {
+	if dbPools[p.dbName] != p {
+		return false
+	}
+	delete(dbPools, p.dbName)
+	p.removed = true
+	if p.refs == 0 {
+		purgePoolStatements(p.conn)
+		p.conn.Close()
+	}
+	return true
+}
+
+// discardConn closes a dedicated connection instead of returning it to its pool, for
+// connections left in a state the next user must not inherit, such as a prepared XA branch.
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	conn.Close()
+}
+
+// maintainDBPools runs the health checks of the pools. A pool that fails its ping is closed,
+// so the next request opens a fresh one and reports the error if the database is still
+// unreachable; a pool unused for the idle timeout is closed too.
+func maintainDBPools() {
+	for {
+		time.Sleep(time.Duration(config.Pool.HealthCheckSeconds) * time.Second)
+
+		dbPoolsMutex.Lock()
+		pools := make([]*dbPool, 0, len(dbPools))
+		for _, p := range dbPools {
+			pools = append(pools, p)
+		}
+		dbPoolsMutex.Unlock()
+
+		idleTimeout := time.Duration(config.Pool.IdleTimeoutSeconds) * time.Second
+		for _, p := range pools {
+			dbPoolsMutex.Lock()
+			if time.Since(p.lastUsed) > idleTimeout && p.refs == 0 && p.conn.Stats().InUse == 0 {
+				if removeDBPool(p) {
+					dbPoolCounter.ClosedIdle++
+					log.Printf("Connection pool for database '%s' unused for %s, closed it", p.dbName, idleTimeout)
+				}
+				dbPoolsMutex.Unlock()
+				continue
+			}
+			dbPoolsMutex.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			err := p.conn.PingContext(ctx)
+			cancel()
+
+			dbPoolsMutex.Lock()
+			p.lastCheck = time.Now()
+			if err != nil {
+				dbPoolCounter.FailedHealthChecks++
+				dbPoolCounter.LastHealthCheckError = fmt.Sprintf("%s: %v", p.dbName, err)
+				if removeDBPool(p) {
+					dbPoolCounter.ClosedUnhealthy++
+					log.Printf("Health check of connection pool for database '%s' failed, closed it: %v", p.dbName, err)
+				}
+			}
+			dbPoolsMutex.Unlock()
+		}
+	}
+}
+
+type poolStats struct {
+	MaxOpen        int   `json:"maxOpen"`
+	Open           int   `json:"open"`
+	InUse          int   `json:"inUse"`
+	Idle           int   `json:"idle"`
+	WaitCount      int64 `json:"waitCount"`
+	WaitMillis     int64 `json:"waitMillis"`
+	ClosedIdle     int64 `json:"closedIdle"`
+	ClosedIdleTime int64 `json:"closedIdleTime"`
+	ClosedLifetime int64 `json:"closedLifetime"`
+}
+
+type dbPoolStats struct {
+	Database        string    `json:"database"`
+	OpenedAt        time.Time `json:"openedAt"`
+	LastUsed        time.Time `json:"lastUsed"`
+	LastHealthCheck time.Time `json:"lastHealthCheck"`
+	Acquired        int64     `json:"acquired"`
+	Held            int       `json:"held"`
+	poolStats
+}
+
+func newPoolStats(s sql.DBStats) poolStats {
+	return poolStats{
+		MaxOpen:        s.MaxOpenConnections,
+		Open:           s.OpenConnections,
+		InUse:          s.InUse,
+		Idle:           s.Idle,
+		WaitCount:      s.WaitCount,
+		WaitMillis:     s.WaitDuration.Milliseconds(),
+		ClosedIdle:     s.MaxIdleClosed,
+		ClosedIdleTime: s.MaxIdleTimeClosed,
+		ClosedLifetime: s.MaxLifetimeClosed,
+	}
+}
+
+// connectionPoolsHandler reports the pools of this node: limits, usage counters and the
+// time of the last health check of each database pool, plus the server-level pool.
+func connectionPoolsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	dbPoolsMutex.Lock()
+	databases := make([]dbPoolStats, 0, len(dbPools))
+	for _, p := range dbPools {
+		databases = append(databases, dbPoolStats{
+			Database:        p.dbName,
+			OpenedAt:        p.openedAt,
+			LastUsed:        p.lastUsed,
+			LastHealthCheck: p.lastCheck,
+			Acquired:        p.acquired,
+			Held:            p.refs,
+			poolStats:       newPoolStats(p.conn.Stats()),
+		})
+	}
+	counters := dbPoolCounter
+	dbPoolsMutex.Unlock()
+	sort.Slice(databases, func(i, j int) bool { return databases[i].Database < databases[j].Database })
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: fmt.Sprintf("%d database pools open", len(databases)),
+		Result: map[string]interface{}{
+			"limits":     config.Pool,
+			"counters":   counters,
+			"statements": statementCacheStats(),
+			"server":     newPoolStats(db.Stats()),
+			"databases":  databases,
+		},
+	})
+}
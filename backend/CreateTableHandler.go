@@ -1,62 +1,109 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
-	"strconv"
 )
 
-func createTableHandler(w http.ResponseWriter, r *http.Request) {
-	if currentRole != RoleMaster {
-		http.Error(w, "Only master can create tables", http.StatusForbidden)
-		return
+// createTableRequest is the description of a table to create. The master validates it,
+// generates the DDL and sends the same description on to the slaves.
+type createTableRequest struct {
+	DBName    string `json:"dbName"`
+	TableName string `json:"tableName"`
+	// ShardID defaults to the shard the table name hashes to.
+	ShardID *int `json:"shardId,omitempty"`
+	// ShardKey is the column that spreads the rows of the table over the shards, if any.
+	ShardKey string `json:"shardKey,omitempty"`
+	tableDefinition
+}
+
+// validate checks the request and returns the CREATE TABLE statement for it.
+func (req *createTableRequest) validate() (string, error) {
+	if req.DBName == "" || req.TableName == "" {
+		return "", fmt.Errorf("Database name and table name are required")
+	}
+	if !isValidIdentifier(req.DBName) || !isValidIdentifier(req.TableName) || len(req.TableName) > maxIdentifierLength {
+		return "", fmt.Errorf("Invalid database or table name")
 	}
+	if req.ShardID == nil {
+		shardID := calculateShardID(req.DBName + "." + req.TableName)
+		req.ShardID = &shardID
+	}
+	if *req.ShardID < 0 || *req.ShardID >= config.ShardCount {
+		return "", fmt.Errorf("Shard ID must be between 0 and %d", config.ShardCount-1)
+	}
+	if req.ShardKey != "" {
+		col := req.column(req.ShardKey)
+		if col == nil {
+			return "", fmt.Errorf("Shard key '%s' is not a column of the table", req.ShardKey)
+		}
+		if !isShardKeyType(col.typeName()) {
+			return "", fmt.Errorf("Shard key '%s' must be an integer or string column", req.ShardKey)
+		}
+	}
+	return req.createTableSQL(req.DBName, req.TableName)
+}
 
-	dbName := r.FormValue("db")
-	tableName := r.FormValue("name")
-	shardID := r.FormValue("shard_id")
-	columns := r.FormValue("columns")
+func writeJSONStatus(w http.ResponseWriter, status int, resp Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
 
-	if dbName == "" || tableName == "" || shardID == "" || columns == "" {
-		http.Error(w, "Database name, table name, shard ID, and columns are required", http.StatusBadRequest)
+func createTableHandler(w http.ResponseWriter, r *http.Request) {
+	if currentRole != RoleMaster {
+		writeJSONStatus(w, http.StatusForbidden, Response{Success: false, Message: "Only master can create tables"})
 		return
 	}
 
-	if !isValidIdentifier(dbName) || !isValidIdentifier(tableName) {
-		http.Error(w, "Invalid database or table name", http.StatusBadRequest)
+	var req createTableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONStatus(w, http.StatusBadRequest, Response{Success: false, Message: "Invalid request format: " + err.Error()})
 		return
 	}
-
-	shardIDInt, err := strconv.Atoi(shardID)
+	query, err := req.validate()
 	if err != nil {
-		http.Error(w, "Invalid shard ID: must be an integer", http.StatusBadRequest)
-		return
-	}
-
-	if shardIDInt < 0 || shardIDInt >= config.ShardCount {
-		http.Error(w, fmt.Sprintf("Shard ID must be between 0 and %d", config.ShardCount-1), http.StatusBadRequest)
+		writeJSONStatus(w, http.StatusBadRequest, Response{Success: false, Message: err.Error()})
 		return
 	}
 
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (%s)", dbName, tableName, columns)
 	if err := executeSQL(query); err != nil {
-		http.Error(w, fmt.Sprintf("Error creating table: %v", err), http.StatusInternalServerError)
+		writeJSONStatus(w, http.StatusInternalServerError, Response{Success: false, Message: fmt.Sprintf("Error creating table: %v", err)})
 		return
 	}
 
-	insertShardQuery := "INSERT INTO cluster.table_shards (db_name, table_name, shard_id) VALUES (?, ?, ?)"
-	_, err = db.Exec(insertShardQuery, dbName, tableName, shardIDInt)
+	insertShardQuery := "INSERT INTO cluster.table_shards (db_name, table_name, shard_id, shard_key) VALUES (?, ?, ?, ?)"
+	_, err = db.Exec(insertShardQuery, req.DBName, req.TableName, *req.ShardID, sql.NullString{String: req.ShardKey, Valid: req.ShardKey != ""})
 	if err != nil {
 		log.Printf("Error storing shard information: %v", err)
-		http.Error(w, "Failed to store shard information", http.StatusInternalServerError)
+		writeJSONStatus(w, http.StatusInternalServerError, Response{Success: false, Message: "Failed to store shard information"})
 		return
 	}
+	if err := recordMigration(db, req.DBName, req.TableName, 1, "create_table", req, query, migrationApplied); err != nil {
+		log.Printf("Error recording creation of '%s.%s' as migration 1: %v", req.DBName, req.TableName, err)
+	}
+
+	writeJSONStatus(w, http.StatusOK, Response{
+		Success: true,
+		Message: fmt.Sprintf("Table '%s.%s' created in shard %d successfully", req.DBName, req.TableName, *req.ShardID),
+		Result:  map[string]interface{}{"shardId": *req.ShardID, "ddl": query},
+	})
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Table '%s.%s' created in shard %d successfully\n", dbName, tableName, shardIDInt)
+	replicateToNodes(map[string]interface{}{
+		"operation": "create_table",
+		"dbName":    req.DBName,
+		"table":     req.TableName,
+		"shardId":   float64(*req.ShardID),
+	})
 
-	go notifySlaves(fmt.Sprintf("/api/create-table?db=%s&name=%s&shard_id=%d&columns=%s",
-		url.QueryEscape(dbName), url.QueryEscape(tableName), shardIDInt, url.QueryEscape(columns)))
+	// Index names have been filled in by validate, so every node creates identical indexes.
+	description, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("Error encoding description of '%s.%s' for slaves: %v", req.DBName, req.TableName, err)
+		return
+	}
+	go notifySlaves("/api/slave-create-table", description)
 }
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const batchInsertChunk = 1000
+
+type crudBatchItem struct {
+	Operation       string                 `json:"operation"`
+	Data            map[string]interface{} `json:"data,omitempty"`
+	Where           map[string]interface{} `json:"where,omitempty"`
+	Filter          *Filter                `json:"filter,omitempty"`
+	ShardKeyValue   interface{}            `json:"shardKeyValue,omitempty"`
+	ExpectedVersion *int64                 `json:"expectedVersion,omitempty"`
+}
+
+type batchItemResult struct {
+	Index        int    `json:"index"`
+	Operation    string `json:"operation"`
+	ShardID      int    `json:"shardId"`
+	Success      bool   `json:"success"`
+	ID           int64  `json:"id,omitempty"`
+	RowsAffected int64  `json:"rowsAffected,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type batchResult struct {
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Shards    int               `json:"shards"`
+	Items     []batchItemResult `json:"items"`
+}
+
+func lookupTableShard(dbName, table string) (shardID int, shardKey string, err error) {
+	var key sql.NullString
+	err = db.QueryRow("SELECT shard_id, shard_key FROM cluster.table_shards WHERE db_name = ? AND table_name = ?",
+		dbName, table).Scan(&shardID, &key)
+	if err == sql.ErrNoRows {
+		return calculateShardID(dbName + "." + table), "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return shardID, key.String, nil
+}
+
+// itemShard resolves the shard of one batch item the same way routeCrudRequest routes a single write.
+func itemShard(item *crudBatchItem, shardKey string, tableShardID int) (int, error) {
+	if shardKey == "" {
+		return tableShardID, nil
+	}
+	conditions := combineFilters(whereToFilter(item.Where), item.Filter)
+	if shardID, ok := resolveShard(item.Operation, item.ShardKeyValue, conditions, item.Data, shardKey); ok {
+		return shardID, nil
+	}
+	return 0, fmt.Errorf("shardKeyValue for column '%s' is required", shardKey)
+}
+
+// handleBatch applies many rows or mutations to one table. Items are grouped by shard and
+// each shard's group runs in its own transaction, with consecutive creates that share a column
+// set combined into multi-row INSERT statements. A failing item rolls back its shard's group.
+// With an idempotency key, every shard's transaction also stores the outcome so far under the
+// key, so a retry gets back which shards were applied instead of applying them again.
+func handleBatch(w http.ResponseWriter, r *http.Request, req *crudRequest) {
+	items := req.Items
+	for _, row := range req.Rows {
+		items = append(items, crudBatchItem{Operation: "create", Data: row})
+	}
+	if len(items) == 0 {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Batch requires 'rows' or 'items'"})
+		return
+	}
+
+	tableShardID, shardKey, err := lookupTableShard(req.DBName, req.Table)
+	if err != nil {
+		log.Printf("Error retrieving shard info for '%s.%s': %v", req.DBName, req.Table, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error retrieving shard info: " + err.Error()})
+		return
+	}
+	schema, err := loadTableSchema(req.DBName, req.Table)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error loading table schema: " + err.Error()})
+		return
+	}
+
+	pool, release, err := getDBConn(req.DBName)
+	if err != nil {
+		log.Printf("Error connecting to database '%s': %v", req.DBName, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error connecting to DB: " + err.Error()})
+		return
+	}
+	defer release()
+	dbConn := bindDB(r.Context(), pool)
+
+	result := batchResult{Items: make([]batchItemResult, len(items))}
+	groups := make(map[int][]int)
+	for i := range items {
+		res := &result.Items[i]
+		res.Index = i
+		res.Operation = items[i].Operation
+		switch items[i].Operation {
+		case "create", "update", "delete":
+		default:
+			res.Error = fmt.Sprintf("invalid batch operation '%s'", items[i].Operation)
+			continue
+		}
+		shardID, err := itemShard(&items[i], shardKey, tableShardID)
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		res.ShardID = shardID
+		groups[shardID] = append(groups[shardID], i)
+	}
+
+	shardIDs := make([]int, 0, len(groups))
+	for id := range groups {
+		shardIDs = append(shardIDs, id)
+	}
+	sort.Ints(shardIDs)
+	result.Shards = len(shardIDs)
+
+	for _, shardID := range shardIDs {
+		indexes := groups[shardID]
+		var signal map[string]interface{}
+		if currentRole == RoleMaster {
+			signal = map[string]interface{}{
+				"operation": "batch",
+				"dbName":    req.DBName,
+				"table":     req.Table,
+				"itemCount": float64(len(indexes)),
+				"shardId":   float64(shardID),
+			}
+		}
+		beforeCommit := func(exec sqlExecutor) error {
+			if err := queueWebhooks(exec, signal); err != nil {
+				return err
+			}
+			// Items of shards that have not run yet are reported as such, should the request
+			// end before they do.
+			partial := batchResult{Shards: result.Shards, Items: append([]batchItemResult(nil), result.Items...)}
+			for n := range partial.Items {
+				if res := &partial.Items[n]; !res.Success && res.Error == "" {
+					res.Error = fmt.Sprintf("not applied: the batch ended before shard %d ran", res.ShardID)
+				}
+			}
+			return recordIdempotencyKey(r.Context(), exec, batchResponse(partial))
+		}
+		if failedAt, err := runBatchGroup(dbConn, req.Table, schema, items, indexes, result.Items, beforeCommit); err != nil {
+			if r.Context().Err() != nil {
+				err = requestEndedError(r.Context())
+			}
+			log.Printf("Batch group for shard %d of '%s.%s' rolled back at item %d: %v", shardID, req.DBName, req.Table, failedAt, err)
+			for _, i := range indexes {
+				res := &result.Items[i]
+				res.Success, res.ID, res.RowsAffected = false, 0, 0
+				if i == failedAt {
+					res.Error = err.Error()
+				} else {
+					res.Error = fmt.Sprintf("rolled back because item %d in shard %d failed", failedAt, shardID)
+				}
+			}
+			continue
+		}
+
+		if signal != nil {
+			replicateToNodes(signal)
+		}
+	}
+
+	resp := batchResponse(result)
+	log.Printf("Batch on '%s.%s': %s across %d shards", req.DBName, req.Table, resp.Message, result.Shards)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// batchResponse counts the items of a batch that succeeded and failed and reports them.
+func batchResponse(result batchResult) Response {
+	result.Succeeded, result.Failed = 0, 0
+	for _, res := range result.Items {
+		if res.Success {
+			result.Succeeded++
+		} else {
+			result.Failed++
+		}
+	}
+	return Response{
+		Success: result.Failed == 0,
+		Message: fmt.Sprintf("%d of %d batch items applied", result.Succeeded, len(result.Items)),
+		Result:  result,
+	}
+}
+
+// runBatchGroup applies the items of one shard in a single transaction, and runs beforeCommit
+// in it once they all succeeded. On error it returns the index of the item that failed.
+func runBatchGroup(dbConn *requestDB, table string, schema *TableSchema, items []crudBatchItem, indexes []int, results []batchItemResult, beforeCommit func(sqlExecutor) error) (int, error) {
+	for _, i := range indexes {
+		data, err := coerceRow(schema, items[i].Data)
+		if err != nil {
+			return i, fmt.Errorf("invalid data: %w", err)
+		}
+		items[i].Data = data
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return indexes[0], fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	exec := withContext(dbConn.ctx, tx)
+
+	var changes []rowChange
+	for pos := 0; pos < len(indexes); {
+		i := indexes[pos]
+		item := &items[i]
+
+		if item.Operation == "create" {
+			run := []int{i}
+			signature := columnSignature(item.Data)
+			for pos+len(run) < len(indexes) && len(run) < batchInsertChunk {
+				next := indexes[pos+len(run)]
+				if items[next].Operation != "create" || columnSignature(items[next].Data) != signature {
+					break
+				}
+				run = append(run, next)
+			}
+			if failedAt, err := batchInsert(exec, table, schema, items, run, results); err != nil {
+				return failedAt, err
+			}
+			rows := make([]map[string]interface{}, len(run))
+			ids := make([]int64, len(run))
+			for n, i := range run {
+				rows[n], ids[n] = items[i].Data, results[i].ID
+			}
+			inserted, err := captureInserts(exec, schema, rows, ids)
+			if err != nil {
+				return run[0], err
+			}
+			changes = append(changes, inserted...)
+			pos += len(run)
+			continue
+		}
+
+		whereSQL, whereArgs, err := compileFilter(combineFilters(whereToFilter(item.Where), item.Filter), schema)
+		if err != nil {
+			return i, fmt.Errorf("invalid filter: %w", err)
+		}
+		if whereSQL == "" {
+			return i, fmt.Errorf("where or filter required for %s", item.Operation)
+		}
+
+		if item.Operation == "update" {
+			for col := range item.Data {
+				if !schema.HasColumn(col) {
+					return i, fmt.Errorf("unknown column '%s'", col)
+				}
+			}
+		}
+		spec := changeSpec{Operation: item.Operation, Data: item.Data, WhereSQL: whereSQL, WhereArgs: whereArgs}
+		res, itemChanges, err := captureWrite(exec, schema, spec, func(exec sqlExecutor) (interface{}, error) {
+			if item.Operation == "update" {
+				return executeUpdate(exec, schema, item.Data, whereSQL, whereArgs, item.ExpectedVersion)
+			}
+			return executeDelete(exec, schema, whereSQL, whereArgs, item.ExpectedVersion)
+		})
+		if err != nil {
+			return i, err
+		}
+		changes = append(changes, itemChanges...)
+		results[i].RowsAffected, _ = res.(map[string]interface{})["rowsAffected"].(int64)
+		results[i].Success = true
+		pos++
+	}
+
+	if err := recordChanges(exec, changes); err != nil {
+		return indexes[0], err
+	}
+	if err := beforeCommit(exec); err != nil {
+		return indexes[0], err
+	}
+	if err := tx.Commit(); err != nil {
+		return indexes[0], fmt.Errorf("commit failed: %w", err)
+	}
+	if len(changes) > 0 {
+		notifyChangeLog()
+	}
+	return -1, nil
+}
+
+func columnSignature(data map[string]interface{}) string {
+	cols := keys(data)
+	sort.Strings(cols)
+	return strings.Join(cols, ",")
+}
+
+// batchInsert inserts a run of rows that share a column set. Rows whose key MySQL generates
+// are inserted one statement each, so that every row reports the id it was given: a multi-row
+// INSERT only reports the first, and the others need not follow it. All other runs are
+// inserted with multi-row statements.
+func batchInsert(exec ctxExecutor, table string, schema *TableSchema, items []crudBatchItem, run []int, results []batchItemResult) (int, error) {
+	first := items[run[0]].Data
+	if len(first) == 0 {
+		return run[0], fmt.Errorf("no data provided for create operation")
+	}
+	cols := keys(first)
+	sort.Strings(cols)
+	quoted := make([]string, len(cols))
+	for n, col := range cols {
+		if !schema.HasColumn(col) {
+			return run[0], fmt.Errorf("unknown column '%s'", col)
+		}
+		quoted[n] = quoteIdentifier(col)
+	}
+	rowPlaceholder := "(" + strings.Join(createPlaceholders(len(cols)), ", ") + ")"
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", quoteIdentifier(table), strings.Join(quoted, ", "))
+
+	autoIncrement := schema.AutoIncrementColumn()
+	if autoIncrement != "" && !containsFold(cols, autoIncrement) {
+		stmt, err := exec.Prepare(prefix + rowPlaceholder)
+		if err != nil {
+			return run[0], fmt.Errorf("failed to prepare insert: %w", err)
+		}
+		defer stmt.Close()
+		args := make([]interface{}, len(cols))
+		for _, i := range run {
+			for n, col := range cols {
+				args[n] = items[i].Data[col]
+			}
+			res, err := stmt.ExecContext(exec.ctx, args...)
+			if err != nil {
+				return i, fmt.Errorf("insert failed: %w", err)
+			}
+			results[i].Success = true
+			results[i].RowsAffected = 1
+			results[i].ID, _ = res.LastInsertId()
+		}
+		return -1, nil
+	}
+
+	placeholders := make([]string, len(run))
+	args := make([]interface{}, 0, len(run)*len(cols))
+	for n, i := range run {
+		placeholders[n] = rowPlaceholder
+		for _, col := range cols {
+			args = append(args, items[i].Data[col])
+		}
+	}
+	if _, err := exec.Exec(prefix+strings.Join(placeholders, ", "), args...); err != nil {
+		return run[0], fmt.Errorf("multi-row insert of %d rows failed: %w", len(run), err)
+	}
+	for _, i := range run {
+		results[i].Success = true
+		results[i].RowsAffected = 1
+		if autoIncrement != "" {
+			// The rows carry their own auto-increment values.
+			results[i].ID, _ = lookupFold(items[i].Data, autoIncrement).(int64)
+		}
+	}
+	return -1, nil
+}
@@ -8,8 +8,46 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
+type crudRequest struct {
+	DBName          string                   `json:"dbName"`
+	Operation       string                   `json:"operation"`
+	Table           string                   `json:"table"`
+	Data            map[string]interface{}   `json:"data,omitempty"`
+	Where           map[string]interface{}   `json:"where,omitempty"`
+	Filter          *Filter                  `json:"filter,omitempty"`
+	ShardKeyValue   interface{}              `json:"shardKeyValue,omitempty"`
+	Columns         []string                 `json:"columns,omitempty"`
+	OrderBy         []OrderTerm              `json:"orderBy,omitempty"`
+	Limit           int                      `json:"limit,omitempty"`
+	Offset          int                      `json:"offset,omitempty"`
+	Cursor          string                   `json:"cursor,omitempty"`
+	IncludeTotal    bool                     `json:"includeTotal,omitempty"`
+	Rows            []map[string]interface{} `json:"rows,omitempty"`
+	Items           []crudBatchItem          `json:"items,omitempty"`
+	ConflictColumns []string                 `json:"conflictColumns,omitempty"`
+	UpdateColumns   []string                 `json:"updateColumns,omitempty"`
+	Aggregates      []AggregateSpec          `json:"aggregates,omitempty"`
+	GroupBy         []string                 `json:"groupBy,omitempty"`
+	Having          *Filter                  `json:"having,omitempty"`
+	Include         []IncludeSpec            `json:"include,omitempty"`
+	JoinStyle       string                   `json:"joinStyle,omitempty"`
+	Stream          string                   `json:"stream,omitempty"`
+	ExpectedVersion *int64                   `json:"expectedVersion,omitempty"`
+
+	// ShardScope is set on the per-shard requests of a scatter-gather read; the receiving node
+	// returns only the rows of that shard, unpaged, for the coordinator to merge. For aggregates
+	// it returns the shard's partial aggregates instead.
+	ShardScope *int `json:"shardScope,omitempty"`
+}
+
+// conditions returns the legacy where map and the structured filter combined into one filter.
+func (req *crudRequest) conditions() *Filter {
+	return combineFilters(whereToFilter(req.Where), req.Filter)
+}
+
 func crudHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -18,14 +56,7 @@ func crudHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		DBName        string                 `json:"dbName"`
-		Operation     string                 `json:"operation"`
-		Table         string                 `json:"table"`
-		Data          map[string]interface{} `json:"data,omitempty"`
-		Where         map[string]interface{} `json:"where,omitempty"`
-		ShardKeyValue interface{}            `json:"shardKeyValue,omitempty"`
-	}
+	var req crudRequest
 
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -35,7 +66,7 @@ func crudHandler(w http.ResponseWriter, r *http.Request) {
 
 	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+	if err := decodeJSONNumbers(bodyBytes, &req); err != nil {
 		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request format: " + err.Error()})
 		return
 	}
@@ -48,60 +79,31 @@ func crudHandler(w http.ResponseWriter, r *http.Request) {
 	req.DBName = SanitizeIdentifier(req.DBName)
 	req.Table = SanitizeIdentifier(req.Table)
 
-	isWriteOperation := (req.Operation == "create" || req.Operation == "update" || req.Operation == "delete")
-
-	var shardIDForRequest int
-	var tableShardKeyCol sql.NullString
-	var registeredTableShardID int
+	if req.Stream != "" {
+		if err := validateStream(&req); err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+			return
+		}
+	}
 
-	err = db.QueryRow("SELECT shard_id, shard_key FROM cluster.table_shards WHERE db_name = ? AND table_name = ?",
-		req.DBName, req.Table).Scan(&registeredTableShardID, &tableShardKeyCol)
+	isWriteOperation := (req.Operation == "create" || req.Operation == "update" || req.Operation == "delete" || req.Operation == "batch" || req.Operation == "upsert")
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("Warning: Table '%s.%s' not found in cluster.table_shards. Calculating shardID based on table name for routing.", req.DBName, req.Table)
-			shardIDForRequest = calculateShardID(req.DBName + "." + req.Table)
-		} else {
-			log.Printf("Error retrieving shard info for '%s.%s': %v", req.DBName, req.Table, err)
-			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error retrieving shard info: " + err.Error()})
+	if req.Operation == "batch" {
+		if currentRole == RoleSlave {
+			log.Printf("Slave node received BATCH op for '%s.%s', forwarding to master.", req.DBName, req.Table)
+			forwardRequestToMaster(w, r)
 			return
 		}
-	} else {
-		if tableShardKeyCol.Valid && tableShardKeyCol.String != "" {
+		handleBatch(w, r, &req)
+		return
+	}
 
-			if req.ShardKeyValue != nil {
-				shardIDForRequest = calculateShardID(fmt.Sprintf("%v", req.ShardKeyValue))
-				log.Printf("Calculated shardID %d for table '%s.%s' based on provided ShardKeyValue '%v' (shard_key column: '%s')",
-					shardIDForRequest, req.DBName, req.Table, req.ShardKeyValue, tableShardKeyCol.String)
-			} else if isWriteOperation {
-
-				var inferredShardValue interface{}
-				if req.Operation == "create" || req.Operation == "update" {
-					if val, ok := req.Data[tableShardKeyCol.String]; ok {
-						inferredShardValue = val
-					}
-				}
-				if inferredShardValue != nil {
-					shardIDForRequest = calculateShardID(fmt.Sprintf("%v", inferredShardValue))
-					log.Printf("Calculated shardID %d for table '%s.%s' based on inferred ShardKeyValue '%v' from Data (shard_key column: '%s')",
-						shardIDForRequest, req.DBName, req.Table, inferredShardValue, tableShardKeyCol.String)
-				} else {
-					log.Printf("Error: Write operation on sharded table '%s.%s' (key: '%s') but ShardKeyValue not provided and not inferable from Data.",
-						req.DBName, req.Table, tableShardKeyCol.String)
-					json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("ShardKeyValue for column '%s' is required for this operation on table '%s.%s'", tableShardKeyCol.String, req.DBName, req.Table)})
-					return
-				}
-			} else {
-				shardIDForRequest = registeredTableShardID
-				log.Printf("Read operation on sharded table '%s.%s' (key: '%s') without ShardKeyValue. Using table's registered shardID: %d.",
-					req.DBName, req.Table, tableShardKeyCol.String, shardIDForRequest)
-			}
-		} else {
-			shardIDForRequest = registeredTableShardID
-			log.Printf("Table '%s.%s' has no specific shard_key column in cluster.table_shards. Using its registered shardID: %d.",
-				req.DBName, req.Table, shardIDForRequest)
-		}
+	route, err := routeCrudRequest(&req, isWriteOperation)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+		return
 	}
+	shardIDForRequest, scatter := route.ShardID, route.Scatter
 
 	if currentRole == RoleSlave {
 		if isWriteOperation {
@@ -111,7 +113,7 @@ func crudHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		slaveOwnsShardID := calculateShardID(config.SelfURL)
-		if shardIDForRequest != slaveOwnsShardID {
+		if !scatter && shardIDForRequest != slaveOwnsShardID {
 			log.Printf("Slave (serves shard %d) received READ request for data in shard %d of '%s.%s'. Denying access.",
 				slaveOwnsShardID, shardIDForRequest, req.DBName, req.Table)
 			json.NewEncoder(w).Encode(Response{
@@ -123,14 +125,70 @@ func crudHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Slave (serves shard %d) handling READ request for its shard for '%s.%s'.", slaveOwnsShardID, req.DBName, req.Table)
 	}
 
-	dbConn, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-		config.MySQL.User, config.MySQL.Password, config.MySQL.Host, config.MySQL.Port, req.DBName))
+	pool, release, err := getDBConn(req.DBName)
 	if err != nil {
 		log.Printf("Error connecting to database '%s': %v", req.DBName, err)
 		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error connecting to DB: " + err.Error()})
 		return
 	}
-	defer dbConn.Close()
+	defer release()
+	dbConn := bindDB(r.Context(), pool)
+
+	schema, err := loadTableSchema(req.DBName, req.Table)
+	if err != nil {
+		log.Printf("Error loading schema for '%s.%s': %v", req.DBName, req.Table, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error loading table schema: " + err.Error()})
+		return
+	}
+	if req.Data, err = coerceRow(schema, req.Data); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid data: " + err.Error()})
+		return
+	}
+
+	var whereSQL string
+	var whereArgs []interface{}
+	if req.Operation != "create" {
+		whereSQL, whereArgs, err = compileFilter(req.conditions(), schema)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid filter: " + err.Error()})
+			return
+		}
+	}
+
+	// Reads of tables that opted into the result cache are answered from it while fresh.
+	var cacheKey string
+	var cacheTables []string
+	var cacheTTL time.Duration
+	var cacheGen uint64
+	if isReadOperation(req.Operation) && req.Stream == "" {
+		if cacheTables, cacheTTL = readCachePolicy(&req, schema); cacheTTL > 0 {
+			cacheKey = resultCacheKey("crud", req)
+			var cached json.RawMessage
+			var ok bool
+			if cached, cacheGen, ok = getCachedResult(cacheKey, req.DBName+"."+req.Table); ok {
+				w.Header().Set("X-Result-Cache", "hit")
+				json.NewEncoder(w).Encode(Response{Success: true, Result: cached})
+				return
+			}
+		}
+	}
+
+	// The replication signal of a write; webhook deliveries of it are queued with the write.
+	var signal map[string]interface{}
+	if isWriteOperation && currentRole == RoleMaster {
+		signal = map[string]interface{}{
+			"operation":       req.Operation,
+			"dbName":          req.DBName,
+			"table":           req.Table,
+			"data":            req.Data,
+			"where":           req.Where,
+			"filter":          req.Filter,
+			"conflictColumns": req.ConflictColumns,
+			"updateColumns":   req.UpdateColumns,
+			"shardId":         float64(shardIDForRequest),
+			"shardKeyValue":   req.ShardKeyValue,
+		}
+	}
 
 	var result interface{}
 	var execErr error
@@ -141,44 +199,240 @@ func crudHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(Response{Success: false, Message: "Data required for create"})
 			return
 		}
-		result, execErr = executeCreate(dbConn, req.Table, req.Data)
+		result, execErr = writeWithCapture(dbConn, schema, changeSpec{Operation: "create", Data: req.Data}, signal, func(exec sqlExecutor) (interface{}, error) {
+			return executeCreate(exec, req.Table, req.Data)
+		})
+	case "upsert":
+		if req.Data == nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Data required for upsert"})
+			return
+		}
+		spec := changeSpec{Operation: "upsert", Data: req.Data, ConflictColumns: req.ConflictColumns}
+		result, execErr = writeWithCapture(dbConn, schema, spec, signal, func(exec sqlExecutor) (interface{}, error) {
+			return executeUpsert(exec, schema, req.Data, req.ConflictColumns, req.UpdateColumns)
+		})
 	case "read":
-		result, execErr = executeRead(dbConn, req.Table, req.Where)
+		if schema.VersionColumn != "" && len(req.Columns) > 0 && !containsFold(req.Columns, schema.VersionColumn) {
+			// The version is always returned so that the client can send it back as expectedVersion.
+			req.Columns = append(req.Columns, schema.VersionColumn)
+		}
+		plan, err := buildReadPlan(&req, schema)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid read options: " + err.Error()})
+			return
+		}
+		if scatter || req.ShardScope != nil {
+			plan.addSortKeys(schema)
+		}
+		if req.Stream != "" {
+			streamRead(w, r, dbConn, &req, plan, route.ShardKey, scatter, whereSQL, whereArgs)
+			return
+		}
+		if len(req.Include) > 0 && req.ShardScope == nil {
+			result, execErr = runJoinRead(dbConn, &req, schema, plan, route.ShardKey, scatter, whereSQL, whereArgs)
+		} else {
+			result, execErr = runRead(dbConn, &req, plan, route.ShardKey, scatter, whereSQL, whereArgs)
+		}
+	case "aggregate":
+		plan, err := buildAggregatePlan(&req, schema)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid aggregate options: " + err.Error()})
+			return
+		}
+		result, execErr = runAggregate(dbConn, &req, plan, route.ShardKey, scatter, whereSQL, whereArgs)
 	case "update":
-		if req.Data == nil || req.Where == nil {
-			json.NewEncoder(w).Encode(Response{Success: false, Message: "Data and where required for update"})
+		if req.Data == nil || whereSQL == "" {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Data and where or filter required for update"})
 			return
 		}
-		result, execErr = executeUpdate(dbConn, req.Table, req.Data, req.Where)
+		spec := changeSpec{Operation: "update", Data: req.Data, WhereSQL: whereSQL, WhereArgs: whereArgs}
+		result, execErr = writeWithCapture(dbConn, schema, spec, signal, func(exec sqlExecutor) (interface{}, error) {
+			return executeUpdate(exec, schema, req.Data, whereSQL, whereArgs, req.ExpectedVersion)
+		})
 	case "delete":
-		if req.Where == nil {
-			json.NewEncoder(w).Encode(Response{Success: false, Message: "Where required for delete"})
+		if whereSQL == "" {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Where or filter required for delete"})
 			return
 		}
-		result, execErr = executeDelete(dbConn, req.Table, req.Where)
+		spec := changeSpec{Operation: "delete", WhereSQL: whereSQL, WhereArgs: whereArgs}
+		result, execErr = writeWithCapture(dbConn, schema, spec, signal, func(exec sqlExecutor) (interface{}, error) {
+			return executeDelete(exec, schema, whereSQL, whereArgs, req.ExpectedVersion)
+		})
 	default:
 		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid operation"})
 		return
 	}
 
+	if conflict, ok := execErr.(*versionConflictError); ok {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: conflict.Error(), Result: conflict.Row})
+		return
+	}
+	if execErr != nil && r.Context().Err() != nil {
+		execErr = requestEndedError(r.Context())
+	}
 	if execErr != nil {
 		log.Printf("Error executing %s on '%s.%s': %v", req.Operation, req.DBName, req.Table, execErr)
 		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error executing operation: " + execErr.Error()})
 		return
 	}
 
-	if isWriteOperation && currentRole == RoleMaster {
+	if signal != nil {
 		log.Printf("Master executed %s on '%s.%s' for data shard %d. Initiating HTTP replication signal.", req.Operation, req.DBName, req.Table, shardIDForRequest)
-		replicateToNodes(map[string]interface{}{
-			"operation":     req.Operation,
-			"dbName":        req.DBName,
-			"table":         req.Table,
-			"data":          req.Data,
-			"where":         req.Where,
-			"shardId":       float64(shardIDForRequest),
-			"shardKeyValue": req.ShardKeyValue,
-		})
+		replicateToNodes(signal)
+	}
+
+	if cacheKey != "" {
+		w.Header().Set("X-Result-Cache", "miss")
+		if encoded := putCachedResult(cacheKey, req.DBName, cacheTables, result, cacheTTL, cacheGen); encoded != nil {
+			result = encoded
+		}
 	}
 
 	json.NewEncoder(w).Encode(Response{Success: true, Result: result})
 }
+
+// isReadOperation reports whether a CRUD operation only reads data. Aggregates are reads: they
+// are routed and scattered like them, may be cached, and are never recorded under an
+// idempotency key.
+func isReadOperation(operation string) bool {
+	return operation == "read" || operation == "aggregate"
+}
+
+// crudRoute is where a CRUD request runs: the data shard it targets, or every shard for a
+// scatter-gather read. ShardKey is the table's shard key column, if it is sharded by key.
+type crudRoute struct {
+	ShardID  int
+	Scatter  bool
+	ShardKey string
+}
+
+// resolveShard finds the shard a request or batch item on a table sharded by shardKey
+// addresses: its shardKeyValue, else a filter pinning the shard key unless the operation is
+// a create or upsert, else the shard key value in the data of a create, update or upsert.
+// ok is false when none of them decides.
+func resolveShard(operation string, shardKeyValue interface{}, conditions *Filter, data map[string]interface{}, shardKey string) (shardID int, ok bool) {
+	if shardKeyValue != nil {
+		return calculateShardID(fmt.Sprintf("%v", shardKeyValue)), true
+	}
+	if operation != "create" && operation != "upsert" {
+		if pinned, ok := pinnedShard(conditions, shardKey); ok {
+			return pinned, true
+		}
+	}
+	if operation == "create" || operation == "update" || operation == "upsert" {
+		if val, ok := data[shardKey]; ok && val != nil {
+			return calculateShardID(fmt.Sprintf("%v", val)), true
+		}
+	}
+	return 0, false
+}
+
+// routeCrudRequest resolves the shard of a request from the table's entry in
+// cluster.table_shards, the shard key value, the filter, or the written data.
+func routeCrudRequest(req *crudRequest, isWrite bool) (crudRoute, error) {
+	var route crudRoute
+	var tableShardKeyCol sql.NullString
+	var registeredTableShardID int
+
+	err := db.QueryRow("SELECT shard_id, shard_key FROM cluster.table_shards WHERE db_name = ? AND table_name = ?",
+		req.DBName, req.Table).Scan(&registeredTableShardID, &tableShardKeyCol)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("Warning: Table '%s.%s' not found in cluster.table_shards. Calculating shardID based on table name for routing.", req.DBName, req.Table)
+			route.ShardID = calculateShardID(req.DBName + "." + req.Table)
+		} else {
+			log.Printf("Error retrieving shard info for '%s.%s': %v", req.DBName, req.Table, err)
+			return route, fmt.Errorf("Error retrieving shard info: %w", err)
+		}
+	} else {
+		if tableShardKeyCol.Valid && tableShardKeyCol.String != "" {
+
+			if req.ShardScope != nil {
+				if !isReadOperation(req.Operation) || *req.ShardScope < 0 || *req.ShardScope >= config.ShardCount {
+					return route, fmt.Errorf("shardScope is only valid for reads of an existing shard")
+				}
+				route.ShardID = *req.ShardScope
+				log.Printf("Shard-scoped READ for shard %d of '%s.%s' (shard_key column: '%s')",
+					route.ShardID, req.DBName, req.Table, tableShardKeyCol.String)
+			} else if shardID, ok := resolveShard(req.Operation, req.ShardKeyValue, req.conditions(), req.Data, tableShardKeyCol.String); ok {
+				route.ShardID = shardID
+				log.Printf("Calculated shardID %d for %s on table '%s.%s' (shard_key column: '%s')",
+					route.ShardID, req.Operation, req.DBName, req.Table, tableShardKeyCol.String)
+			} else if isWrite {
+				log.Printf("Error: Write operation on sharded table '%s.%s' (key: '%s') but ShardKeyValue not provided and not inferable from Data.",
+					req.DBName, req.Table, tableShardKeyCol.String)
+				return route, fmt.Errorf("ShardKeyValue for column '%s' is required for this operation on table '%s.%s'", tableShardKeyCol.String, req.DBName, req.Table)
+			} else {
+				route.Scatter = true
+				log.Printf("Read operation on sharded table '%s.%s' (key: '%s') without ShardKeyValue. Scattering across %d shards.",
+					req.DBName, req.Table, tableShardKeyCol.String, config.ShardCount)
+			}
+		} else {
+			route.ShardID = registeredTableShardID
+			log.Printf("Table '%s.%s' has no specific shard_key column in cluster.table_shards. Using its registered shardID: %d.",
+				req.DBName, req.Table, route.ShardID)
+		}
+	}
+	if (route.Scatter || req.ShardScope != nil) && !scatterReadsEnabled {
+		return route, fmt.Errorf("reads of sharded table '%s.%s' need a ShardKeyValue or a filter pinning '%s': scatter-gather reads are disabled on this node",
+			req.DBName, req.Table, tableShardKeyCol.String)
+	}
+	route.ShardKey = tableShardKeyCol.String
+	return route, nil
+}
+
+func runRead(dbConn *requestDB, req *crudRequest, plan *readPlan, shardKey string, scatter bool, whereSQL string, whereArgs []interface{}) (interface{}, error) {
+	if req.ShardScope != nil {
+		predicate, predArgs := shardPredicateSQL(shardKey, *req.ShardScope)
+		whereSQL, whereArgs = andSQL(whereSQL, whereArgs, predicate, predArgs)
+		rows, err := executeRead(dbConn, plan, whereSQL, whereArgs)
+		if err != nil {
+			return nil, err
+		}
+		page := &readPage{Rows: rows}
+		if plan.IncludeTotal {
+			total, err := countRows(dbConn, plan.Table, whereSQL, whereArgs)
+			if err != nil {
+				return nil, err
+			}
+			page.Total = &total
+		}
+		return page, nil
+	}
+
+	rows, total, err := readRows(dbConn, req, plan, shardKey, scatter, whereSQL, whereArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	page := finishPage(plan, rows)
+	page.Total = total
+	if !req.wantsPage() {
+		return page.Rows, nil
+	}
+	return page, nil
+}
+
+// readRows returns the rows of a read, including the over-fetched row and hidden columns that
+// finishPage removes.
+func readRows(dbConn *requestDB, req *crudRequest, plan *readPlan, shardKey string, scatter bool, whereSQL string, whereArgs []interface{}) ([]map[string]interface{}, *int64, error) {
+	var rows []map[string]interface{}
+	var total *int64
+	var err error
+	if scatter {
+		rows, total, err = scatterRead(dbConn, req, plan, shardKey, whereSQL, whereArgs)
+	} else {
+		rows, err = executeRead(dbConn, plan, whereSQL, whereArgs)
+		if err == nil && plan.IncludeTotal {
+			var n int64
+			n, err = countRows(dbConn, plan.Table, whereSQL, whereArgs)
+			total = &n
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return rows, total, nil
+}
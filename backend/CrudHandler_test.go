@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestResolveShard(t *testing.T) {
+	defer func(n int) { config.ShardCount = n }(config.ShardCount)
+	config.ShardCount = 16
+	byKey := func(v interface{}) int { return calculateShardID(fmt.Sprintf("%v", v)) }
+	pin := &Filter{Column: "tenant", Op: "=", Value: "b"}
+	data := map[string]interface{}{"tenant": "c"}
+	tests := []struct {
+		name          string
+		operation     string
+		shardKeyValue interface{}
+		conditions    *Filter
+		data          map[string]interface{}
+		want          int
+		wantOK        bool
+	}{
+		{"shard key value first", "update", "a", pin, data, byKey("a"), true},
+		{"pinned filter before data on update", "update", nil, pin, data, byKey("b"), true},
+		{"pinned filter on delete", "delete", nil, pin, nil, byKey("b"), true},
+		{"data on create", "create", nil, pin, data, byKey("c"), true},
+		{"data on upsert", "upsert", nil, pin, data, byKey("c"), true},
+		{"data on update without a pin", "update", nil, nil, data, byKey("c"), true},
+		{"delete ignores data", "delete", nil, nil, data, 0, false},
+		{"null data value", "create", nil, nil, map[string]interface{}{"tenant": nil}, 0, false},
+		{"read without a pin", "read", nil, &Filter{Column: "tenant", Op: ">", Value: "a"}, nil, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := resolveShard(tt.operation, tt.shardKeyValue, tt.conditions, tt.data, "tenant")
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("resolveShard = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
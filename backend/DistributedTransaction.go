@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Two-phase commit states recorded in cluster.xa_log. Once a transaction reaches
+// xaCommitting, every prepared branch must be committed, including during recovery.
+const (
+	xaPreparing  = "preparing"
+	xaCommitting = "committing"
+	xaCommitted  = "committed"
+	xaAborting   = "aborting"
+	xaAborted    = "aborted"
+)
+
+type xaBranch struct {
+	ShardID int
+	Bqual   string
+	Ops     []int
+	conn    *sql.Conn
+	ended   bool
+}
+
+func xaID(gtrid, bqual string) string {
+	return fmt.Sprintf("'%s','%s'", gtrid, bqual)
+}
+
+func setXAState(gtrid, state string) error {
+	_, err := db.Exec("UPDATE cluster.xa_log SET state = ?, updated_at = ? WHERE gtrid = ?", state, time.Now(), gtrid)
+	if err != nil {
+		log.Printf("Error recording state %s for distributed transaction %s: %v", state, gtrid, err)
+	}
+	return err
+}
+
+// recordCommitDecision moves a transaction to xaCommitting. The row changes of its branches,
+// the webhook deliveries of its signals and the idempotency key of the request ctx belongs to
+// are recorded in the same transaction, since the branches are bound to commit from then on.
+// The changes are not recorded inside the branches: a prepared branch would hold its
+// change_log positions until phase 2, and readers skip positions missing for too long.
+func recordCommitDecision(ctx context.Context, gtrid string, changes []rowChange, signals []map[string]interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE cluster.xa_log SET state = ?, updated_at = ? WHERE gtrid = ?", xaCommitting, time.Now(), gtrid); err != nil {
+		return err
+	}
+	if err := recordChanges(tx, changes); err != nil {
+		return err
+	}
+	for _, signal := range signals {
+		if err := queueWebhooks(tx, signal); err != nil {
+			return err
+		}
+	}
+	if err := recordIdempotencyKey(ctx, tx, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// distributedTransactionHandler runs operations that span several shards atomically using
+// MySQL XA: one branch per shard, prepared together, with the commit decision written to
+// cluster.xa_log before any branch is committed.
+func distributedTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+	if currentRole == RoleSlave {
+		log.Println("Slave node received distributed transaction request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		DBName     string        `json:"dbName"`
+		Operations []txOperation `json:"operations"`
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request body: " + err.Error()})
+		return
+	}
+	if err := decodeJSONNumbers(bodyBytes, &req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request format: " + err.Error()})
+		return
+	}
+	if req.DBName == "" || len(req.Operations) == 0 {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "DB name and operations required"})
+		return
+	}
+	dbName := SanitizeIdentifier(req.DBName)
+
+	shardKeys := make([]string, len(req.Operations))
+	branchByShard := make(map[int]*xaBranch)
+	schemas := make(map[string]*TableSchema)
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		shardID, shardKey, err := resolveOpShard(dbName, op)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Operation %d: %v", i, err)})
+			return
+		}
+		if _, ok := schemas[op.Table]; !ok {
+			schema, err := loadTableSchema(dbName, op.Table)
+			if err != nil {
+				json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Operation %d: %v", i, err)})
+				return
+			}
+			schemas[op.Table] = schema
+		}
+		shardKeys[i] = shardKey
+		branch, ok := branchByShard[shardID]
+		if !ok {
+			branch = &xaBranch{ShardID: shardID, Bqual: fmt.Sprintf("shard-%d", shardID)}
+			branchByShard[shardID] = branch
+		}
+		branch.Ops = append(branch.Ops, i)
+	}
+
+	branches := make([]*xaBranch, 0, len(branchByShard))
+	for _, b := range branchByShard {
+		branches = append(branches, b)
+	}
+	sort.Slice(branches, func(i, j int) bool { return branches[i].ShardID < branches[j].ShardID })
+
+	dbConn, release, err := getDBConn(dbName)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error connecting to DB: " + err.Error()})
+		return
+	}
+	defer release()
+
+	gtrid := strings.ReplaceAll(newIdempotencyKey("ddb"), "-", "")
+	bquals := make([]string, len(branches))
+	for i, b := range branches {
+		bquals[i] = b.Bqual
+	}
+	now := time.Now()
+	_, err = db.Exec(`
+		INSERT INTO cluster.xa_log (gtrid, db_name, branches, state, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, gtrid, dbName, strings.Join(bquals, ","), xaPreparing, now, now)
+	if err != nil {
+		log.Printf("Error writing coordinator log for %s: %v", gtrid, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Failed to write coordinator log: " + err.Error()})
+		return
+	}
+	log.Printf("Distributed transaction %s on '%s' started with %d branches", gtrid, dbName, len(branches))
+
+	results := make([]interface{}, len(req.Operations))
+	abort := func(cause error) {
+		setXAState(gtrid, xaAborting)
+		for _, b := range branches {
+			if b.conn == nil {
+				continue
+			}
+			xid := xaID(gtrid, b.Bqual)
+			if !b.ended {
+				b.conn.ExecContext(context.Background(), "XA END "+xid)
+			}
+			if _, err := b.conn.ExecContext(context.Background(), "XA ROLLBACK "+xid); err != nil {
+				log.Printf("Error rolling back branch %s of %s: %v", b.Bqual, gtrid, err)
+				// The branch may still be attached to the session; keep it out of the pool.
+				discardConn(b.conn)
+				continue
+			}
+			b.conn.Close()
+		}
+		setXAState(gtrid, xaAborted)
+		log.Printf("Distributed transaction %s aborted: %v", gtrid, cause)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Distributed transaction aborted: " + cause.Error()})
+	}
+
+	// Phase 1: run every branch and prepare it.
+	var changes []rowChange
+	for _, b := range branches {
+		b.conn, err = dbConn.Conn(context.Background())
+		if err != nil {
+			abort(fmt.Errorf("shard %d: %w", b.ShardID, err))
+			return
+		}
+		xid := xaID(gtrid, b.Bqual)
+		if _, err := b.conn.ExecContext(context.Background(), "XA START "+xid); err != nil {
+			b.conn.Close()
+			b.conn = nil
+			abort(fmt.Errorf("shard %d: XA START failed: %w", b.ShardID, err))
+			return
+		}
+		// A branch runs every statement on its pinned session. Its operations stop with the
+		// request; the XA statements that end the branch must run regardless.
+		exec := withContext(r.Context(), b.conn)
+		for _, i := range b.Ops {
+			op := &req.Operations[i]
+			result, opChanges, err := applyTxOperation(exec, op, schemas[op.Table], shardKeys[i], b.ShardID)
+			if err != nil {
+				if r.Context().Err() != nil {
+					err = requestEndedError(r.Context())
+				}
+				abort(fmt.Errorf("operation %d (%s on '%s'): %w", i, op.Operation, op.Table, err))
+				return
+			}
+			results[i] = result
+			changes = append(changes, opChanges...)
+		}
+		if _, err := b.conn.ExecContext(context.Background(), "XA END "+xid); err != nil {
+			abort(fmt.Errorf("shard %d: XA END failed: %w", b.ShardID, err))
+			return
+		}
+		b.ended = true
+		if _, err := b.conn.ExecContext(context.Background(), "XA PREPARE "+xid); err != nil {
+			abort(fmt.Errorf("shard %d: XA PREPARE failed: %w", b.ShardID, err))
+			return
+		}
+	}
+
+	var signals []map[string]interface{}
+	for _, b := range branches {
+		var ops []txOperation
+		for _, i := range b.Ops {
+			if isWriteOp(req.Operations[i].Operation) {
+				ops = append(ops, req.Operations[i])
+			}
+		}
+		if len(ops) > 0 {
+			signals = append(signals, map[string]interface{}{
+				"operation":  "distributed_transaction",
+				"dbName":     dbName,
+				"txId":       gtrid,
+				"operations": ops,
+				"shardId":    float64(b.ShardID),
+			})
+		}
+	}
+
+	// The commit decision is durable once this update succeeds.
+	if err := recordCommitDecision(r.Context(), gtrid, changes, signals); err != nil {
+		log.Printf("Error recording commit decision for distributed transaction %s: %v", gtrid, err)
+		abort(fmt.Errorf("failed to record commit decision: %w", err))
+		return
+	}
+
+	// Phase 2: commit every branch. A branch that fails here stays prepared and is committed
+	// by recoverInDoubtTransactions.
+	inDoubt := 0
+	for _, b := range branches {
+		if _, err := b.conn.ExecContext(context.Background(), "XA COMMIT "+xaID(gtrid, b.Bqual)); err != nil {
+			log.Printf("Error committing branch %s of %s, leaving it for recovery: %v", b.Bqual, gtrid, err)
+			inDoubt++
+			discardConn(b.conn)
+			continue
+		}
+		b.conn.Close()
+	}
+	if inDoubt == 0 {
+		setXAState(gtrid, xaCommitted)
+	}
+	if len(changes) > 0 {
+		notifyChangeLog()
+	}
+
+	for _, signal := range signals {
+		replicateToNodes(signal)
+	}
+
+	shardIDs := make([]int, len(branches))
+	for i, b := range branches {
+		shardIDs[i] = b.ShardID
+	}
+	log.Printf("Distributed transaction %s committed across shards %v", gtrid, shardIDs)
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: fmt.Sprintf("Distributed transaction committed across %d shards", len(branches)),
+		Result:  map[string]interface{}{"txId": gtrid, "shards": shardIDs, "results": results},
+	})
+}
+
+// recoverInDoubtTransactions resolves XA branches left prepared by a crash of the coordinator
+// or of MySQL. Branches whose transaction reached the commit decision are committed; all
+// others are rolled back. Transactions touched within the grace period are skipped, because
+// their coordinator may still be running. It runs on the master at startup and on promotion
+// with no grace, and periodically with one.
+func recoverInDoubtTransactions(grace time.Duration) {
+	if db == nil || currentRole != RoleMaster {
+		return
+	}
+	rows, err := db.Query("XA RECOVER")
+	if err != nil {
+		log.Printf("Error listing prepared XA transactions: %v", err)
+		return
+	}
+	type preparedXid struct{ gtrid, bqual string }
+	var prepared []preparedXid
+	for rows.Next() {
+		var formatID, gtridLen, bqualLen int
+		var data string
+		if err := rows.Scan(&formatID, &gtridLen, &bqualLen, &data); err != nil {
+			log.Printf("Error scanning prepared XA transaction: %v", err)
+			continue
+		}
+		if gtridLen+bqualLen > len(data) || !strings.HasPrefix(data, "ddb") {
+			continue
+		}
+		prepared = append(prepared, preparedXid{gtrid: data[:gtridLen], bqual: data[gtridLen : gtridLen+bqualLen]})
+	}
+	rows.Close()
+
+	// unresolved holds the transactions with a branch still prepared after this pass.
+	unresolved := make(map[string]bool)
+	cutoff := time.Now().Add(-grace)
+	for _, x := range prepared {
+		var state string
+		var updatedAt time.Time
+		err := db.QueryRow("SELECT state, updated_at FROM cluster.xa_log WHERE gtrid = ?", x.gtrid).Scan(&state, &updatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Error reading coordinator log for %s: %v", x.gtrid, err)
+			unresolved[x.gtrid] = true
+			continue
+		}
+		if err == nil && updatedAt.After(cutoff) {
+			continue
+		}
+		xid := xaID(x.gtrid, x.bqual)
+		if state == xaCommitting || state == xaCommitted {
+			if _, err := db.Exec("XA COMMIT " + xid); err != nil {
+				log.Printf("Recovery: error committing in-doubt branch %s: %v", xid, err)
+				unresolved[x.gtrid] = true
+				continue
+			}
+			log.Printf("Recovery: committed in-doubt branch %s", xid)
+		} else {
+			if _, err := db.Exec("XA ROLLBACK " + xid); err != nil {
+				log.Printf("Recovery: error rolling back in-doubt branch %s: %v", xid, err)
+				unresolved[x.gtrid] = true
+				continue
+			}
+			log.Printf("Recovery: rolled back in-doubt branch %s (coordinator state %q)", xid, state)
+		}
+	}
+
+	// Transactions past the grace period with no branch left prepared are finished, so their
+	// log entries can be closed. Those with a branch that failed to resolve keep their state
+	// and are retried by the next pass.
+	exclude, excludeArgs := "", []interface{}{}
+	if len(unresolved) > 0 {
+		placeholders := make([]string, 0, len(unresolved))
+		for gtrid := range unresolved {
+			placeholders = append(placeholders, "?")
+			excludeArgs = append(excludeArgs, gtrid)
+		}
+		exclude = " AND gtrid NOT IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+	_, err = db.Exec(`UPDATE cluster.xa_log SET state = ?, updated_at = ? WHERE state = ? AND updated_at <= ?`+exclude,
+		append([]interface{}{xaCommitted, time.Now(), xaCommitting, cutoff}, excludeArgs...)...)
+	if err != nil {
+		log.Printf("Error closing committed transactions in coordinator log: %v", err)
+	}
+	_, err = db.Exec(`UPDATE cluster.xa_log SET state = ?, updated_at = ? WHERE state IN (?, ?) AND updated_at <= ?`+exclude,
+		append([]interface{}{xaAborted, time.Now(), xaPreparing, xaAborting, cutoff}, excludeArgs...)...)
+	if err != nil {
+		log.Printf("Error closing aborted transactions in coordinator log: %v", err)
+	}
+}
+
+func recoverInDoubtTransactionsLoop() {
+	for {
+		time.Sleep(time.Minute)
+		recoverInDoubtTransactions(time.Minute)
+	}
+}
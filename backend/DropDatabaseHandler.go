@@ -52,6 +52,8 @@ func dropDatabaseHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error dropping database: " + err.Error()})
 		return
 	}
+	invalidateTableSchema(SanitizeIdentifier(req.DBName), "")
+	closeDBConn(SanitizeIdentifier(req.DBName))
 	log.Printf("Database '%s' dropped successfully on master.", req.DBName)
 
 	replicateToNodes(map[string]interface{}{
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -45,14 +44,13 @@ func dropTableHandler(w http.ResponseWriter, r *http.Request) {
 	safeDBName := SanitizeIdentifier(req.DBName)
 	safeTableName := SanitizeIdentifier(req.TableName)
 
-	dbConn, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-		config.MySQL.User, config.MySQL.Password, config.MySQL.Host, config.MySQL.Port, safeDBName))
+	dbConn, release, err := getDBConn(safeDBName)
 	if err != nil {
 		log.Printf("Error connecting to database '%s' on master: %v", safeDBName, err)
 		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error connecting to DB: " + err.Error()})
 		return
 	}
-	defer dbConn.Close()
+	defer release()
 
 	_, err = dbConn.Exec("DROP TABLE IF EXISTS " + safeTableName)
 	if err != nil {
@@ -61,11 +59,32 @@ func dropTableHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("Table '%s.%s' dropped successfully on master.", safeDBName, safeTableName)
+	invalidateTableSchema(safeDBName, safeTableName)
 
 	_, err = db.Exec("DELETE FROM cluster.table_shards WHERE db_name = ? AND table_name = ?", safeDBName, safeTableName)
 	if err != nil {
 		log.Printf("Error removing table shard mapping for '%s.%s' on master: %v", safeDBName, safeTableName, err)
 	}
+	_, err = db.Exec("DELETE FROM cluster.table_links WHERE db_name = ? AND (parent_table = ? OR child_table = ?)", safeDBName, safeTableName, safeTableName)
+	if err != nil {
+		log.Printf("Error removing table links of '%s.%s' on master: %v", safeDBName, safeTableName, err)
+	}
+	_, err = db.Exec("DELETE FROM cluster.table_versions WHERE db_name = ? AND table_name = ?", safeDBName, safeTableName)
+	if err != nil {
+		log.Printf("Error removing version column of '%s.%s' on master: %v", safeDBName, safeTableName, err)
+	}
+	_, err = db.Exec("DELETE FROM cluster.table_cache WHERE db_name = ? AND table_name = ?", safeDBName, safeTableName)
+	if err != nil {
+		log.Printf("Error removing cache policy of '%s.%s' on master: %v", safeDBName, safeTableName, err)
+	}
+	_, err = db.Exec("DELETE FROM cluster.table_ttl WHERE db_name = ? AND table_name = ?", safeDBName, safeTableName)
+	if err != nil {
+		log.Printf("Error removing TTL policy of '%s.%s' on master: %v", safeDBName, safeTableName, err)
+	}
+	_, err = db.Exec("DELETE FROM cluster.table_migrations WHERE db_name = ? AND table_name = ?", safeDBName, safeTableName)
+	if err != nil {
+		log.Printf("Error removing migration history of '%s.%s' on master: %v", safeDBName, safeTableName, err)
+	}
 
 	// Determine a representative shardId for the dropped table for notification purposes
 	shardID := calculateShardID(safeDBName + "." + safeTableName)
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Filter is the structured condition language accepted by /api/crud. A filter node is either
+// a group (and, or, not) or a single condition on a column:
+//
+//	{"and": [
+//	    {"column": "age", "op": ">=", "value": 18},
+//	    {"or": [{"column": "city", "op": "in", "values": ["Cairo", "Giza"]},
+//	            {"column": "email", "op": "isNull"}]},
+//	    {"not": {"column": "name", "op": "like", "value": "test%"}}
+//	]}
+type Filter struct {
+	And    []Filter      `json:"and,omitempty"`
+	Or     []Filter      `json:"or,omitempty"`
+	Not    *Filter       `json:"not,omitempty"`
+	Column string        `json:"column,omitempty"`
+	Op     string        `json:"op,omitempty"`
+	Value  interface{}   `json:"value,omitempty"`
+	Values []interface{} `json:"values,omitempty"`
+}
+
+const maxFilterDepth = 32
+
+var comparisonOps = map[string]string{
+	"=":  "=",
+	"eq": "=",
+	"!=": "<>",
+	"<>": "<>",
+	"ne": "<>",
+	"<":  "<",
+	"lt": "<",
+	"<=": "<=",
+	"le": "<=",
+	">":  ">",
+	"gt": ">",
+	">=": ">=",
+	"ge": ">=",
+}
+
+// whereToFilter converts the legacy equality map into a filter. Keys are sorted so that the
+// generated SQL is stable.
+func whereToFilter(where map[string]interface{}) *Filter {
+	if len(where) == 0 {
+		return nil
+	}
+	cols := keys(where)
+	sort.Strings(cols)
+	f := &Filter{}
+	for _, col := range cols {
+		f.And = append(f.And, Filter{Column: col, Op: "=", Value: where[col]})
+	}
+	return f
+}
+
+// combineFilters joins the non-nil filters with AND.
+func combineFilters(filters ...*Filter) *Filter {
+	var parts []Filter
+	for _, f := range filters {
+		if f != nil {
+			parts = append(parts, *f)
+		}
+	}
+	switch len(parts) {
+	case 0:
+		return nil
+	case 1:
+		return &parts[0]
+	}
+	return &Filter{And: parts}
+}
+
+// compileFilter turns a filter into a parameterized SQL condition. Every column must exist in
+// the table schema.
+func compileFilter(f *Filter, schema *TableSchema) (string, []interface{}, error) {
+	if f == nil {
+		return "", nil, nil
+	}
+	var args []interface{}
+	cond, err := compileFilterNode(f, schema, &args, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return cond, args, nil
+}
+
+func compileFilterNode(f *Filter, schema *TableSchema, args *[]interface{}, depth int) (string, error) {
+	if depth > maxFilterDepth {
+		return "", fmt.Errorf("filter is nested too deeply (max %d levels)", maxFilterDepth)
+	}
+
+	kinds := 0
+	if len(f.And) > 0 {
+		kinds++
+	}
+	if len(f.Or) > 0 {
+		kinds++
+	}
+	if f.Not != nil {
+		kinds++
+	}
+	if f.Column != "" {
+		kinds++
+	}
+	if kinds != 1 {
+		return "", fmt.Errorf("each filter node must have exactly one of 'and', 'or', 'not' or 'column'")
+	}
+
+	switch {
+	case len(f.And) > 0 || len(f.Or) > 0:
+		children, joiner := f.And, " AND "
+		if len(f.Or) > 0 {
+			children, joiner = f.Or, " OR "
+		}
+		parts := make([]string, 0, len(children))
+		for i := range children {
+			part, err := compileFilterNode(&children[i], schema, args, depth+1)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, part)
+		}
+		return "(" + strings.Join(parts, joiner) + ")", nil
+	case f.Not != nil:
+		part, err := compileFilterNode(f.Not, schema, args, depth+1)
+		if err != nil {
+			return "", err
+		}
+		return "NOT " + part, nil
+	}
+
+	col, ok := schema.Column(f.Column)
+	if !ok {
+		return "", fmt.Errorf("unknown column '%s' in filter for table '%s'", f.Column, schema.Table)
+	}
+	qcol := quoteIdentifier(col.Name)
+
+	op := strings.ToLower(strings.TrimSpace(f.Op))
+	if op == "" {
+		op = "="
+	}
+	if sqlOp, ok := comparisonOps[op]; ok {
+		if f.Value == nil {
+			switch sqlOp {
+			case "=":
+				return fmt.Sprintf("(%s IS NULL)", qcol), nil
+			case "<>":
+				return fmt.Sprintf("(%s IS NOT NULL)", qcol), nil
+			}
+			return "", fmt.Errorf("operator '%s' on column '%s' requires a non-null value", f.Op, col.Name)
+		}
+		value, err := filterValue(col, f.Value)
+		if err != nil {
+			return "", err
+		}
+		*args = append(*args, value)
+		return fmt.Sprintf("(%s %s ?)", qcol, sqlOp), nil
+	}
+
+	switch op {
+	case "in", "notin", "not in":
+		if len(f.Values) == 0 {
+			return "", fmt.Errorf("operator '%s' on column '%s' requires a non-empty 'values' list", f.Op, col.Name)
+		}
+		for _, v := range f.Values {
+			value, err := filterValue(col, v)
+			if err != nil {
+				return "", err
+			}
+			*args = append(*args, value)
+		}
+		keyword := "IN"
+		if op != "in" {
+			keyword = "NOT IN"
+		}
+		return fmt.Sprintf("(%s %s (%s))", qcol, keyword, strings.Join(createPlaceholders(len(f.Values)), ", ")), nil
+	case "between":
+		if len(f.Values) != 2 {
+			return "", fmt.Errorf("operator 'between' on column '%s' requires exactly two 'values'", col.Name)
+		}
+		for _, v := range f.Values {
+			value, err := filterValue(col, v)
+			if err != nil {
+				return "", err
+			}
+			*args = append(*args, value)
+		}
+		return fmt.Sprintf("(%s BETWEEN ? AND ?)", qcol), nil
+	case "like", "notlike", "not like":
+		pattern, ok := f.Value.(string)
+		if !ok {
+			return "", fmt.Errorf("operator '%s' on column '%s' requires a string pattern", f.Op, col.Name)
+		}
+		*args = append(*args, pattern)
+		keyword := "LIKE"
+		if op != "like" {
+			keyword = "NOT LIKE"
+		}
+		return fmt.Sprintf("(%s %s ?)", qcol, keyword), nil
+	case "isnull", "is null":
+		return fmt.Sprintf("(%s IS NULL)", qcol), nil
+	case "isnotnull", "is not null":
+		return fmt.Sprintf("(%s IS NOT NULL)", qcol), nil
+	}
+	return "", fmt.Errorf("unsupported filter operator '%s' on column '%s'", f.Op, col.Name)
+}
+
+// filterValue converts a comparison value to the column's type, like the values of a write.
+// Range, length and enum checks are left out: a value outside them simply matches nothing.
+// JSON columns are compared as MySQL compares them, so their values are passed unchanged.
+func filterValue(col ColumnInfo, v interface{}) (interface{}, error) {
+	switch col.DataType {
+	case "json":
+		return v, nil
+	case "tinyint", "smallint", "mediumint", "int", "integer":
+		col.DataType, col.ColumnType = "bigint", "bigint"
+	case "decimal", "numeric":
+		col.ColumnType = "decimal(65,30)"
+	case "char", "varchar", "enum", "set":
+		col.DataType = "text"
+	}
+	return coerceValue(col, v)
+}
+
+// filterShards returns the set of shards that rows matching the filter can live in, based on
+// the table's shard key. constrained is false when the filter does not restrict the shard key.
+func filterShards(f *Filter, shardKey string) (shards map[int]bool, constrained bool) {
+	if f == nil || shardKey == "" {
+		return nil, false
+	}
+	switch {
+	case len(f.And) > 0:
+		var result map[int]bool
+		for i := range f.And {
+			child, ok := filterShards(&f.And[i], shardKey)
+			if !ok {
+				continue
+			}
+			if result == nil {
+				result = child
+				continue
+			}
+			for id := range result {
+				if !child[id] {
+					delete(result, id)
+				}
+			}
+		}
+		return result, result != nil
+	case len(f.Or) > 0:
+		result := make(map[int]bool)
+		for i := range f.Or {
+			child, ok := filterShards(&f.Or[i], shardKey)
+			if !ok {
+				return nil, false
+			}
+			for id := range child {
+				result[id] = true
+			}
+		}
+		return result, true
+	case f.Not != nil:
+		return nil, false
+	}
+
+	if !strings.EqualFold(f.Column, shardKey) {
+		return nil, false
+	}
+	op := strings.ToLower(strings.TrimSpace(f.Op))
+	switch {
+	case (op == "" || comparisonOps[op] == "=") && f.Value != nil:
+		return map[int]bool{calculateShardID(fmt.Sprintf("%v", f.Value)): true}, true
+	case op == "in" && len(f.Values) > 0:
+		result := make(map[int]bool)
+		for _, v := range f.Values {
+			result[calculateShardID(fmt.Sprintf("%v", v))] = true
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+// pinnedShard reports the single shard a filter confines the table's rows to, if any.
+func pinnedShard(f *Filter, shardKey string) (int, bool) {
+	shards, ok := filterShards(f, shardKey)
+	if !ok || len(shards) != 1 {
+		return 0, false
+	}
+	for id := range shards {
+		return id, true
+	}
+	return 0, false
+}
+
+// matchFilter evaluates a filter against a row in memory, for conditions that can only be
+// checked after rows from several shards have been merged.
+func matchFilter(f *Filter, row map[string]interface{}) (bool, error) {
+	return matchFilterNode(f, row, 0)
+}
+
+func matchFilterNode(f *Filter, row map[string]interface{}, depth int) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	if depth > maxFilterDepth {
+		return false, fmt.Errorf("filter is nested too deeply (max %d levels)", maxFilterDepth)
+	}
+	switch {
+	case len(f.And) > 0:
+		for i := range f.And {
+			ok, err := matchFilterNode(&f.And[i], row, depth+1)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case len(f.Or) > 0:
+		for i := range f.Or {
+			ok, err := matchFilterNode(&f.Or[i], row, depth+1)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case f.Not != nil:
+		ok, err := matchFilterNode(f.Not, row, depth+1)
+		return !ok, err
+	}
+
+	value, found := row[f.Column]
+	if !found {
+		for k, v := range row {
+			if strings.EqualFold(k, f.Column) {
+				value, found = v, true
+				break
+			}
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("unknown column '%s' in filter", f.Column)
+	}
+
+	op := strings.ToLower(strings.TrimSpace(f.Op))
+	if op == "" {
+		op = "="
+	}
+	if sqlOp, ok := comparisonOps[op]; ok {
+		if f.Value == nil {
+			return (sqlOp == "=") == (value == nil), nil
+		}
+		if value == nil {
+			return false, nil
+		}
+		c := compareValues(value, f.Value)
+		switch sqlOp {
+		case "=":
+			return c == 0, nil
+		case "<>":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}
+
+	switch op {
+	case "in", "notin", "not in":
+		if value == nil {
+			return false, nil
+		}
+		in := false
+		for _, v := range f.Values {
+			if v != nil && compareValues(value, v) == 0 {
+				in = true
+				break
+			}
+		}
+		return in == (op == "in"), nil
+	case "between":
+		if len(f.Values) != 2 {
+			return false, fmt.Errorf("operator 'between' on column '%s' requires exactly two 'values'", f.Column)
+		}
+		if value == nil {
+			return false, nil
+		}
+		return compareValues(value, f.Values[0]) >= 0 && compareValues(value, f.Values[1]) <= 0, nil
+	case "like", "notlike", "not like":
+		pattern, ok := f.Value.(string)
+		if !ok {
+			return false, fmt.Errorf("operator '%s' on column '%s' requires a string pattern", f.Op, f.Column)
+		}
+		if value == nil {
+			return false, nil
+		}
+		matched := likePattern(pattern).MatchString(fmt.Sprint(value))
+		return matched == (op == "like"), nil
+	case "isnull", "is null":
+		return value == nil, nil
+	case "isnotnull", "is not null":
+		return value != nil, nil
+	}
+	return false, fmt.Errorf("unsupported filter operator '%s' on column '%s'", f.Op, f.Column)
+}
+
+// likePattern translates a SQL LIKE pattern into a case-insensitive regular expression.
+func likePattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
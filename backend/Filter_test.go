@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSchema builds a table schema without a database.
+func testSchema(table string, cols ...ColumnInfo) *TableSchema {
+	schema := &TableSchema{DBName: "test", Table: table, byName: make(map[string]int)}
+	for _, col := range cols {
+		if col.ColumnType == "" {
+			col.ColumnType = col.DataType
+		}
+		schema.byName[strings.ToLower(col.Name)] = len(schema.Columns)
+		schema.Columns = append(schema.Columns, col)
+	}
+	return schema
+}
+
+func studentsSchema() *TableSchema {
+	return testSchema("students",
+		ColumnInfo{Name: "id", DataType: "bigint", Key: "PRI", AutoIncrement: true},
+		ColumnInfo{Name: "Name", DataType: "varchar", ColumnType: "varchar(100)"},
+		ColumnInfo{Name: "age", DataType: "int"},
+		ColumnInfo{Name: "city", DataType: "varchar", ColumnType: "varchar(50)", Nullable: true},
+	)
+}
+
+func TestCompileFilter(t *testing.T) {
+	schema := studentsSchema()
+	tests := []struct {
+		name     string
+		filter   string
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			name:     "equality",
+			filter:   `{"column": "age", "op": "=", "value": 18}`,
+			wantSQL:  "(`age` = ?)",
+			wantArgs: []interface{}{int64(18)},
+		},
+		{
+			name:     "default operator and column case",
+			filter:   `{"column": "NAME", "value": "Ada"}`,
+			wantSQL:  "(`Name` = ?)",
+			wantArgs: []interface{}{"Ada"},
+		},
+		{
+			name:    "null equality",
+			filter:  `{"column": "city", "op": "eq", "value": null}`,
+			wantSQL: "(`city` IS NULL)",
+		},
+		{
+			name:    "null inequality",
+			filter:  `{"column": "city", "op": "!=", "value": null}`,
+			wantSQL: "(`city` IS NOT NULL)",
+		},
+		{
+			name:     "in",
+			filter:   `{"column": "city", "op": "in", "values": ["Cairo", "Giza"]}`,
+			wantSQL:  "(`city` IN (?, ?))",
+			wantArgs: []interface{}{"Cairo", "Giza"},
+		},
+		{
+			name:     "not in",
+			filter:   `{"column": "age", "op": "not in", "values": [1]}`,
+			wantSQL:  "(`age` NOT IN (?))",
+			wantArgs: []interface{}{int64(1)},
+		},
+		{
+			name:     "between",
+			filter:   `{"column": "age", "op": "between", "values": [10, 20]}`,
+			wantSQL:  "(`age` BETWEEN ? AND ?)",
+			wantArgs: []interface{}{int64(10), int64(20)},
+		},
+		{
+			name:     "not like",
+			filter:   `{"column": "Name", "op": "notlike", "value": "test%"}`,
+			wantSQL:  "(`Name` NOT LIKE ?)",
+			wantArgs: []interface{}{"test%"},
+		},
+		{
+			name:    "is not null",
+			filter:  `{"column": "city", "op": "isNotNull"}`,
+			wantSQL: "(`city` IS NOT NULL)",
+		},
+		{
+			name: "nested groups",
+			filter: `{"and": [
+				{"column": "age", "op": ">=", "value": 18},
+				{"or": [{"column": "city", "op": "=", "value": "Cairo"}, {"column": "city", "op": "isNull"}]},
+				{"not": {"column": "Name", "op": "like", "value": "x%"}}
+			]}`,
+			wantSQL:  "((`age` >= ?) AND ((`city` = ?) OR (`city` IS NULL)) AND NOT (`Name` LIKE ?))",
+			wantArgs: []interface{}{int64(18), "Cairo", "x%"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f Filter
+			if err := decodeJSONNumbers([]byte(tt.filter), &f); err != nil {
+				t.Fatal(err)
+			}
+			sql, args, err := compileFilter(&f, schema)
+			if err != nil {
+				t.Fatalf("compileFilter: %v", err)
+			}
+			if sql != tt.wantSQL {
+				t.Errorf("sql = %s, want %s", sql, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	schema := studentsSchema()
+	deep := `{"column": "age", "value": 1}`
+	for i := 0; i <= maxFilterDepth; i++ {
+		deep = `{"not": ` + deep + `}`
+	}
+	tests := []struct {
+		name    string
+		filter  string
+		wantErr string
+	}{
+		{"unknown column", `{"column": "grade", "value": 1}`, "unknown column 'grade'"},
+		{"two kinds", `{"column": "age", "value": 1, "not": {"column": "age", "value": 2}}`, "exactly one of"},
+		{"empty node", `{}`, "exactly one of"},
+		{"unknown operator", `{"column": "age", "op": "~", "value": 1}`, "unsupported filter operator"},
+		{"ordering null", `{"column": "age", "op": "<", "value": null}`, "requires a non-null value"},
+		{"empty in", `{"column": "age", "op": "in", "values": []}`, "non-empty 'values'"},
+		{"between arity", `{"column": "age", "op": "between", "values": [1]}`, "exactly two"},
+		{"like pattern type", `{"column": "Name", "op": "like", "value": 5}`, "string pattern"},
+		{"value type", `{"column": "age", "value": "old"}`, "column 'age'"},
+		{"too deep", deep, "nested too deeply"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f Filter
+			if err := decodeJSONNumbers([]byte(tt.filter), &f); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err := compileFilter(&f, schema)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileFilterNil(t *testing.T) {
+	sql, args, err := compileFilter(nil, studentsSchema())
+	if sql != "" || args != nil || err != nil {
+		t.Fatalf("compileFilter(nil) = %q, %v, %v", sql, args, err)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// ForwardedByHeader names the node that sent a request on behalf of a client, as a slave
+// forwarding a write to the master or a scatter-gather read.
+const ForwardedByHeader = "X-Forwarded-By-Node"
+
+// Idempotency key states in cluster.idempotency_keys. A key is recorded as applied in the
+// transaction of its write, and done once the response to the request has been stored.
+const (
+	idempotencyApplied = "applied"
+	idempotencyDone    = "done"
+)
+
+// Requests with the same key on this node are serialized through a fixed set of striped locks,
+// so that a duplicate waits for the first request and gets its response. What keeps a write
+// from being applied twice is the key row committed with it.
+var idempotencyLocks [64]sync.Mutex
+
+// idempotencyClaim is the idempotency key of the request being handled. Handlers that write
+// in transactions record it in them through recordIdempotencyKey, so the key commits, and
+// replicates, together with the write.
+type idempotencyClaim struct {
+	key         string
+	fingerprint string
+	owner       string
+	used        bool
+}
+
+type idempotencyClaimKey struct{}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func idempotencyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &idempotencyLocks[h.Sum32()%uint32(len(idempotencyLocks))]
+}
+
+func newIdempotencyKey(prefix string) string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano())
+	}
+	return prefix + "-" + hex.EncodeToString(buf)
+}
+
+func idempotencyWindow() time.Duration {
+	return time.Duration(config.Idempotency.WindowSeconds) * time.Second
+}
+
+// requestIdempotencyKey returns the key from the Idempotency-Key header or, failing that,
+// from an "idempotencyKey" field in the JSON body.
+func requestIdempotencyKey(r *http.Request, body []byte) string {
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" {
+		return key
+	}
+	var payload struct {
+		IdempotencyKey string `json:"idempotencyKey"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+	return payload.IdempotencyKey
+}
+
+// isReadRequest reports whether a CRUD payload only reads data; such requests are never
+// recorded under an idempotency key.
+func isReadRequest(body []byte) bool {
+	var payload struct {
+		Operation string `json:"operation"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return false
+	}
+	return isReadOperation(payload.Operation)
+}
+
+// requestFingerprint hashes a request by its decoded body, so a retry that encodes the same
+// payload with other key order or whitespace matches. Bodies that are not JSON are hashed as
+// they are.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	var payload interface{}
+	if err := decodeJSONNumbers(body, &payload); err == nil {
+		if canonical, err := json.Marshal(payload); err == nil {
+			body = canonical
+		}
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent makes a write endpoint safe to retry: on the master, a request carrying an
+// idempotency key that was already applied gets the stored response back instead of being
+// executed again. The keys live in the cluster database, so they replicate to the slaves and
+// remain valid after a failover. Reusing a key for a different payload is rejected.
+//
+// Handlers that write in a transaction record the key in it, so a write whose response was
+// lost in a crash is still never applied again. The key of any other handler, such as one
+// running DDL, which commits on its own, is stored after it succeeds.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentRole != RoleMaster || db == nil || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request body: " + err.Error()})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+
+		key := requestIdempotencyKey(r, bodyBytes)
+		if key == "" || isReadRequest(bodyBytes) {
+			next(w, r)
+			return
+		}
+		if len(key) > 128 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Idempotency key must be at most 128 characters"})
+			return
+		}
+		fingerprint := requestFingerprint(r, bodyBytes)
+
+		lock := idempotencyLock(key)
+		lock.Lock()
+		defer lock.Unlock()
+
+		var storedHash, state string
+		var status int
+		var contentType string
+		var stored []byte
+		err = db.QueryRow(`
+			SELECT request_hash, state, status_code, content_type, response
+			FROM cluster.idempotency_keys
+			WHERE idem_key = ? AND created_at > ?`, key, time.Now().Add(-idempotencyWindow())).Scan(&storedHash, &state, &status, &contentType, &stored)
+		if err == nil {
+			if storedHash != fingerprint {
+				log.Printf("Idempotency key %s reused with a different payload for %s %s", key, r.Method, r.URL.Path)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(Response{Success: false, Message: "Idempotency key was already used for a different request"})
+				return
+			}
+			log.Printf("Replaying stored response for idempotency key %s (%s %s, %s)", key, r.Method, r.URL.Path, state)
+			w.Header().Set("Idempotent-Replayed", "true")
+			if len(stored) == 0 {
+				// The write committed, but the node failed before the response was stored.
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(Response{Success: true, Message: "Request was already applied; its response was not recorded"})
+				return
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(status)
+			w.Write(stored)
+			return
+		}
+		if err != sql.ErrNoRows {
+			log.Printf("Error looking up idempotency key %s: %v", key, err)
+		}
+		// An expired key may still be stored; it no longer applies.
+		if _, err := db.Exec("DELETE FROM cluster.idempotency_keys WHERE idem_key = ? AND created_at <= ?", key, time.Now().Add(-idempotencyWindow())); err != nil {
+			log.Printf("Error removing expired idempotency key %s: %v", key, err)
+		}
+
+		claim := &idempotencyClaim{key: key, fingerprint: fingerprint, owner: newIdempotencyKey("req")}
+		r = r.WithContext(context.WithValue(r.Context(), idempotencyClaimKey{}, claim))
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if claim.used {
+			// The key row exists only if a transaction of the handler committed, in which case
+			// the response is stored whatever it says: part of the request was applied.
+			_, err = db.Exec(`
+				UPDATE cluster.idempotency_keys SET state = ?, status_code = ?, content_type = ?, response = ?
+				WHERE idem_key = ? AND owner = ?`, idempotencyDone, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes(), key, claim.owner)
+			if err != nil {
+				log.Printf("Error storing result for idempotency key %s: %v", key, err)
+			}
+			return
+		}
+		if !isCompletedResponse(rec.status, rec.body.Bytes()) {
+			return
+		}
+		_, err = db.Exec(`
+			REPLACE INTO cluster.idempotency_keys (idem_key, request_hash, owner, state, status_code, content_type, response, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, key, fingerprint, claim.owner, idempotencyDone, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes(), time.Now())
+		if err != nil {
+			log.Printf("Error storing result for idempotency key %s: %v", key, err)
+		}
+	}
+}
+
+// recordIdempotencyKey records the idempotency key of the request ctx belongs to, if it has
+// one, through exec, which must be the transaction of the request's write. A request that
+// writes in several transactions records the key in each; the first one creates it. partial,
+// if not nil, is stored as the response to replay should the request end before it completes.
+func recordIdempotencyKey(ctx context.Context, exec sqlExecutor, partial interface{}) error {
+	claim, _ := ctx.Value(idempotencyClaimKey{}).(*idempotencyClaim)
+	if claim == nil {
+		return nil
+	}
+	claim.used = true
+
+	response := []byte{}
+	if partial != nil {
+		b, err := json.Marshal(partial)
+		if err != nil {
+			return fmt.Errorf("failed to encode response for idempotency key: %w", err)
+		}
+		response = b
+	}
+	var owner string
+	err := exec.QueryRow("SELECT owner FROM cluster.idempotency_keys WHERE idem_key = ? FOR UPDATE", claim.key).Scan(&owner)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = exec.Exec(`
+			INSERT INTO cluster.idempotency_keys (idem_key, request_hash, owner, state, status_code, content_type, response, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, claim.key, claim.fingerprint, claim.owner, idempotencyApplied, http.StatusOK, "application/json", response, time.Now())
+	case err != nil:
+	case owner != claim.owner:
+		return fmt.Errorf("idempotency key %s was used by another request", claim.key)
+	case partial != nil:
+		_, err = exec.Exec("UPDATE cluster.idempotency_keys SET response = ? WHERE idem_key = ?", response, claim.key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record idempotency key: %w", err)
+	}
+	return nil
+}
+
+// hasIdempotencyKey reports whether the request ctx belongs to carries an idempotency key that
+// must be recorded with its write.
+func hasIdempotencyKey(ctx context.Context) bool {
+	_, ok := ctx.Value(idempotencyClaimKey{}).(*idempotencyClaim)
+	return ok
+}
+
+// isCompletedResponse reports whether a response describes work that was actually applied.
+// Failed operations are not remembered, so a retry with the same key runs them again.
+func isCompletedResponse(status int, body []byte) bool {
+	if status < 200 || status >= 300 {
+		return false
+	}
+	var resp Response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return true
+	}
+	return resp.Success
+}
+
+func purgeExpiredIdempotencyKeys() {
+	for {
+		time.Sleep(10 * time.Minute)
+		if currentRole != RoleMaster || db == nil {
+			continue
+		}
+		res, err := db.Exec("DELETE FROM cluster.idempotency_keys WHERE created_at <= ?", time.Now().Add(-idempotencyWindow()))
+		if err != nil {
+			log.Printf("Error purging expired idempotency keys: %v", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Purged %d expired idempotency keys", n)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+const joinLookupChunk = 1000
+
+// IncludeSpec asks a read to expand the rows of a table linked to the read table through
+// /api/link-tables. Via names the link constraint when the tables are linked more than once.
+type IncludeSpec struct {
+	Table   string   `json:"table"`
+	As      string   `json:"as,omitempty"`
+	Via     string   `json:"via,omitempty"`
+	Columns []string `json:"columns,omitempty"`
+	Filter  *Filter  `json:"filter,omitempty"`
+}
+
+type tableLink struct {
+	Constraint   string
+	ParentTable  string
+	ParentColumn string
+	ChildTable   string
+	ChildColumn  string
+}
+
+// joinPlan describes how the rows of one included table are matched to the rows of the read.
+// Many is set when the read table is the parent of the link, so each row has a list of related
+// rows; otherwise each row has at most one related row.
+type joinPlan struct {
+	As           string
+	Table        string
+	LocalColumn  string
+	RemoteColumn string
+	Many         bool
+	Colocated    bool
+	ShardID      int
+	ShardKey     string
+	Schema       *TableSchema
+	Columns      []string
+	Filter       *Filter
+	whereSQL     string
+	whereArgs    []interface{}
+}
+
+func findTableLink(dbName, table, other, via string) (*tableLink, error) {
+	query := `
+		SELECT constraint_name, parent_table, parent_column, child_table, child_column
+		FROM cluster.table_links
+		WHERE db_name = ? AND ((parent_table = ? AND child_table = ?) OR (parent_table = ? AND child_table = ?))`
+	args := []interface{}{dbName, table, other, other, table}
+	if via != "" {
+		query += " AND constraint_name = ?"
+		args = append(args, SanitizeIdentifier(via))
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load links between '%s' and '%s': %w", table, other, err)
+	}
+	defer rows.Close()
+
+	var links []tableLink
+	for rows.Next() {
+		var l tableLink
+		if err := rows.Scan(&l.Constraint, &l.ParentTable, &l.ParentColumn, &l.ChildTable, &l.ChildColumn); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	switch len(links) {
+	case 0:
+		return nil, fmt.Errorf("tables '%s' and '%s' are not linked", table, other)
+	case 1:
+		return &links[0], nil
+	}
+	return nil, fmt.Errorf("tables '%s' and '%s' are linked more than once; choose a link with 'via'", table, other)
+}
+
+func buildJoinPlans(req *crudRequest, schema *TableSchema) ([]*joinPlan, error) {
+	baseShardID, baseShardKey, err := lookupTableShard(req.DBName, schema.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	used := make(map[string]bool)
+	var joins []*joinPlan
+	for _, spec := range req.Include {
+		table := SanitizeIdentifier(spec.Table)
+		if table == "" {
+			return nil, fmt.Errorf("include requires a table")
+		}
+		link, err := findTableLink(req.DBName, schema.Table, table, spec.Via)
+		if err != nil {
+			return nil, err
+		}
+		join := &joinPlan{As: spec.As, Table: table, Filter: spec.Filter}
+		if link.ChildTable == schema.Table {
+			// Self links resolve to the parent row.
+			join.LocalColumn, join.RemoteColumn = link.ChildColumn, link.ParentColumn
+		} else {
+			join.LocalColumn, join.RemoteColumn, join.Many = link.ParentColumn, link.ChildColumn, true
+		}
+		if join.As == "" {
+			join.As = table
+		}
+		if !isValidIdentifier(join.As) {
+			return nil, fmt.Errorf("invalid include alias '%s'", join.As)
+		}
+		if schema.HasColumn(join.As) || used[strings.ToLower(join.As)] {
+			return nil, fmt.Errorf("include alias '%s' collides with a column or another include", join.As)
+		}
+		used[strings.ToLower(join.As)] = true
+
+		join.Schema, err = loadTableSchema(req.DBName, table)
+		if err != nil {
+			return nil, err
+		}
+		local, ok := schema.Column(join.LocalColumn)
+		if !ok {
+			return nil, fmt.Errorf("link column '%s' no longer exists in table '%s'", join.LocalColumn, schema.Table)
+		}
+		remote, ok := join.Schema.Column(join.RemoteColumn)
+		if !ok {
+			return nil, fmt.Errorf("link column '%s' no longer exists in table '%s'", join.RemoteColumn, table)
+		}
+		join.LocalColumn, join.RemoteColumn = local.Name, remote.Name
+
+		for _, name := range spec.Columns {
+			col, ok := join.Schema.Column(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown column '%s' in include of table '%s'", name, table)
+			}
+			join.Columns = append(join.Columns, col.Name)
+		}
+		join.whereSQL, join.whereArgs, err = compileFilter(spec.Filter, join.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include filter for table '%s': %w", table, err)
+		}
+
+		join.ShardID, join.ShardKey, err = lookupTableShard(req.DBName, table)
+		if err != nil {
+			return nil, err
+		}
+		// Related rows live on the same shard when both tables sit on one shard, or when both
+		// are sharded by the columns of the link, which hash to the same shard.
+		switch {
+		case baseShardKey == "" && join.ShardKey == "":
+			join.Colocated = baseShardID == join.ShardID
+		case baseShardKey != "" && join.ShardKey != "":
+			join.Colocated = strings.EqualFold(baseShardKey, join.LocalColumn) && strings.EqualFold(join.ShardKey, join.RemoteColumn)
+		}
+		joins = append(joins, join)
+	}
+	return joins, nil
+}
+
+// runJoinRead reads rows of the request's table and expands the related rows of every
+// include. Co-located tables are joined in SQL; other tables are fetched from the shards that
+// hold them by the join values of the page (a lookup join). Paging applies to the read table.
+func runJoinRead(dbConn *requestDB, req *crudRequest, schema *TableSchema, plan *readPlan, shardKey string, scatter bool, whereSQL string, whereArgs []interface{}) (interface{}, error) {
+	style := strings.ToLower(req.JoinStyle)
+	if style != "" && style != "nested" && style != "flat" {
+		return nil, fmt.Errorf("joinStyle must be 'nested' or 'flat'")
+	}
+	joins, err := buildJoinPlans(req, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	// The join columns must be read even when the projection leaves them out.
+	base := *req
+	base.Include = nil
+	var added []string
+	if len(base.Columns) > 0 {
+		base.Columns = append([]string{}, req.Columns...)
+		for _, join := range joins {
+			if !plan.Hidden[join.LocalColumn] && !containsFold(plan.Select, join.LocalColumn) {
+				base.Columns = append(base.Columns, join.LocalColumn)
+				added = append(added, join.LocalColumn)
+			}
+		}
+		if len(added) > 0 {
+			if plan, err = buildReadPlan(&base, schema); err != nil {
+				return nil, err
+			}
+			for _, name := range added {
+				plan.Hidden[name] = true
+			}
+			if scatter {
+				plan.addSortKeys(schema)
+			}
+		}
+	}
+
+	rows, total, err := readRows(dbConn, &base, plan, shardKey, scatter, whereSQL, whereArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, join := range joins {
+		var related []map[string]interface{}
+		if join.Colocated && !scatter {
+			related, err = sqlJoinRows(dbConn, plan, whereSQL, whereArgs, join)
+		} else {
+			related, err = lookupJoinRows(dbConn, req.DBName, rows, join)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("include '%s': %w", join.As, err)
+		}
+		attachRelated(rows, related, join)
+	}
+
+	page := finishPage(plan, rows)
+	page.Total = total
+	if style == "flat" {
+		page.Rows = flattenJoinRows(page.Rows, joins)
+	}
+	if !req.wantsPage() {
+		return page.Rows, nil
+	}
+	return page, nil
+}
+
+// sqlJoinRows joins the included table against the read itself, embedded as a derived table,
+// so related rows of a co-located table come back in one statement.
+func sqlJoinRows(dbConn *requestDB, plan *readPlan, whereSQL string, whereArgs []interface{}, join *joinPlan) ([]map[string]interface{}, error) {
+	baseSQL, args := readQuery(plan, whereSQL, whereArgs)
+	cols := "j.*"
+	if len(join.Columns) > 0 {
+		quoted := []string{"j." + quoteIdentifier(join.RemoteColumn)}
+		for _, name := range join.Columns {
+			quoted = append(quoted, "j."+quoteIdentifier(name))
+		}
+		cols = strings.Join(quoted, ", ")
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s AS j JOIN (SELECT DISTINCT %s AS __join_key FROM (%s) AS p) AS b ON j.%s = b.__join_key",
+		cols, quoteIdentifier(join.Table), quoteIdentifier(join.LocalColumn), baseSQL, quoteIdentifier(join.RemoteColumn))
+	if join.whereSQL != "" {
+		query += " WHERE " + join.whereSQL
+		args = append(args, join.whereArgs...)
+	}
+	query += join.orderSQL("j.")
+
+	log.Printf("Executing SQL: %s with values: %v", query, args)
+	rows, err := dbConn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("join query failed: %w", err)
+	}
+	defer rows.Close()
+	return rowsToJSON(rows)
+}
+
+// lookupJoinRows fetches the related rows whose join column matches the values of rows, in
+// chunks, from the shards of the included table.
+func lookupJoinRows(dbConn *requestDB, dbName string, rows []map[string]interface{}, join *joinPlan) ([]map[string]interface{}, error) {
+	seen := make(map[string]bool)
+	var values []interface{}
+	for _, row := range rows {
+		v := row[join.LocalColumn]
+		if v == nil || seen[fmt.Sprint(v)] {
+			continue
+		}
+		seen[fmt.Sprint(v)] = true
+		values = append(values, v)
+	}
+
+	var related []map[string]interface{}
+	for start := 0; start < len(values); start += joinLookupChunk {
+		end := start + joinLookupChunk
+		if end > len(values) {
+			end = len(values)
+		}
+		in := &Filter{Column: join.RemoteColumn, Op: "in", Values: values[start:end]}
+		chunk, err := fetchRelatedRows(dbConn, dbName, join, in)
+		if err != nil {
+			return nil, err
+		}
+		related = append(related, chunk...)
+	}
+	return related, nil
+}
+
+func fetchRelatedRows(dbConn *requestDB, dbName string, join *joinPlan, in *Filter) ([]map[string]interface{}, error) {
+	if join.ShardKey != "" && !scatterReadsEnabled {
+		return nil, fmt.Errorf("cannot include sharded table '%s': scatter-gather reads are disabled on this node", join.Table)
+	}
+	var shards []int
+	switch {
+	case join.ShardKey == "":
+		shards = []int{join.ShardID}
+	case strings.EqualFold(join.ShardKey, join.RemoteColumn):
+		targets, _ := filterShards(in, join.ShardKey)
+		for id := range targets {
+			shards = append(shards, id)
+		}
+		sort.Ints(shards)
+	default:
+		for id := 0; id < config.ShardCount; id++ {
+			shards = append(shards, id)
+		}
+	}
+
+	sub := crudRequest{DBName: dbName, Operation: "read", Table: join.Table, Filter: combineFilters(in, join.Filter)}
+	if len(join.Columns) > 0 {
+		sub.Columns = append([]string{join.RemoteColumn}, join.Columns...)
+	}
+	whereSQL, whereArgs, err := compileFilter(sub.Filter, join.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	var related []map[string]interface{}
+	for _, shardID := range shards {
+		shardReq := sub
+		if join.ShardKey != "" {
+			id := shardID
+			shardReq.ShardScope = &id
+		}
+
+		if nodeURL := shardNodeURL(shardID); nodeURL != config.SelfURL {
+			var err error
+			if shardReq.ShardScope != nil {
+				var page readPage
+				if err = postShardRequest(dbConn.ctx, nodeURL, "/api/crud", shardReq, &page); err == nil {
+					related = append(related, page.Rows...)
+					continue
+				}
+			} else {
+				var rows []map[string]interface{}
+				if err = postShardRequest(dbConn.ctx, nodeURL, "/api/crud", shardReq, &rows); err == nil {
+					related = append(related, rows...)
+					continue
+				}
+			}
+			log.Printf("Lookup of '%s' on %s for shard %d failed, serving it locally: %v", join.Table, nodeURL, shardID, err)
+		}
+
+		plan, err := buildReadPlan(&shardReq, join.Schema)
+		if err != nil {
+			return nil, err
+		}
+		cond, args := whereSQL, whereArgs
+		if join.ShardKey != "" {
+			predicate, predArgs := shardPredicateSQL(join.ShardKey, shardID)
+			cond, args = andSQL(cond, args, predicate, predArgs)
+		}
+		rows, err := executeRead(dbConn, plan, cond, args)
+		if err != nil {
+			return nil, err
+		}
+		related = append(related, rows...)
+	}
+
+	sort.SliceStable(related, func(i, j int) bool {
+		for _, col := range join.Schema.Columns {
+			if col.Key != "PRI" {
+				continue
+			}
+			if c := compareValues(related[i][col.Name], related[j][col.Name]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return related, nil
+}
+
+// orderSQL orders related rows by the primary key of the included table.
+func (join *joinPlan) orderSQL(prefix string) string {
+	var parts []string
+	for _, col := range join.Schema.Columns {
+		if col.Key == "PRI" {
+			parts = append(parts, prefix+quoteIdentifier(col.Name))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " ORDER BY " + strings.Join(parts, ", ")
+}
+
+// attachRelated stores the related rows of every row under the include's alias: a list for
+// one-to-many includes and an object or null for many-to-one includes.
+func attachRelated(rows, related []map[string]interface{}, join *joinPlan) {
+	byKey := make(map[string][]map[string]interface{})
+	for _, r := range related {
+		key := fmt.Sprint(r[join.RemoteColumn])
+		if len(join.Columns) > 0 {
+			projected := make(map[string]interface{}, len(join.Columns))
+			for _, name := range join.Columns {
+				projected[name] = r[name]
+			}
+			r = projected
+		}
+		byKey[key] = append(byKey[key], r)
+	}
+
+	for _, row := range rows {
+		var matches []map[string]interface{}
+		if v := row[join.LocalColumn]; v != nil {
+			matches = byKey[fmt.Sprint(v)]
+		}
+		if join.Many {
+			if matches == nil {
+				matches = []map[string]interface{}{}
+			}
+			row[join.As] = matches
+		} else if len(matches) > 0 {
+			row[join.As] = matches[0]
+		} else {
+			row[join.As] = nil
+		}
+	}
+}
+
+// flattenJoinRows turns nested includes into one row per combination of related rows, with
+// included columns named "<alias>.<column>". Rows without related rows are kept with nulls.
+func flattenJoinRows(rows []map[string]interface{}, joins []*joinPlan) []map[string]interface{} {
+	flat := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		combos := []map[string]interface{}{{}}
+		for k, v := range row {
+			combos[0][k] = v
+		}
+		for _, join := range joins {
+			delete(combos[0], join.As)
+		}
+
+		for _, join := range joins {
+			var matches []map[string]interface{}
+			switch v := row[join.As].(type) {
+			case []map[string]interface{}:
+				matches = v
+			case map[string]interface{}:
+				matches = []map[string]interface{}{v}
+			}
+			if len(matches) == 0 {
+				matches = []map[string]interface{}{nil}
+			}
+
+			columns := join.Columns
+			if len(columns) == 0 {
+				columns = join.Schema.ColumnNames()
+			}
+			next := make([]map[string]interface{}, 0, len(combos)*len(matches))
+			for _, combo := range combos {
+				for _, m := range matches {
+					out := make(map[string]interface{}, len(combo)+len(columns))
+					for k, v := range combo {
+						out[k] = v
+					}
+					for _, col := range columns {
+						out[join.As+"."+col] = m[col]
+					}
+					next = append(next, out)
+				}
+			}
+			combos = next
+		}
+		flat = append(flat, combos...)
+	}
+	return flat
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
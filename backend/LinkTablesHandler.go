@@ -1,12 +1,12 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"time"
 )
 
 func linkTablesHandler(w http.ResponseWriter, r *http.Request) {
@@ -55,14 +55,13 @@ func linkTablesHandler(w http.ResponseWriter, r *http.Request) {
 		constraintName = SanitizeIdentifier(fmt.Sprintf("fk_%s_%s_%s_%s", safeTable2, safeCol2, safeTable1, safeCol1))
 	}
 
-	dbConn, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-		config.MySQL.User, config.MySQL.Password, config.MySQL.Host, config.MySQL.Port, safeDBName))
+	dbConn, release, err := getDBConn(safeDBName)
 	if err != nil {
 		log.Printf("Error connecting to database '%s' on master for linkTables: %v", safeDBName, err)
 		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error connecting to DB: " + err.Error()})
 		return
 	}
-	defer dbConn.Close()
+	defer release()
 
 	query := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s(%s)",
 		safeTable2, constraintName, safeCol2, safeTable1, safeCol1)
@@ -74,6 +73,18 @@ func linkTablesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Printf("Tables '%s' and '%s' linked successfully on master.", safeTable2, safeTable1)
+	invalidateTableSchema(safeDBName, safeTable2)
+
+	// The relationship is recorded so that reads can include related rows along it.
+	_, err = db.Exec(`
+		INSERT INTO cluster.table_links (db_name, constraint_name, parent_table, parent_column, child_table, child_column, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE parent_table = VALUES(parent_table), parent_column = VALUES(parent_column),
+			child_table = VALUES(child_table), child_column = VALUES(child_column)`,
+		safeDBName, constraintName, safeTable1, safeCol1, safeTable2, safeCol2, time.Now())
+	if err != nil {
+		log.Printf("Error recording link '%s' between '%s' and '%s' on master: %v", constraintName, safeTable2, safeTable1, err)
+	}
 
 	shardID := calculateShardID(safeDBName + "." + safeTable2)
 	replicateToNodes(map[string]interface{}{
@@ -86,3 +97,25 @@ func linkTablesHandler(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(Response{Success: true, Message: "Tables linked successfully"})
 }
+
+// backfillTableLinks records in cluster.table_links the single-column foreign keys that exist
+// in MySQL but are not recorded yet, such as ones created before links were recorded or
+// outside /api/link-tables, so that reads can include rows along them too. It runs on the
+// master at startup; the rows replicate to the slaves.
+func backfillTableLinks() {
+	res, err := db.Exec(`
+		INSERT IGNORE INTO cluster.table_links (db_name, constraint_name, parent_table, parent_column, child_table, child_column, created_at)
+		SELECT TABLE_SCHEMA, CONSTRAINT_NAME, MIN(REFERENCED_TABLE_NAME), MIN(REFERENCED_COLUMN_NAME), MIN(TABLE_NAME), MIN(COLUMN_NAME), ?
+		FROM information_schema.KEY_COLUMN_USAGE
+		WHERE REFERENCED_TABLE_NAME IS NOT NULL AND REFERENCED_TABLE_SCHEMA = TABLE_SCHEMA
+			AND TABLE_SCHEMA NOT IN ('cluster', 'mysql', 'sys', 'information_schema', 'performance_schema')
+		GROUP BY TABLE_SCHEMA, CONSTRAINT_NAME
+		HAVING COUNT(*) = 1`, time.Now())
+	if err != nil {
+		log.Printf("Error backfilling table links from foreign keys: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Recorded %d table links from existing foreign keys", n)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
 func listTablesHandler(w http.ResponseWriter, r *http.Request) {
@@ -28,8 +29,22 @@ func listTablesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dbConn, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
-		config.MySQL.User, config.MySQL.Password, config.MySQL.Host, config.MySQL.Port, dbName))
+	dbName = SanitizeIdentifier(dbName)
+
+	var cacheKey string
+	var cacheGen uint64
+	if config.ResultCache.ListTablesTTLSeconds > 0 {
+		cacheKey = resultCacheKey("list-tables", dbName)
+		cached, gen, ok := getCachedResult(cacheKey, "list-tables:"+dbName)
+		if ok {
+			w.Header().Set("X-Result-Cache", "hit")
+			json.NewEncoder(w).Encode(Response{Success: true, Result: cached})
+			return
+		}
+		cacheGen = gen
+	}
+
+	pool, release, err := getDBConn(dbName)
 	if err != nil {
 		json.NewEncoder(w).Encode(Response{
 			Success: false,
@@ -37,7 +52,8 @@ func listTablesHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	defer dbConn.Close()
+	defer release()
+	dbConn := bindDB(r.Context(), pool)
 
 	rows, err := dbConn.Query("SHOW TABLES")
 	if err != nil {
@@ -109,8 +125,17 @@ func listTablesHandler(w http.ResponseWriter, r *http.Request) {
 		tables = append(tables, tableInfo)
 	}
 
+	var result interface{} = tables
+	if cacheKey != "" {
+		w.Header().Set("X-Result-Cache", "miss")
+		ttl := time.Duration(config.ResultCache.ListTablesTTLSeconds) * time.Second
+		if encoded := putCachedResult(cacheKey, dbName, nil, tables, ttl, cacheGen); encoded != nil {
+			result = encoded
+		}
+	}
+
 	json.NewEncoder(w).Encode(Response{
 		Success: true,
-		Result:  tables,
+		Result:  result,
 	})
 }
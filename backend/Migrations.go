@@ -0,0 +1,625 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tables change through numbered migrations. The master runs each one as an ALTER TABLE or
+// RENAME TABLE statement and then records it in cluster.table_migrations. MySQL replication
+// carries the statement and its record to every slave in binlog order, so each node applies
+// the migrations of a table in order, and the history a node reports is the history it has
+// applied. A table's schema version is the number of its latest migration; creating a table
+// through /api/create-table records version 1.
+//
+// DDL commits on its own, so a migration is recorded as pending before its statement runs
+// and marked applied together with the metadata it changes. One left pending, because the
+// master stopped or the second step failed, is settled by reconcileMigrations before the
+// next migration and when the master starts.
+
+// migrationMutex serializes migrations on the master so versions are assigned in the order
+// the statements run.
+var migrationMutex sync.Mutex
+
+// States of a recorded migration.
+const (
+	migrationPending = "pending"
+	migrationApplied = "applied"
+)
+
+type migrationRequest struct {
+	DBName string `json:"dbName"`
+	Table  string `json:"table"`
+	// Operation is add_column, drop_column, rename_column, modify_column or rename_table.
+	Operation string `json:"operation"`
+	// Column is the column to add, or the complete new definition of the column to modify.
+	Column *columnDefinition `json:"column,omitempty"`
+	// ColumnName is the column to drop or rename.
+	ColumnName string `json:"columnName,omitempty"`
+	// NewName is the new name of the renamed column or table.
+	NewName string `json:"newName,omitempty"`
+	// First or After place an added or modified column; by default it keeps its place, or
+	// goes last when added.
+	First bool   `json:"first,omitempty"`
+	After string `json:"after,omitempty"`
+	// ExpectedVersion, if set, must be the table's schema version for the migration to run.
+	ExpectedVersion *int `json:"expectedVersion,omitempty"`
+}
+
+type migration struct {
+	Version   int             `json:"version"`
+	Operation string          `json:"operation"`
+	Change    json.RawMessage `json:"change"`
+	Statement string          `json:"statement"`
+	AppliedAt time.Time       `json:"appliedAt"`
+}
+
+// schemaVersion returns the number of the latest migration of a table, 0 if it has none.
+func schemaVersion(exec sqlExecutor, dbName, table string) (int, error) {
+	var version int
+	err := exec.QueryRow("SELECT COALESCE(MAX(version), 0) FROM cluster.table_migrations WHERE db_name = ? AND table_name = ? AND state = ?",
+		dbName, table, migrationApplied).Scan(&version)
+	return version, err
+}
+
+// recordMigration stores a migration of a table in the given state.
+func recordMigration(exec sqlExecutor, dbName, table string, version int, operation string, change interface{}, statement, state string) error {
+	spec, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	_, err = exec.Exec(`
+		INSERT INTO cluster.table_migrations (db_name, table_name, version, operation, change_spec, statement, applied_at, state)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		dbName, table, version, operation, spec, statement, time.Now().UTC(), state)
+	return err
+}
+
+// completeMigration marks a pending migration applied and updates the metadata it changes,
+// in one transaction. column is the migrated column as the table spelled it beforehand.
+func completeMigration(req *migrationRequest, column string, version int) error {
+	table := req.Table
+	if req.Operation == "rename_table" {
+		table = req.NewName
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// A renamed table takes its history, the pending migration included, along.
+	if err := migrationMetadataUpdates(tx, req, column); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE cluster.table_migrations SET state = ?, applied_at = ? WHERE db_name = ? AND table_name = ? AND version = ?",
+		migrationApplied, time.Now().UTC(), req.DBName, table, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrationTookEffect reports whether the statement of a pending migration changed its table.
+// A modified column cannot be told from the schema, so its statement, which yields the same
+// table when run again, is rerun.
+func migrationTookEffect(req *migrationRequest, statement string) (bool, error) {
+	tableExists := func(table string) (bool, error) {
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?",
+			req.DBName, table).Scan(&n)
+		return n > 0, err
+	}
+	switch req.Operation {
+	case "rename_table":
+		renamed, err := tableExists(req.NewName)
+		if err != nil || !renamed {
+			return false, err
+		}
+		original, err := tableExists(req.Table)
+		return !original, err
+	case "modify_column":
+		if err := executeSQL(statement); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	schema, err := fetchTableSchema(req.DBName, req.Table)
+	if err != nil {
+		return false, err
+	}
+	switch req.Operation {
+	case "add_column":
+		return req.Column != nil && schema.HasColumn(req.Column.Name), nil
+	case "drop_column":
+		return !schema.HasColumn(req.ColumnName), nil
+	case "rename_column":
+		return schema.HasColumn(req.NewName) && !schema.HasColumn(req.ColumnName), nil
+	}
+	return false, fmt.Errorf("invalid operation '%s'", req.Operation)
+}
+
+// reconcileMigrations settles every pending migration: one whose statement changed its table
+// is completed, one whose statement did not is dropped. One that cannot be settled is logged
+// and stays pending, which blocks further migrations of its table. Callers hold
+// migrationMutex.
+func reconcileMigrations() error {
+	type pending struct {
+		dbName, table, statement string
+		version                  int
+		change                   []byte
+	}
+	rows, err := db.Query("SELECT db_name, table_name, version, change_spec, statement FROM cluster.table_migrations WHERE state = ?",
+		migrationPending)
+	if err != nil {
+		return err
+	}
+	var migrations []pending
+	for rows.Next() {
+		var m pending
+		if err := rows.Scan(&m.dbName, &m.table, &m.version, &m.change, &m.statement); err != nil {
+			rows.Close()
+			return err
+		}
+		migrations = append(migrations, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := settleMigration(m.dbName, m.table, m.version, m.change, m.statement); err != nil {
+			log.Printf("Error settling pending migration %d of '%s.%s': %v", m.version, m.dbName, m.table, err)
+		}
+	}
+	return nil
+}
+
+// settleMigration completes or drops one pending migration.
+func settleMigration(dbName, table string, version int, change []byte, statement string) error {
+	var req migrationRequest
+	if err := json.Unmarshal(change, &req); err != nil {
+		return err
+	}
+	applied, err := migrationTookEffect(&req, statement)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		_, err := db.Exec("DELETE FROM cluster.table_migrations WHERE db_name = ? AND table_name = ? AND version = ? AND state = ?",
+			dbName, table, version, migrationPending)
+		if err != nil {
+			return err
+		}
+		log.Printf("Dropped pending migration %d of '%s.%s': its statement did not run", version, dbName, table)
+		return nil
+	}
+	invalidateTableSchema(req.DBName, req.Table)
+	invalidateTableSchema(req.DBName, req.NewName)
+	if err := completeMigration(&req, req.ColumnName, version); err != nil {
+		return err
+	}
+	if req.Operation == "rename_table" {
+		invalidateWebhookCache()
+	}
+	log.Printf("Completed pending migration %d (%s) of '%s.%s'", version, req.Operation, dbName, table)
+	return nil
+}
+
+// columnRoles describes what cluster metadata refers to a column of a table: the shard key,
+// the version column, the TTL column or table links.
+func columnRoles(dbName, table, column string) ([]string, error) {
+	var roles []string
+	for _, check := range []struct {
+		role  string
+		query string
+	}{
+		{"the shard key", "SELECT shard_key FROM cluster.table_shards WHERE db_name = ? AND table_name = ?"},
+		{"the version column", "SELECT version_column FROM cluster.table_versions WHERE db_name = ? AND table_name = ?"},
+		{"the TTL column", "SELECT ttl_column FROM cluster.table_ttl WHERE db_name = ? AND table_name = ?"},
+	} {
+		var name sql.NullString
+		err := db.QueryRow(check.query, dbName, table).Scan(&name)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if name.Valid && strings.EqualFold(name.String, column) {
+			roles = append(roles, check.role)
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT constraint_name FROM cluster.table_links
+		WHERE db_name = ? AND ((parent_table = ? AND parent_column = ?) OR (child_table = ? AND child_column = ?))`,
+		dbName, table, column, table, column)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var constraint string
+		if err := rows.Scan(&constraint); err != nil {
+			return nil, err
+		}
+		roles = append(roles, fmt.Sprintf("linked by '%s'", constraint))
+	}
+	return roles, rows.Err()
+}
+
+// migrationSQL validates a migration against the current schema of its table and returns
+// the statement that applies it.
+func migrationSQL(req *migrationRequest, schema *TableSchema) (string, error) {
+	target := quoteIdentifier(req.DBName) + "." + quoteIdentifier(req.Table)
+
+	position := func(column string) (string, error) {
+		switch {
+		case req.First && req.After != "":
+			return "", fmt.Errorf("first and after are exclusive")
+		case req.First:
+			return " FIRST", nil
+		case req.After == "":
+			return "", nil
+		case strings.EqualFold(req.After, column):
+			return "", fmt.Errorf("column '%s' cannot be placed after itself", column)
+		case !schema.HasColumn(req.After):
+			return "", fmt.Errorf("unknown column '%s' for table '%s'", req.After, req.Table)
+		}
+		return " AFTER " + quoteIdentifier(req.After), nil
+	}
+	existing := func(column string) (ColumnInfo, error) {
+		if column == "" {
+			return ColumnInfo{}, fmt.Errorf("columnName is required for %s", req.Operation)
+		}
+		col, ok := schema.Column(column)
+		if !ok {
+			return col, fmt.Errorf("unknown column '%s' for table '%s'", column, req.Table)
+		}
+		return col, nil
+	}
+	validName := func(name string) error {
+		if !isValidIdentifier(name) || len(name) > maxIdentifierLength {
+			return fmt.Errorf("invalid name '%s'", name)
+		}
+		return nil
+	}
+	if req.Operation != "add_column" && req.Operation != "modify_column" && (req.First || req.After != "") {
+		return "", fmt.Errorf("first and after only apply to add_column and modify_column")
+	}
+
+	switch req.Operation {
+	case "add_column":
+		if req.Column == nil {
+			return "", fmt.Errorf("column is required for add_column")
+		}
+		if schema.HasColumn(req.Column.Name) {
+			return "", fmt.Errorf("table '%s' already has a column '%s'", req.Table, req.Column.Name)
+		}
+		clause, _, err := req.Column.columnSQL()
+		if err != nil {
+			return "", err
+		}
+		pos, err := position(req.Column.Name)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s%s", target, clause, pos), nil
+
+	case "modify_column":
+		if req.Column == nil {
+			return "", fmt.Errorf("column is required for modify_column")
+		}
+		col, err := existing(req.Column.Name)
+		if err != nil {
+			return "", err
+		}
+		clause, rule, err := req.Column.columnSQL()
+		if err != nil {
+			return "", err
+		}
+		roles, err := columnRoles(req.DBName, req.Table, col.Name)
+		if err != nil {
+			return "", err
+		}
+		typeName := req.Column.typeName()
+		for _, role := range roles {
+			if role == "the version column" && !rule.integer {
+				return "", fmt.Errorf("column '%s' is the version column and must stay an integer", col.Name)
+			}
+			if role == "the shard key" && !isShardKeyType(typeName) {
+				return "", fmt.Errorf("column '%s' is the shard key and must stay an integer or string", col.Name)
+			}
+			if role == "the TTL column" && typeName != "date" && typeName != "datetime" && typeName != "timestamp" {
+				return "", fmt.Errorf("column '%s' is the TTL column and must stay a date, datetime or timestamp", col.Name)
+			}
+		}
+		pos, err := position(col.Name)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s%s", target, clause, pos), nil
+
+	case "drop_column":
+		col, err := existing(req.ColumnName)
+		if err != nil {
+			return "", err
+		}
+		roles, err := columnRoles(req.DBName, req.Table, col.Name)
+		if err != nil {
+			return "", err
+		}
+		if len(roles) > 0 {
+			return "", fmt.Errorf("column '%s' cannot be dropped: it is %s", col.Name, strings.Join(roles, ", "))
+		}
+		return fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", target, quoteIdentifier(col.Name)), nil
+
+	case "rename_column":
+		col, err := existing(req.ColumnName)
+		if err != nil {
+			return "", err
+		}
+		if err := validName(req.NewName); err != nil {
+			return "", err
+		}
+		if schema.HasColumn(req.NewName) {
+			return "", fmt.Errorf("table '%s' already has a column '%s'", req.Table, req.NewName)
+		}
+		return fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", target, quoteIdentifier(col.Name), quoteIdentifier(req.NewName)), nil
+
+	case "rename_table":
+		if err := validName(req.NewName); err != nil {
+			return "", err
+		}
+		var exists int
+		err := db.QueryRow("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?",
+			req.DBName, req.NewName).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if exists > 0 {
+			return "", fmt.Errorf("table '%s.%s' already exists", req.DBName, req.NewName)
+		}
+		return fmt.Sprintf("RENAME TABLE %s TO %s.%s", target, quoteIdentifier(req.DBName), quoteIdentifier(req.NewName)), nil
+	}
+	return "", fmt.Errorf("invalid operation '%s'", req.Operation)
+}
+
+// migrationMetadataUpdates keeps cluster metadata pointing at a renamed column or table.
+func migrationMetadataUpdates(exec sqlExecutor, req *migrationRequest, column string) error {
+	var updates []string
+	var args []interface{}
+	switch req.Operation {
+	case "rename_column":
+		updates = []string{
+			"UPDATE cluster.table_shards SET shard_key = ? WHERE db_name = ? AND table_name = ? AND shard_key = ?",
+			"UPDATE cluster.table_versions SET version_column = ? WHERE db_name = ? AND table_name = ? AND version_column = ?",
+			"UPDATE cluster.table_ttl SET ttl_column = ? WHERE db_name = ? AND table_name = ? AND ttl_column = ?",
+			"UPDATE cluster.table_links SET parent_column = ? WHERE db_name = ? AND parent_table = ? AND parent_column = ?",
+			"UPDATE cluster.table_links SET child_column = ? WHERE db_name = ? AND child_table = ? AND child_column = ?",
+		}
+		args = []interface{}{req.NewName, req.DBName, req.Table, column}
+	case "rename_table":
+		for _, t := range []string{"table_shards", "table_versions", "table_cache", "table_ttl", "webhooks", "table_migrations"} {
+			updates = append(updates, "UPDATE cluster."+t+" SET table_name = ? WHERE db_name = ? AND table_name = ?")
+		}
+		updates = append(updates,
+			"UPDATE cluster.table_links SET parent_table = ? WHERE db_name = ? AND parent_table = ?",
+			"UPDATE cluster.table_links SET child_table = ? WHERE db_name = ? AND child_table = ?")
+		args = []interface{}{req.NewName, req.DBName, req.Table}
+	}
+	for _, update := range updates {
+		if _, err := exec.Exec(update, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigrationHandler changes the schema of a table and records the change as its next
+// migration.
+func applyMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	if currentRole == RoleSlave {
+		log.Println("Slave node received migration request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req migrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request format: " + err.Error()})
+		return
+	}
+	if !isValidIdentifier(req.DBName) || !isValidIdentifier(req.Table) {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Valid DB name and table required"})
+		return
+	}
+
+	migrationMutex.Lock()
+	defer migrationMutex.Unlock()
+
+	if err := reconcileMigrations(); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error settling unfinished migrations: " + err.Error()})
+		return
+	}
+	schema, err := fetchTableSchema(req.DBName, req.Table)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error loading table schema: " + err.Error()})
+		return
+	}
+	current, err := schemaVersion(db, req.DBName, req.Table)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error reading schema version: " + err.Error()})
+		return
+	}
+	var unsettled int
+	err = db.QueryRow("SELECT COUNT(*) FROM cluster.table_migrations WHERE db_name = ? AND table_name = ? AND state = ?",
+		req.DBName, req.Table, migrationPending).Scan(&unsettled)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error reading schema version: " + err.Error()})
+		return
+	}
+	if unsettled > 0 {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Table '%s' has an unfinished migration that could not be settled; see the master log", req.Table)})
+		return
+	}
+	if req.ExpectedVersion != nil && *req.ExpectedVersion != current {
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: fmt.Sprintf("Table '%s' is at schema version %d, not %d", req.Table, current, *req.ExpectedVersion),
+			Result:  map[string]interface{}{"version": current},
+		})
+		return
+	}
+	statement, err := migrationSQL(&req, schema)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+		return
+	}
+	// Metadata is matched by the column's name as the table spells it.
+	column := req.ColumnName
+	if col, ok := schema.Column(req.ColumnName); ok {
+		column = col.Name
+	}
+
+	version := current + 1
+	if err := recordMigration(db, req.DBName, req.Table, version, req.Operation, req, statement, migrationPending); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error recording migration: " + err.Error()})
+		return
+	}
+	if err := executeSQL(statement); err != nil {
+		_, derr := db.Exec("DELETE FROM cluster.table_migrations WHERE db_name = ? AND table_name = ? AND version = ? AND state = ?",
+			req.DBName, req.Table, version, migrationPending)
+		if derr != nil {
+			log.Printf("Error dropping pending migration %d of '%s.%s': %v", version, req.DBName, req.Table, derr)
+		}
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error applying migration: " + err.Error()})
+		return
+	}
+	table := req.Table
+	if req.Operation == "rename_table" {
+		table = req.NewName
+	}
+	invalidateTableSchema(req.DBName, req.Table)
+	invalidateTableSchema(req.DBName, table)
+
+	if err := completeMigration(&req, column, version); err != nil {
+		log.Printf("Error recording migration %d of '%s.%s' after applying it: %v", version, req.DBName, table, err)
+		json.NewEncoder(w).Encode(Response{
+			Success: false,
+			Message: "Migration applied but left pending; it is completed before the next migration: " + err.Error(),
+		})
+		return
+	}
+	if req.Operation == "rename_table" {
+		invalidateWebhookCache()
+	}
+	log.Printf("Applied migration %d (%s) to '%s.%s': %s", version, req.Operation, req.DBName, table, statement)
+
+	shardID := calculateShardID(req.DBName + "." + table)
+	replicateToNodes(map[string]interface{}{
+		"operation": "migrate",
+		"dbName":    req.DBName,
+		"table":     req.Table,
+		"newTable":  table,
+		"migration": req.Operation,
+		"version":   float64(version),
+		"shardId":   float64(shardID),
+	})
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: fmt.Sprintf("Migration %d (%s) applied to '%s.%s'", version, req.Operation, req.DBName, table),
+		Result:  map[string]interface{}{"version": version, "statement": statement},
+	})
+}
+
+// listMigrationsHandler reports the migrations this node has applied: the history and schema
+// version of a table (?db=&table=), or the version of every migrated table of a database.
+func listMigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	dbName := r.URL.Query().Get("db")
+	table := r.URL.Query().Get("table")
+	if !isValidIdentifier(dbName) || (table != "" && !isValidIdentifier(table)) {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Valid DB name required"})
+		return
+	}
+
+	if table == "" {
+		rows, err := db.Query(`
+			SELECT table_name, MAX(version), COUNT(*), MAX(applied_at)
+			FROM cluster.table_migrations WHERE db_name = ? AND state = ?
+			GROUP BY table_name ORDER BY table_name`, dbName, migrationApplied)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error listing migrations: " + err.Error()})
+			return
+		}
+		defer rows.Close()
+		tables := []map[string]interface{}{}
+		for rows.Next() {
+			var name string
+			var version, count int
+			var lastApplied time.Time
+			if err := rows.Scan(&name, &version, &count, &lastApplied); err != nil {
+				json.NewEncoder(w).Encode(Response{Success: false, Message: "Error reading migrations: " + err.Error()})
+				return
+			}
+			tables = append(tables, map[string]interface{}{"table": name, "version": version, "migrations": count, "lastAppliedAt": lastApplied})
+		}
+		if err := rows.Err(); err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error reading migrations: " + err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(Response{Success: true, Result: map[string]interface{}{"node": config.SelfURL, "tables": tables}})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT version, operation, change_spec, statement, applied_at
+		FROM cluster.table_migrations WHERE db_name = ? AND table_name = ? AND state = ?
+		ORDER BY version`, dbName, table, migrationApplied)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error listing migrations: " + err.Error()})
+		return
+	}
+	defer rows.Close()
+	migrations := []migration{}
+	for rows.Next() {
+		var m migration
+		var change []byte
+		if err := rows.Scan(&m.Version, &m.Operation, &change, &m.Statement, &m.AppliedAt); err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error reading migrations: " + err.Error()})
+			return
+		}
+		m.Change = change
+		migrations = append(migrations, m)
+	}
+	if err := rows.Err(); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error reading migrations: " + err.Error()})
+		return
+	}
+	version := 0
+	if len(migrations) > 0 {
+		version = migrations[len(migrations)-1].Version
+	}
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Result:  map[string]interface{}{"node": config.SelfURL, "table": table, "version": version, "migrations": migrations},
+	})
+}
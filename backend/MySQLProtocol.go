@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// The MySQL wire-protocol front end lets standard MySQL drivers talk to the cluster. Every
+// statement is lowered to a CRUD request and runs through the same routing as /api/crud.
+
+const (
+	mysqlServerVersion  = "8.0.0-ddb"
+	mysqlNativePassword = "mysql_native_password"
+	maxMySQLPacket      = 1<<24 - 1
+
+	clientLongPassword               = 0x00000001
+	clientFoundRows                  = 0x00000002
+	clientLongFlag                   = 0x00000004
+	clientConnectWithDB              = 0x00000008
+	clientProtocol41                 = 0x00000200
+	clientTransactions               = 0x00002000
+	clientSecureConnection           = 0x00008000
+	clientMultiResults               = 0x00020000
+	clientPluginAuth                 = 0x00080000
+	clientPluginAuthLenencClientData = 0x00200000
+
+	serverCapabilities = clientLongPassword | clientFoundRows | clientLongFlag | clientConnectWithDB |
+		clientProtocol41 | clientTransactions | clientSecureConnection | clientMultiResults |
+		clientPluginAuth | clientPluginAuthLenencClientData
+
+	serverStatusAutocommit = 0x0002
+
+	comQuit             = 0x01
+	comInitDB           = 0x02
+	comQuery            = 0x03
+	comPing             = 0x0e
+	comStmtPrepare      = 0x16
+	comStmtExecute      = 0x17
+	comStmtSendLongData = 0x18
+	comStmtClose        = 0x19
+	comStmtReset        = 0x1a
+	comSetOption        = 0x1b
+	comResetConnection  = 0x1f
+
+	mysqlTypeTiny       = 0x01
+	mysqlTypeShort      = 0x02
+	mysqlTypeLong       = 0x03
+	mysqlTypeFloat      = 0x04
+	mysqlTypeDouble     = 0x05
+	mysqlTypeNull       = 0x06
+	mysqlTypeTimestamp  = 0x07
+	mysqlTypeLongLong   = 0x08
+	mysqlTypeInt24      = 0x09
+	mysqlTypeDate       = 0x0a
+	mysqlTypeTime       = 0x0b
+	mysqlTypeDateTime   = 0x0c
+	mysqlTypeYear       = 0x0d
+	mysqlTypeNewDecimal = 0xf6
+	mysqlTypeVarString  = 0xfd
+
+	charsetUTF8MB4 = 45
+	charsetBinary  = 63
+)
+
+var mysqlConnectionID uint32
+
+// errMySQLPacketTooLarge is returned for a client packet over mysql_protocol.max_packet_bytes.
+// The rest of the packet is not read, so the connection cannot continue.
+var errMySQLPacketTooLarge = errors.New("packet larger than max_packet_bytes")
+
+func startMySQLProtocolServer() {
+	addr := fmt.Sprintf(":%d", config.Protocol.Port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Failed to start MySQL protocol listener on %s: %v", addr, err)
+		return
+	}
+	log.Printf("MySQL protocol listener started on %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("MySQL protocol accept failed: %v", err)
+			continue
+		}
+		go serveMySQLConn(conn)
+	}
+}
+
+// mysqlConn is one client session of the wire-protocol front end.
+type mysqlConn struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	w            *bufio.Writer
+	seq          byte
+	id           uint32
+	user         string
+	dbName       string
+	capabilities uint32
+	lastInsertID int64
+	stmts        map[uint32]*mysqlStmt
+	nextStmtID   uint32
+}
+
+func serveMySQLConn(conn net.Conn) {
+	c := &mysqlConn{
+		conn:  conn,
+		r:     bufio.NewReader(conn),
+		w:     bufio.NewWriter(conn),
+		id:    atomic.AddUint32(&mysqlConnectionID, 1),
+		stmts: make(map[uint32]*mysqlStmt),
+	}
+	defer conn.Close()
+
+	// Until it has authenticated, a client gets handshake_timeout_seconds for the whole
+	// exchange.
+	conn.SetDeadline(time.Now().Add(time.Duration(config.Protocol.HandshakeTimeoutSeconds) * time.Second))
+	if err := c.handshake(); err != nil {
+		c.readFailed(err)
+		log.Printf("MySQL protocol handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("MySQL protocol client %s connected as '%s' (connection %d)", conn.RemoteAddr(), c.user, c.id)
+
+	idle := time.Duration(config.Protocol.IdleTimeoutSeconds) * time.Second
+	for {
+		c.seq = 0
+		conn.SetReadDeadline(time.Now().Add(idle))
+		packet, err := c.readPacket()
+		if err != nil {
+			c.readFailed(err)
+			var netErr net.Error
+			switch {
+			case errors.As(err, &netErr) && netErr.Timeout():
+				log.Printf("MySQL protocol connection %d closed after %s idle", c.id, idle)
+			case err != io.EOF:
+				log.Printf("MySQL protocol connection %d read failed: %v", c.id, err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		if len(packet) == 0 {
+			continue
+		}
+		if packet[0] == comQuit {
+			return
+		}
+		if err := c.dispatch(packet[0], packet[1:]); err != nil {
+			log.Printf("MySQL protocol connection %d write failed: %v", c.id, err)
+			return
+		}
+		if err := c.w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// readPacket reads one client packet, joining the parts of a split one. A packet over
+// mysql_protocol.max_packet_bytes fails with errMySQLPacketTooLarge before it is read.
+func (c *mysqlConn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, err
+		}
+		length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+		c.seq = header[3] + 1
+		if limit := config.Protocol.MaxPacketBytes; limit > 0 && len(payload)+length > limit {
+			return nil, errMySQLPacketTooLarge
+		}
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(c.r, chunk); err != nil {
+			return nil, err
+		}
+		payload = append(payload, chunk...)
+		if length < maxMySQLPacket {
+			return payload, nil
+		}
+	}
+}
+
+func (c *mysqlConn) writePacket(payload []byte) error {
+	for {
+		length := len(payload)
+		if length > maxMySQLPacket {
+			length = maxMySQLPacket
+		}
+		header := []byte{byte(length), byte(length >> 8), byte(length >> 16), c.seq}
+		c.seq++
+		if _, err := c.w.Write(header); err != nil {
+			return err
+		}
+		if _, err := c.w.Write(payload[:length]); err != nil {
+			return err
+		}
+		payload = payload[length:]
+		if length < maxMySQLPacket {
+			return nil
+		}
+	}
+}
+
+func (c *mysqlConn) handshake() error {
+	scramble := make([]byte, 20)
+	if _, err := rand.Read(scramble); err != nil {
+		return err
+	}
+	for i := range scramble {
+		// Keep the scramble printable and free of NUL bytes, like MySQL does.
+		scramble[i] = scramble[i]%94 + 33
+	}
+
+	var p bytes.Buffer
+	p.WriteByte(10)
+	p.WriteString(mysqlServerVersion)
+	p.WriteByte(0)
+	binary.Write(&p, binary.LittleEndian, c.id)
+	p.Write(scramble[:8])
+	p.WriteByte(0)
+	binary.Write(&p, binary.LittleEndian, uint16(serverCapabilities&0xffff))
+	p.WriteByte(charsetUTF8MB4)
+	binary.Write(&p, binary.LittleEndian, uint16(serverStatusAutocommit))
+	binary.Write(&p, binary.LittleEndian, uint16(serverCapabilities>>16))
+	p.WriteByte(21)
+	p.Write(make([]byte, 10))
+	p.Write(scramble[8:])
+	p.WriteByte(0)
+	p.WriteString(mysqlNativePassword)
+	p.WriteByte(0)
+	if err := c.writePacket(p.Bytes()); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(packet) < 32 {
+		return fmt.Errorf("handshake response too short")
+	}
+	c.capabilities = binary.LittleEndian.Uint32(packet[0:4]) & serverCapabilities
+	if c.capabilities&clientProtocol41 == 0 {
+		c.writeError(1043, "08S01", "Client does not support the 4.1 protocol")
+		c.w.Flush()
+		return fmt.Errorf("client does not support protocol 4.1")
+	}
+
+	rest := packet[32:]
+	user, rest, ok := readNulString(rest)
+	if !ok {
+		return fmt.Errorf("malformed handshake response")
+	}
+	var authResponse []byte
+	switch {
+	case c.capabilities&clientPluginAuthLenencClientData != 0:
+		n, size := readLenEncInt(rest)
+		if size == 0 || uint64(len(rest)-size) < n {
+			return fmt.Errorf("malformed auth response")
+		}
+		authResponse, rest = rest[size:size+int(n)], rest[size+int(n):]
+	case c.capabilities&clientSecureConnection != 0:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return fmt.Errorf("malformed auth response")
+		}
+		authResponse, rest = rest[1:1+int(rest[0])], rest[1+int(rest[0]):]
+	default:
+		var s string
+		s, rest, _ = readNulString(rest)
+		authResponse = []byte(s)
+	}
+	var dbName string
+	if c.capabilities&clientConnectWithDB != 0 && len(rest) > 0 {
+		var s string
+		s, rest, _ = readNulString(rest)
+		dbName = s
+	}
+	plugin := mysqlNativePassword
+	if c.capabilities&clientPluginAuth != 0 && len(rest) > 0 {
+		plugin, _, _ = readNulString(rest)
+	}
+
+	if plugin != mysqlNativePassword {
+		// Ask the client to answer the scramble with mysql_native_password instead.
+		var sw bytes.Buffer
+		sw.WriteByte(0xfe)
+		sw.WriteString(mysqlNativePassword)
+		sw.WriteByte(0)
+		sw.Write(scramble)
+		sw.WriteByte(0)
+		if err := c.writePacket(sw.Bytes()); err != nil {
+			return err
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+		if authResponse, err = c.readPacket(); err != nil {
+			return err
+		}
+	}
+
+	if user != config.Protocol.User || !checkNativePassword(scramble, authResponse, config.Protocol.Password) {
+		c.writeError(1045, "28000", fmt.Sprintf("Access denied for user '%s'", user))
+		c.w.Flush()
+		return fmt.Errorf("access denied for user '%s'", user)
+	}
+	c.user = user
+
+	if dbName != "" {
+		if err := c.useDatabase(dbName); err != nil {
+			c.writeError(1049, "42000", err.Error())
+			c.w.Flush()
+			return err
+		}
+	}
+	if err := c.writeOK(0, 0); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// checkNativePassword verifies a mysql_native_password response:
+// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password))).
+func checkNativePassword(scramble, response []byte, password string) bool {
+	if password == "" {
+		return len(response) == 0
+	}
+	if len(response) != sha1.Size {
+		return false
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(scramble)
+	h.Write(stage2[:])
+	mix := h.Sum(nil)
+	expected := make([]byte, sha1.Size)
+	for i := range expected {
+		expected[i] = stage1[i] ^ mix[i]
+	}
+	return subtle.ConstantTimeCompare(expected, response) == 1
+}
+
+// readFailed tells the client why the connection is being closed when a read ends it for a
+// reason of the server's: a packet that is too large or an idle timeout.
+func (c *mysqlConn) readFailed(err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errMySQLPacketTooLarge):
+		c.writeError(1153, "08S01", "Got a packet bigger than 'max_allowed_packet' bytes")
+	case errors.As(err, &netErr) && netErr.Timeout() && c.user != "":
+		c.seq = 0
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeError(4031, "HY000", "The client was disconnected by the server because of inactivity.")
+	default:
+		return
+	}
+	c.w.Flush()
+}
+
+func (c *mysqlConn) writeOK(affectedRows, insertID uint64) error {
+	p := []byte{0x00}
+	p = appendLenEncInt(p, affectedRows)
+	p = appendLenEncInt(p, insertID)
+	p = append(p, byte(serverStatusAutocommit), byte(serverStatusAutocommit>>8), 0, 0)
+	return c.writePacket(p)
+}
+
+func (c *mysqlConn) writeEOF() error {
+	return c.writePacket([]byte{0xfe, 0, 0, byte(serverStatusAutocommit), byte(serverStatusAutocommit >> 8)})
+}
+
+func (c *mysqlConn) writeError(code uint16, sqlState, message string) error {
+	p := []byte{0xff, byte(code), byte(code >> 8), '#'}
+	p = append(p, sqlState...)
+	p = append(p, message...)
+	return c.writePacket(p)
+}
+
+func appendLenEncInt(b []byte, n uint64) []byte {
+	switch {
+	case n < 251:
+		return append(b, byte(n))
+	case n < 1<<16:
+		return append(b, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		return append(b, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	}
+	b = append(b, 0xfe)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(n>>(8*i)))
+	}
+	return b
+}
+
+func appendLenEncString(b []byte, s string) []byte {
+	b = appendLenEncInt(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// readLenEncInt decodes a length-encoded integer and returns it with the number of bytes it
+// used; size is 0 when the input is malformed.
+func readLenEncInt(b []byte) (n uint64, size int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	switch b[0] {
+	case 0xfc:
+		if len(b) < 3 {
+			return 0, 0
+		}
+		return uint64(b[1]) | uint64(b[2])<<8, 3
+	case 0xfd:
+		if len(b) < 4 {
+			return 0, 0
+		}
+		return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, 4
+	case 0xfe:
+		if len(b) < 9 {
+			return 0, 0
+		}
+		return binary.LittleEndian.Uint64(b[1:9]), 9
+	case 0xfb, 0xff:
+		return 0, 0
+	}
+	return uint64(b[0]), 1
+}
+
+func readNulString(b []byte) (string, []byte, bool) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return string(b), nil, false
+	}
+	return string(b[:i]), b[i+1:], true
+}
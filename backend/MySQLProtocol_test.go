@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+// testMySQLConn returns a connection that reads in and writes to out.
+func testMySQLConn(in []byte, out *bytes.Buffer) *mysqlConn {
+	return &mysqlConn{r: bufio.NewReader(bytes.NewReader(in)), w: bufio.NewWriter(out)}
+}
+
+func TestLenEncInt(t *testing.T) {
+	tests := []struct {
+		n       uint64
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{250, []byte{0xfa}},
+		{251, []byte{0xfc, 0xfb, 0x00}},
+		{1<<16 - 1, []byte{0xfc, 0xff, 0xff}},
+		{1 << 16, []byte{0xfd, 0x00, 0x00, 0x01}},
+		{1<<24 - 1, []byte{0xfd, 0xff, 0xff, 0xff}},
+		{1 << 24, []byte{0xfe, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}},
+		{1<<64 - 1, []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		got := appendLenEncInt(nil, tt.n)
+		if !bytes.Equal(got, tt.encoded) {
+			t.Errorf("appendLenEncInt(%d) = % x, want % x", tt.n, got, tt.encoded)
+		}
+		n, size := readLenEncInt(append(got, 0x99))
+		if n != tt.n || size != len(tt.encoded) {
+			t.Errorf("readLenEncInt(% x) = %d, %d, want %d, %d", got, n, size, tt.n, len(tt.encoded))
+		}
+	}
+}
+
+func TestReadLenEncIntMalformed(t *testing.T) {
+	for _, b := range [][]byte{nil, {0xfb}, {0xff}, {0xfc, 0x01}, {0xfd, 0x01, 0x02}, {0xfe, 1, 2, 3, 4, 5, 6, 7}} {
+		if n, size := readLenEncInt(b); size != 0 {
+			t.Errorf("readLenEncInt(% x) = %d, %d, want size 0", b, n, size)
+		}
+	}
+}
+
+func TestReadNulString(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		s    string
+		rest []byte
+		ok   bool
+	}{
+		{[]byte("root\x00rest"), "root", []byte("rest"), true},
+		{[]byte("\x00"), "", []byte{}, true},
+		{[]byte("unterminated"), "unterminated", nil, false},
+	}
+	for _, tt := range tests {
+		s, rest, ok := readNulString(tt.in)
+		if s != tt.s || !bytes.Equal(rest, tt.rest) || ok != tt.ok {
+			t.Errorf("readNulString(%q) = %q, %q, %v, want %q, %q, %v", tt.in, s, rest, ok, tt.s, tt.rest, tt.ok)
+		}
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		packets int
+	}{
+		{"empty", 0, 1},
+		{"small", 300, 1},
+		{"just under the limit", maxMySQLPacket - 1, 1},
+		// A payload of exactly the limit is followed by an empty packet.
+		{"exactly the limit", maxMySQLPacket, 2},
+		{"split", maxMySQLPacket + 10, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := make([]byte, tt.size)
+			for i := range payload {
+				payload[i] = byte(i)
+			}
+			var wire bytes.Buffer
+			w := testMySQLConn(nil, &wire)
+			w.seq = 3
+			if err := w.writePacket(payload); err != nil {
+				t.Fatal(err)
+			}
+			w.w.Flush()
+			if w.seq != byte(3+tt.packets) {
+				t.Errorf("sequence after write = %d, want %d", w.seq, 3+tt.packets)
+			}
+			if want := tt.size + 4*tt.packets; wire.Len() != want {
+				t.Fatalf("wrote %d bytes, want %d", wire.Len(), want)
+			}
+
+			r := testMySQLConn(wire.Bytes(), nil)
+			got, err := r.readPacket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("read %d bytes back, want the %d written", len(got), len(payload))
+			}
+			if r.seq != byte(3+tt.packets) {
+				t.Errorf("sequence after read = %d, want %d", r.seq, 3+tt.packets)
+			}
+		})
+	}
+}
+
+func TestReadPacketTruncated(t *testing.T) {
+	for _, in := range [][]byte{{0x05, 0x00}, {0x05, 0x00, 0x00, 0x00, 'a', 'b'}} {
+		if _, err := testMySQLConn(in, nil).readPacket(); err == nil {
+			t.Errorf("readPacket(% x) succeeded", in)
+		}
+	}
+}
+
+func TestReadPacketTooLarge(t *testing.T) {
+	defer func(n int) { config.Protocol.MaxPacketBytes = n }(config.Protocol.MaxPacketBytes)
+	config.Protocol.MaxPacketBytes = 8
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr error
+	}{
+		{"at the limit", []byte{0x08, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}, nil},
+		// The header alone is enough to reject the packet.
+		{"over the limit", []byte{0x09, 0, 0, 0}, errMySQLPacketTooLarge},
+		{"split over the limit", []byte{0xff, 0xff, 0xff, 0}, errMySQLPacketTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := testMySQLConn(tt.in, nil).readPacket(); err != tt.wantErr {
+				t.Errorf("readPacket error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResponsePackets(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(c *mysqlConn) error
+		want  []byte
+	}{
+		{
+			name:  "OK",
+			write: func(c *mysqlConn) error { return c.writeOK(3, 300) },
+			want:  []byte{0x09, 0, 0, 0, 0x00, 0x03, 0xfc, 0x2c, 0x01, 0x02, 0x00, 0x00, 0x00},
+		},
+		{
+			name:  "EOF",
+			write: func(c *mysqlConn) error { return c.writeEOF() },
+			want:  []byte{0x05, 0, 0, 0, 0xfe, 0x00, 0x00, 0x02, 0x00},
+		},
+		{
+			name:  "error",
+			write: func(c *mysqlConn) error { return c.writeError(1146, "42S02", "no") },
+			want:  []byte{0x0b, 0, 0, 0, 0xff, 0x7a, 0x04, '#', '4', '2', 'S', '0', '2', 'n', 'o'},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := testMySQLConn(nil, &out)
+			if err := tt.write(c); err != nil {
+				t.Fatal(err)
+			}
+			c.w.Flush()
+			if !bytes.Equal(out.Bytes(), tt.want) {
+				t.Errorf("packet = % x, want % x", out.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+// nativePasswordResponse computes the client side of mysql_native_password.
+func nativePasswordResponse(scramble []byte, password string) []byte {
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	mix := sha1.Sum(append(append([]byte{}, scramble...), stage2[:]...))
+	for i := range mix {
+		mix[i] ^= stage1[i]
+	}
+	return mix[:]
+}
+
+func TestCheckNativePassword(t *testing.T) {
+	scramble := []byte("abcdefghijklmnopqrst")
+	tests := []struct {
+		name     string
+		response []byte
+		password string
+		want     bool
+	}{
+		{"correct", nativePasswordResponse(scramble, "secret"), "secret", true},
+		{"wrong password", nativePasswordResponse(scramble, "guess"), "secret", false},
+		{"other scramble", nativePasswordResponse([]byte("tsrqponmlkjihgfedcba"), "secret"), "secret", false},
+		{"truncated", nativePasswordResponse(scramble, "secret")[:10], "secret", false},
+		{"empty for empty password", nil, "", true},
+		{"response for empty password", nativePasswordResponse(scramble, "x"), "", false},
+		{"empty for a password", nil, "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkNativePassword(scramble, tt.response, tt.password); got != tt.want {
+				t.Errorf("checkNativePassword = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
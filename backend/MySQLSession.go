@@ -0,0 +1,1043 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type mysqlError struct {
+	Code    uint16
+	State   string
+	Message string
+}
+
+func (e *mysqlError) Error() string {
+	return e.Message
+}
+
+func newMySQLError(code uint16, state, format string, args ...interface{}) *mysqlError {
+	return &mysqlError{Code: code, State: state, Message: fmt.Sprintf(format, args...)}
+}
+
+type mysqlColumn struct {
+	Name  string
+	Table string
+	Type  byte
+}
+
+// mysqlResult is a result set in the order the client expects its columns.
+type mysqlResult struct {
+	Columns []mysqlColumn
+	Rows    [][]interface{}
+}
+
+type mysqlStmt struct {
+	id          uint32
+	query       string
+	numParams   int
+	paramTypes  []uint16
+	hasLongData bool
+}
+
+func (c *mysqlConn) dispatch(cmd byte, data []byte) error {
+	switch cmd {
+	case comPing:
+		return c.writeOK(0, 0)
+	case comResetConnection:
+		c.stmts = make(map[uint32]*mysqlStmt)
+		return c.writeOK(0, 0)
+	case comInitDB:
+		if err := c.useDatabase(string(data)); err != nil {
+			return c.writeError(1049, "42000", err.Error())
+		}
+		return c.writeOK(0, 0)
+	case comQuery:
+		return c.runStatement(string(data), nil, false)
+	case comStmtPrepare:
+		return c.prepare(string(data))
+	case comStmtExecute:
+		return c.executeStmt(data)
+	case comStmtSendLongData:
+		// No response is sent for this command; the following execute reports the error.
+		if len(data) >= 4 {
+			if stmt, ok := c.stmts[binary.LittleEndian.Uint32(data[0:4])]; ok {
+				stmt.hasLongData = true
+			}
+		}
+		return nil
+	case comStmtClose:
+		if len(data) >= 4 {
+			delete(c.stmts, binary.LittleEndian.Uint32(data[0:4]))
+		}
+		return nil
+	case comStmtReset:
+		if len(data) >= 4 {
+			if stmt, ok := c.stmts[binary.LittleEndian.Uint32(data[0:4])]; ok {
+				stmt.hasLongData = false
+				return c.writeOK(0, 0)
+			}
+		}
+		return c.writeError(1243, "HY000", "Unknown prepared statement handler")
+	case comSetOption:
+		return c.writeEOF()
+	}
+	return c.writeError(1047, "08S01", fmt.Sprintf("Unknown command %d", cmd))
+}
+
+func (c *mysqlConn) useDatabase(name string) error {
+	name = SanitizeIdentifier(name)
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = ?", name).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("Unknown database '%s'", name)
+	}
+	c.dbName = name
+	return nil
+}
+
+// runStatement executes one statement and writes its result set, OK or error packet. binary
+// selects the prepared-statement row format.
+func (c *mysqlConn) runStatement(query string, params []interface{}, binaryRows bool) error {
+	ctx, done := c.statementContext()
+	result, affected, insertID, err := c.runQuery(ctx, query, params)
+	done()
+	if err != nil {
+		if myErr, ok := err.(*mysqlError); ok {
+			return c.writeError(myErr.Code, myErr.State, myErr.Message)
+		}
+		return c.writeError(1105, "HY000", err.Error())
+	}
+	if result == nil {
+		return c.writeOK(affected, insertID)
+	}
+	return c.writeResultSet(result, binaryRows)
+}
+
+// mysqlProtocolRoute is the route statements that do not go through the API router are
+// rate limited under; rate_limit.routes may configure it like an API route.
+const mysqlProtocolRoute = "mysql"
+
+// admit applies the API's admission control to a statement that does not go through the API
+// router: a token from the client IP's bucket and an in-flight slot, which the returned
+// function gives back.
+func (c *mysqlConn) admit() (func(), error) {
+	if !config.RateLimit.Enabled {
+		return func() {}, nil
+	}
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		host = c.conn.RemoteAddr().String()
+	}
+	if allowed, retryAfter := takeToken("ip:"+host, mysqlProtocolRoute); !allowed {
+		return nil, newMySQLError(1226, "42000", "Rate limit exceeded; retry in %s", retryAfter.Round(time.Millisecond))
+	}
+	if !takeDBSlot(mysqlProtocolRoute) {
+		return nil, newMySQLError(1226, "42000", "Server busy: %d requests already in flight", config.RateLimit.MaxConcurrentDBOps)
+	}
+	return releaseDBSlot, nil
+}
+
+// statementContext returns the context a statement runs under: the default query deadline,
+// ended early when the client closes the connection. The client waits for the answer before
+// it sends anything else, so a pending read only completes when the connection closes. done
+// must be called once the statement has finished and before the next packet is read.
+func (c *mysqlConn) statementContext() (ctx context.Context, done func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.QueryTimeout.DefaultSeconds)*time.Second)
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		if _, err := c.r.Peek(1); err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				cancel()
+			}
+		}
+	}()
+	return ctx, func() {
+		// An expired read deadline ends the pending peek; bufio does not keep its error.
+		c.conn.SetReadDeadline(time.Now())
+		<-watched
+		c.conn.SetReadDeadline(time.Time{})
+		cancel()
+	}
+}
+
+func (c *mysqlConn) runQuery(ctx context.Context, query string, params []interface{}) (*mysqlResult, uint64, uint64, error) {
+	toks, err := tokenizeSQL(query)
+	if err != nil {
+		return nil, 0, 0, newMySQLError(1064, "42000", "%v", err)
+	}
+	if toks[0].kind == tokEOF {
+		return nil, 0, 0, newMySQLError(1065, "42000", "Query was empty")
+	}
+
+	head := ""
+	if toks[0].kind == tokIdent {
+		head = strings.ToUpper(toks[0].text)
+	}
+	switch head {
+	case "SET":
+		// Session settings sent by drivers are accepted and ignored, except turning off
+		// autocommit, which would promise transactions this front end does not provide.
+		if setsAutocommitOff(toks) {
+			return nil, 0, 0, newMySQLError(1235, "42000", "autocommit cannot be disabled; use /api/transaction for transactions")
+		}
+		return nil, 0, 0, nil
+	case "USE":
+		p := &sqlParser{toks: toks, pos: 1}
+		name, err := p.parseIdent()
+		if err != nil {
+			return nil, 0, 0, newMySQLError(1064, "42000", "%v", err)
+		}
+		if err := c.useDatabase(name); err != nil {
+			return nil, 0, 0, newMySQLError(1049, "42000", "%v", err)
+		}
+		return nil, 0, 0, nil
+	case "BEGIN", "START":
+		return nil, 0, 0, newMySQLError(1235, "42000", "transactions are not supported over the MySQL protocol; use /api/transaction")
+	case "COMMIT", "ROLLBACK":
+		// Every statement has already been committed on its own; accepting these would tell
+		// the client that a transaction it never had was committed or undone.
+		return nil, 0, 0, newMySQLError(1235, "42000", "transactions are not supported over the MySQL protocol; use /api/transaction")
+	case "SHOW", "DESCRIBE", "DESC":
+		release, err := c.admit()
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		defer release()
+		result, err := c.metadataQuery(ctx, query)
+		return result, 0, 0, err
+	case "SELECT":
+		if !hasKeyword(toks, "FROM") {
+			result, err := c.systemSelect(toks, params)
+			return result, 0, 0, err
+		}
+	}
+
+	stmt, err := parseSQL(query, params)
+	if err != nil {
+		return nil, 0, 0, newMySQLError(1064, "42000", "%v", err)
+	}
+	if stmt.DBName == "" {
+		stmt.DBName = c.dbName
+	}
+	if stmt.DBName == "" {
+		return nil, 0, 0, newMySQLError(1046, "3D000", "No database selected")
+	}
+	stmt.DBName = SanitizeIdentifier(stmt.DBName)
+	stmt.Table = SanitizeIdentifier(stmt.Table)
+	if stmt.Operation == "upsert" {
+		if stmt.ConflictColumns, err = inferConflictColumns(stmt.DBName, stmt.Table, stmt.Data); err != nil {
+			return nil, 0, 0, newMySQLError(1064, "42000", "%v", err)
+		}
+	}
+
+	raw, err := c.runCrudRequest(ctx, stmt)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if isReadOperation(stmt.Operation) {
+		result, err := crudResultSet(stmt, raw)
+		return result, 0, 0, err
+	}
+
+	var written struct {
+		ID           json.Number `json:"id"`
+		RowsAffected json.Number `json:"rowsAffected"`
+		Succeeded    int64       `json:"succeeded"`
+		Items        []struct {
+			ID json.Number `json:"id"`
+		} `json:"items"`
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &written); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	var affected, insertID int64
+	switch stmt.Operation {
+	case "create":
+		affected = 1
+		insertID, _ = written.ID.Int64()
+	case "batch":
+		affected = written.Succeeded
+		if len(written.Items) > 0 {
+			insertID, _ = written.Items[0].ID.Int64()
+		}
+	default:
+		affected, _ = written.RowsAffected.Int64()
+		insertID, _ = written.ID.Int64()
+	}
+	if insertID > 0 {
+		c.lastInsertID = insertID
+	}
+	return nil, uint64(affected), uint64(insertID), nil
+}
+
+// runCrudRequest runs a CRUD request through the API router as a POST to /api/crud from the
+// client's address, so it is rate limited, runs under the default deadline and is handled
+// like any other API request; crudHandler forwards writes to the master. On a slave, reads of
+// a shard this node does not serve are sent to a node that serves it.
+func (c *mysqlConn) runCrudRequest(ctx context.Context, req *crudRequest) (json.RawMessage, error) {
+	if isReadOperation(req.Operation) && currentRole == RoleSlave {
+		route, err := routeCrudRequest(req, false)
+		if err != nil {
+			return nil, err
+		}
+		if !route.Scatter && route.ShardID != calculateShardID(config.SelfURL) {
+			nodeURL := shardNodeURL(route.ShardID)
+			if nodeURL == config.SelfURL {
+				nodeURL = state.CurrentMaster
+			}
+			release, err := c.admit()
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			log.Printf("MySQL protocol read of '%s.%s' for shard %d routed to %s", req.DBName, req.Table, route.ShardID, nodeURL)
+			var raw json.RawMessage
+			err = postShardRequest(ctx, nodeURL, "/api/crud", req, &raw)
+			return raw, err
+		}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/crud", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.RemoteAddr = c.conn.RemoteAddr().String()
+	rec := &bufferedResponse{header: make(http.Header)}
+	apiRouter.ServeHTTP(rec, httpReq)
+
+	var envelope struct {
+		Success bool            `json:"success"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(rec.body.Bytes(), &envelope); err != nil {
+		if rec.status != 0 && rec.status != http.StatusOK {
+			return nil, fmt.Errorf("%s", strings.TrimSpace(rec.body.String()))
+		}
+		return nil, err
+	}
+	if !envelope.Success {
+		return nil, fmt.Errorf("%s", envelope.Message)
+	}
+	return envelope.Result, nil
+}
+
+// bufferedResponse collects the response of a handler that is called in-process.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// crudResultSet orders the rows of a read or aggregate by the statement's select list.
+func crudResultSet(stmt *crudRequest, raw json.RawMessage) (*mysqlResult, error) {
+	schema, err := loadTableSchema(stmt.DBName, stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &mysqlResult{}
+	var binaryColumns []bool
+	addColumn := func(name, dataType string) {
+		result.Columns = append(result.Columns, mysqlColumn{Name: name, Table: stmt.Table, Type: mysqlColumnType(dataType)})
+		switch dataType {
+		case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+			binaryColumns = append(binaryColumns, true)
+		default:
+			binaryColumns = append(binaryColumns, false)
+		}
+	}
+	if stmt.Operation == "aggregate" {
+		for _, name := range stmt.GroupBy {
+			col, _ := schema.Column(name)
+			addColumn(col.Name, col.DataType)
+		}
+		for _, spec := range stmt.Aggregates {
+			col, _ := schema.Column(spec.Column)
+			spec.Column = col.Name
+			if spec.As == "" {
+				spec.As = spec.defaultAlias()
+			}
+			switch strings.ToUpper(spec.Func) {
+			case "COUNT":
+				addColumn(spec.As, "bigint")
+			case "SUM", "AVG":
+				addColumn(spec.As, "decimal")
+			default:
+				addColumn(spec.As, col.DataType)
+			}
+		}
+	} else if len(stmt.Columns) > 0 {
+		for _, name := range stmt.Columns {
+			col, _ := schema.Column(name)
+			addColumn(col.Name, col.DataType)
+		}
+	} else {
+		for _, col := range schema.Columns {
+			addColumn(col.Name, col.DataType)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var decoded interface{}
+	if err := dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	if page, ok := decoded.(map[string]interface{}); ok {
+		decoded = page["rows"]
+	}
+	list, _ := decoded.([]interface{})
+	for _, item := range list {
+		row, _ := item.(map[string]interface{})
+		values := make([]interface{}, len(result.Columns))
+		for i, col := range result.Columns {
+			values[i] = row[col.Name]
+			if s, ok := values[i].(string); ok && binaryColumns[i] {
+				// CRUD results carry binary columns base64-encoded; MySQL clients expect the bytes.
+				if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+					values[i] = string(b)
+				}
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	return result, nil
+}
+
+func mysqlColumnType(dataType string) byte {
+	switch strings.ToLower(dataType) {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year", "bit":
+		return mysqlTypeLongLong
+	case "float", "double", "real":
+		return mysqlTypeDouble
+	case "decimal", "numeric":
+		return mysqlTypeNewDecimal
+	case "date":
+		return mysqlTypeDate
+	case "datetime":
+		return mysqlTypeDateTime
+	case "timestamp":
+		return mysqlTypeTimestamp
+	}
+	return mysqlTypeVarString
+}
+
+// metadataQuery runs read-only SHOW and DESCRIBE statements against the local MySQL, which
+// holds a full replica of the cluster's schemas.
+func (c *mysqlConn) metadataQuery(ctx context.Context, query string) (*mysqlResult, error) {
+	// Without a current database, statements such as SHOW DATABASES run on the server pool.
+	dbConn := db
+	if c.dbName != "" {
+		var release func()
+		var err error
+		if dbConn, release, err = getDBConn(c.dbName); err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	rows, err := dbConn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, newMySQLError(1064, "42000", "%v", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := &mysqlResult{}
+	for _, name := range columns {
+		result.Columns = append(result.Columns, mysqlColumn{Name: name, Type: mysqlTypeVarString})
+	}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make([]interface{}, len(columns))
+		for i, v := range values {
+			if v.Valid {
+				row[i] = v.String
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result, rows.Err()
+}
+
+var mysqlSystemVariables = map[string]interface{}{
+	"version":                  mysqlServerVersion,
+	"version_comment":          "DDB distributed database",
+	"max_allowed_packet":       int64(64 << 20),
+	"auto_increment_increment": int64(1),
+	"autocommit":               int64(1),
+	"character_set_client":     "utf8mb4",
+	"character_set_connection": "utf8mb4",
+	"character_set_results":    "utf8mb4",
+	"character_set_server":     "utf8mb4",
+	"collation_connection":     "utf8mb4_general_ci",
+	"collation_server":         "utf8mb4_general_ci",
+	"init_connect":             "",
+	"interactive_timeout":      int64(28800),
+	"wait_timeout":             int64(28800),
+	"net_write_timeout":        int64(60),
+	"license":                  "GPL",
+	"lower_case_table_names":   int64(0),
+	"performance_schema":       int64(0),
+	"query_cache_size":         int64(0),
+	"query_cache_type":         "OFF",
+	"sql_mode":                 "",
+	"system_time_zone":         "UTC",
+	"time_zone":                "SYSTEM",
+	"transaction_isolation":    "REPEATABLE-READ",
+	"tx_isolation":             "REPEATABLE-READ",
+	"transaction_read_only":    int64(0),
+	"tx_read_only":             int64(0),
+}
+
+// systemSelect answers SELECT statements without FROM that drivers send on connect, such as
+// SELECT @@max_allowed_packet or SELECT DATABASE().
+func (c *mysqlConn) systemSelect(toks []sqlToken, params []interface{}) (*mysqlResult, error) {
+	p := &sqlParser{toks: toks, pos: 1, params: params}
+	result := &mysqlResult{}
+	row := []interface{}{}
+	for {
+		var name string
+		var value interface{}
+		start := p.pos
+		switch {
+		case p.acceptSymbol("@"):
+			if !p.acceptSymbol("@") {
+				// User variables are never set on this front end.
+				if _, err := p.parseIdent(); err != nil {
+					return nil, newMySQLError(1064, "42000", "%v", err)
+				}
+				break
+			}
+			variable, err := p.parseIdent()
+			if err != nil {
+				return nil, newMySQLError(1064, "42000", "%v", err)
+			}
+			if p.acceptSymbol(".") {
+				if variable, err = p.parseIdent(); err != nil {
+					return nil, newMySQLError(1064, "42000", "%v", err)
+				}
+			}
+			v, ok := mysqlSystemVariables[strings.ToLower(variable)]
+			if !ok {
+				return nil, newMySQLError(1193, "HY000", "Unknown system variable '%s'", variable)
+			}
+			value = v
+		case p.peek().kind == tokIdent && p.toks[p.pos+1].kind == tokSymbol && p.toks[p.pos+1].text == "(":
+			fn := strings.ToUpper(p.next().text)
+			p.next()
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, newMySQLError(1064, "42000", "%v", err)
+			}
+			switch fn {
+			case "DATABASE", "SCHEMA":
+				if c.dbName != "" {
+					value = c.dbName
+				}
+			case "VERSION":
+				value = mysqlServerVersion
+			case "CONNECTION_ID":
+				value = int64(c.id)
+			case "USER", "CURRENT_USER", "SESSION_USER", "SYSTEM_USER":
+				value = c.user + "@%"
+			case "NOW", "CURRENT_TIMESTAMP", "SYSDATE":
+				value = time.Now().Format("2006-01-02 15:04:05")
+			case "LAST_INSERT_ID":
+				value = c.lastInsertID
+			default:
+				return nil, newMySQLError(1305, "42000", "FUNCTION %s does not exist", fn)
+			}
+		default:
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, newMySQLError(1064, "42000", "%v", err)
+			}
+			value = v
+		}
+		for i := start; i < p.pos; i++ {
+			name += p.toks[i].text
+		}
+		if p.acceptKeyword("AS") || p.peek().kind == tokQuotedIdent ||
+			(p.peek().kind == tokIdent && !sqlReservedWords[strings.ToUpper(p.peek().text)]) {
+			alias, err := p.parseIdent()
+			if err != nil {
+				return nil, newMySQLError(1064, "42000", "%v", err)
+			}
+			name = alias
+		}
+
+		typ := byte(mysqlTypeVarString)
+		switch v := value.(type) {
+		case int64, int:
+			typ = mysqlTypeLongLong
+		case float64:
+			typ = mysqlTypeDouble
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				typ = mysqlTypeLongLong
+			} else {
+				typ = mysqlTypeNewDecimal
+			}
+		}
+		result.Columns = append(result.Columns, mysqlColumn{Name: name, Type: typ})
+		row = append(row, value)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		if _, err := p.parseCount(); err != nil {
+			return nil, newMySQLError(1064, "42000", "%v", err)
+		}
+	}
+	p.acceptSymbol(";")
+	if p.peek().kind != tokEOF {
+		return nil, newMySQLError(1064, "42000", "unexpected '%s'", p.peek().text)
+	}
+	result.Rows = [][]interface{}{row}
+	return result, nil
+}
+
+func hasKeyword(toks []sqlToken, kw string) bool {
+	for _, t := range toks {
+		if t.kind == tokIdent && strings.EqualFold(t.text, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+func setsAutocommitOff(toks []sqlToken) bool {
+	for i := 0; i+2 < len(toks); i++ {
+		if toks[i].kind == tokIdent && strings.EqualFold(toks[i].text, "autocommit") && toks[i+1].text == "=" {
+			v := strings.ToUpper(toks[i+2].text)
+			return v == "0" || v == "OFF" || v == "FALSE"
+		}
+	}
+	return false
+}
+
+func (c *mysqlConn) writeResultSet(result *mysqlResult, binaryRows bool) error {
+	if err := c.writePacket(appendLenEncInt(nil, uint64(len(result.Columns)))); err != nil {
+		return err
+	}
+	for _, col := range result.Columns {
+		if err := c.writeColumnDefinition(col); err != nil {
+			return err
+		}
+	}
+	if err := c.writeEOF(); err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		var packet []byte
+		var err error
+		if binaryRows {
+			packet, err = binaryRow(result.Columns, row)
+		} else {
+			packet = textRow(result.Columns, row)
+		}
+		if err != nil {
+			return c.writeError(1105, "HY000", err.Error())
+		}
+		if err := c.writePacket(packet); err != nil {
+			return err
+		}
+	}
+	return c.writeEOF()
+}
+
+func (c *mysqlConn) writeColumnDefinition(col mysqlColumn) error {
+	charset, length, decimals := uint16(charsetUTF8MB4), uint32(65535), byte(0x1f)
+	switch col.Type {
+	case mysqlTypeLongLong:
+		charset, length, decimals = charsetBinary, 20, 0
+	case mysqlTypeDouble:
+		charset, length = charsetBinary, 22
+	case mysqlTypeNewDecimal:
+		charset, length = charsetBinary, 67
+	case mysqlTypeDate:
+		charset, length, decimals = charsetBinary, 10, 0
+	case mysqlTypeDateTime, mysqlTypeTimestamp:
+		charset, length, decimals = charsetBinary, 26, 6
+	}
+	p := appendLenEncString(nil, "def")
+	p = appendLenEncString(p, c.dbName)
+	p = appendLenEncString(p, col.Table)
+	p = appendLenEncString(p, col.Table)
+	p = appendLenEncString(p, col.Name)
+	p = appendLenEncString(p, col.Name)
+	p = append(p, 0x0c, byte(charset), byte(charset>>8))
+	p = binary.LittleEndian.AppendUint32(p, length)
+	p = append(p, col.Type, 0, 0, decimals, 0, 0)
+	return c.writePacket(p)
+}
+
+// mysqlText renders a value the way MySQL sends it in the text protocol.
+func mysqlText(v interface{}, typ byte) (string, bool) {
+	switch val := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		if typ == mysqlTypeDate || typ == mysqlTypeDateTime || typ == mysqlTypeTimestamp {
+			if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+				if typ == mysqlTypeDate {
+					return t.Format("2006-01-02"), true
+				}
+				return t.Format("2006-01-02 15:04:05.999999"), true
+			}
+		}
+		return val, true
+	case bool:
+		if val {
+			return "1", true
+		}
+		return "0", true
+	case json.Number:
+		return val.String(), true
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(val)
+		return string(b), true
+	}
+	return fmt.Sprint(v), true
+}
+
+func textRow(columns []mysqlColumn, row []interface{}) []byte {
+	var p []byte
+	for i, col := range columns {
+		s, ok := mysqlText(row[i], col.Type)
+		if !ok {
+			p = append(p, 0xfb)
+			continue
+		}
+		p = appendLenEncString(p, s)
+	}
+	return p
+}
+
+func binaryRow(columns []mysqlColumn, row []interface{}) ([]byte, error) {
+	nullBitmap := make([]byte, (len(columns)+7+2)/8)
+	var values []byte
+	for i, col := range columns {
+		s, ok := mysqlText(row[i], col.Type)
+		if !ok {
+			pos := i + 2
+			nullBitmap[pos/8] |= 1 << (pos % 8)
+			continue
+		}
+		switch col.Type {
+		case mysqlTypeLongLong:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				u, uerr := strconv.ParseUint(s, 10, 64)
+				if uerr != nil {
+					return nil, fmt.Errorf("column '%s': invalid integer '%s'", col.Name, s)
+				}
+				n = int64(u)
+			}
+			values = binary.LittleEndian.AppendUint64(values, uint64(n))
+		case mysqlTypeDouble:
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("column '%s': invalid number '%s'", col.Name, s)
+			}
+			values = binary.LittleEndian.AppendUint64(values, math.Float64bits(f))
+		case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp:
+			encoded, err := binaryDateTime(s)
+			if err != nil {
+				return nil, fmt.Errorf("column '%s': %v", col.Name, err)
+			}
+			values = append(values, encoded...)
+		default:
+			values = appendLenEncString(values, s)
+		}
+	}
+	p := append([]byte{0x00}, nullBitmap...)
+	return append(p, values...), nil
+}
+
+func binaryDateTime(s string) ([]byte, error) {
+	if strings.HasPrefix(s, "0000-00-00") {
+		return []byte{0}, nil
+	}
+	var t time.Time
+	var err error
+	for _, layout := range []string{"2006-01-02 15:04:05.999999", "2006-01-02"} {
+		if t, err = time.Parse(layout, s); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid date '%s'", s)
+	}
+	p := []byte{0, byte(t.Year()), byte(t.Year() >> 8), byte(t.Month()), byte(t.Day())}
+	switch {
+	case t.Nanosecond() != 0:
+		p = append(p, byte(t.Hour()), byte(t.Minute()), byte(t.Second()))
+		p = binary.LittleEndian.AppendUint32(p, uint32(t.Nanosecond()/1000))
+	case t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0:
+		p = append(p, byte(t.Hour()), byte(t.Minute()), byte(t.Second()))
+	}
+	p[0] = byte(len(p) - 1)
+	return p, nil
+}
+
+func (c *mysqlConn) prepare(query string) error {
+	toks, err := tokenizeSQL(query)
+	if err != nil {
+		return c.writeError(1064, "42000", err.Error())
+	}
+	numParams := 0
+	for _, t := range toks {
+		if t.kind == tokParam {
+			numParams++
+		}
+	}
+	if toks[0].kind == tokIdent {
+		switch strings.ToUpper(toks[0].text) {
+		case "SELECT", "INSERT", "UPDATE", "DELETE":
+			if hasKeyword(toks, "FROM") || !strings.EqualFold(toks[0].text, "SELECT") {
+				if _, err := parseSQL(query, make([]interface{}, numParams)); err != nil {
+					return c.writeError(1064, "42000", err.Error())
+				}
+			}
+		}
+	}
+
+	c.nextStmtID++
+	stmt := &mysqlStmt{id: c.nextStmtID, query: query, numParams: numParams}
+	c.stmts[stmt.id] = stmt
+
+	p := []byte{0x00}
+	p = binary.LittleEndian.AppendUint32(p, stmt.id)
+	p = append(p, 0, 0, byte(numParams), byte(numParams>>8), 0, 0, 0)
+	if err := c.writePacket(p); err != nil {
+		return err
+	}
+	if numParams > 0 {
+		for i := 0; i < numParams; i++ {
+			if err := c.writeColumnDefinition(mysqlColumn{Name: "?", Type: mysqlTypeVarString}); err != nil {
+				return err
+			}
+		}
+		return c.writeEOF()
+	}
+	return nil
+}
+
+func (c *mysqlConn) executeStmt(data []byte) error {
+	if len(data) < 9 {
+		return c.writeError(1064, "42000", "malformed COM_STMT_EXECUTE")
+	}
+	stmt, ok := c.stmts[binary.LittleEndian.Uint32(data[0:4])]
+	if !ok {
+		return c.writeError(1243, "HY000", "Unknown prepared statement handler")
+	}
+	if stmt.hasLongData {
+		return c.writeError(1235, "42000", "COM_STMT_SEND_LONG_DATA is not supported")
+	}
+	params, err := stmt.decodeParams(data[9:])
+	if err != nil {
+		return c.writeError(1210, "HY000", err.Error())
+	}
+	return c.runStatement(stmt.query, params, true)
+}
+
+// decodeParams reads the bound values of COM_STMT_EXECUTE. Types are only sent when the client
+// rebinds them, so they are remembered between executions.
+func (stmt *mysqlStmt) decodeParams(data []byte) ([]interface{}, error) {
+	n := stmt.numParams
+	if n == 0 {
+		return nil, nil
+	}
+	bitmapLen := (n + 7) / 8
+	if len(data) < bitmapLen+1 {
+		return nil, fmt.Errorf("malformed parameters")
+	}
+	nullBitmap := data[:bitmapLen]
+	data = data[bitmapLen:]
+	if data[0] == 1 {
+		data = data[1:]
+		if len(data) < 2*n {
+			return nil, fmt.Errorf("malformed parameter types")
+		}
+		stmt.paramTypes = make([]uint16, n)
+		for i := range stmt.paramTypes {
+			stmt.paramTypes[i] = binary.LittleEndian.Uint16(data[2*i:])
+		}
+		data = data[2*n:]
+	} else {
+		data = data[1:]
+	}
+	if len(stmt.paramTypes) != n {
+		return nil, fmt.Errorf("parameter types were never bound")
+	}
+
+	params := make([]interface{}, n)
+	need := func(size int) error {
+		if len(data) < size {
+			return fmt.Errorf("parameter data too short")
+		}
+		return nil
+	}
+	for i := 0; i < n; i++ {
+		if nullBitmap[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		typ := byte(stmt.paramTypes[i])
+		unsigned := stmt.paramTypes[i]&0x8000 != 0
+		switch typ {
+		case mysqlTypeNull:
+		case mysqlTypeTiny:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			if unsigned {
+				params[i] = int64(data[0])
+			} else {
+				params[i] = int64(int8(data[0]))
+			}
+			data = data[1:]
+		case mysqlTypeShort, mysqlTypeYear:
+			if err := need(2); err != nil {
+				return nil, err
+			}
+			v := binary.LittleEndian.Uint16(data)
+			if unsigned {
+				params[i] = int64(v)
+			} else {
+				params[i] = int64(int16(v))
+			}
+			data = data[2:]
+		case mysqlTypeLong, mysqlTypeInt24:
+			if err := need(4); err != nil {
+				return nil, err
+			}
+			v := binary.LittleEndian.Uint32(data)
+			if unsigned {
+				params[i] = int64(v)
+			} else {
+				params[i] = int64(int32(v))
+			}
+			data = data[4:]
+		case mysqlTypeLongLong:
+			if err := need(8); err != nil {
+				return nil, err
+			}
+			v := binary.LittleEndian.Uint64(data)
+			if unsigned {
+				params[i] = json.Number(strconv.FormatUint(v, 10))
+			} else {
+				params[i] = int64(v)
+			}
+			data = data[8:]
+		case mysqlTypeFloat:
+			if err := need(4); err != nil {
+				return nil, err
+			}
+			params[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+			data = data[4:]
+		case mysqlTypeDouble:
+			if err := need(8); err != nil {
+				return nil, err
+			}
+			params[i] = math.Float64frombits(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp, mysqlTypeTime:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			size := int(data[0])
+			if err := need(1 + size); err != nil {
+				return nil, err
+			}
+			params[i] = decodeBinaryTemporal(typ, data[1:1+size])
+			data = data[1+size:]
+		default:
+			length, size := readLenEncInt(data)
+			if size == 0 || uint64(len(data)-size) < length {
+				return nil, fmt.Errorf("parameter data too short")
+			}
+			params[i] = string(data[size : size+int(length)])
+			data = data[size+int(length):]
+		}
+	}
+	return params, nil
+}
+
+func decodeBinaryTemporal(typ byte, b []byte) string {
+	if typ == mysqlTypeTime {
+		if len(b) < 8 {
+			return "00:00:00"
+		}
+		sign := ""
+		if b[0] == 1 {
+			sign = "-"
+		}
+		hours := int(binary.LittleEndian.Uint32(b[1:5]))*24 + int(b[5])
+		s := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, b[6], b[7])
+		if len(b) >= 12 {
+			s += fmt.Sprintf(".%06d", binary.LittleEndian.Uint32(b[8:12]))
+		}
+		return s
+	}
+	if len(b) < 4 {
+		return "0000-00-00 00:00:00"
+	}
+	s := fmt.Sprintf("%04d-%02d-%02d", binary.LittleEndian.Uint16(b[0:2]), b[2], b[3])
+	if len(b) >= 7 {
+		s += fmt.Sprintf(" %02d:%02d:%02d", b[4], b[5], b[6])
+	}
+	if len(b) >= 11 {
+		s += fmt.Sprintf(".%06d", binary.LittleEndian.Uint32(b[7:11]))
+	}
+	return s
+}
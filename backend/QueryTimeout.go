@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Every API request runs under a deadline: query_timeout.default_seconds, or the
+// X-Query-Timeout-Ms header of the request, capped at query_timeout.max_seconds. Statements
+// run with the request context, so they end when the deadline passes or the client goes
+// away. The MySQL driver only drops its connection then, which leaves the statement running
+// on the server; connections are therefore opened through killingConnector, which also
+// issues KILL QUERY for it.
+
+// QueryTimeoutHeader carries the time a request may take, in milliseconds. Slaves set it to
+// what is left of their own deadline when they forward a request to the master.
+const QueryTimeoutHeader = "X-Query-Timeout-Ms"
+
+// Streams end when the client stops reading; they are not bounded by the default deadline.
+var deadlineExemptRoutes = map[string]bool{
+	"/api/cdc/stream": true,
+}
+
+type undeadlinedContextKey struct{}
+
+func queryDeadlineMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || !strings.HasPrefix(r.URL.Path, "/api/") || deadlineExemptRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeout := time.Duration(config.QueryTimeout.DefaultSeconds) * time.Second
+		if v := r.Header.Get(QueryTimeoutHeader); v != "" {
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || ms <= 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Invalid %s header: %s", QueryTimeoutHeader, v)})
+				return
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		if limit := time.Duration(config.QueryTimeout.MaxSeconds) * time.Second; timeout > limit {
+			timeout = limit
+		}
+		parent := r.Context()
+		ctx, cancel := context.WithTimeout(context.WithValue(parent, undeadlinedContextKey{}, parent), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// streamContext is the context of a streamed read. An export lasts as long as the client
+// keeps reading, so the default deadline does not apply; one the client asked for does.
+func streamContext(r *http.Request) context.Context {
+	if r.Header.Get(QueryTimeoutHeader) != "" {
+		return r.Context()
+	}
+	if parent, ok := r.Context().Value(undeadlinedContextKey{}).(context.Context); ok {
+		return parent
+	}
+	return r.Context()
+}
+
+// propagateDeadline passes what is left of ctx's deadline on to the node req is sent to, so
+// that node stops when this one gives up.
+func propagateDeadline(ctx context.Context, req *http.Request) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	ms := time.Until(deadline).Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	req.Header.Set(QueryTimeoutHeader, strconv.FormatInt(ms, 10))
+}
+
+// requestEndedError replaces the driver's error for a statement stopped because its request
+// ran out of time or was abandoned by the client.
+func requestEndedError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("query timed out and was cancelled; set the %s header, up to %d seconds, for a longer timeout",
+			QueryTimeoutHeader, config.QueryTimeout.MaxSeconds)
+	}
+	return fmt.Errorf("query cancelled: the client closed the request")
+}
+
+// requestDB is a database pool bound to the context of a request: statements run through it,
+// and transactions begun from it, carry that context.
+type requestDB struct {
+	ctx  context.Context
+	pool *sql.DB
+}
+
+func bindDB(ctx context.Context, pool *sql.DB) *requestDB {
+	return &requestDB{ctx: ctx, pool: pool}
+}
+
+func (d *requestDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.pool.ExecContext(d.ctx, query, args...)
+}
+
+func (d *requestDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.pool.QueryContext(d.ctx, query, args...)
+}
+
+func (d *requestDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return d.pool.QueryRowContext(d.ctx, query, args...)
+}
+
+// Begin starts a transaction that is rolled back if the request ends first. Its statements
+// must be run through withContext to be cancelled as well.
+func (d *requestDB) Begin() (*sql.Tx, error) {
+	return d.pool.BeginTx(d.ctx, nil)
+}
+
+type contextExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// ctxExecutor adapts a transaction or a pinned connection to sqlExecutor, running every
+// statement with ctx.
+type ctxExecutor struct {
+	ctx  context.Context
+	exec contextExecutor
+}
+
+func withContext(ctx context.Context, exec contextExecutor) ctxExecutor {
+	return ctxExecutor{ctx: ctx, exec: exec}
+}
+
+func (c ctxExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.exec.ExecContext(c.ctx, query, args...)
+}
+
+func (c ctxExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.exec.QueryContext(c.ctx, query, args...)
+}
+
+func (c ctxExecutor) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.exec.QueryRowContext(c.ctx, query, args...)
+}
+
+// Prepare prepares a statement on the transaction or connection. It must be run with
+// ExecContext or QueryContext and c's context to be cancelled with it.
+func (c ctxExecutor) Prepare(query string) (*sql.Stmt, error) {
+	return c.exec.PrepareContext(c.ctx, query)
+}
+
+// openMySQL opens a pool whose connections kill their running statement on the server when
+// its context ends.
+func openMySQL(dsn string) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(killingConnector{connector}), nil
+}
+
+// killQuery stops the statement running on a MySQL connection. It runs on the server-level
+// pool, since the connection itself is busy.
+func killQuery(connID int64, cause error) {
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", connID)); err != nil {
+		var mysqlErr *mysql.MySQLError
+		// 1094: the connection already finished and closed.
+		if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1094 {
+			log.Printf("Error killing query on MySQL connection %d: %v", connID, err)
+		}
+		return
+	}
+	log.Printf("Killed query on MySQL connection %d: %v", connID, cause)
+}
+
+type killingConnector struct {
+	driver.Connector
+}
+
+func (c killingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kc := &killingConn{conn: conn}
+	if err := kc.loadConnectionID(ctx); err != nil {
+		log.Printf("Error reading MySQL connection id, its statements cannot be killed: %v", err)
+	}
+	return kc, nil
+}
+
+// killingConn wraps a MySQL driver connection and kills its statement when the statement's
+// context ends before it does. A query is running until its rows are closed.
+type killingConn struct {
+	conn driver.Conn
+	id   int64
+}
+
+func (c *killingConn) loadConnectionID(ctx context.Context) error {
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(ctx, "SELECT CONNECTION_ID()", nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		return err
+	}
+	switch v := dest[0].(type) {
+	case int64:
+		c.id = v
+	case []byte:
+		c.id, err = strconv.ParseInt(string(v), 10, 64)
+	default:
+		err = fmt.Errorf("unexpected connection id %v", v)
+	}
+	return err
+}
+
+// watch arranges for the statement starting on the connection to be killed if ctx ends
+// first. The returned function marks the end of the statement; once it returns, no kill for
+// the statement is pending, so the connection can safely serve the next one.
+func (c *killingConn) watch(ctx context.Context) func() {
+	if c.id == 0 || ctx.Done() == nil {
+		return func() {}
+	}
+	var mu sync.Mutex
+	finished := false
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !finished {
+			killQuery(c.id, context.Cause(ctx))
+		}
+	})
+	return func() {
+		if !stop() {
+			mu.Lock()
+			finished = true
+			mu.Unlock()
+		}
+	}
+}
+
+func (c *killingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *killingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &killingStmt{stmt: stmt, conn: c}, nil
+}
+
+func (c *killingConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *killingConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *killingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *killingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	done := c.watch(ctx)
+	defer done()
+	return c.conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *killingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	done := c.watch(ctx)
+	rows, err := c.conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return &killingRows{rows: rows, done: done}, nil
+}
+
+func (c *killingConn) Ping(ctx context.Context) error {
+	return c.conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *killingConn) ResetSession(ctx context.Context) error {
+	return c.conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *killingConn) IsValid() bool {
+	return c.conn.(driver.Validator).IsValid()
+}
+
+func (c *killingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+type killingStmt struct {
+	stmt driver.Stmt
+	conn *killingConn
+}
+
+func (s *killingStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *killingStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *killingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.stmt.Exec(args)
+}
+
+func (s *killingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.stmt.Query(args)
+}
+
+func (s *killingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	done := s.conn.watch(ctx)
+	defer done()
+	return s.stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s *killingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	done := s.conn.watch(ctx)
+	rows, err := s.stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return &killingRows{rows: rows, done: done}, nil
+}
+
+func (s *killingStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	return s.stmt.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+func (s *killingStmt) ColumnConverter(idx int) driver.ValueConverter {
+	return s.stmt.(driver.ColumnConverter).ColumnConverter(idx)
+}
+
+// killingRows passes the column type information of the MySQL driver through; query
+// results are typed from it.
+type killingRows struct {
+	rows driver.Rows
+	done func()
+}
+
+func (r *killingRows) Columns() []string {
+	return r.rows.Columns()
+}
+
+func (r *killingRows) Close() error {
+	err := r.rows.Close()
+	r.done()
+	return err
+}
+
+func (r *killingRows) Next(dest []driver.Value) error {
+	return r.rows.Next(dest)
+}
+
+func (r *killingRows) HasNextResultSet() bool {
+	return r.rows.(driver.RowsNextResultSet).HasNextResultSet()
+}
+
+func (r *killingRows) NextResultSet() error {
+	return r.rows.(driver.RowsNextResultSet).NextResultSet()
+}
+
+func (r *killingRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.rows.(driver.RowsColumnTypeDatabaseTypeName).ColumnTypeDatabaseTypeName(i)
+}
+
+func (r *killingRows) ColumnTypeNullable(i int) (bool, bool) {
+	return r.rows.(driver.RowsColumnTypeNullable).ColumnTypeNullable(i)
+}
+
+func (r *killingRows) ColumnTypePrecisionScale(i int) (int64, int64, bool) {
+	return r.rows.(driver.RowsColumnTypePrecisionScale).ColumnTypePrecisionScale(i)
+}
+
+func (r *killingRows) ColumnTypeScanType(i int) reflect.Type {
+	return r.rows.(driver.RowsColumnTypeScanType).ColumnTypeScanType(i)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Admission control has two parts. Every client, identified by its API key if the key is
+// configured in rate_limit.clients or else by its IP, gets a token bucket per route; a request takes one token and is refused with 429 when the
+// bucket is empty. Independently, at most max_concurrent_db_ops API requests run at once on
+// a node; a request waits up to queue_wait_ms for a slot before it is refused.
+
+// Cluster-internal routes are never limited: throttling them could stall replication, an
+// election or a node joining.
+var rateLimitExemptRoutes = map[string]bool{
+	"/api/register":           true,
+	"/api/health":             true,
+	"/api/election":           true,
+	"/api/new-master":         true,
+	"/api/node-role":          true,
+	"/api/shutdown-slave":     true,
+	"/api/shutdown":           true,
+	"/api/slave-online":       true,
+	"/api/slave-create-table": true,
+	"/api/replicate":          true,
+	"/api/setup-replication":  true,
+	"/api/rate-limits":        true,
+}
+
+// Long-lived routes take a token but no concurrency slot, which they would hold for hours.
+var concurrencyExemptRoutes = map[string]bool{
+	"/api/cdc/stream": true,
+}
+
+type tokenBucket struct {
+	tokens   float64
+	rate     float64
+	burst    float64
+	updated  time.Time
+	lastSeen time.Time
+}
+
+// take refills the bucket for the time since its last use and takes one token. When it is
+// empty it returns how long until a token is available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated, b.lastSeen = now, now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Minute
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+type bucketKey struct {
+	client string
+	route  string
+}
+
+type routeLimitCounters struct {
+	Allowed  int64 `json:"allowed"`
+	Limited  int64 `json:"limited"`
+	Rejected int64 `json:"rejectedAtCapacity"`
+}
+
+var (
+	rateBuckets      = make(map[bucketKey]*tokenBucket)
+	rateRouteCounter = make(map[string]*routeLimitCounters)
+	rateLimitMutex   sync.Mutex
+
+	// dbSlots holds one token per API request in flight; it is sized on first use.
+	dbSlots     chan struct{}
+	dbSlotsOnce sync.Once
+	dbWaiting   int64
+)
+
+// limitFor returns the limit of a client on a route: the client's own limit if configured,
+// else the route's, else the default. Clients are configured by API key or IP alone.
+func limitFor(client, route string) RateLimit {
+	if l, ok := config.RateLimit.Clients[client[strings.Index(client, ":")+1:]]; ok {
+		return l
+	}
+	if l, ok := config.RateLimit.Routes[route]; ok {
+		return l
+	}
+	return RateLimit{RequestsPerSecond: config.RateLimit.RequestsPerSecond, Burst: config.RateLimit.Burst}
+}
+
+// rateLimitClient identifies the client of a request by its API key, or else its IP address.
+// Only keys configured in rate_limit.clients count: any other key would let a client get a
+// fresh bucket per request by sending a new key each time.
+func rateLimitClient(r *http.Request) string {
+	if key := r.Header.Get(config.RateLimit.APIKeyHeader); key != "" {
+		if _, ok := config.RateLimit.Clients[key]; ok {
+			return "key:" + key
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	if config.RateLimit.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fromClusterNode reports whether a request was forwarded by another node of the cluster:
+// it carries the forwarding header and comes from the host of a known node. The node that
+// forwarded it already admitted it.
+func fromClusterNode(r *http.Request) bool {
+	if r.Header.Get(ForwardedByHeader) == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	for _, node := range state.Nodes {
+		if node.URL == config.SelfURL {
+			continue
+		}
+		if u, err := url.Parse(node.URL); err == nil && u.Hostname() == host {
+			return true
+		}
+	}
+	return false
+}
+
+func routeCounters(route string) *routeLimitCounters {
+	c, ok := rateRouteCounter[route]
+	if !ok {
+		c = &routeLimitCounters{}
+		rateRouteCounter[route] = c
+	}
+	return c
+}
+
+func rejectRequest(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(Response{Success: false, Message: message})
+}
+
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !config.RateLimit.Enabled || r.Method == http.MethodOptions || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		if rateLimitExemptRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !fromClusterNode(r) {
+			if allowed, retryAfter := takeToken(rateLimitClient(r), route); !allowed {
+				rejectRequest(w, retryAfter, fmt.Sprintf("Rate limit exceeded for %s; retry in %s", route, retryAfter.Round(time.Millisecond)))
+				return
+			}
+		}
+
+		if concurrencyExemptRoutes[route] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !takeDBSlot(route) {
+			rejectRequest(w, time.Second, fmt.Sprintf("Server busy: %d requests already in flight", config.RateLimit.MaxConcurrentDBOps))
+			return
+		}
+		defer releaseDBSlot()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// takeToken takes a token from the bucket of client on route. When the bucket is empty it
+// returns how long until a token is available.
+func takeToken(client, route string) (bool, time.Duration) {
+	limit := limitFor(client, route)
+	now := time.Now()
+	rateLimitMutex.Lock()
+	key := bucketKey{client: client, route: route}
+	bucket, ok := rateBuckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		rateBuckets[key] = bucket
+	}
+	// Limits may have been reconfigured since the bucket was created.
+	bucket.rate, bucket.burst = limit.RequestsPerSecond, float64(limit.Burst)
+	allowed, retryAfter := bucket.take(now)
+	counters := routeCounters(route)
+	if allowed {
+		counters.Allowed++
+	} else {
+		counters.Limited++
+	}
+	rateLimitMutex.Unlock()
+	if !allowed {
+		log.Printf("Rate limit of %s on %s exceeded (%.2f/s, burst %d)", client, route, limit.RequestsPerSecond, limit.Burst)
+	}
+	return allowed, retryAfter
+}
+
+// takeDBSlot takes an in-flight slot for a request on route; the caller must give it back with
+// releaseDBSlot.
+func takeDBSlot(route string) bool {
+	if acquireDBSlot() {
+		return true
+	}
+	rateLimitMutex.Lock()
+	routeCounters(route).Rejected++
+	rateLimitMutex.Unlock()
+	log.Printf("Refused %s: %d requests already in flight", route, config.RateLimit.MaxConcurrentDBOps)
+	return false
+}
+
+func dbSlotPool() chan struct{} {
+	dbSlotsOnce.Do(func() {
+		dbSlots = make(chan struct{}, config.RateLimit.MaxConcurrentDBOps)
+	})
+	return dbSlots
+}
+
+// acquireDBSlot waits up to queue_wait_ms for an in-flight slot.
+func acquireDBSlot() bool {
+	slots := dbSlotPool()
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	rateLimitMutex.Lock()
+	dbWaiting++
+	rateLimitMutex.Unlock()
+	defer func() {
+		rateLimitMutex.Lock()
+		dbWaiting--
+		rateLimitMutex.Unlock()
+	}()
+	timer := time.NewTimer(time.Duration(config.RateLimit.QueueWaitMillis) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func releaseDBSlot() {
+	<-dbSlotPool()
+}
+
+// purgeIdleRateBuckets drops the buckets of clients not seen for ten minutes. A dropped bucket
+// comes back full, which an idle client's bucket would be by then anyway.
+func purgeIdleRateBuckets() {
+	for {
+		time.Sleep(time.Minute)
+		cutoff := time.Now().Add(-10 * time.Minute)
+		rateLimitMutex.Lock()
+		for key, bucket := range rateBuckets {
+			if bucket.lastSeen.Before(cutoff) {
+				delete(rateBuckets, key)
+			}
+		}
+		rateLimitMutex.Unlock()
+	}
+}
+
+// redactClientKey stands in for a configured client key in reports: API keys are credentials,
+// so only a prefix of their hash is shown.
+func redactClientKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// redactedRateLimitConfig is the rate limit configuration with its client keys redacted.
+func redactedRateLimitConfig() RateLimitConfig {
+	redacted := config.RateLimit
+	if len(redacted.Clients) > 0 {
+		redacted.Clients = make(map[string]RateLimit, len(config.RateLimit.Clients))
+		for key, limit := range config.RateLimit.Clients {
+			redacted.Clients[redactClientKey(key)] = limit
+		}
+	}
+	return redacted
+}
+
+type rateBucketStats struct {
+	Client string  `json:"client"`
+	Route  string  `json:"route"`
+	Tokens float64 `json:"tokens"`
+	Rate   float64 `json:"rate"`
+	Burst  float64 `json:"burst"`
+}
+
+// rateLimitsHandler reports the limiter state of this node: the configuration, the in-flight
+// requests, the counters per route and the buckets of clients, emptiest first (?limit=, 100
+// by default). Client keys are reported redacted, since the route needs no credentials.
+func rateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid limit: " + l})
+			return
+		}
+		limit = n
+	}
+
+	now := time.Now()
+	rateLimitMutex.Lock()
+	routes := make(map[string]routeLimitCounters, len(rateRouteCounter))
+	for route, c := range rateRouteCounter {
+		routes[route] = *c
+	}
+	buckets := make([]rateBucketStats, 0, len(rateBuckets))
+	for key, b := range rateBuckets {
+		client := key.client
+		if apiKey, ok := strings.CutPrefix(client, "key:"); ok {
+			client = "key:" + redactClientKey(apiKey)
+		}
+		buckets = append(buckets, rateBucketStats{
+			Client: client,
+			Route:  key.route,
+			Tokens: math.Min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.rate),
+			Rate:   b.rate,
+			Burst:  b.burst,
+		})
+	}
+	waiting := dbWaiting
+	rateLimitMutex.Unlock()
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Tokens < buckets[j].Tokens })
+	tracked := len(buckets)
+	if len(buckets) > limit {
+		buckets = buckets[:limit]
+	}
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Result: map[string]interface{}{
+			"config": redactedRateLimitConfig(),
+			"concurrency": map[string]interface{}{
+				"max":      config.RateLimit.MaxConcurrentDBOps,
+				"inFlight": len(dbSlotPool()),
+				"waiting":  waiting,
+			},
+			"routes":         routes,
+			"trackedBuckets": tracked,
+			"buckets":        buckets,
+		},
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const maxReadLimit = 10000
+
+type OrderTerm struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc,omitempty"`
+}
+
+// readPlan is the validated form of the projection and paging options of a read request.
+type readPlan struct {
+	Table  string
+	Select []string
+	Hidden map[string]bool
+	Order  []OrderTerm
+	// SortKeys maps text order columns to the alias of their collation sort key, selected
+	// when rows from several shards are merged in Go.
+	SortKeys     map[string]string
+	Keyset       bool
+	Limit        int
+	Offset       int
+	After        []interface{}
+	IncludeTotal bool
+}
+
+type readPage struct {
+	Rows       []map[string]interface{} `json:"rows"`
+	NextCursor string                   `json:"nextCursor,omitempty"`
+	Total      *int64                   `json:"total,omitempty"`
+}
+
+type readCursor struct {
+	Order  string        `json:"o"`
+	Values []interface{} `json:"v"`
+}
+
+func (req *crudRequest) wantsPage() bool {
+	return req.Limit > 0 || req.Cursor != "" || req.IncludeTotal
+}
+
+func buildReadPlan(req *crudRequest, schema *TableSchema) (*readPlan, error) {
+	plan := &readPlan{
+		Table:        schema.Table,
+		Hidden:       make(map[string]bool),
+		Limit:        req.Limit,
+		Offset:       req.Offset,
+		IncludeTotal: req.IncludeTotal,
+	}
+	if plan.Limit < 0 || plan.Offset < 0 {
+		return nil, fmt.Errorf("limit and offset must not be negative")
+	}
+	if plan.Limit > maxReadLimit && req.ShardScope == nil {
+		return nil, fmt.Errorf("limit must not exceed %d", maxReadLimit)
+	}
+	if plan.Limit == 0 && (req.Cursor != "" || plan.Offset > 0) {
+		plan.Limit = maxReadLimit
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range req.Columns {
+		col, ok := schema.Column(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown column '%s' in columns for table '%s'", name, schema.Table)
+		}
+		if !selected[col.Name] {
+			selected[col.Name] = true
+			plan.Select = append(plan.Select, col.Name)
+		}
+	}
+
+	ordered := make(map[string]bool)
+	for _, term := range req.OrderBy {
+		col, ok := schema.Column(term.Column)
+		if !ok {
+			return nil, fmt.Errorf("unknown column '%s' in orderBy for table '%s'", term.Column, schema.Table)
+		}
+		if !ordered[col.Name] {
+			ordered[col.Name] = true
+			plan.Order = append(plan.Order, OrderTerm{Column: col.Name, Desc: term.Desc})
+		}
+	}
+
+	// Keyset pagination needs a total order, so the primary key is appended as a tiebreaker.
+	var primaryKey []string
+	for _, col := range schema.Columns {
+		if col.Key == "PRI" {
+			primaryKey = append(primaryKey, col.Name)
+		}
+	}
+	if len(primaryKey) > 0 {
+		plan.Keyset = true
+		for _, name := range primaryKey {
+			if !ordered[name] {
+				ordered[name] = true
+				plan.Order = append(plan.Order, OrderTerm{Column: name})
+			}
+		}
+	}
+
+	if len(plan.Select) > 0 {
+		for _, term := range plan.Order {
+			if !selected[term.Column] {
+				selected[term.Column] = true
+				plan.Select = append(plan.Select, term.Column)
+				plan.Hidden[term.Column] = true
+			}
+		}
+	}
+
+	if req.Cursor != "" {
+		if !plan.Keyset {
+			return nil, fmt.Errorf("cursor pagination requires table '%s' to have a primary key", schema.Table)
+		}
+		after, err := decodeReadCursor(req.Cursor, plan, schema)
+		if err != nil {
+			return nil, err
+		}
+		plan.After = after
+	}
+	return plan, nil
+}
+
+func (plan *readPlan) orderSignature() string {
+	parts := make([]string, len(plan.Order))
+	for i, term := range plan.Order {
+		parts[i] = term.Column
+		if term.Desc {
+			parts[i] += " DESC"
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (plan *readPlan) selectSQL() string {
+	cols := []string{"*"}
+	if len(plan.Select) > 0 {
+		cols = make([]string, len(plan.Select))
+		for i, name := range plan.Select {
+			cols[i] = quoteIdentifier(name)
+		}
+	}
+	for _, term := range plan.Order {
+		if alias, ok := plan.SortKeys[term.Column]; ok {
+			cols = append(cols, fmt.Sprintf("HEX(WEIGHT_STRING(%s)) AS %s", quoteIdentifier(term.Column), quoteIdentifier(alias)))
+		}
+	}
+	return strings.Join(cols, ", ")
+}
+
+// addSortKeys selects a sort key for every text order column. MySQL orders text by the
+// column's collation; the hex of its weight string orders the same way byte by byte, so rows
+// read from different shards can be merged in the order each shard returned them.
+func (plan *readPlan) addSortKeys(schema *TableSchema) {
+	for _, term := range plan.Order {
+		col, _ := schema.Column(term.Column)
+		if !isTextType(col.DataType) {
+			continue
+		}
+		if plan.SortKeys == nil {
+			plan.SortKeys = make(map[string]string)
+		}
+		alias := "_sort_" + col.Name
+		plan.SortKeys[col.Name] = alias
+		plan.Hidden[alias] = true
+	}
+}
+
+// mergeOrder is the order to merge rows of several shards by: the plan's order, with text
+// columns compared by their sort keys.
+func (plan *readPlan) mergeOrder() []OrderTerm {
+	order := make([]OrderTerm, len(plan.Order))
+	for i, term := range plan.Order {
+		order[i] = term
+		if alias, ok := plan.SortKeys[term.Column]; ok {
+			order[i].Column = alias
+		}
+	}
+	return order
+}
+
+func (plan *readPlan) orderSQL() string {
+	if len(plan.Order) == 0 {
+		return ""
+	}
+	parts := make([]string, len(plan.Order))
+	for i, term := range plan.Order {
+		dir := "ASC"
+		if term.Desc {
+			dir = "DESC"
+		}
+		parts[i] = quoteIdentifier(term.Column) + " " + dir
+	}
+	return " ORDER BY " + strings.Join(parts, ", ")
+}
+
+// keysetSQL expands "rows after the cursor" into
+// (a > ?) OR (a = ? AND b > ?) OR ..., honoring each term's direction.
+func (plan *readPlan) keysetSQL() (string, []interface{}) {
+	if len(plan.After) == 0 {
+		return "", nil
+	}
+	var branches []string
+	var args []interface{}
+	for i, term := range plan.Order {
+		var conds []string
+		for j := 0; j < i; j++ {
+			conds = append(conds, quoteIdentifier(plan.Order[j].Column)+" = ?")
+			args = append(args, plan.After[j])
+		}
+		op := ">"
+		if term.Desc {
+			op = "<"
+		}
+		conds = append(conds, fmt.Sprintf("%s %s ?", quoteIdentifier(term.Column), op))
+		args = append(args, plan.After[i])
+		branches = append(branches, "("+strings.Join(conds, " AND ")+")")
+	}
+	return "(" + strings.Join(branches, " OR ") + ")", args
+}
+
+func encodeReadCursor(plan *readPlan, row map[string]interface{}) string {
+	cur := readCursor{Order: plan.orderSignature()}
+	for _, term := range plan.Order {
+		v := row[term.Column]
+		if t, ok := v.(time.Time); ok {
+			v = t.Format("2006-01-02 15:04:05.999999")
+		}
+		cur.Values = append(cur.Values, v)
+	}
+	b, err := json.Marshal(cur)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeReadCursor(token string, plan *readPlan, schema *TableSchema) ([]interface{}, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.UseNumber()
+	var cur readCursor
+	if err := dec.Decode(&cur); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if cur.Order != plan.orderSignature() || len(cur.Values) != len(plan.Order) {
+		return nil, fmt.Errorf("cursor does not match the requested ordering")
+	}
+	for i, v := range cur.Values {
+		switch val := v.(type) {
+		case json.Number:
+			cur.Values[i] = val.String()
+		case string:
+			col, _ := schema.Column(plan.Order[i].Column)
+			if isTemporalType(col.DataType) {
+				if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+					cur.Values[i] = t.Format("2006-01-02 15:04:05.999999")
+				}
+			}
+		}
+	}
+	return cur.Values, nil
+}
+
+func isTextType(dataType string) bool {
+	switch strings.ToLower(dataType) {
+	case "char", "varchar", "tinytext", "text", "mediumtext", "longtext":
+		return true
+	}
+	return false
+}
+
+func isTemporalType(dataType string) bool {
+	switch strings.ToLower(dataType) {
+	case "date", "datetime", "timestamp":
+		return true
+	}
+	return false
+}
+
+// finishPage trims the over-fetched row, emits the cursor for the next page and removes
+// columns that were only selected for ordering.
+func finishPage(plan *readPlan, rows []map[string]interface{}) *readPage {
+	page := &readPage{Rows: rows}
+	if plan.Limit > 0 && len(rows) > plan.Limit {
+		page.Rows = rows[:plan.Limit]
+		if plan.Keyset {
+			page.NextCursor = encodeReadCursor(plan, page.Rows[len(page.Rows)-1])
+		}
+	}
+	if len(plan.Hidden) > 0 {
+		for _, row := range page.Rows {
+			for col := range plan.Hidden {
+				delete(row, col)
+			}
+		}
+	}
+	if page.Rows == nil {
+		page.Rows = []map[string]interface{}{}
+	}
+	return page
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func eventsSchema() *TableSchema {
+	return testSchema("events",
+		ColumnInfo{Name: "id", DataType: "bigint", Key: "PRI"},
+		ColumnInfo{Name: "title", DataType: "varchar", ColumnType: "varchar(100)"},
+		ColumnInfo{Name: "at", DataType: "datetime"},
+		ColumnInfo{Name: "score", DataType: "decimal", ColumnType: "decimal(10,2)", Nullable: true},
+	)
+}
+
+func TestReadCursorRoundTrip(t *testing.T) {
+	schema := eventsSchema()
+	at := time.Date(2024, 3, 1, 12, 30, 0, 250000000, time.UTC)
+	tests := []struct {
+		name  string
+		order []OrderTerm
+		row   map[string]interface{}
+		want  []interface{}
+	}{
+		{
+			name:  "integer",
+			order: []OrderTerm{{Column: "id"}},
+			row:   map[string]interface{}{"id": int64(42), "title": "a"},
+			want:  []interface{}{"42"},
+		},
+		{
+			name:  "text then integer",
+			order: []OrderTerm{{Column: "title", Desc: true}, {Column: "id"}},
+			row:   map[string]interface{}{"id": int64(7), "title": "Zoë"},
+			want:  []interface{}{"Zoë", "7"},
+		},
+		{
+			name:  "datetime",
+			order: []OrderTerm{{Column: "at"}, {Column: "id"}},
+			row:   map[string]interface{}{"id": int64(1), "at": at},
+			want:  []interface{}{"2024-03-01 12:30:00.25", "1"},
+		},
+		{
+			name:  "RFC 3339 datetime",
+			order: []OrderTerm{{Column: "at"}},
+			row:   map[string]interface{}{"at": "2024-03-01T14:30:00Z"},
+			want:  []interface{}{"2024-03-01 14:30:00"},
+		},
+		{
+			name:  "exact decimal and null",
+			order: []OrderTerm{{Column: "score"}, {Column: "title"}},
+			row:   map[string]interface{}{"score": "12345678901234567.89"},
+			want:  []interface{}{"12345678901234567.89", nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := &readPlan{Table: schema.Table, Order: tt.order, Keyset: true}
+			token := encodeReadCursor(plan, tt.row)
+			if token == "" {
+				t.Fatal("empty cursor")
+			}
+			got, err := decodeReadCursor(token, plan, schema)
+			if err != nil {
+				t.Fatalf("decodeReadCursor: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("values = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeReadCursorErrors(t *testing.T) {
+	schema := eventsSchema()
+	plan := &readPlan{Table: schema.Table, Order: []OrderTerm{{Column: "id"}}, Keyset: true}
+	other := &readPlan{Table: schema.Table, Order: []OrderTerm{{Column: "id", Desc: true}}, Keyset: true}
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"not base64", "!!!", "invalid cursor"},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("nope")), "invalid cursor"},
+		{"other ordering", encodeReadCursor(other, map[string]interface{}{"id": int64(1)}), "does not match"},
+		{"wrong arity", base64.RawURLEncoding.EncodeToString([]byte(`{"o":"id","v":[1,2]}`)), "does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeReadCursor(tt.token, plan, schema)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeysetSQL(t *testing.T) {
+	tests := []struct {
+		name     string
+		order    []OrderTerm
+		after    []interface{}
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			name:    "no cursor",
+			order:   []OrderTerm{{Column: "id"}},
+			wantSQL: "",
+		},
+		{
+			name:     "single column",
+			order:    []OrderTerm{{Column: "id"}},
+			after:    []interface{}{"5"},
+			wantSQL:  "((`id` > ?))",
+			wantArgs: []interface{}{"5"},
+		},
+		{
+			name:     "mixed directions",
+			order:    []OrderTerm{{Column: "at", Desc: true}, {Column: "id"}},
+			after:    []interface{}{"2024-03-01 12:30:00", "9"},
+			wantSQL:  "((`at` < ?) OR (`at` = ? AND `id` > ?))",
+			wantArgs: []interface{}{"2024-03-01 12:30:00", "2024-03-01 12:30:00", "9"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := &readPlan{Order: tt.order, After: tt.after}
+			sql, args := plan.keysetSQL()
+			if sql != tt.wantSQL {
+				t.Errorf("sql = %s, want %s", sql, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
@@ -36,6 +36,31 @@ func replicationHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Slave (%s) received HTTP replication signal: Op=%s, DBName=%s, data_shardId=%v, FullReq: %+v",
 		config.SelfURL, operation, dbName, req["shardId"], req)
 
+	// Schema changes arrive through MySQL replication; drop what this node has cached for them.
+	switch operation {
+	case "drop_table":
+		tableName, _ := req["tableName"].(string)
+		invalidateTableSchema(dbName, tableName)
+	case "enable_versioning", "table_cache":
+		tableName, _ := req["table"].(string)
+		invalidateTableSchema(dbName, tableName)
+	case "link_tables":
+		tableName, _ := req["table2"].(string)
+		invalidateTableSchema(dbName, tableName)
+	case "migrate":
+		tableName, _ := req["table"].(string)
+		newTableName, _ := req["newTable"].(string)
+		invalidateTableSchema(dbName, tableName)
+		invalidateTableSchema(dbName, newTableName)
+		if migration, _ := req["migration"].(string); migration == "rename_table" {
+			invalidateWebhookCache()
+		}
+	case "drop_database":
+		invalidateTableSchema(dbName, "")
+		closeDBConn(dbName)
+	}
+	invalidateResultsForSignal(req)
+
 	if !shardIdOk {
 		log.Printf("Slave: Received replication signal without a valid data_shardId. Req: %+v", req)
 		json.NewEncoder(w).Encode(Response{
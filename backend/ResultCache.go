@@ -0,0 +1,371 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The result cache keeps the encoded results of reads of tables that opted in through
+// /api/table-cache, and of /api/list-tables. Entries expire after the table's TTL and are
+// dropped on every node as soon as the master signals a write or schema change to one of
+// their tables. Signals reach slaves before MySQL replication may have applied the change, so
+// the TTL also bounds how long a slave can serve a result read just before that.
+type resultCacheEntry struct {
+	key       string
+	dbName    string
+	tables    []string // nil for list-tables results, which depend on every table's schema
+	result    json.RawMessage
+	expiresAt time.Time
+}
+
+type resultCacheCounters struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Expired       int64 `json:"expired"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+type tableCacheCounters struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+var (
+	resultCache        = make(map[string]*list.Element)
+	resultCacheLRU     = list.New()
+	resultCacheBytes   int
+	resultCacheCounter resultCacheCounters
+	resultCacheTables  = make(map[string]*tableCacheCounters)
+	resultCacheMutex   sync.Mutex
+
+	// resultCacheGen counts invalidations, and resultCacheInvalidated holds the last one of each
+	// table ("db.table") and of each database's schema ("db"). A result is only stored if none
+	// of its tables was invalidated since its lookup missed, so a read racing with a write
+	// cannot cache what the write replaced.
+	resultCacheGen         uint64
+	resultCacheInvalidated = make(map[string]uint64)
+)
+
+// loadCacheTTL returns the result cache TTL a table opted into, or 0 if it is not cached.
+func loadCacheTTL(dbName, table string) (time.Duration, error) {
+	var seconds int
+	err := db.QueryRow("SELECT ttl_seconds FROM cluster.table_cache WHERE db_name = ? AND table_name = ?",
+		dbName, table).Scan(&seconds)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to load cache policy of '%s.%s': %w", dbName, table, err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// readCachePolicy returns the tables a read depends on and the TTL its result may be cached
+// for: the smallest TTL among them, or 0 when one of them has not opted in.
+func readCachePolicy(req *crudRequest, schema *TableSchema) ([]string, time.Duration) {
+	if schema.CacheTTL <= 0 || req.Stream != "" {
+		return nil, 0
+	}
+	tables := []string{req.Table}
+	ttl := schema.CacheTTL
+	for _, inc := range req.Include {
+		for _, t := range []string{inc.Table, inc.Via} {
+			if t == "" {
+				continue
+			}
+			related, err := loadTableSchema(req.DBName, SanitizeIdentifier(t))
+			if err != nil || related.CacheTTL <= 0 {
+				return nil, 0
+			}
+			if related.CacheTTL < ttl {
+				ttl = related.CacheTTL
+			}
+			tables = append(tables, related.Table)
+		}
+	}
+	return tables, ttl
+}
+
+// resultCacheKey identifies a read by everything that shapes its result. Maps are encoded with
+// sorted keys, so equal requests give equal keys.
+func resultCacheKey(kind string, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return kind + ":" + string(b)
+}
+
+// getCachedResult returns the live entry for key, counting the lookup under counterName. On a
+// miss it returns the generation to pass to putCachedResult.
+func getCachedResult(key, counterName string) (json.RawMessage, uint64, bool) {
+	resultCacheMutex.Lock()
+	defer resultCacheMutex.Unlock()
+	counters := resultCacheTableCounters(counterName)
+	el, ok := resultCache[key]
+	if ok {
+		entry := el.Value.(*resultCacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			resultCacheLRU.MoveToFront(el)
+			resultCacheCounter.Hits++
+			counters.Hits++
+			return entry.result, 0, true
+		}
+		removeResult(entry)
+		resultCacheCounter.Expired++
+	}
+	resultCacheCounter.Misses++
+	counters.Misses++
+	return nil, resultCacheGen, false
+}
+
+// resultCacheTableCounters returns the counters of a table. resultCacheMutex must be held.
+func resultCacheTableCounters(name string) *tableCacheCounters {
+	c, ok := resultCacheTables[name]
+	if !ok {
+		c = &tableCacheCounters{}
+		resultCacheTables[name] = c
+	}
+	return c
+}
+
+// putCachedResult stores the encoded result of a read, evicting the least recently used
+// entries while the cache is over its entry or byte limit.
+func putCachedResult(key, dbName string, tables []string, result interface{}, ttl time.Duration, gen uint64) json.RawMessage {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return nil
+	}
+	if len(encoded) > config.ResultCache.MaxBytes/4 {
+		// Results this large would push out most of the cache.
+		return encoded
+	}
+	resultCacheMutex.Lock()
+	defer resultCacheMutex.Unlock()
+	if resultCacheInvalidated[dbName] > gen {
+		return encoded
+	}
+	for _, t := range tables {
+		if resultCacheInvalidated[dbName+"."+t] > gen {
+			return encoded
+		}
+	}
+	if el, ok := resultCache[key]; ok {
+		removeResult(el.Value.(*resultCacheEntry))
+	}
+	entry := &resultCacheEntry{key: key, dbName: dbName, tables: tables, result: encoded, expiresAt: time.Now().Add(ttl)}
+	resultCache[key] = resultCacheLRU.PushFront(entry)
+	resultCacheBytes += len(encoded)
+	for resultCacheLRU.Len() > config.ResultCache.MaxEntries || resultCacheBytes > config.ResultCache.MaxBytes {
+		removeResult(resultCacheLRU.Back().Value.(*resultCacheEntry))
+		resultCacheCounter.Evictions++
+	}
+	return encoded
+}
+
+// removeResult drops an entry. resultCacheMutex must be held.
+func removeResult(entry *resultCacheEntry) {
+	if el, ok := resultCache[entry.key]; ok {
+		resultCacheLRU.Remove(el)
+		delete(resultCache, entry.key)
+		resultCacheBytes -= len(entry.result)
+	}
+}
+
+// invalidateResults drops the entries of a database that depend on any of tables. Schema
+// changes also drop the database's list-tables results; an empty tables list with ddl set
+// drops every entry of the database.
+func invalidateResults(dbName string, tables []string, ddl bool) {
+	changed := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		changed[t] = true
+	}
+	resultCacheMutex.Lock()
+	defer resultCacheMutex.Unlock()
+	resultCacheGen++
+	for t := range changed {
+		resultCacheInvalidated[dbName+"."+t] = resultCacheGen
+	}
+	if ddl {
+		resultCacheInvalidated[dbName] = resultCacheGen
+	}
+	n := 0
+	for _, el := range resultCache {
+		entry := el.Value.(*resultCacheEntry)
+		if entry.dbName != dbName {
+			continue
+		}
+		drop := ddl && (entry.tables == nil || len(tables) == 0)
+		for _, t := range entry.tables {
+			if changed[t] {
+				drop = true
+			}
+		}
+		if drop {
+			removeResult(entry)
+			n++
+		}
+	}
+	resultCacheCounter.Invalidations += int64(n)
+}
+
+// invalidateResultsForSignal applies a replication signal to the result cache. The master
+// calls it for every signal it sends, and slaves for every signal they receive.
+func invalidateResultsForSignal(signal map[string]interface{}) {
+	dbName, _ := signal["dbName"].(string)
+	if dbName == "" {
+		return
+	}
+	str := func(key string) []string {
+		if s, _ := signal[key].(string); s != "" {
+			return []string{s}
+		}
+		return nil
+	}
+	switch operation, _ := signal["operation"].(string); operation {
+	case "create", "update", "delete", "upsert", "batch", "expire":
+		invalidateResults(dbName, str("table"), false)
+	case "transaction", "distributed_transaction":
+		var tables []string
+		switch ops := signal["operations"].(type) {
+		case []txOperation:
+			for _, op := range ops {
+				tables = append(tables, op.Table)
+			}
+		case []interface{}:
+			for _, op := range ops {
+				if m, ok := op.(map[string]interface{}); ok {
+					if t, _ := m["table"].(string); t != "" {
+						tables = append(tables, t)
+					}
+				}
+			}
+		}
+		invalidateResults(dbName, tables, false)
+	case "drop_table":
+		invalidateResults(dbName, str("tableName"), true)
+	case "link_tables":
+		invalidateResults(dbName, append(str("table1"), str("table2")...), true)
+	case "create_table", "enable_versioning", "table_cache":
+		invalidateResults(dbName, str("table"), true)
+	case "migrate":
+		invalidateResults(dbName, append(str("table"), str("newTable")...), true)
+	case "drop_database":
+		invalidateResults(dbName, nil, true)
+	}
+}
+
+// tableCacheHandler opts a table into the result cache, or out of it with a ttlSeconds of 0.
+func tableCacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	if currentRole == RoleSlave {
+		log.Println("Slave node received tableCache request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		DBName     string `json:"dbName"`
+		Table      string `json:"table"`
+		TTLSeconds int    `json:"ttlSeconds"`
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request body: " + err.Error()})
+		return
+	}
+	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request: " + err.Error()})
+		return
+	}
+	if req.DBName == "" || req.Table == "" {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "DB name and table required"})
+		return
+	}
+	if req.TTLSeconds < 0 || req.TTLSeconds > 24*60*60 {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "ttlSeconds must be between 0 and 86400"})
+		return
+	}
+
+	safeDBName := SanitizeIdentifier(req.DBName)
+	safeTable := SanitizeIdentifier(req.Table)
+	if _, err := loadTableSchema(safeDBName, safeTable); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error loading table schema: " + err.Error()})
+		return
+	}
+
+	if req.TTLSeconds == 0 {
+		_, err = db.Exec("DELETE FROM cluster.table_cache WHERE db_name = ? AND table_name = ?", safeDBName, safeTable)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO cluster.table_cache (db_name, table_name, ttl_seconds, created_at)
+			VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE ttl_seconds = VALUES(ttl_seconds)`,
+			safeDBName, safeTable, req.TTLSeconds, time.Now())
+	}
+	if err != nil {
+		log.Printf("Error recording cache policy of '%s.%s' on master: %v", safeDBName, safeTable, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error recording cache policy: " + err.Error()})
+		return
+	}
+	log.Printf("Table '%s.%s' result cache TTL set to %ds.", safeDBName, safeTable, req.TTLSeconds)
+	invalidateTableSchema(safeDBName, safeTable)
+
+	shardID := calculateShardID(safeDBName + "." + safeTable)
+	replicateToNodes(map[string]interface{}{
+		"operation":  "table_cache",
+		"dbName":     safeDBName,
+		"table":      safeTable,
+		"ttlSeconds": float64(req.TTLSeconds),
+		"shardId":    float64(shardID),
+	})
+
+	message := fmt.Sprintf("Reads of table '%s' are cached for %d seconds", safeTable, req.TTLSeconds)
+	if req.TTLSeconds == 0 {
+		message = fmt.Sprintf("Reads of table '%s' are no longer cached", safeTable)
+	}
+	json.NewEncoder(w).Encode(Response{Success: true, Message: message})
+}
+
+// cacheStatsHandler reports the result cache counters of this node, overall and per table.
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	resultCacheMutex.Lock()
+	counters := resultCacheCounter
+	entries, bytes := resultCacheLRU.Len(), resultCacheBytes
+	names := make([]string, 0, len(resultCacheTables))
+	for name := range resultCacheTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tables := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		c := resultCacheTables[name]
+		tables = append(tables, map[string]interface{}{"table": name, "hits": c.Hits, "misses": c.Misses})
+	}
+	resultCacheMutex.Unlock()
+
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Result: map[string]interface{}{
+			"entries":    entries,
+			"bytes":      bytes,
+			"maxEntries": config.ResultCache.MaxEntries,
+			"maxBytes":   config.ResultCache.MaxBytes,
+			"counters":   counters,
+			"tables":     tables,
+		},
+	})
+}
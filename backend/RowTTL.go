@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ttlPolicy expires the rows of a table once their TTL column is older than the retention
+// period. The master deletes them in the background; the last-run statistics are stored with
+// the policy in cluster.table_ttl.
+type ttlPolicy struct {
+	DBName           string     `json:"dbName"`
+	Table            string     `json:"table"`
+	Column           string     `json:"column"`
+	RetentionSeconds int64      `json:"retentionSeconds"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	LastRunAt        *time.Time `json:"lastRunAt,omitempty"`
+	LastDeleted      int64      `json:"lastDeleted"`
+	LastDurationMs   int64      `json:"lastDurationMs"`
+	LastError        string     `json:"lastError,omitempty"`
+	TotalDeleted     int64      `json:"totalDeleted"`
+}
+
+func loadTTLPolicies(dbName string) ([]ttlPolicy, error) {
+	query := `
+		SELECT db_name, table_name, ttl_column, retention_seconds, created_at,
+			last_run_at, last_deleted, last_duration_ms, last_error, total_deleted
+		FROM cluster.table_ttl`
+	var args []interface{}
+	if dbName != "" {
+		query += " WHERE db_name = ?"
+		args = append(args, dbName)
+	}
+	query += " ORDER BY db_name, table_name"
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TTL policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []ttlPolicy
+	for rows.Next() {
+		var p ttlPolicy
+		var lastRun sql.NullTime
+		var lastError sql.NullString
+		if err := rows.Scan(&p.DBName, &p.Table, &p.Column, &p.RetentionSeconds, &p.CreatedAt,
+			&lastRun, &p.LastDeleted, &p.LastDurationMs, &lastError, &p.TotalDeleted); err != nil {
+			return nil, fmt.Errorf("failed to scan TTL policy: %w", err)
+		}
+		if lastRun.Valid {
+			p.LastRunAt = &lastRun.Time
+		}
+		p.LastError = lastError.String
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// expireRowsLoop runs the TTL policies on the master every row_ttl.interval_seconds.
+func expireRowsLoop() {
+	for {
+		time.Sleep(time.Duration(config.RowTTL.IntervalSeconds) * time.Second)
+		if currentRole != RoleMaster || db == nil {
+			continue
+		}
+		policies, err := loadTTLPolicies("")
+		if err != nil {
+			log.Printf("Error loading TTL policies: %v", err)
+			continue
+		}
+		for _, p := range policies {
+			expireRows(p)
+		}
+	}
+}
+
+// expireRows deletes the expired rows of one table, batch_size rows per statement with a
+// pause of batch_pause_ms between statements, so that expiry does not starve regular
+// traffic. A run stops after max_batches_per_run; the rest is left for the next run.
+// Expired rows are captured as deletes when change data capture is enabled.
+func expireRows(p ttlPolicy) {
+	started := time.Now()
+	condition := fmt.Sprintf("%s < ? ORDER BY %s LIMIT %d",
+		quoteIdentifier(p.Column), quoteIdentifier(p.Column), config.RowTTL.BatchSize)
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s", quoteIdentifier(p.Table), condition)
+
+	var deleted int64
+	var runErr error
+	var schema *TableSchema
+	// The cutoff is taken from the server once per run, in the session's time zone, so it
+	// compares with DATETIME and TIMESTAMP columns as NOW() would, and the rows captured and
+	// the rows deleted by each batch agree on it.
+	var cutoff string
+	dbConn, release, err := getDBConn(p.DBName)
+	if err != nil {
+		runErr = err
+	} else {
+		defer release()
+		schema, runErr = loadTableSchema(p.DBName, p.Table)
+	}
+	if runErr == nil {
+		runErr = dbConn.QueryRow("SELECT CAST(NOW(6) - INTERVAL ? SECOND AS CHAR)", p.RetentionSeconds).Scan(&cutoff)
+	}
+	for batch := 0; runErr == nil && batch < config.RowTTL.MaxBatchesPerRun; batch++ {
+		if currentRole != RoleMaster {
+			break
+		}
+		if batch > 0 {
+			time.Sleep(time.Duration(config.RowTTL.BatchPauseMillis) * time.Millisecond)
+		}
+		spec := changeSpec{Operation: "delete", WhereSQL: condition, WhereArgs: []interface{}{cutoff}}
+		signal := map[string]interface{}{
+			"operation": "expire",
+			"dbName":    p.DBName,
+			"table":     p.Table,
+			"column":    p.Column,
+			"before":    cutoff,
+			"shardId":   float64(calculateShardID(p.DBName + "." + p.Table)),
+		}
+		var n int64
+		_, err := writeWithCapture(bindDB(context.Background(), dbConn), schema, spec, signal, func(exec sqlExecutor) (interface{}, error) {
+			res, err := cachedExec(exec, p.Table, query, cutoff)
+			if err != nil {
+				return nil, err
+			}
+			n, _ = res.RowsAffected()
+			signal["rows"] = float64(n)
+			return res, nil
+		})
+		if err != nil {
+			runErr = err
+			break
+		}
+		if n == 0 {
+			break
+		}
+		deleted += n
+		replicateToNodes(signal)
+		if n < int64(config.RowTTL.BatchSize) {
+			break
+		}
+	}
+
+	var lastError interface{}
+	if runErr != nil {
+		log.Printf("Error expiring rows of '%s.%s': %v", p.DBName, p.Table, runErr)
+		lastError = runErr.Error()
+	} else if deleted > 0 {
+		log.Printf("Expired %d rows of '%s.%s' older than %s", deleted, p.DBName, p.Table, cutoff)
+	}
+	_, err = db.Exec(`
+		UPDATE cluster.table_ttl
+		SET last_run_at = ?, last_deleted = ?, last_duration_ms = ?, last_error = ?, total_deleted = total_deleted + ?
+		WHERE db_name = ? AND table_name = ?`,
+		started, deleted, time.Since(started).Milliseconds(), lastError, deleted, p.DBName, p.Table)
+	if err != nil {
+		log.Printf("Error recording TTL run of '%s.%s': %v", p.DBName, p.Table, err)
+	}
+}
+
+// tableTTLHandler sets the TTL policy of a table, or removes it with a retentionSeconds of 0.
+func tableTTLHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	if currentRole == RoleSlave {
+		log.Println("Slave node received tableTTL request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		DBName           string `json:"dbName"`
+		Table            string `json:"table"`
+		Column           string `json:"column"`
+		RetentionSeconds int64  `json:"retentionSeconds"`
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request body: " + err.Error()})
+		return
+	}
+	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request: " + err.Error()})
+		return
+	}
+	if req.DBName == "" || req.Table == "" {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "DB name and table required"})
+		return
+	}
+	if req.RetentionSeconds < 0 {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "retentionSeconds must not be negative"})
+		return
+	}
+
+	safeDBName := SanitizeIdentifier(req.DBName)
+	safeTable := SanitizeIdentifier(req.Table)
+	schema, err := loadTableSchema(safeDBName, safeTable)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error loading table schema: " + err.Error()})
+		return
+	}
+
+	var message string
+	if req.RetentionSeconds == 0 {
+		_, err = db.Exec("DELETE FROM cluster.table_ttl WHERE db_name = ? AND table_name = ?", safeDBName, safeTable)
+		message = fmt.Sprintf("Rows of table '%s' no longer expire", safeTable)
+	} else {
+		col, ok := schema.Column(req.Column)
+		if !ok {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Unknown column '%s'", req.Column)})
+			return
+		}
+		switch col.DataType {
+		case "date", "datetime", "timestamp":
+		default:
+			json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Column '%s' has type %s; a TTL column must be a date, datetime or timestamp", col.Name, col.DataType)})
+			return
+		}
+		_, err = db.Exec(`
+			INSERT INTO cluster.table_ttl (db_name, table_name, ttl_column, retention_seconds, created_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE ttl_column = VALUES(ttl_column), retention_seconds = VALUES(retention_seconds)`,
+			safeDBName, safeTable, col.Name, req.RetentionSeconds, time.Now())
+		message = fmt.Sprintf("Rows of table '%s' expire %d seconds after their '%s'", safeTable, req.RetentionSeconds, col.Name)
+	}
+	if err != nil {
+		log.Printf("Error recording TTL policy of '%s.%s' on master: %v", safeDBName, safeTable, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error recording TTL policy: " + err.Error()})
+		return
+	}
+	log.Printf("TTL policy of '%s.%s' updated: %s", safeDBName, safeTable, message)
+	json.NewEncoder(w).Encode(Response{Success: true, Message: message})
+}
+
+// listTTLPoliciesHandler returns the TTL policies, of one database with ?db=, and the
+// statistics of their last run.
+func listTTLPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	policies, err := loadTTLPolicies(SanitizeIdentifier(r.URL.Query().Get("db")))
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+		return
+	}
+	if policies == nil {
+		policies = []ttlPolicy{}
+	}
+	json.NewEncoder(w).Encode(Response{Success: true, Result: policies})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type sqlRequest struct {
+	DBName string        `json:"dbName"`
+	SQL    string        `json:"sql"`
+	Params []interface{} `json:"params,omitempty"`
+	Stream string        `json:"stream,omitempty"`
+}
+
+// sqlHandler accepts one SQL statement, lowers it to a CRUD request and hands it to the CRUD
+// handler, which routes it by shard key, scatters it, or forwards it to the master.
+func sqlHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	var req sqlRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request body: " + err.Error()})
+		return
+	}
+	if err := decodeJSONNumbers(bodyBytes, &req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request format: " + err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.SQL) == "" {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "sql required"})
+		return
+	}
+
+	stmt, err := parseSQL(req.SQL, req.Params)
+	if err != nil {
+		log.Printf("Rejected SQL statement: %v", err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid SQL: " + err.Error()})
+		return
+	}
+	if stmt.DBName == "" {
+		stmt.DBName = req.DBName
+	}
+	if stmt.DBName == "" {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "dbName required, or qualify the table as db.table"})
+		return
+	}
+
+	if stmt.Operation == "upsert" {
+		stmt.ConflictColumns, err = inferConflictColumns(SanitizeIdentifier(stmt.DBName), SanitizeIdentifier(stmt.Table), stmt.Data)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid SQL: " + err.Error()})
+			return
+		}
+	}
+
+	if req.Stream != "" {
+		stmt.Stream = req.Stream
+	}
+
+	log.Printf("SQL statement lowered to %s on '%s.%s'", stmt.Operation, stmt.DBName, stmt.Table)
+	dispatchCrud(w, r, stmt)
+}
+
+// dispatchCrud runs a CRUD request as if it had been posted to /api/crud, so that it takes the
+// same routing, forwarding and idempotency path.
+func dispatchCrud(w http.ResponseWriter, r *http.Request, req *crudRequest) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error encoding request: " + err.Error()})
+		return
+	}
+	inner, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "/api/crud", bytes.NewReader(body))
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error building request: " + err.Error()})
+		return
+	}
+	for name, headers := range r.Header {
+		for _, h := range headers {
+			inner.Header.Add(name, h)
+		}
+	}
+	inner.Header.Set("Content-Type", "application/json")
+	idempotent(crudHandler)(w, inner)
+}
+
+// inferConflictColumns picks the key an INSERT ... ON DUPLICATE KEY UPDATE collides on: the
+// primary key if all its columns are inserted, otherwise the only fully inserted unique key.
+func inferConflictColumns(dbName, table string, data map[string]interface{}) ([]string, error) {
+	uniqueKeys, err := loadUniqueKeys(dbName, table)
+	if err != nil {
+		return nil, err
+	}
+	covered := func(cols []string) bool {
+		for _, c := range cols {
+			found := false
+			for k := range data {
+				if strings.EqualFold(k, c) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+	if cols, ok := uniqueKeys["PRIMARY"]; ok && covered(cols) {
+		return cols, nil
+	}
+	var candidates []string
+	for name, cols := range uniqueKeys {
+		if name != "PRIMARY" && covered(cols) {
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Strings(candidates)
+	switch len(candidates) {
+	case 0:
+		return nil, fmt.Errorf("ON DUPLICATE KEY UPDATE requires the inserted columns to cover the primary key or a unique key")
+	case 1:
+		return uniqueKeys[candidates[0]], nil
+	}
+	return nil, fmt.Errorf("ON DUPLICATE KEY UPDATE is ambiguous: the inserted columns cover unique keys %s", strings.Join(candidates, ", "))
+}
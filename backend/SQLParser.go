@@ -0,0 +1,924 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The SQL front end accepts a single SELECT, INSERT, UPDATE or DELETE statement on one table
+// and lowers it to the crudRequest that /api/crud would receive, so that SQL goes through the
+// same validation, shard routing and master/slave rules as JSON requests.
+//
+// Supported forms:
+//
+//	SELECT * | col [AS a], FUNC(col|*) [AS a], ... FROM t [WHERE cond] [GROUP BY cols]
+//	    [HAVING cond] [ORDER BY col [ASC|DESC], ...] [LIMIT n [OFFSET m] | LIMIT m, n]
+//	INSERT INTO t (cols) VALUES (...), ... [ON DUPLICATE KEY UPDATE col = VALUES(col), ...]
+//	UPDATE t SET col = value, ... WHERE cond
+//	DELETE FROM t WHERE cond
+//
+// Conditions combine comparisons, [NOT] IN, [NOT] BETWEEN, [NOT] LIKE and IS [NOT] NULL with
+// AND, OR, NOT and parentheses. Values are literals or ? placeholders bound from params.
+
+type sqlTokenKind int
+
+const (
+	tokEOF sqlTokenKind = iota
+	tokIdent
+	tokQuotedIdent
+	tokNumber
+	tokString
+	tokSymbol
+	tokParam
+)
+
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	pos  int
+}
+
+var sqlDDLKeywords = map[string]bool{
+	"CREATE": true, "DROP": true, "ALTER": true, "TRUNCATE": true, "RENAME": true,
+	"GRANT": true, "REVOKE": true, "LOCK": true, "UNLOCK": true, "SET": true, "USE": true,
+	"CALL": true, "LOAD": true, "REPLACE": true, "HANDLER": true, "FLUSH": true, "KILL": true,
+}
+
+var sqlReservedWords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "AND": true, "OR": true, "NOT": true, "IN": true,
+	"BETWEEN": true, "LIKE": true, "IS": true, "NULL": true, "GROUP": true, "BY": true, "HAVING": true,
+	"ORDER": true, "LIMIT": true, "OFFSET": true, "AS": true, "INSERT": true, "INTO": true,
+	"VALUES": true, "UPDATE": true, "SET": true, "DELETE": true, "ON": true, "TRUE": true, "FALSE": true,
+}
+
+func tokenizeSQL(input string) ([]sqlToken, error) {
+	var toks []sqlToken
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-', r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			end := strings.Index(string(runes[i+2:]), "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at position %d", i)
+			}
+			i += 2 + len([]rune(string(runes[i+2:])[:end])) + 2
+		case r == '`':
+			start := i
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated identifier at position %d", start)
+				}
+				if runes[i] == '`' {
+					if i+1 < len(runes) && runes[i+1] == '`' {
+						b.WriteRune('`')
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteRune(runes[i])
+			}
+			toks = append(toks, sqlToken{kind: tokQuotedIdent, text: b.String(), pos: start})
+		case r == '\'' || r == '"':
+			start := i
+			quote := r
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				c := runes[i]
+				if c == '\\' && i+1 < len(runes) {
+					i++
+					switch runes[i] {
+					case 'n':
+						b.WriteRune('\n')
+					case 't':
+						b.WriteRune('\t')
+					case 'r':
+						b.WriteRune('\r')
+					case '0':
+						b.WriteRune(0)
+					default:
+						b.WriteRune(runes[i])
+					}
+					continue
+				}
+				if c == quote {
+					if i+1 < len(runes) && runes[i+1] == quote {
+						b.WriteRune(quote)
+						i++
+						continue
+					}
+					i++
+					break
+				}
+				b.WriteRune(c)
+			}
+			toks = append(toks, sqlToken{kind: tokString, text: b.String(), pos: start})
+		case isASCIIDigit(r) || (r == '.' && i+1 < len(runes) && isASCIIDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (isASCIIDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				i++
+				if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+					i++
+				}
+				for i < len(runes) && isASCIIDigit(runes[i]) {
+					i++
+				}
+			}
+			toks = append(toks, sqlToken{kind: tokNumber, text: string(runes[start:i]), pos: start})
+		case unicode.IsLetter(r) || r == '_' || r == '$':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '$') {
+				i++
+			}
+			toks = append(toks, sqlToken{kind: tokIdent, text: string(runes[start:i]), pos: start})
+		case r == '?':
+			toks = append(toks, sqlToken{kind: tokParam, text: "?", pos: i})
+			i++
+		default:
+			start := i
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "<=", ">=", "<>", "!=":
+				toks = append(toks, sqlToken{kind: tokSymbol, text: two, pos: start})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune("=<>(),.*;-+@", r) {
+				return nil, fmt.Errorf("unexpected character '%c' at position %d", r, i)
+			}
+			toks = append(toks, sqlToken{kind: tokSymbol, text: string(r), pos: start})
+			i++
+		}
+	}
+	return append(toks, sqlToken{kind: tokEOF, pos: len(runes)}), nil
+}
+
+type sqlParser struct {
+	toks     []sqlToken
+	pos      int
+	params   []interface{}
+	paramIdx int
+
+	// resolveCall maps an aggregate call in HAVING or ORDER BY to the alias of the matching
+	// select item.
+	resolveCall func(fn, column string) (string, error)
+}
+
+// parseSQL lowers one statement to a crudRequest. DBName is only set when the table is
+// qualified with a database name.
+func parseSQL(input string, params []interface{}) (*crudRequest, error) {
+	toks, err := tokenizeSQL(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{toks: toks, params: params}
+	if p.peek().kind == tokEOF {
+		return nil, fmt.Errorf("empty statement")
+	}
+
+	var stmt *crudRequest
+	head := strings.ToUpper(p.peek().text)
+	switch {
+	case p.peek().kind != tokIdent:
+		return nil, p.errorf("expected a statement")
+	case head == "SELECT":
+		stmt, err = p.parseSelect()
+	case head == "INSERT":
+		stmt, err = p.parseInsert()
+	case head == "UPDATE":
+		stmt, err = p.parseUpdate()
+	case head == "DELETE":
+		stmt, err = p.parseDelete()
+	case sqlDDLKeywords[head]:
+		return nil, fmt.Errorf("%s statements are not allowed; only SELECT, INSERT, UPDATE and DELETE are supported", head)
+	default:
+		return nil, fmt.Errorf("unsupported statement '%s'; only SELECT, INSERT, UPDATE and DELETE are supported", p.peek().text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.acceptSymbol(";") {
+		if p.peek().kind != tokEOF {
+			return nil, fmt.Errorf("multiple statements are not allowed")
+		}
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected '%s'", p.peek().text)
+	}
+	if p.paramIdx != len(p.params) {
+		return nil, fmt.Errorf("statement has %d placeholders but %d params were given", p.paramIdx, len(p.params))
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.toks[p.pos]
+}
+
+func (p *sqlParser) next() sqlToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *sqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at position %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+func (p *sqlParser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, kw)
+}
+
+func (p *sqlParser) acceptKeyword(kws ...string) bool {
+	save := p.pos
+	for _, kw := range kws {
+		if !p.isKeyword(kw) {
+			p.pos = save
+			return false
+		}
+		p.pos++
+	}
+	return true
+}
+
+func (p *sqlParser) expectKeyword(kws ...string) error {
+	if !p.acceptKeyword(kws...) {
+		return p.errorf("expected %s", strings.Join(kws, " "))
+	}
+	return nil
+}
+
+func (p *sqlParser) acceptSymbol(s string) bool {
+	t := p.peek()
+	if t.kind == tokSymbol && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectSymbol(s string) error {
+	if !p.acceptSymbol(s) {
+		return p.errorf("expected '%s'", s)
+	}
+	return nil
+}
+
+func (p *sqlParser) parseIdent() (string, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokQuotedIdent:
+		p.pos++
+		return t.text, nil
+	case t.kind == tokIdent && !sqlReservedWords[strings.ToUpper(t.text)]:
+		p.pos++
+		return t.text, nil
+	}
+	return "", p.errorf("expected an identifier")
+}
+
+// parseColumnRef accepts col or table.col; the qualifier must name the statement's table.
+func (p *sqlParser) parseColumnRef(table string) (string, error) {
+	name, err := p.parseIdent()
+	if err != nil {
+		return "", err
+	}
+	if p.acceptSymbol(".") {
+		if table != "" && !strings.EqualFold(name, table) {
+			return "", fmt.Errorf("column qualifier '%s' does not match table '%s'", name, table)
+		}
+		return p.parseIdent()
+	}
+	return name, nil
+}
+
+func (p *sqlParser) parseTableRef(req *crudRequest) error {
+	name, err := p.parseIdent()
+	if err != nil {
+		return err
+	}
+	if p.acceptSymbol(".") {
+		req.DBName = name
+		if name, err = p.parseIdent(); err != nil {
+			return err
+		}
+	}
+	req.Table = name
+	return nil
+}
+
+func (p *sqlParser) parseValue() (interface{}, error) {
+	save := p.pos
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return sqlNumber(t)
+	case tokString:
+		return t.text, nil
+	case tokParam:
+		if p.paramIdx >= len(p.params) {
+			return nil, fmt.Errorf("not enough params for the placeholders in the statement")
+		}
+		v := p.params[p.paramIdx]
+		p.paramIdx++
+		return v, nil
+	case tokSymbol:
+		if t.text == "-" || t.text == "+" {
+			n := p.next()
+			if n.kind != tokNumber {
+				return nil, fmt.Errorf("syntax error at position %d: expected a number", n.pos)
+			}
+			v, err := sqlNumber(n)
+			if err != nil || t.text == "+" {
+				return v, err
+			}
+			return json.Number("-" + string(v)), nil
+		}
+	case tokIdent:
+		switch strings.ToUpper(t.text) {
+		case "NULL":
+			return nil, nil
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		}
+	}
+	p.pos = save
+	return nil, p.errorf("expected a value")
+}
+
+func isASCIIDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// sqlNumber turns a numeric literal into the JSON number it is sent as, keeping its digits
+// exactly: SQL allows forms such as .5, 5. and 007 that JSON does not.
+func sqlNumber(t sqlToken) (json.Number, error) {
+	mantissa, exponent := t.text, ""
+	if i := strings.IndexAny(mantissa, "eE"); i >= 0 {
+		mantissa, exponent = mantissa[:i], mantissa[i:]
+	}
+	intPart, fracPart, hasPoint := strings.Cut(mantissa, ".")
+	if strings.Contains(fracPart, ".") || (exponent != "" && strings.TrimLeft(exponent[1:], "+-") == "") {
+		return "", fmt.Errorf("syntax error at position %d: invalid number '%s'", t.pos, t.text)
+	}
+	intPart = strings.TrimLeft(intPart, "0")
+	if intPart == "" {
+		intPart = "0"
+	}
+	text := intPart
+	if hasPoint && fracPart != "" {
+		text += "." + fracPart
+	}
+	return json.Number(text + exponent), nil
+}
+
+func (p *sqlParser) parseValueList() ([]interface{}, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var values []interface{}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	return values, p.expectSymbol(")")
+}
+
+// parseCondition parses an OR of ANDs of predicates into a Filter.
+func (p *sqlParser) parseCondition(table string) (*Filter, error) {
+	left, err := p.parseAnd(table)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("OR") {
+		return left, nil
+	}
+	f := &Filter{Or: []Filter{*left}}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd(table)
+		if err != nil {
+			return nil, err
+		}
+		f.Or = append(f.Or, *right)
+	}
+	return f, nil
+}
+
+func (p *sqlParser) parseAnd(table string) (*Filter, error) {
+	left, err := p.parseNot(table)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isKeyword("AND") {
+		return left, nil
+	}
+	f := &Filter{And: []Filter{*left}}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot(table)
+		if err != nil {
+			return nil, err
+		}
+		f.And = append(f.And, *right)
+	}
+	return f, nil
+}
+
+func (p *sqlParser) parseNot(table string) (*Filter, error) {
+	if p.acceptKeyword("NOT") {
+		inner, err := p.parseNot(table)
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{Not: inner}, nil
+	}
+	if p.acceptSymbol("(") {
+		inner, err := p.parseCondition(table)
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expectSymbol(")")
+	}
+	return p.parsePredicate(table)
+}
+
+var flippedOps = map[string]string{"=": "=", "<>": "<>", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// parseOperand reads a column reference, or an aggregate call when resolveCall is set.
+func (p *sqlParser) parseOperand(table string) (string, error) {
+	if p.resolveCall != nil && p.peek().kind == tokIdent && aggregateFuncs[strings.ToUpper(p.peek().text)] &&
+		p.toks[p.pos+1].kind == tokSymbol && p.toks[p.pos+1].text == "(" {
+		fn, column, err := p.parseAggregateCall(table)
+		if err != nil {
+			return "", err
+		}
+		return p.resolveCall(fn, column)
+	}
+	return p.parseColumnRef(table)
+}
+
+func (p *sqlParser) parsePredicate(table string) (*Filter, error) {
+	// value op column is turned around into column op value.
+	if t := p.peek(); t.kind == tokNumber || t.kind == tokString || t.kind == tokParam ||
+		(t.kind == tokSymbol && (t.text == "-" || t.text == "+")) {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		op := p.next()
+		flipped, ok := flippedOps[op.text]
+		if op.kind != tokSymbol || !ok {
+			return nil, fmt.Errorf("syntax error at position %d: expected a comparison operator", op.pos)
+		}
+		col, err := p.parseOperand(table)
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{Column: col, Op: flipped, Value: value}, nil
+	}
+
+	col, err := p.parseOperand(table)
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind == tokSymbol {
+		if _, ok := flippedOps[t.text]; ok {
+			p.pos++
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			return &Filter{Column: col, Op: t.text, Value: value}, nil
+		}
+	}
+
+	if p.acceptKeyword("IS") {
+		if p.acceptKeyword("NOT", "NULL") {
+			return &Filter{Column: col, Op: "isNotNull"}, nil
+		}
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return &Filter{Column: col, Op: "isNull"}, nil
+	}
+
+	negate := p.acceptKeyword("NOT")
+	switch {
+	case p.acceptKeyword("IN"):
+		values, err := p.parseValueList()
+		if err != nil {
+			return nil, err
+		}
+		op := "in"
+		if negate {
+			op = "notIn"
+		}
+		return &Filter{Column: col, Op: op, Values: values}, nil
+	case p.acceptKeyword("BETWEEN"):
+		low, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		f := &Filter{Column: col, Op: "between", Values: []interface{}{low, high}}
+		if negate {
+			f = &Filter{Not: f}
+		}
+		return f, nil
+	case p.acceptKeyword("LIKE"):
+		pattern, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		op := "like"
+		if negate {
+			op = "notLike"
+		}
+		return &Filter{Column: col, Op: op, Value: pattern}, nil
+	}
+	return nil, p.errorf("expected a comparison")
+}
+
+func (p *sqlParser) parseAggregateCall(table string) (fn, column string, err error) {
+	fn = strings.ToUpper(p.next().text)
+	if err := p.expectSymbol("("); err != nil {
+		return "", "", err
+	}
+	if p.acceptSymbol("*") {
+		if fn != "COUNT" {
+			return "", "", fmt.Errorf("%s(*) is not supported", fn)
+		}
+	} else {
+		if p.isKeyword("DISTINCT") {
+			return "", "", fmt.Errorf("%s(DISTINCT ...) is not supported", fn)
+		}
+		if column, err = p.parseColumnRef(table); err != nil {
+			return "", "", err
+		}
+	}
+	return fn, column, p.expectSymbol(")")
+}
+
+func (p *sqlParser) parseSelect() (*crudRequest, error) {
+	p.next()
+	type selectItem struct {
+		column string
+		agg    *AggregateSpec
+	}
+	var items []selectItem
+	star := false
+	if p.acceptSymbol("*") {
+		star = true
+	} else {
+		for {
+			var item selectItem
+			if t := p.peek(); t.kind == tokIdent && aggregateFuncs[strings.ToUpper(t.text)] &&
+				p.toks[p.pos+1].kind == tokSymbol && p.toks[p.pos+1].text == "(" {
+				fn, column, err := p.parseAggregateCall("")
+				if err != nil {
+					return nil, err
+				}
+				item.agg = &AggregateSpec{Func: fn, Column: column}
+			} else {
+				column, err := p.parseColumnRef("")
+				if err != nil {
+					return nil, err
+				}
+				item.column = column
+			}
+			if p.acceptKeyword("AS") || p.peek().kind == tokQuotedIdent ||
+				(p.peek().kind == tokIdent && !sqlReservedWords[strings.ToUpper(p.peek().text)]) {
+				alias, err := p.parseIdent()
+				if err != nil {
+					return nil, err
+				}
+				if item.agg == nil {
+					if !strings.EqualFold(alias, item.column) {
+						return nil, fmt.Errorf("column aliases are only supported on aggregates")
+					}
+				} else {
+					item.agg.As = alias
+				}
+			}
+			items = append(items, item)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	req := &crudRequest{Operation: "read"}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if err := p.parseTableRef(req); err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item.agg != nil {
+			req.Operation = "aggregate"
+			req.Aggregates = append(req.Aggregates, *item.agg)
+		} else {
+			req.Columns = append(req.Columns, item.column)
+		}
+	}
+	if star && p.isKeyword("GROUP") {
+		return nil, fmt.Errorf("SELECT * cannot be combined with GROUP BY")
+	}
+
+	if p.acceptKeyword("WHERE") {
+		f, err := p.parseCondition(req.Table)
+		if err != nil {
+			return nil, err
+		}
+		req.Filter = f
+	}
+
+	if p.acceptKeyword("GROUP", "BY") {
+		for {
+			col, err := p.parseColumnRef(req.Table)
+			if err != nil {
+				return nil, err
+			}
+			req.GroupBy = append(req.GroupBy, col)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+		req.Operation = "aggregate"
+	}
+	if req.Operation == "aggregate" {
+		for _, col := range req.Columns {
+			if !containsFold(req.GroupBy, col) {
+				return nil, fmt.Errorf("column '%s' must appear in GROUP BY or be aggregated", col)
+			}
+		}
+		if len(req.Aggregates) == 0 {
+			return nil, fmt.Errorf("GROUP BY requires at least one aggregate in the select list")
+		}
+		req.Columns = nil
+		p.resolveCall = func(fn, column string) (string, error) {
+			for i, spec := range req.Aggregates {
+				if strings.EqualFold(spec.Func, fn) && strings.EqualFold(spec.Column, column) {
+					if spec.As == "" {
+						req.Aggregates[i].As = spec.defaultAlias()
+					}
+					return req.Aggregates[i].As, nil
+				}
+			}
+			return "", fmt.Errorf("%s(%s) must also appear in the select list", fn, column)
+		}
+	}
+
+	if p.acceptKeyword("HAVING") {
+		if req.Operation != "aggregate" {
+			return nil, fmt.Errorf("HAVING requires GROUP BY or aggregates")
+		}
+		f, err := p.parseCondition(req.Table)
+		if err != nil {
+			return nil, err
+		}
+		req.Having = f
+	}
+
+	if p.acceptKeyword("ORDER", "BY") {
+		for {
+			col, err := p.parseOperand(req.Table)
+			if err != nil {
+				return nil, err
+			}
+			term := OrderTerm{Column: col}
+			if p.acceptKeyword("DESC") {
+				term.Desc = true
+			} else {
+				p.acceptKeyword("ASC")
+			}
+			req.OrderBy = append(req.OrderBy, term)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.acceptKeyword("LIMIT") {
+		first, err := p.parseCount()
+		if err != nil {
+			return nil, err
+		}
+		req.Limit = first
+		if p.acceptSymbol(",") {
+			if req.Limit, err = p.parseCount(); err != nil {
+				return nil, err
+			}
+			req.Offset = first
+		} else if p.acceptKeyword("OFFSET") {
+			if req.Offset, err = p.parseCount(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return req, nil
+}
+
+func (p *sqlParser) parseCount() (int, error) {
+	v, err := p.parseValue()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if _, err := fmt.Sscanf(fmt.Sprint(v), "%d", &n); err != nil || n < 0 || fmt.Sprint(n) != fmt.Sprint(v) {
+		return 0, fmt.Errorf("LIMIT and OFFSET must be non-negative integers")
+	}
+	return n, nil
+}
+
+func (p *sqlParser) parseInsert() (*crudRequest, error) {
+	p.next()
+	req := &crudRequest{Operation: "create"}
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	if err := p.parseTableRef(req); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var columns []string
+	for {
+		col, err := p.parseIdent()
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, col)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	if !p.acceptKeyword("VALUES") && !p.acceptKeyword("VALUE") {
+		return nil, p.errorf("expected VALUES")
+	}
+	var rows []map[string]interface{}
+	for {
+		values, err := p.parseValueList()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != len(columns) {
+			return nil, fmt.Errorf("row %d has %d values for %d columns", len(rows)+1, len(values), len(columns))
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			row[col] = values[i]
+		}
+		rows = append(rows, row)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+
+	if p.acceptKeyword("ON", "DUPLICATE", "KEY", "UPDATE") {
+		if len(rows) > 1 {
+			return nil, fmt.Errorf("ON DUPLICATE KEY UPDATE is only supported for single-row inserts")
+		}
+		req.Operation = "upsert"
+		for {
+			col, err := p.parseIdent()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectSymbol("="); err != nil {
+				return nil, err
+			}
+			if err := p.expectKeyword("VALUES"); err != nil {
+				return nil, fmt.Errorf("ON DUPLICATE KEY UPDATE only supports col = VALUES(col)")
+			}
+			if err := p.expectSymbol("("); err != nil {
+				return nil, err
+			}
+			src, err := p.parseIdent()
+			if err != nil {
+				return nil, err
+			}
+			if !strings.EqualFold(src, col) {
+				return nil, fmt.Errorf("ON DUPLICATE KEY UPDATE only supports col = VALUES(col)")
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return nil, err
+			}
+			req.UpdateColumns = append(req.UpdateColumns, col)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+
+	if len(rows) == 1 {
+		req.Data = rows[0]
+	} else {
+		req.Operation = "batch"
+		req.Rows = rows
+	}
+	return req, nil
+}
+
+func (p *sqlParser) parseUpdate() (*crudRequest, error) {
+	p.next()
+	req := &crudRequest{Operation: "update", Data: make(map[string]interface{})}
+	if err := p.parseTableRef(req); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.parseColumnRef(req.Table)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		req.Data[col] = value
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if err := p.expectKeyword("WHERE"); err != nil {
+		return nil, fmt.Errorf("UPDATE requires a WHERE clause")
+	}
+	f, err := p.parseCondition(req.Table)
+	if err != nil {
+		return nil, err
+	}
+	req.Filter = f
+	return req, nil
+}
+
+func (p *sqlParser) parseDelete() (*crudRequest, error) {
+	p.next()
+	req := &crudRequest{Operation: "delete"}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	if err := p.parseTableRef(req); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("WHERE"); err != nil {
+		return nil, fmt.Errorf("DELETE requires a WHERE clause")
+	}
+	f, err := p.parseCondition(req.Table)
+	if err != nil {
+		return nil, err
+	}
+	req.Filter = f
+	return req, nil
+}
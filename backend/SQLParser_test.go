@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSQL(t *testing.T) {
+	tests := []struct {
+		name   string
+		sql    string
+		params []interface{}
+		want   *crudRequest
+	}{
+		{
+			name: "select all",
+			sql:  "SELECT * FROM students",
+			want: &crudRequest{Operation: "read", Table: "students"},
+		},
+		{
+			name: "select columns with filter, order and limit",
+			sql:  "select id, students.name from school.students where age >= 18 and (city = 'Cairo' or city is null) order by name desc, id limit 10 offset 20;",
+			want: &crudRequest{
+				Operation: "read", DBName: "school", Table: "students",
+				Columns: []string{"id", "name"},
+				Filter: &Filter{And: []Filter{
+					{Column: "age", Op: ">=", Value: json.Number("18")},
+					{Or: []Filter{{Column: "city", Op: "=", Value: "Cairo"}, {Column: "city", Op: "isNull"}}},
+				}},
+				OrderBy: []OrderTerm{{Column: "name", Desc: true}, {Column: "id"}},
+				Limit:   10, Offset: 20,
+			},
+		},
+		{
+			name: "MySQL limit form",
+			sql:  "SELECT * FROM t LIMIT 5, 10",
+			want: &crudRequest{Operation: "read", Table: "t", Limit: 10, Offset: 5},
+		},
+		{
+			name: "flipped comparison and predicates",
+			sql:  "SELECT * FROM t WHERE 5 < a AND b NOT IN (1, 2) AND c NOT BETWEEN -1 AND 1 AND d NOT LIKE 'x%' AND NOT e IS NOT NULL",
+			want: &crudRequest{Operation: "read", Table: "t", Filter: &Filter{And: []Filter{
+				{Column: "a", Op: ">", Value: json.Number("5")},
+				{Column: "b", Op: "notIn", Values: []interface{}{json.Number("1"), json.Number("2")}},
+				{Not: &Filter{Column: "c", Op: "between", Values: []interface{}{json.Number("-1"), json.Number("1")}}},
+				{Column: "d", Op: "notLike", Value: "x%"},
+				{Not: &Filter{Column: "e", Op: "isNotNull"}},
+			}}},
+		},
+		{
+			name:   "placeholders",
+			sql:    "SELECT * FROM t WHERE a = ? AND b IN (?, ?)",
+			params: []interface{}{"x", json.Number("1"), nil},
+			want: &crudRequest{Operation: "read", Table: "t", Filter: &Filter{And: []Filter{
+				{Column: "a", Op: "=", Value: "x"},
+				{Column: "b", Op: "in", Values: []interface{}{json.Number("1"), nil}},
+			}}},
+		},
+		{
+			name: "aggregate with group, having and order",
+			sql:  "SELECT city, COUNT(*) AS n, SUM(amount) FROM orders GROUP BY city HAVING COUNT(*) > 1 ORDER BY SUM(amount) DESC",
+			want: &crudRequest{
+				Operation: "aggregate", Table: "orders",
+				Aggregates: []AggregateSpec{{Func: "COUNT", As: "n"}, {Func: "SUM", Column: "amount", As: "sum_amount"}},
+				GroupBy:    []string{"city"},
+				Having:     &Filter{Column: "n", Op: ">", Value: json.Number("1")},
+				OrderBy:    []OrderTerm{{Column: "sum_amount", Desc: true}},
+			},
+		},
+		{
+			name: "ungrouped aggregate",
+			sql:  "SELECT MAX(age) FROM students",
+			want: &crudRequest{Operation: "aggregate", Table: "students", Aggregates: []AggregateSpec{{Func: "MAX", Column: "age"}}},
+		},
+		{
+			name: "insert",
+			sql:  "INSERT INTO students (name, age, active, note) VALUES ('Ada', 36, TRUE, NULL)",
+			want: &crudRequest{Operation: "create", Table: "students", Data: map[string]interface{}{
+				"name": "Ada", "age": json.Number("36"), "active": true, "note": nil,
+			}},
+		},
+		{
+			name: "multi-row insert",
+			sql:  "INSERT INTO t (a) VALUES (1), (2)",
+			want: &crudRequest{Operation: "batch", Table: "t", Rows: []map[string]interface{}{
+				{"a": json.Number("1")}, {"a": json.Number("2")},
+			}},
+		},
+		{
+			name: "upsert",
+			sql:  "INSERT INTO t (id, a) VALUES (1, 'x') ON DUPLICATE KEY UPDATE a = VALUES(a)",
+			want: &crudRequest{Operation: "upsert", Table: "t", UpdateColumns: []string{"a"}, Data: map[string]interface{}{
+				"id": json.Number("1"), "a": "x",
+			}},
+		},
+		{
+			name: "update",
+			sql:  "UPDATE t SET a = -2.50, t.b = 'y' WHERE id = 3",
+			want: &crudRequest{Operation: "update", Table: "t",
+				Data:   map[string]interface{}{"a": json.Number("-2.50"), "b": "y"},
+				Filter: &Filter{Column: "id", Op: "=", Value: json.Number("3")},
+			},
+		},
+		{
+			name: "delete with quoted identifiers",
+			sql:  "DELETE FROM `order` WHERE `select` <> 'it''s'",
+			want: &crudRequest{Operation: "delete", Table: "order",
+				Filter: &Filter{Column: "select", Op: "<>", Value: "it's"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSQL(tt.sql, tt.params)
+			if err != nil {
+				t.Fatalf("parseSQL: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				t.Errorf("request = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestParseSQLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		params  []interface{}
+		wantErr string
+	}{
+		{"empty", "  ", nil, "empty statement"},
+		{"DDL", "DROP TABLE t", nil, "not allowed"},
+		{"unsupported statement", "SHOW TABLES", nil, "unsupported statement"},
+		{"multiple statements", "SELECT * FROM t; DELETE FROM t WHERE a = 1", nil, "multiple statements"},
+		{"update without where", "UPDATE t SET a = 1", nil, "requires a WHERE clause"},
+		{"delete without where", "DELETE FROM t", nil, "requires a WHERE clause"},
+		{"too few params", "SELECT * FROM t WHERE a = ?", nil, "not enough params"},
+		{"too many params", "SELECT * FROM t WHERE a = ?", []interface{}{1, 2}, "1 placeholders but 2 params"},
+		{"ungrouped column", "SELECT city, COUNT(*) FROM t", nil, "must appear in GROUP BY"},
+		{"having without aggregate", "SELECT * FROM t HAVING a > 1", nil, "HAVING requires"},
+		{"having on unselected aggregate", "SELECT COUNT(*) FROM t HAVING SUM(a) > 1", nil, "must also appear in the select list"},
+		{"column alias", "SELECT a AS b FROM t", nil, "column aliases"},
+		{"wrong qualifier", "SELECT * FROM t WHERE u.a = 1", nil, "does not match table"},
+		{"row count mismatch", "INSERT INTO t (a, b) VALUES (1)", nil, "row 1 has 1 values for 2 columns"},
+		{"upsert expression", "INSERT INTO t (a) VALUES (1) ON DUPLICATE KEY UPDATE a = a + 1", nil, "only supports col = VALUES(col)"},
+		{"negative limit", "SELECT * FROM t LIMIT -1", nil, "non-negative integers"},
+		{"fractional limit", "SELECT * FROM t LIMIT 1.5", nil, "non-negative integers"},
+		{"trailing tokens", "SELECT * FROM t WHERE a = 1 b", nil, "unexpected 'b'"},
+		{"distinct aggregate", "SELECT COUNT(DISTINCT a) FROM t", nil, "DISTINCT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseSQL(tt.sql, tt.params)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSQLNumber(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    json.Number
+		wantErr bool
+	}{
+		{text: "42", want: "42"},
+		{text: "007", want: "7"},
+		{text: "0", want: "0"},
+		{text: ".5", want: "0.5"},
+		{text: "5.", want: "5"},
+		{text: "1.250", want: "1.250"},
+		{text: "12345678901234567890.123456789", want: "12345678901234567890.123456789"},
+		{text: "1e10", want: "1e10"},
+		{text: "2.5E-3", want: "2.5E-3"},
+		{text: "1e", wantErr: true},
+		{text: "1e+", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := sqlNumber(sqlToken{kind: tokNumber, text: tt.text})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sqlNumber(%q) = %q, want an error", tt.text, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("sqlNumber(%q) = %q, %v, want %q", tt.text, got, err, tt.want)
+			}
+		})
+	}
+}
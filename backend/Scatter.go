@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scatterReadsEnabled is set once cluster.shard_of exists. Without it a node cannot select
+// the rows of one shard, so reads that would scatter are refused.
+var scatterReadsEnabled bool
+
+// shardPredicateSQL restricts a query to the rows of one shard. cluster.shard_of mirrors
+// calculateShardID, so rows are assigned to the same shard the router would pick for them.
+func shardPredicateSQL(shardKey string, shardID int) (string, []interface{}) {
+	return fmt.Sprintf("(cluster.shard_of(CAST(%s AS CHAR), ?) = ?)", quoteIdentifier(shardKey)),
+		[]interface{}{config.ShardCount, shardID}
+}
+
+func andSQL(a string, aArgs []interface{}, b string, bArgs []interface{}) (string, []interface{}) {
+	switch {
+	case a == "":
+		return b, bArgs
+	case b == "":
+		return a, aArgs
+	}
+	args := append(append([]interface{}{}, aArgs...), bArgs...)
+	return a + " AND " + b, args
+}
+
+// shardNodeURL picks the node that serves reads for a shard: this node if it owns the shard,
+// otherwise a healthy node registered for it. Every node holds a full replica, so this node
+// is also the fallback when no owner is available.
+func shardNodeURL(shardID int) string {
+	if calculateShardID(config.SelfURL) == shardID {
+		return config.SelfURL
+	}
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	for _, node := range state.Nodes {
+		if node.IsHealthy && node.ShardID == shardID && node.URL != config.SelfURL {
+			return node.URL
+		}
+	}
+	return config.SelfURL
+}
+
+type shardResult struct {
+	ShardID int
+	Rows    []map[string]interface{}
+	Total   *int64
+	Err     error
+}
+
+// scatterShards queries every shard concurrently, through remote when another node owns the
+// shard and through local otherwise, and returns the per-shard results in shard order.
+func scatterShards(local func(shardID int) shardResult, remote func(nodeURL string, shardID int) shardResult) []shardResult {
+	results := make([]shardResult, config.ShardCount)
+	var wg sync.WaitGroup
+	for shardID := 0; shardID < config.ShardCount; shardID++ {
+		wg.Add(1)
+		go func(shardID int) {
+			defer wg.Done()
+			nodeURL := shardNodeURL(shardID)
+			if nodeURL != config.SelfURL {
+				res := remote(nodeURL, shardID)
+				if res.Err == nil {
+					results[shardID] = res
+					return
+				}
+				log.Printf("Scatter to %s for shard %d failed, serving it locally: %v", nodeURL, shardID, res.Err)
+			}
+			results[shardID] = local(shardID)
+		}(shardID)
+	}
+	wg.Wait()
+	return results
+}
+
+// postShardRequest sends a shard-scoped request to another node's endpoint and decodes the
+// Result of its Response into out.
+func postShardRequest(ctx context.Context, nodeURL, path string, payload interface{}, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", nodeURL+path, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ForwardedByHeader, config.SelfURL)
+	propagateDeadline(ctx, req)
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node returned status %d", resp.StatusCode)
+	}
+
+	var envelope struct {
+		Success bool            `json:"success"`
+		Message string          `json:"message"`
+		Result  json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return err
+	}
+	if !envelope.Success {
+		return fmt.Errorf("node rejected shard request: %s", envelope.Message)
+	}
+	dec := json.NewDecoder(bytes.NewReader(envelope.Result))
+	dec.UseNumber()
+	return dec.Decode(out)
+}
+
+func scatterRead(dbConn *requestDB, req *crudRequest, plan *readPlan, shardKey, whereSQL string, whereArgs []interface{}) ([]map[string]interface{}, *int64, error) {
+	// Each shard returns enough rows to cover offset+limit; the merge applies the offset once.
+	shardPlan := *plan
+	shardPlan.Offset = 0
+	if plan.Limit > 0 {
+		shardPlan.Limit = plan.Offset + plan.Limit
+	}
+
+	local := func(shardID int) shardResult {
+		predicate, predArgs := shardPredicateSQL(shardKey, shardID)
+		cond, args := andSQL(whereSQL, whereArgs, predicate, predArgs)
+		res := shardResult{ShardID: shardID}
+		rows, err := executeRead(dbConn, &shardPlan, cond, args)
+		if err != nil {
+			res.Err = err
+			return res
+		}
+		res.Rows, res.Err = normalizeRows(rows)
+		if res.Err == nil && plan.IncludeTotal {
+			var total int64
+			total, res.Err = countRows(dbConn, plan.Table, cond, args)
+			res.Total = &total
+		}
+		return res
+	}
+	remote := func(nodeURL string, shardID int) shardResult {
+		sub := *req
+		sub.ShardScope = &shardID
+		sub.Offset = 0
+		sub.Limit = shardPlan.Limit
+		res := shardResult{ShardID: shardID}
+		var page readPage
+		if res.Err = postShardRequest(dbConn.ctx, nodeURL, "/api/crud", sub, &page); res.Err != nil {
+			return res
+		}
+		res.Rows, res.Total = page.Rows, page.Total
+		return res
+	}
+
+	var merged []map[string]interface{}
+	var total *int64
+	for _, res := range scatterShards(local, remote) {
+		if res.Err != nil {
+			return nil, nil, fmt.Errorf("shard %d: %w", res.ShardID, res.Err)
+		}
+		merged = append(merged, res.Rows...)
+		if res.Total != nil {
+			if total == nil {
+				total = new(int64)
+			}
+			*total += *res.Total
+		}
+	}
+
+	if len(plan.Order) > 0 {
+		order := plan.mergeOrder()
+		sort.SliceStable(merged, func(i, j int) bool {
+			for _, term := range order {
+				c := compareValues(merged[i][term.Column], merged[j][term.Column])
+				if c != 0 {
+					if term.Desc {
+						return c > 0
+					}
+					return c < 0
+				}
+			}
+			return false
+		})
+	}
+
+	if plan.Offset > 0 {
+		if plan.Offset >= len(merged) {
+			merged = nil
+		} else {
+			merged = merged[plan.Offset:]
+		}
+	}
+	if plan.Limit > 0 && len(merged) > plan.Limit+1 {
+		merged = merged[:plan.Limit+1]
+	}
+	return merged, total, nil
+}
+
+// normalizeRows round-trips rows through JSON so that rows read locally compare the same way
+// as rows received from other nodes.
+func normalizeRows(rows []map[string]interface{}) ([]map[string]interface{}, error) {
+	b, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var out []map[string]interface{}
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// compareValues orders JSON values the way MySQL orders the column values they came from:
+// NULL first, numbers numerically and exactly, everything else as bytes. Text columns only
+// compare the way MySQL does through their sort keys, see addSortKeys.
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+	if ai, ok := a.(int64); ok {
+		if bi, ok := b.(int64); ok {
+			switch {
+			case ai < bi:
+				return -1
+			case ai > bi:
+				return 1
+			}
+			return 0
+		}
+	}
+	ar, aNum := numericValue(a)
+	br, bNum := numericValue(b)
+	if aNum && bNum {
+		return ar.Cmp(br)
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// numericValue converts a number to a big.Rat, so BIGINT and DECIMAL values compare without
+// the rounding of float64.
+func numericValue(v interface{}) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(n.String())
+	case float64:
+		r := new(big.Rat)
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return r, false
+		}
+		return r.SetFloat64(n), true
+	case int64:
+		return new(big.Rat).SetInt64(n), true
+	case uint64:
+		return new(big.Rat).SetUint64(n), true
+	case int:
+		return new(big.Rat).SetInt64(int64(n)), true
+	}
+	return nil, false
+}
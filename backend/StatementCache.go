@@ -0,0 +1,184 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+)
+
+// Statements generated for CRUD operations are prepared once per pool and reused. The key is
+// the statement text, which only holds placeholders for values, so every request of the same
+// shape on the same table shares one statement. Statements run inside a transaction or an XA
+// branch are not cached: they are bound to that transaction's connection.
+type stmtCacheKey struct {
+	pool  *sql.DB
+	table string
+	query string
+}
+
+type stmtCacheEntry struct {
+	key     stmtCacheKey
+	stmt    *sql.Stmt
+	refs    int
+	evicted bool
+}
+
+type stmtCacheCounters struct {
+	Size        int   `json:"size"`
+	Capacity    int   `json:"capacity"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Evictions   int64 `json:"evictions"`
+	Invalidated int64 `json:"invalidated"`
+}
+
+var (
+	stmtCache        = make(map[stmtCacheKey]*list.Element)
+	stmtCacheLRU     = list.New()
+	stmtCacheMutex   sync.Mutex
+	stmtCacheCounter stmtCacheCounters
+)
+
+// acquireStmt returns the cached statement for query, preparing it on a miss. The caller must
+// release it once the Exec or Query call returns; rows already returned stay valid after the
+// statement is closed.
+func acquireStmt(ctx context.Context, pool *sql.DB, table, query string) (*stmtCacheEntry, error) {
+	key := stmtCacheKey{pool: pool, table: table, query: query}
+	stmtCacheMutex.Lock()
+	if el, ok := stmtCache[key]; ok {
+		stmtCacheLRU.MoveToFront(el)
+		entry := el.Value.(*stmtCacheEntry)
+		entry.refs++
+		stmtCacheCounter.Hits++
+		stmtCacheMutex.Unlock()
+		return entry, nil
+	}
+	stmtCacheCounter.Misses++
+	stmtCacheMutex.Unlock()
+
+	stmt, err := pool.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	if el, ok := stmtCache[key]; ok {
+		// Prepared concurrently by another request.
+		stmt.Close()
+		entry := el.Value.(*stmtCacheEntry)
+		entry.refs++
+		return entry, nil
+	}
+	entry := &stmtCacheEntry{key: key, stmt: stmt, refs: 1}
+	stmtCache[key] = stmtCacheLRU.PushFront(entry)
+	for stmtCacheLRU.Len() > config.Pool.StatementCacheSize {
+		removeStmt(stmtCacheLRU.Back().Value.(*stmtCacheEntry))
+		stmtCacheCounter.Evictions++
+	}
+	return entry, nil
+}
+
+func releaseStmt(entry *stmtCacheEntry) {
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	entry.refs--
+	if entry.evicted && entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// removeStmt takes an entry out of the cache, closing its statement unless a request is
+// still about to use it. stmtCacheMutex must be held.
+func removeStmt(entry *stmtCacheEntry) {
+	if el, ok := stmtCache[entry.key]; ok {
+		stmtCacheLRU.Remove(el)
+		delete(stmtCache, entry.key)
+	}
+	entry.evicted = true
+	if entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// invalidateStatements drops the cached statements of a table after it was dropped or
+// altered. Tables are matched by name in every pool, which at worst re-prepares a few
+// statements of a same-named table in another database.
+func invalidateStatements(table string) {
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	for key, el := range stmtCache {
+		if key.table == table {
+			removeStmt(el.Value.(*stmtCacheEntry))
+			stmtCacheCounter.Invalidated++
+		}
+	}
+}
+
+// purgePoolStatements drops every cached statement of a pool that is being closed.
+func purgePoolStatements(pool *sql.DB) {
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	for key, el := range stmtCache {
+		if key.pool == pool {
+			removeStmt(el.Value.(*stmtCacheEntry))
+		}
+	}
+}
+
+func statementCacheStats() stmtCacheCounters {
+	stmtCacheMutex.Lock()
+	defer stmtCacheMutex.Unlock()
+	stats := stmtCacheCounter
+	stats.Size = stmtCacheLRU.Len()
+	stats.Capacity = config.Pool.StatementCacheSize
+	return stats
+}
+
+// statementPool returns the pool of dbConn and the context its statements run with, if it
+// is a pool rather than a transaction.
+func statementPool(dbConn sqlExecutor) (context.Context, *sql.DB, bool) {
+	switch c := dbConn.(type) {
+	case *sql.DB:
+		return context.Background(), c, true
+	case *requestDB:
+		return c.ctx, c.pool, true
+	}
+	return nil, nil, false
+}
+
+// cachedExec runs a generated statement through the statement cache when dbConn is a pool,
+// and directly otherwise.
+func cachedExec(dbConn sqlExecutor, table, query string, args ...interface{}) (sql.Result, error) {
+	ctx, pool, ok := statementPool(dbConn)
+	if !ok {
+		return dbConn.Exec(query, args...)
+	}
+	entry, err := acquireStmt(ctx, pool, table, query)
+	if err != nil {
+		log.Printf("Error preparing statement for '%s', running it unprepared: %v", table, err)
+		return pool.ExecContext(ctx, query, args...)
+	}
+	defer releaseStmt(entry)
+	return entry.stmt.ExecContext(ctx, args...)
+}
+
+// cachedQuery is cachedExec for statements that return rows.
+func cachedQuery(dbConn sqlExecutor, table, query string, args ...interface{}) (*sql.Rows, error) {
+	if ctx, pool, ok := statementPool(dbConn); ok {
+		return cachedQueryContext(ctx, pool, table, query, args...)
+	}
+	return dbConn.Query(query, args...)
+}
+
+func cachedQueryContext(ctx context.Context, pool *sql.DB, table, query string, args ...interface{}) (*sql.Rows, error) {
+	entry, err := acquireStmt(ctx, pool, table, query)
+	if err != nil {
+		log.Printf("Error preparing statement for '%s', running it unprepared: %v", table, err)
+		return pool.QueryContext(ctx, query, args...)
+	}
+	defer releaseStmt(entry)
+	return entry.stmt.QueryContext(ctx, args...)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Rows of a streamed read are flushed to the client in groups of this size. Writes block while
+// the client is not reading, which in turn pauses the scan of the MySQL result.
+const streamFlushRows = 100
+
+const (
+	streamNDJSON = "ndjson"
+	streamArray  = "array"
+)
+
+// rowSource yields the rows of one shard of a streamed read. Next returns io.EOF after the last
+// row.
+type rowSource interface {
+	Next() (map[string]interface{}, error)
+	Close() error
+}
+
+type sqlRowSource struct {
+	rows      *sql.Rows
+	scanner   *rowScanner
+	normalize bool
+}
+
+// queryRowSource starts a read plan's query. The query is cancelled with ctx, which for a
+// streamed request ends when the client disconnects.
+func queryRowSource(ctx context.Context, dbConn *requestDB, plan *readPlan, whereSQL string, whereArgs []interface{}, normalize bool) (*sqlRowSource, error) {
+	query, values := readQuery(plan, whereSQL, whereArgs)
+	log.Printf("Executing streamed SQL: %s with values: %v", query, values)
+	rows, err := cachedQueryContext(ctx, dbConn.pool, plan.Table, query, values...)
+	if err != nil {
+		return nil, fmt.Errorf("stream query failed: %w", err)
+	}
+	scanner, err := newRowScanner(rows)
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+	return &sqlRowSource{rows: rows, scanner: scanner, normalize: normalize}, nil
+}
+
+func (s *sqlRowSource) Next() (map[string]interface{}, error) {
+	if !s.rows.Next() {
+		if err := s.rows.Err(); err != nil {
+			return nil, fmt.Errorf("stream row iteration failed: %w", err)
+		}
+		return nil, io.EOF
+	}
+	entry, err := s.scanner.scan(s.rows)
+	if err != nil {
+		return nil, fmt.Errorf("stream row scan failed: %w", err)
+	}
+	if !s.normalize {
+		return entry, nil
+	}
+	normalized, err := normalizeRows([]map[string]interface{}{entry})
+	if err != nil {
+		return nil, err
+	}
+	return normalized[0], nil
+}
+
+func (s *sqlRowSource) Close() error {
+	return s.rows.Close()
+}
+
+// remoteRowSource reads the NDJSON stream of a shard-scoped read served by another node.
+type remoteRowSource struct {
+	body io.ReadCloser
+	dec  *json.Decoder
+}
+
+func openRemoteRowSource(ctx context.Context, nodeURL string, req crudRequest) (*remoteRowSource, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, nodeURL+"/api/crud", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	propagateDeadline(ctx, httpReq)
+	// No client timeout: the stream lasts as long as the export, and ends with ctx.
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("node returned status %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-ndjson") {
+		// The node answered with a regular Response, which is how it reports errors found
+		// before streaming starts.
+		defer resp.Body.Close()
+		var envelope Response
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("node rejected shard stream: %s", envelope.Message)
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	return &remoteRowSource{body: resp.Body, dec: dec}, nil
+}
+
+func (s *remoteRowSource) Next() (map[string]interface{}, error) {
+	var row map[string]interface{}
+	if err := s.dec.Decode(&row); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("shard stream interrupted: %w", err)
+	}
+	return row, nil
+}
+
+func (s *remoteRowSource) Close() error {
+	return s.body.Close()
+}
+
+// rowStreamWriter writes rows to the client as they are produced, either as newline-delimited
+// JSON or as the elements of one JSON array.
+type rowStreamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	format  string
+	started bool
+	rows    int
+}
+
+func newRowStreamWriter(w http.ResponseWriter, format string) *rowStreamWriter {
+	flusher, _ := w.(http.Flusher)
+	return &rowStreamWriter{w: w, flusher: flusher, format: format}
+}
+
+func (s *rowStreamWriter) start() error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	if s.format == streamArray {
+		s.w.Header().Set("Content-Type", "application/json")
+		_, err := io.WriteString(s.w, "[")
+		return err
+	}
+	s.w.Header().Set("Content-Type", "application/x-ndjson")
+	s.w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *rowStreamWriter) WriteRow(row map[string]interface{}) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	switch {
+	case s.format == streamNDJSON:
+		b = append(b, '\n')
+	case s.rows > 0:
+		b = append([]byte{','}, b...)
+	}
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.rows++
+	if s.rows%streamFlushRows == 0 && s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+func (s *rowStreamWriter) Finish() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	if s.format == streamArray {
+		if _, err := io.WriteString(s.w, "]"); err != nil {
+			return err
+		}
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// validateStream rejects options a streamed read cannot honour: streams have no page envelope,
+// so there is nowhere to return a total or a next cursor.
+func validateStream(req *crudRequest) error {
+	if req.Stream != streamNDJSON && req.Stream != streamArray {
+		return fmt.Errorf("stream must be '%s' or '%s'", streamNDJSON, streamArray)
+	}
+	if req.Operation != "read" {
+		return fmt.Errorf("stream is only valid for reads")
+	}
+	if req.IncludeTotal || len(req.Include) > 0 {
+		return fmt.Errorf("includeTotal and include cannot be combined with stream")
+	}
+	return nil
+}
+
+// streamRead writes the rows of a read while they are scanned. A single-shard read streams
+// its query directly; a scatter read opens one stream per shard and merges them in order.
+// Errors found before the first row is written are reported as a regular Response; after
+// that, the response is aborted so the client cannot mistake a partial stream for a full one.
+func streamRead(w http.ResponseWriter, r *http.Request, dbConn *requestDB, req *crudRequest, plan *readPlan, shardKey string, scatter bool, whereSQL string, whereArgs []interface{}) {
+	ctx := streamContext(r)
+	var sources []rowSource
+	defer func() {
+		for _, src := range sources {
+			src.Close()
+		}
+	}()
+
+	limit, offset := plan.Limit, 0
+	if scatter {
+		shardPlan := *plan
+		shardPlan.Offset = 0
+		if plan.Limit > 0 {
+			shardPlan.Limit = plan.Offset + plan.Limit
+		}
+		offset = plan.Offset
+		for shardID := 0; shardID < config.ShardCount; shardID++ {
+			src, err := openShardRowSource(ctx, dbConn, req, &shardPlan, shardKey, shardID, whereSQL, whereArgs)
+			if err != nil {
+				json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Error executing operation: shard %d: %v", shardID, err)})
+				return
+			}
+			sources = append(sources, src)
+		}
+	} else {
+		if req.ShardScope != nil {
+			predicate, predArgs := shardPredicateSQL(shardKey, *req.ShardScope)
+			whereSQL, whereArgs = andSQL(whereSQL, whereArgs, predicate, predArgs)
+		}
+		src, err := queryRowSource(ctx, dbConn, plan, whereSQL, whereArgs, false)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error executing operation: " + err.Error()})
+			return
+		}
+		sources = append(sources, src)
+	}
+
+	// The per-shard streams of a scatter read keep the columns selected only for ordering: the
+	// coordinator merges on them and removes them itself.
+	out := newRowStreamWriter(w, req.Stream)
+	err := mergeRowSources(sources, plan.mergeOrder(), offset, limit, func(row map[string]interface{}) error {
+		if req.ShardScope == nil {
+			for col := range plan.Hidden {
+				delete(row, col)
+			}
+		}
+		return out.WriteRow(row)
+	})
+	if err == nil {
+		err = out.Finish()
+	}
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			log.Printf("Stream of '%s.%s' cancelled after %d rows: client disconnected", req.DBName, req.Table, out.rows)
+			return
+		}
+		log.Printf("Stream of '%s.%s' failed after %d rows: %v", req.DBName, req.Table, out.rows, err)
+		if !out.started {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error executing operation: " + err.Error()})
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("Streamed %d rows of '%s.%s'", out.rows, req.DBName, req.Table)
+}
+
+// openShardRowSource opens the stream of one shard, from the node that owns it when that is
+// another node, and locally otherwise or when that node cannot be reached.
+func openShardRowSource(ctx context.Context, dbConn *requestDB, req *crudRequest, shardPlan *readPlan, shardKey string, shardID int, whereSQL string, whereArgs []interface{}) (rowSource, error) {
+	if nodeURL := shardNodeURL(shardID); nodeURL != config.SelfURL {
+		sub := *req
+		sub.ShardScope = &shardID
+		sub.Offset = 0
+		sub.Limit = shardPlan.Limit
+		sub.Stream = streamNDJSON
+		src, err := openRemoteRowSource(ctx, nodeURL, sub)
+		if err == nil {
+			return src, nil
+		}
+		log.Printf("Stream from %s for shard %d failed, serving it locally: %v", nodeURL, shardID, err)
+	}
+	predicate, predArgs := shardPredicateSQL(shardKey, shardID)
+	cond, args := andSQL(whereSQL, whereArgs, predicate, predArgs)
+	return queryRowSource(ctx, dbConn, shardPlan, cond, args, true)
+}
+
+// mergeRowSources passes the rows of all sources to emit, skipping offset rows and stopping
+// after limit rows. Without an order the sources are drained one after another; with one, the
+// source with the smallest next row is picked each time, as each source is already sorted.
+func mergeRowSources(sources []rowSource, order []OrderTerm, offset, limit int, emit func(map[string]interface{}) error) error {
+	heads := make([]map[string]interface{}, len(sources))
+	done := make([]bool, len(sources))
+	advance := func(i int) error {
+		row, err := sources[i].Next()
+		if err == io.EOF {
+			heads[i], done[i] = nil, true
+			return nil
+		}
+		heads[i] = row
+		return err
+	}
+	for i := range sources {
+		if len(order) == 0 && i > 0 {
+			break
+		}
+		if err := advance(i); err != nil {
+			return err
+		}
+	}
+
+	emitted, skipped := 0, 0
+	current := 0
+	for limit == 0 || emitted < limit {
+		pick := -1
+		if len(order) == 0 {
+			for current < len(sources) && done[current] {
+				current++
+				if current < len(sources) {
+					if err := advance(current); err != nil {
+						return err
+					}
+				}
+			}
+			if current < len(sources) {
+				pick = current
+			}
+		} else {
+			for i := range sources {
+				if done[i] {
+					continue
+				}
+				if pick < 0 || compareRows(heads[i], heads[pick], order) < 0 {
+					pick = i
+				}
+			}
+		}
+		if pick < 0 {
+			return nil
+		}
+
+		row := heads[pick]
+		if err := advance(pick); err != nil {
+			return err
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		if err := emit(row); err != nil {
+			return err
+		}
+		emitted++
+	}
+	return nil
+}
+
+func compareRows(a, b map[string]interface{}, order []OrderTerm) int {
+	for _, term := range order {
+		c := compareValues(a[term.Column], b[term.Column])
+		if c != 0 {
+			if term.Desc {
+				return -c
+			}
+			return c
+		}
+	}
+	return 0
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tables are described as data rather than SQL: columns with a type from columnTypeRules,
+// nullability and a default, a primary key, unique constraints and indexes. The DDL is
+// generated here from a validated description, so nothing a client sends is spliced into a
+// statement except identifiers checked by isValidIdentifier and literals quoted by
+// quoteLiteral.
+
+type columnDefinition struct {
+	Name string `json:"name"`
+	// Type is a MySQL type with its parameters, e.g. "VARCHAR(255)", "DECIMAL(10,2)" or
+	// "INT UNSIGNED". ENUM and SET take their members from Values.
+	Type          string   `json:"type"`
+	Values        []string `json:"values,omitempty"`
+	Nullable      bool     `json:"nullable,omitempty"`
+	AutoIncrement bool     `json:"autoIncrement,omitempty"`
+	// Default is a literal default value: a string, number, boolean or null.
+	Default json.RawMessage `json:"default,omitempty"`
+	// DefaultCurrentTimestamp and OnUpdateCurrentTimestamp apply to DATETIME and TIMESTAMP.
+	DefaultCurrentTimestamp  bool `json:"defaultCurrentTimestamp,omitempty"`
+	OnUpdateCurrentTimestamp bool `json:"onUpdateCurrentTimestamp,omitempty"`
+}
+
+type indexDefinition struct {
+	// Name is generated from the columns when empty.
+	Name    string   `json:"name,omitempty"`
+	Columns []string `json:"columns"`
+}
+
+type tableDefinition struct {
+	Columns    []columnDefinition `json:"columns"`
+	PrimaryKey []string           `json:"primaryKey,omitempty"`
+	Unique     []indexDefinition  `json:"unique,omitempty"`
+	Indexes    []indexDefinition  `json:"indexes,omitempty"`
+}
+
+// columnTypeRule describes an allowed column type: how many parameters it takes and what it
+// may be combined with.
+type columnTypeRule struct {
+	maxParams      int   // parameters the type accepts
+	requiredParams int   // parameters the type requires
+	maxLength      int64 // upper bound of the first parameter
+	unsigned       bool  // accepts UNSIGNED
+	integer        bool  // accepts AUTO_INCREMENT
+	temporal       bool  // accepts CURRENT_TIMESTAMP defaults
+	members        bool  // members come from values
+	noDefault      bool  // MySQL allows no literal default
+	unindexable    bool  // needs a prefix length to be indexed
+}
+
+var columnTypeRules = map[string]columnTypeRule{
+	"tinyint":    {maxParams: 1, maxLength: 255, unsigned: true, integer: true},
+	"smallint":   {maxParams: 1, maxLength: 255, unsigned: true, integer: true},
+	"mediumint":  {maxParams: 1, maxLength: 255, unsigned: true, integer: true},
+	"int":        {maxParams: 1, maxLength: 255, unsigned: true, integer: true},
+	"integer":    {maxParams: 1, maxLength: 255, unsigned: true, integer: true},
+	"bigint":     {maxParams: 1, maxLength: 255, unsigned: true, integer: true},
+	"boolean":    {},
+	"bool":       {},
+	"bit":        {maxParams: 1, maxLength: 64},
+	"decimal":    {maxParams: 2, maxLength: 65},
+	"numeric":    {maxParams: 2, maxLength: 65},
+	"float":      {},
+	"double":     {},
+	"char":       {maxParams: 1, maxLength: 255},
+	"varchar":    {maxParams: 1, requiredParams: 1, maxLength: 65535},
+	"binary":     {maxParams: 1, maxLength: 255},
+	"varbinary":  {maxParams: 1, requiredParams: 1, maxLength: 65535},
+	"tinytext":   {noDefault: true, unindexable: true},
+	"text":       {noDefault: true, unindexable: true},
+	"mediumtext": {noDefault: true, unindexable: true},
+	"longtext":   {noDefault: true, unindexable: true},
+	"tinyblob":   {noDefault: true, unindexable: true},
+	"blob":       {noDefault: true, unindexable: true},
+	"mediumblob": {noDefault: true, unindexable: true},
+	"longblob":   {noDefault: true, unindexable: true},
+	"json":       {noDefault: true, unindexable: true},
+	"date":       {},
+	"datetime":   {maxParams: 1, maxLength: 6, temporal: true},
+	"timestamp":  {maxParams: 1, maxLength: 6, temporal: true},
+	"time":       {maxParams: 1, maxLength: 6},
+	"year":       {},
+	"enum":       {members: true},
+	"set":        {members: true},
+}
+
+var columnTypePattern = regexp.MustCompile(`^([a-z]+)\s*(?:\(\s*(\d+)\s*(?:,\s*(\d+)\s*)?\))?(\s+unsigned)?$`)
+
+// maxIdentifierLength is MySQL's limit on table, column and index names.
+const maxIdentifierLength = 64
+
+// columnSQL validates a column and renders its clause of a CREATE or ALTER TABLE statement.
+// It returns the type rule so callers can check how the column may be used.
+func (c *columnDefinition) columnSQL() (string, columnTypeRule, error) {
+	if !isValidIdentifier(c.Name) || len(c.Name) > maxIdentifierLength {
+		return "", columnTypeRule{}, fmt.Errorf("invalid column name '%s'", c.Name)
+	}
+	m := columnTypePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(c.Type)))
+	if m == nil {
+		return "", columnTypeRule{}, fmt.Errorf("column '%s': unsupported type '%s'", c.Name, c.Type)
+	}
+	name, unsigned := m[1], m[4] != ""
+	rule, ok := columnTypeRules[name]
+	if !ok {
+		return "", rule, fmt.Errorf("column '%s': unsupported type '%s'", c.Name, c.Type)
+	}
+
+	var params []int64
+	for _, p := range m[2:4] {
+		if p == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return "", rule, fmt.Errorf("column '%s': invalid type parameter '%s'", c.Name, p)
+		}
+		params = append(params, n)
+	}
+	if len(params) < rule.requiredParams {
+		return "", rule, fmt.Errorf("column '%s': type %s needs a length", c.Name, strings.ToUpper(name))
+	}
+	if len(params) > rule.maxParams {
+		return "", rule, fmt.Errorf("column '%s': type %s takes at most %d parameters", c.Name, strings.ToUpper(name), rule.maxParams)
+	}
+	if len(params) > 0 && params[0] > rule.maxLength {
+		return "", rule, fmt.Errorf("column '%s': %s length %d exceeds %d", c.Name, strings.ToUpper(name), params[0], rule.maxLength)
+	}
+	if len(params) == 2 && params[1] > params[0] {
+		return "", rule, fmt.Errorf("column '%s': scale %d exceeds precision %d", c.Name, params[1], params[0])
+	}
+	if unsigned && !rule.unsigned {
+		return "", rule, fmt.Errorf("column '%s': type %s cannot be UNSIGNED", c.Name, strings.ToUpper(name))
+	}
+
+	var b strings.Builder
+	b.WriteString(quoteIdentifier(c.Name) + " " + strings.ToUpper(name))
+	switch {
+	case rule.members:
+		if len(c.Values) == 0 {
+			return "", rule, fmt.Errorf("column '%s': %s needs values", c.Name, strings.ToUpper(name))
+		}
+		members := make([]string, len(c.Values))
+		for i, v := range c.Values {
+			if !utf8.ValidString(v) || (name == "set" && strings.Contains(v, ",")) {
+				return "", rule, fmt.Errorf("column '%s': invalid member '%s'", c.Name, v)
+			}
+			members[i] = quoteLiteral(v)
+		}
+		b.WriteString("(" + strings.Join(members, ",") + ")")
+	case len(c.Values) > 0:
+		return "", rule, fmt.Errorf("column '%s': values only apply to ENUM and SET", c.Name)
+	case len(params) == 1:
+		fmt.Fprintf(&b, "(%d)", params[0])
+	case len(params) == 2:
+		fmt.Fprintf(&b, "(%d,%d)", params[0], params[1])
+	}
+	if unsigned {
+		b.WriteString(" UNSIGNED")
+	}
+
+	if c.Nullable {
+		b.WriteString(" NULL")
+	} else {
+		b.WriteString(" NOT NULL")
+	}
+
+	if c.AutoIncrement {
+		if !rule.integer {
+			return "", rule, fmt.Errorf("column '%s': only integer columns can be AUTO_INCREMENT", c.Name)
+		}
+		if len(c.Default) > 0 || c.DefaultCurrentTimestamp {
+			return "", rule, fmt.Errorf("column '%s': an AUTO_INCREMENT column cannot have a default", c.Name)
+		}
+		b.WriteString(" AUTO_INCREMENT")
+	}
+	if (c.DefaultCurrentTimestamp || c.OnUpdateCurrentTimestamp) && !rule.temporal {
+		return "", rule, fmt.Errorf("column '%s': CURRENT_TIMESTAMP only applies to DATETIME and TIMESTAMP", c.Name)
+	}
+	// A CURRENT_TIMESTAMP default must have the column's fractional seconds precision.
+	now := "CURRENT_TIMESTAMP"
+	if len(params) == 1 && params[0] > 0 {
+		now = fmt.Sprintf("CURRENT_TIMESTAMP(%d)", params[0])
+	}
+	switch {
+	case c.DefaultCurrentTimestamp && len(c.Default) > 0:
+		return "", rule, fmt.Errorf("column '%s': default and defaultCurrentTimestamp are exclusive", c.Name)
+	case c.DefaultCurrentTimestamp:
+		b.WriteString(" DEFAULT " + now)
+	case len(c.Default) > 0:
+		if rule.noDefault {
+			return "", rule, fmt.Errorf("column '%s': %s columns cannot have a default", c.Name, strings.ToUpper(name))
+		}
+		literal, err := defaultLiteral(c.Default)
+		if err != nil {
+			return "", rule, fmt.Errorf("column '%s': %v", c.Name, err)
+		}
+		if literal == "NULL" && !c.Nullable {
+			return "", rule, fmt.Errorf("column '%s': a NOT NULL column cannot default to null", c.Name)
+		}
+		b.WriteString(" DEFAULT " + literal)
+	}
+	if c.OnUpdateCurrentTimestamp {
+		b.WriteString(" ON UPDATE " + now)
+	}
+	return b.String(), rule, nil
+}
+
+// defaultLiteral renders a JSON default value as an SQL literal. MySQL checks that it fits
+// the column when the statement runs.
+func defaultLiteral(raw json.RawMessage) (string, error) {
+	var v interface{}
+	if err := decodeJSONNumbers(raw, &v); err != nil {
+		return "", fmt.Errorf("invalid default: %v", err)
+	}
+	switch v := v.(type) {
+	case nil:
+		return "NULL", nil
+	case bool:
+		if v {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case json.Number:
+		// json.Number holds exactly what the client sent, which the decoder validated as a
+		// JSON number.
+		return v.String(), nil
+	case string:
+		if !utf8.ValidString(v) {
+			return "", fmt.Errorf("default is not valid UTF-8")
+		}
+		return quoteLiteral(v), nil
+	default:
+		return "", fmt.Errorf("default must be a string, number, boolean or null")
+	}
+}
+
+// quoteLiteral quotes a string for use as an SQL literal. Nodes connect with the server's
+// default SQL mode, in which a backslash escapes the next character.
+func quoteLiteral(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'':
+			b.WriteString("''")
+		case '\\':
+			b.WriteString(`\\`)
+		case 0:
+			b.WriteString(`\0`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// createTableSQL validates a table description and generates its CREATE TABLE statement.
+func (d *tableDefinition) createTableSQL(dbName, tableName string) (string, error) {
+	if len(d.Columns) == 0 {
+		return "", fmt.Errorf("a table needs at least one column")
+	}
+	rules := make(map[string]columnTypeRule, len(d.Columns))
+	nullable := make(map[string]bool, len(d.Columns))
+	var clauses []string
+	autoIncrement := ""
+	for i := range d.Columns {
+		col := &d.Columns[i]
+		clause, rule, err := col.columnSQL()
+		if err != nil {
+			return "", err
+		}
+		key := strings.ToLower(col.Name)
+		if _, dup := rules[key]; dup {
+			return "", fmt.Errorf("duplicate column '%s'", col.Name)
+		}
+		rules[key], nullable[key] = rule, col.Nullable
+		if col.AutoIncrement {
+			if autoIncrement != "" {
+				return "", fmt.Errorf("only one column can be AUTO_INCREMENT, found '%s' and '%s'", autoIncrement, col.Name)
+			}
+			autoIncrement = col.Name
+		}
+		clauses = append(clauses, clause)
+	}
+
+	keyColumns := func(kind string, cols []string) (string, error) {
+		if len(cols) == 0 {
+			return "", fmt.Errorf("%s needs at least one column", kind)
+		}
+		seen := make(map[string]bool, len(cols))
+		quoted := make([]string, len(cols))
+		for i, c := range cols {
+			rule, ok := rules[strings.ToLower(c)]
+			if !ok {
+				return "", fmt.Errorf("%s refers to unknown column '%s'", kind, c)
+			}
+			if rule.unindexable {
+				return "", fmt.Errorf("%s cannot include column '%s': its type cannot be indexed", kind, c)
+			}
+			if seen[strings.ToLower(c)] {
+				return "", fmt.Errorf("%s lists column '%s' twice", kind, c)
+			}
+			seen[strings.ToLower(c)] = true
+			quoted[i] = quoteIdentifier(c)
+		}
+		return strings.Join(quoted, ", "), nil
+	}
+
+	// MySQL requires an AUTO_INCREMENT column to lead some key.
+	autoIncrementKeyed := false
+	leads := func(cols []string) {
+		if autoIncrement != "" && len(cols) > 0 && strings.EqualFold(cols[0], autoIncrement) {
+			autoIncrementKeyed = true
+		}
+	}
+
+	if len(d.PrimaryKey) > 0 {
+		cols, err := keyColumns("primary key", d.PrimaryKey)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range d.PrimaryKey {
+			if nullable[strings.ToLower(c)] {
+				return "", fmt.Errorf("primary key column '%s' cannot be nullable", c)
+			}
+		}
+		leads(d.PrimaryKey)
+		clauses = append(clauses, "PRIMARY KEY ("+cols+")")
+	}
+	names := make(map[string]bool)
+	for _, set := range []struct {
+		kind    string
+		prefix  string
+		indexes []indexDefinition
+	}{{"unique constraint", "uq", d.Unique}, {"index", "idx", d.Indexes}} {
+		for i := range set.indexes {
+			idx := &set.indexes[i]
+			cols, err := keyColumns(set.kind, idx.Columns)
+			if err != nil {
+				return "", err
+			}
+			if idx.Name == "" {
+				idx.Name = set.prefix + "_" + strings.Join(idx.Columns, "_")
+				if len(idx.Name) > maxIdentifierLength {
+					idx.Name = idx.Name[:maxIdentifierLength]
+				}
+			}
+			if !isValidIdentifier(idx.Name) || len(idx.Name) > maxIdentifierLength || strings.EqualFold(idx.Name, "primary") {
+				return "", fmt.Errorf("invalid %s name '%s'", set.kind, idx.Name)
+			}
+			if names[strings.ToLower(idx.Name)] {
+				return "", fmt.Errorf("duplicate index name '%s'", idx.Name)
+			}
+			names[strings.ToLower(idx.Name)] = true
+			leads(idx.Columns)
+			if set.prefix == "uq" {
+				clauses = append(clauses, fmt.Sprintf("UNIQUE KEY %s (%s)", quoteIdentifier(idx.Name), cols))
+			} else {
+				clauses = append(clauses, fmt.Sprintf("KEY %s (%s)", quoteIdentifier(idx.Name), cols))
+			}
+		}
+	}
+	if autoIncrement != "" && !autoIncrementKeyed {
+		return "", fmt.Errorf("AUTO_INCREMENT column '%s' must be the first column of the primary key, a unique constraint or an index", autoIncrement)
+	}
+
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (\n  %s\n)",
+		quoteIdentifier(dbName), quoteIdentifier(tableName), strings.Join(clauses, ",\n  ")), nil
+}
+
+// hasColumn reports whether the description declares a column, ignoring case as MySQL does.
+func (d *tableDefinition) hasColumn(name string) bool {
+	return d.column(name) != nil
+}
+
+func (d *tableDefinition) column(name string) *columnDefinition {
+	for i := range d.Columns {
+		if strings.EqualFold(d.Columns[i].Name, name) {
+			return &d.Columns[i]
+		}
+	}
+	return nil
+}
+
+// isShardKeyType reports whether a column type can be a shard key. The router hashes the text
+// of a key value as JSON carries it and cluster.shard_of hashes the column cast to CHAR; the
+// two agree for integers and strings but not for decimals, floats or dates.
+func isShardKeyType(typeName string) bool {
+	if columnTypeRules[typeName].integer {
+		return true
+	}
+	return isTextType(typeName)
+}
+
+// typeName returns the lower-case name of the column's type without its parameters.
+func (c *columnDefinition) typeName() string {
+	if m := columnTypePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(c.Type))); m != nil {
+		return m[1]
+	}
+	return ""
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Table schemas are cached for schemaCacheTTL. DDL issued through this node invalidates the
+// entry right away; the TTL bounds how long other changes take to be noticed.
+const schemaCacheTTL = 30 * time.Second
+
+type schemaCacheEntry struct {
+	schema   *TableSchema
+	loadedAt time.Time
+}
+
+var (
+	schemaCache      = make(map[string]schemaCacheEntry)
+	schemaCacheMutex sync.Mutex
+)
+
+type ColumnInfo struct {
+	Name       string `json:"name"`
+	DataType   string `json:"dataType"`
+	ColumnType string `json:"columnType"`
+	Nullable   bool   `json:"nullable"`
+	Key        string `json:"key"`
+
+	// AutoIncrement is set on the column MySQL fills from the table's counter.
+	AutoIncrement bool `json:"autoIncrement,omitempty"`
+}
+
+type TableSchema struct {
+	DBName  string
+	Table   string
+	Columns []ColumnInfo
+	byName  map[string]int
+
+	// VersionColumn is the column updates bump and expectedVersion is checked against, if
+	// the table opted into versioning.
+	VersionColumn string
+
+	// CacheTTL is how long read results of the table may be cached, if it opted in.
+	CacheTTL time.Duration
+}
+
+func (s *TableSchema) Column(name string) (ColumnInfo, bool) {
+	i, ok := s.byName[strings.ToLower(name)]
+	if !ok {
+		return ColumnInfo{}, false
+	}
+	return s.Columns[i], true
+}
+
+func (s *TableSchema) HasColumn(name string) bool {
+	_, ok := s.byName[strings.ToLower(name)]
+	return ok
+}
+
+// PrimaryKey returns the primary key columns in table order, or nil if there is none.
+func (s *TableSchema) PrimaryKey() []string {
+	var pk []string
+	for _, c := range s.Columns {
+		if c.Key == "PRI" {
+			pk = append(pk, c.Name)
+		}
+	}
+	return pk
+}
+
+// AutoIncrementColumn returns the auto-increment column of the table, or "" if it has none.
+func (s *TableSchema) AutoIncrementColumn() string {
+	for _, c := range s.Columns {
+		if c.AutoIncrement {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+func (s *TableSchema) ColumnNames() []string {
+	names := make([]string, len(s.Columns))
+	for i, c := range s.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// loadTableSchema returns the columns of a table from the schema cache, loading them on a miss.
+// The returned schema is shared and must not be modified.
+func loadTableSchema(dbName, table string) (*TableSchema, error) {
+	key := dbName + "." + table
+	schemaCacheMutex.Lock()
+	entry, ok := schemaCache[key]
+	schemaCacheMutex.Unlock()
+	if ok && time.Since(entry.loadedAt) < schemaCacheTTL {
+		return entry.schema, nil
+	}
+
+	schema, err := fetchTableSchema(dbName, table)
+	if err != nil {
+		return nil, err
+	}
+	schemaCacheMutex.Lock()
+	schemaCache[key] = schemaCacheEntry{schema: schema, loadedAt: time.Now()}
+	schemaCacheMutex.Unlock()
+	return schema, nil
+}
+
+// invalidateTableSchema drops a table from the schema cache, or every table of the database
+// when table is empty. Cached statements of the table are dropped with it; those of a whole
+// database go when its pool is closed.
+func invalidateTableSchema(dbName, table string) {
+	schemaCacheMutex.Lock()
+	defer schemaCacheMutex.Unlock()
+	if table != "" {
+		delete(schemaCache, dbName+"."+table)
+		invalidateStatements(table)
+		return
+	}
+	for key := range schemaCache {
+		if strings.HasPrefix(key, dbName+".") {
+			delete(schemaCache, key)
+		}
+	}
+}
+
+func fetchTableSchema(dbName, table string) (*TableSchema, error) {
+	rows, err := db.Query(`
+		SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, IS_NULLABLE, COLUMN_KEY, EXTRA
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?
+		ORDER BY ORDINAL_POSITION`, dbName, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load columns of '%s.%s': %w", dbName, table, err)
+	}
+	defer rows.Close()
+
+	schema := &TableSchema{DBName: dbName, Table: table, byName: make(map[string]int)}
+	for rows.Next() {
+		var col ColumnInfo
+		var nullable, extra string
+		if err := rows.Scan(&col.Name, &col.DataType, &col.ColumnType, &nullable, &col.Key, &extra); err != nil {
+			return nil, fmt.Errorf("failed to scan column of '%s.%s': %w", dbName, table, err)
+		}
+		col.Nullable = nullable == "YES"
+		col.AutoIncrement = strings.Contains(strings.ToLower(extra), "auto_increment")
+		schema.byName[strings.ToLower(col.Name)] = len(schema.Columns)
+		schema.Columns = append(schema.Columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(schema.Columns) == 0 {
+		return nil, fmt.Errorf("table '%s.%s' does not exist", dbName, table)
+	}
+	if schema.VersionColumn, err = loadVersionColumn(dbName, table); err != nil {
+		return nil, err
+	}
+	if schema.CacheTTL, err = loadCacheTTL(dbName, table); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// loadUniqueKeys returns the column lists of the table's PRIMARY and UNIQUE indexes.
+func loadUniqueKeys(dbName, table string) (map[string][]string, error) {
+	rows, err := db.Query(`
+		SELECT INDEX_NAME, COLUMN_NAME
+		FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND NON_UNIQUE = 0
+		ORDER BY INDEX_NAME, SEQ_IN_INDEX`, dbName, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load unique keys of '%s.%s': %w", dbName, table, err)
+	}
+	defer rows.Close()
+
+	indexes := make(map[string][]string)
+	for rows.Next() {
+		var index, column string
+		if err := rows.Scan(&index, &column); err != nil {
+			return nil, err
+		}
+		indexes[index] = append(indexes[index], column)
+	}
+	return indexes, rows.Err()
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "") + "`"
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTxTimeout = 60 * time.Second
+	maxTxTimeout     = 10 * time.Minute
+)
+
+type txOperation struct {
+	Operation       string                 `json:"operation"`
+	Table           string                 `json:"table"`
+	Data            map[string]interface{} `json:"data,omitempty"`
+	Where           map[string]interface{} `json:"where,omitempty"`
+	Filter          *Filter                `json:"filter,omitempty"`
+	ShardKeyValue   interface{}            `json:"shardKeyValue,omitempty"`
+	Columns         []string               `json:"columns,omitempty"`
+	OrderBy         []OrderTerm            `json:"orderBy,omitempty"`
+	Limit           int                    `json:"limit,omitempty"`
+	ExpectedVersion *int64                 `json:"expectedVersion,omitempty"`
+}
+
+// txSession is an open MySQL transaction bound to one shard. Sessions live on the master;
+// slaves forward every transaction call to it.
+type txSession struct {
+	mu        sync.Mutex
+	ID        string
+	DBName    string
+	ShardID   int
+	Bound     bool
+	ExpiresAt time.Time
+	tx        *sql.Tx
+	release   func()
+	schemas   map[string]*TableSchema
+	writes    []txOperation
+	changes   []rowChange
+	done      bool
+}
+
+var (
+	txSessions      = make(map[string]*txSession)
+	txSessionsMutex = &sync.Mutex{}
+)
+
+func openTxSession(dbName string, timeout time.Duration) (*txSession, error) {
+	conn, release, err := getDBConn(dbName)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to DB: %w", err)
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	return &txSession{
+		ID:        newIdempotencyKey("tx"),
+		DBName:    dbName,
+		ExpiresAt: time.Now().Add(timeout),
+		tx:        tx,
+		release:   release,
+		schemas:   make(map[string]*TableSchema),
+	}, nil
+}
+
+// resolveOpShard returns the shard an operation targets, routed like a single CRUD write.
+func resolveOpShard(dbName string, op *txOperation) (shardID int, shardKey string, err error) {
+	if op.Table == "" {
+		return 0, "", fmt.Errorf("table is required for every operation")
+	}
+	op.Table = SanitizeIdentifier(op.Table)
+
+	tableShardID, shardKey, err := lookupTableShard(dbName, op.Table)
+	if err != nil {
+		return 0, "", fmt.Errorf("error retrieving shard info: %w", err)
+	}
+	shardID, err = itemShard(&crudBatchItem{
+		Operation:     op.Operation,
+		Data:          op.Data,
+		Where:         op.Where,
+		Filter:        op.Filter,
+		ShardKeyValue: op.ShardKeyValue,
+	}, shardKey, tableShardID)
+	return shardID, shardKey, err
+}
+
+// applyTxOperation runs one operation through exec, which is a transaction or an XA branch
+// bound to shardID. The row changes of a write are returned for the caller to record in the
+// same transaction.
+func applyTxOperation(exec sqlExecutor, op *txOperation, schema *TableSchema, shardKey string, shardID int) (interface{}, []rowChange, error) {
+	data, err := coerceRow(schema, op.Data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid data: %w", err)
+	}
+	var whereSQL string
+	var whereArgs []interface{}
+	if op.Operation != "create" {
+		whereSQL, whereArgs, err = compileFilter(combineFilters(whereToFilter(op.Where), op.Filter), schema)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+
+	spec := changeSpec{Operation: op.Operation, Data: data, WhereSQL: whereSQL, WhereArgs: whereArgs}
+	switch op.Operation {
+	case "create":
+		if op.Data == nil {
+			return nil, nil, fmt.Errorf("data required for create")
+		}
+		return captureWrite(exec, schema, spec, func(exec sqlExecutor) (interface{}, error) {
+			return executeCreate(exec, op.Table, data)
+		})
+	case "read":
+		if schema.VersionColumn != "" && len(op.Columns) > 0 && !containsFold(op.Columns, schema.VersionColumn) {
+			op.Columns = append(op.Columns, schema.VersionColumn)
+		}
+		plan, err := buildReadPlan(&crudRequest{Columns: op.Columns, OrderBy: op.OrderBy, Limit: op.Limit}, schema)
+		if err != nil {
+			return nil, nil, err
+		}
+		if shardKey != "" {
+			predicate, predArgs := shardPredicateSQL(shardKey, shardID)
+			whereSQL, whereArgs = andSQL(whereSQL, whereArgs, predicate, predArgs)
+		}
+		rows, err := executeRead(exec, plan, whereSQL, whereArgs)
+		if err != nil {
+			return nil, nil, err
+		}
+		return finishPage(plan, rows).Rows, nil, nil
+	case "update":
+		if op.Data == nil || whereSQL == "" {
+			return nil, nil, fmt.Errorf("data and where or filter required for update")
+		}
+		return captureWrite(exec, schema, spec, func(exec sqlExecutor) (interface{}, error) {
+			return executeUpdate(exec, schema, data, whereSQL, whereArgs, op.ExpectedVersion)
+		})
+	case "delete":
+		if whereSQL == "" {
+			return nil, nil, fmt.Errorf("where or filter required for delete")
+		}
+		return captureWrite(exec, schema, spec, func(exec sqlExecutor) (interface{}, error) {
+			return executeDelete(exec, schema, whereSQL, whereArgs, op.ExpectedVersion)
+		})
+	}
+	return nil, nil, fmt.Errorf("invalid operation '%s'", op.Operation)
+}
+
+// apply runs one operation inside the session's transaction after checking that it targets
+// the shard the session is bound to. The first operation that succeeds binds the session to
+// its shard. The operation is cancelled when ctx ends.
+func (s *txSession) apply(ctx context.Context, op *txOperation) (interface{}, error) {
+	shardID, shardKey, err := resolveOpShard(s.DBName, op)
+	if err != nil {
+		// An unpinned read inside a bound transaction is confined to the bound shard.
+		if op.Operation != "read" || !s.Bound || op.Table == "" {
+			return nil, err
+		}
+		shardID = s.ShardID
+	}
+	if s.Bound && shardID != s.ShardID {
+		return nil, fmt.Errorf("operation on '%s' targets shard %d but the transaction is bound to shard %d", op.Table, shardID, s.ShardID)
+	}
+
+	schema, ok := s.schemas[op.Table]
+	if !ok {
+		if schema, err = loadTableSchema(s.DBName, op.Table); err != nil {
+			return nil, err
+		}
+		s.schemas[op.Table] = schema
+	}
+	result, changes, err := applyTxOperation(withContext(ctx, s.tx), op, schema, shardKey, shardID)
+	if err != nil {
+		return nil, err
+	}
+	s.ShardID, s.Bound = shardID, true
+	s.changes = append(s.changes, changes...)
+	return result, nil
+}
+
+// commit records the session's changes, its webhook deliveries and the idempotency key of the
+// request ctx belongs to in the transaction, and commits it.
+func (s *txSession) commit(ctx context.Context) error {
+	s.done = true
+	defer s.release()
+	var signal map[string]interface{}
+	if len(s.writes) > 0 && currentRole == RoleMaster {
+		signal = map[string]interface{}{
+			"operation":  "transaction",
+			"dbName":     s.DBName,
+			"txId":       s.ID,
+			"operations": s.writes,
+			"shardId":    float64(s.ShardID),
+		}
+	}
+	if err := recordChanges(s.tx, s.changes); err != nil {
+		s.tx.Rollback()
+		return err
+	}
+	if err := queueWebhooks(s.tx, signal); err != nil {
+		s.tx.Rollback()
+		return err
+	}
+	if err := recordIdempotencyKey(ctx, s.tx, nil); err != nil {
+		s.tx.Rollback()
+		return err
+	}
+	if err := s.tx.Commit(); err != nil {
+		return err
+	}
+	if len(s.changes) > 0 {
+		notifyChangeLog()
+	}
+	if signal != nil {
+		log.Printf("Master committed transaction %s on '%s' (shard %d, %d writes). Initiating HTTP replication signal.",
+			s.ID, s.DBName, s.ShardID, len(s.writes))
+		replicateToNodes(signal)
+	}
+	return nil
+}
+
+func (s *txSession) rollback() error {
+	s.done = true
+	defer s.release()
+	return s.tx.Rollback()
+}
+
+func getTxSession(id string) (*txSession, error) {
+	txSessionsMutex.Lock()
+	s, ok := txSessions[id]
+	txSessionsMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("transaction '%s' not found or already finished", id)
+	}
+	return s, nil
+}
+
+func removeTxSession(id string) {
+	txSessionsMutex.Lock()
+	delete(txSessions, id)
+	txSessionsMutex.Unlock()
+}
+
+// reapExpiredTransactions rolls back sessions that outlived their timeout.
+func reapExpiredTransactions() {
+	for {
+		time.Sleep(5 * time.Second)
+		txSessionsMutex.Lock()
+		var expired []*txSession
+		for id, s := range txSessions {
+			if time.Now().After(s.ExpiresAt) {
+				expired = append(expired, s)
+				delete(txSessions, id)
+			}
+		}
+		txSessionsMutex.Unlock()
+
+		for _, s := range expired {
+			s.mu.Lock()
+			if !s.done {
+				log.Printf("Transaction %s on '%s' timed out, rolling back", s.ID, s.DBName)
+				if err := s.rollback(); err != nil {
+					log.Printf("Error rolling back expired transaction %s: %v", s.ID, err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func isWriteOp(operation string) bool {
+	return operation == "create" || operation == "update" || operation == "delete"
+}
+
+// transactionHandler runs an ordered list of operations atomically in one request.
+func transactionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+	if currentRole == RoleSlave {
+		log.Println("Slave node received transaction request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		DBName     string        `json:"dbName"`
+		Operations []txOperation `json:"operations"`
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request body: " + err.Error()})
+		return
+	}
+	if err := decodeJSONNumbers(bodyBytes, &req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request format: " + err.Error()})
+		return
+	}
+	if req.DBName == "" || len(req.Operations) == 0 {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "DB name and operations required"})
+		return
+	}
+
+	session, err := openTxSession(SanitizeIdentifier(req.DBName), defaultTxTimeout)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	results := make([]interface{}, 0, len(req.Operations))
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		result, err := session.apply(r.Context(), op)
+		if err != nil {
+			if r.Context().Err() != nil {
+				err = requestEndedError(r.Context())
+			}
+			session.rollback()
+			log.Printf("Transaction %s rolled back at operation %d: %v", session.ID, i, err)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: fmt.Sprintf("Operation %d (%s on '%s') failed, transaction rolled back: %v", i, op.Operation, op.Table, err),
+			})
+			return
+		}
+		if isWriteOp(op.Operation) {
+			session.writes = append(session.writes, *op)
+		}
+		results = append(results, result)
+	}
+
+	if err := session.commit(r.Context()); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Commit failed: " + err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: fmt.Sprintf("Transaction committed on shard %d", session.ShardID),
+		Result:  map[string]interface{}{"shardId": session.ShardID, "results": results},
+	})
+}
+
+func beginTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+	if currentRole == RoleSlave {
+		log.Println("Slave node received begin-transaction request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		DBName         string `json:"dbName"`
+		TimeoutSeconds int    `json:"timeoutSeconds,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request format: " + err.Error()})
+		return
+	}
+	if req.DBName == "" {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "DB name required"})
+		return
+	}
+
+	timeout := defaultTxTimeout
+	if req.TimeoutSeconds > 0 {
+		timeout = time.Duration(req.TimeoutSeconds) * time.Second
+	}
+	if timeout > maxTxTimeout {
+		timeout = maxTxTimeout
+	}
+
+	session, err := openTxSession(SanitizeIdentifier(req.DBName), timeout)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+		return
+	}
+	txSessionsMutex.Lock()
+	txSessions[session.ID] = session
+	txSessionsMutex.Unlock()
+
+	log.Printf("Began transaction %s on '%s' (expires %s)", session.ID, session.DBName, session.ExpiresAt.Format(time.RFC3339))
+	json.NewEncoder(w).Encode(Response{
+		Success: true,
+		Message: "Transaction started",
+		Result:  map[string]interface{}{"txId": session.ID, "expiresAt": session.ExpiresAt},
+	})
+}
+
+func transactionOpHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+	if currentRole == RoleSlave {
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		TxID string `json:"txId"`
+		txOperation
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request format: " + err.Error()})
+		return
+	}
+	session, err := getTxSession(req.TxID)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.done || time.Now().After(session.ExpiresAt) {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Transaction has expired"})
+		return
+	}
+
+	// A failed operation aborts the transaction, as it does in /api/transaction: a statement
+	// that failed part way may have left some of its rows changed.
+	op := req.txOperation
+	result, err := session.apply(r.Context(), &op)
+	if err != nil {
+		if r.Context().Err() != nil {
+			err = requestEndedError(r.Context())
+		}
+		removeTxSession(session.ID)
+		session.rollback()
+		log.Printf("Transaction %s rolled back after a failed operation: %v", session.ID, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Operation failed, transaction rolled back: %v", err)})
+		return
+	}
+	if isWriteOp(op.Operation) {
+		session.writes = append(session.writes, op)
+	}
+	json.NewEncoder(w).Encode(Response{Success: true, Result: result})
+}
+
+func commitTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	finishTransaction(w, r, true)
+}
+
+func rollbackTransactionHandler(w http.ResponseWriter, r *http.Request) {
+	finishTransaction(w, r, false)
+}
+
+func finishTransaction(w http.ResponseWriter, r *http.Request, commit bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+	if currentRole == RoleSlave {
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		TxID string `json:"txId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request format: " + err.Error()})
+		return
+	}
+	session, err := getTxSession(req.TxID)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	removeTxSession(session.ID)
+	if session.done {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Transaction already finished"})
+		return
+	}
+
+	if commit {
+		if err := session.commit(r.Context()); err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Commit failed: " + err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(Response{Success: true, Message: fmt.Sprintf("Transaction %s committed", session.ID)})
+		return
+	}
+
+	if err := session.rollback(); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Rollback failed: " + err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(Response{Success: true, Message: fmt.Sprintf("Transaction %s rolled back", session.ID)})
+}
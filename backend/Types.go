@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Values of CRUD requests are decoded with json.Number so that BIGINT and DECIMAL values reach
+// MySQL with all their digits; coerceValue then converts them by column type.
+//
+// Results are encoded by column type:
+//   - integer columns as JSON numbers, DECIMAL as a JSON number with the column's exact digits
+//   - DATETIME and TIMESTAMP as RFC 3339 in UTC, DATE as "2006-01-02", TIME as "15:04:05"
+//   - JSON columns as the JSON document itself
+//   - BLOB, BINARY and VARBINARY as base64 strings, which is also how they are written
+//
+// Writes accept the same encodings.
+
+// decodeJSONNumbers unmarshals a request body, keeping numbers as json.Number.
+func decodeJSONNumbers(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+var integerBits = map[string]uint{
+	"tinyint":   8,
+	"smallint":  16,
+	"mediumint": 24,
+	"int":       32,
+	"integer":   32,
+	"bigint":    64,
+}
+
+// coerceRow converts the values of a row to be written to the types of their columns.
+func coerceRow(schema *TableSchema, data map[string]interface{}) (map[string]interface{}, error) {
+	if data == nil {
+		return nil, nil
+	}
+	out := make(map[string]interface{}, len(data))
+	for name, v := range data {
+		col, ok := schema.Column(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown column '%s' for table '%s'", name, schema.Table)
+		}
+		value, err := coerceValue(col, v)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+// coerceValue converts a decoded JSON value to the Go value the MySQL driver should bind for
+// col, or explains why the value does not fit the column.
+func coerceValue(col ColumnInfo, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch col.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		return coerceInteger(col, v)
+	case "year":
+		return coerceInteger(ColumnInfo{Name: col.Name, DataType: "smallint", ColumnType: col.ColumnType}, v)
+	case "bit":
+		return coerceInteger(ColumnInfo{Name: col.Name, DataType: "bigint", ColumnType: "bigint unsigned"}, v)
+	case "decimal", "numeric":
+		return coerceDecimal(col, v)
+	case "float", "double", "real":
+		return coerceFloat(col, v)
+	case "date", "datetime", "timestamp":
+		return coerceTime(col, v)
+	case "json":
+		return coerceJSON(col, v)
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		s, ok := v.(string)
+		if !ok {
+			return nil, typeError(col, "base64-encoded bytes", v)
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, typeError(col, "base64-encoded bytes", v)
+		}
+		return b, nil
+	}
+	return coerceText(col, v)
+}
+
+func typeError(col ColumnInfo, expected string, v interface{}) error {
+	var got string
+	switch val := v.(type) {
+	case string:
+		got = strconv.Quote(val)
+		if len(got) > 40 {
+			got = got[:37] + "...\""
+		}
+	case json.Number:
+		got = val.String()
+	case bool:
+		got = strconv.FormatBool(val)
+	case map[string]interface{}:
+		got = "an object"
+	case []interface{}:
+		got = "an array"
+	default:
+		got = fmt.Sprint(v)
+	}
+	return fmt.Errorf("column '%s' (%s) expects %s, got %s", col.Name, col.ColumnType, expected, got)
+}
+
+// numericText returns the text of a numeric JSON value, or of a string holding a number.
+func numericText(v interface{}) (string, bool) {
+	switch val := v.(type) {
+	case json.Number:
+		return val.String(), true
+	case string:
+		s := strings.TrimSpace(val)
+		return s, s != ""
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), true
+	case int64:
+		return strconv.FormatInt(val, 10), true
+	case int:
+		return strconv.Itoa(val), true
+	}
+	return "", false
+}
+
+func coerceInteger(col ColumnInfo, v interface{}) (interface{}, error) {
+	if b, ok := v.(bool); ok {
+		if b {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	s, ok := numericText(v)
+	if !ok {
+		return nil, typeError(col, "an integer", v)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || !r.IsInt() {
+		return nil, typeError(col, "an integer", v)
+	}
+	n := r.Num()
+
+	bits := integerBits[col.DataType]
+	if bits == 0 {
+		bits = 64
+	}
+	var lo, hi *big.Int
+	if strings.Contains(col.ColumnType, "unsigned") {
+		lo = big.NewInt(0)
+		hi = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), bits), big.NewInt(1))
+	} else {
+		hi = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), bits-1), big.NewInt(1))
+		lo = new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), bits-1))
+	}
+	if n.Cmp(lo) < 0 || n.Cmp(hi) > 0 {
+		return nil, fmt.Errorf("column '%s' (%s) value %s is out of range [%s, %s]", col.Name, col.ColumnType, n, lo, hi)
+	}
+	if n.IsInt64() {
+		return n.Int64(), nil
+	}
+	return n.Uint64(), nil
+}
+
+// decimalPrecision returns the precision and scale of a "decimal(p,s)" column type.
+func decimalPrecision(columnType string) (int, int) {
+	open := strings.IndexByte(columnType, '(')
+	end := strings.IndexByte(columnType, ')')
+	if open < 0 || end < open {
+		return 10, 0
+	}
+	parts := strings.Split(columnType[open+1:end], ",")
+	precision, _ := strconv.Atoi(strings.TrimSpace(parts[0]))
+	scale := 0
+	if len(parts) > 1 {
+		scale, _ = strconv.Atoi(strings.TrimSpace(parts[1]))
+	}
+	return precision, scale
+}
+
+// coerceDecimal passes DECIMAL values to MySQL as text, so that they are never rounded through
+// float64.
+func coerceDecimal(col ColumnInfo, v interface{}) (interface{}, error) {
+	s, ok := numericText(v)
+	if !ok {
+		return nil, typeError(col, "a decimal number", v)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, typeError(col, "a decimal number", v)
+	}
+	precision, scale := decimalPrecision(col.ColumnType)
+	intPart := new(big.Int).Quo(new(big.Int).Abs(r.Num()), r.Denom())
+	if intPart.Sign() != 0 && len(intPart.String()) > precision-scale {
+		return nil, fmt.Errorf("column '%s' (%s) value %s is out of range", col.Name, col.ColumnType, s)
+	}
+	if strings.ContainsAny(s, "eE") {
+		s = r.FloatString(scale)
+	}
+	return s, nil
+}
+
+func coerceFloat(col ColumnInfo, v interface{}) (interface{}, error) {
+	s, ok := numericText(v)
+	if !ok {
+		return nil, typeError(col, "a number", v)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, typeError(col, "a number", v)
+	}
+	return f, nil
+}
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// coerceTime accepts the RFC 3339 values reads return as well as MySQL's own formats. Values
+// with a zone are converted to UTC, the zone the driver reads them back in.
+func coerceTime(col ColumnInfo, v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, typeError(col, "a date string", v)
+	}
+	if strings.HasPrefix(s, "0000-00-00") {
+		return s, nil
+	}
+	for _, layout := range timeLayouts {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		if col.DataType == "date" {
+			return t.Format("2006-01-02"), nil
+		}
+		return t.UTC().Format("2006-01-02 15:04:05.999999"), nil
+	}
+	return nil, typeError(col, "a date in RFC 3339 or 'YYYY-MM-DD hh:mm:ss' format", v)
+}
+
+// coerceJSON stores objects, arrays, numbers and booleans as the JSON document they are.
+// Strings must already hold JSON text.
+func coerceJSON(col ColumnInfo, v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		if !json.Valid([]byte(s)) {
+			return nil, typeError(col, "a JSON document (string values must hold JSON text)", v)
+		}
+		return s, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, typeError(col, "a JSON document", v)
+	}
+	return string(b), nil
+}
+
+func coerceText(col ColumnInfo, v interface{}) (interface{}, error) {
+	var s string
+	switch val := v.(type) {
+	case string:
+		s = val
+	case json.Number:
+		s = val.String()
+	case bool:
+		s = strconv.FormatBool(val)
+	default:
+		if text, ok := numericText(v); ok {
+			s = text
+		} else {
+			return nil, typeError(col, "a string", v)
+		}
+	}
+
+	switch col.DataType {
+	case "char", "varchar":
+		if max, _ := decimalPrecision(col.ColumnType); max > 0 && utf8.RuneCountInString(s) > max {
+			return nil, fmt.Errorf("column '%s' (%s) value is %d characters long, longer than %d", col.Name, col.ColumnType, utf8.RuneCountInString(s), max)
+		}
+	case "enum":
+		allowed := enumValues(col.ColumnType)
+		if !containsFold(allowed, s) {
+			return nil, fmt.Errorf("column '%s' value %q is not one of %s", col.Name, s, strings.Join(allowed, ", "))
+		}
+	}
+	return s, nil
+}
+
+// enumValues parses the members of an "enum('a','b')" column type.
+func enumValues(columnType string) []string {
+	open := strings.IndexByte(columnType, '(')
+	end := strings.LastIndexByte(columnType, ')')
+	if open < 0 || end < open {
+		return nil
+	}
+	var values []string
+	for _, part := range strings.Split(columnType[open+1:end], "','") {
+		part = strings.TrimSuffix(strings.TrimPrefix(part, "'"), "'")
+		values = append(values, strings.ReplaceAll(part, "''", "'"))
+	}
+	return values
+}
+
+// rowScanner reads rows of a result set as JSON-ready values, typed by the column types MySQL
+// reports for the result.
+type rowScanner struct {
+	columns []string
+	types   []string
+}
+
+func newRowScanner(rows *sql.Rows) (*rowScanner, error) {
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	s := &rowScanner{columns: make([]string, len(columnTypes)), types: make([]string, len(columnTypes))}
+	for i, ct := range columnTypes {
+		s.columns[i] = ct.Name()
+		s.types[i] = ct.DatabaseTypeName()
+	}
+	return s, nil
+}
+
+func (s *rowScanner) scan(rows *sql.Rows) (map[string]interface{}, error) {
+	values := make([]interface{}, len(s.columns))
+	ptrs := make([]interface{}, len(s.columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+	entry := make(map[string]interface{}, len(s.columns))
+	for i, col := range s.columns {
+		entry[col] = resultValue(s.types[i], values[i])
+	}
+	return entry, nil
+}
+
+// resultValue converts a scanned value to its JSON encoding. The driver returns text for
+// queries without arguments and native values for prepared ones; both end up the same.
+func resultValue(dbType string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	b, isBytes := v.([]byte)
+	unsigned := strings.HasPrefix(dbType, "UNSIGNED ")
+	switch strings.TrimPrefix(dbType, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "YEAR":
+		if !isBytes {
+			return v
+		}
+		if unsigned {
+			if n, err := strconv.ParseUint(string(b), 10, 64); err == nil {
+				return n
+			}
+		} else if n, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+			return n
+		}
+	case "DECIMAL":
+		if isBytes {
+			return json.Number(string(b))
+		}
+	case "FLOAT", "DOUBLE":
+		switch f := v.(type) {
+		case float32:
+			return float64(f)
+		case []byte:
+			if n, err := strconv.ParseFloat(string(f), 64); err == nil {
+				return n
+			}
+		}
+		return v
+	case "DATE":
+		if t, ok := v.(time.Time); ok {
+			return t.Format("2006-01-02")
+		}
+	case "DATETIME", "TIMESTAMP":
+		if t, ok := v.(time.Time); ok {
+			return t.UTC()
+		}
+	case "JSON":
+		if isBytes {
+			return json.RawMessage(b)
+		}
+	case "BIT":
+		if isBytes {
+			var n uint64
+			for _, c := range b {
+				n = n<<8 | uint64(c)
+			}
+			return n
+		}
+	case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB", "BINARY", "VARBINARY", "GEOMETRY":
+		return v
+	}
+	if isBytes {
+		return string(b)
+	}
+	return v
+}
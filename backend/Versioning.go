@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultVersionColumn = "row_version"
+
+// versionConflictError is returned when an update or delete carries an expectedVersion that no
+// longer matches the row. Row is the row as it is now.
+type versionConflictError struct {
+	Table    string
+	Expected int64
+	Current  interface{}
+	Row      map[string]interface{}
+}
+
+func (e *versionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on table '%s': expected version %d, row has version %v",
+		e.Table, e.Expected, e.Current)
+}
+
+// loadVersionColumn returns the version column a table opted into, or "" if it has none.
+func loadVersionColumn(dbName, table string) (string, error) {
+	var column string
+	err := db.QueryRow("SELECT version_column FROM cluster.table_versions WHERE db_name = ? AND table_name = ?",
+		dbName, table).Scan(&column)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to load version column of '%s.%s': %w", dbName, table, err)
+	}
+	return column, nil
+}
+
+// checkVersionedData rejects writes that set the version column themselves; the server bumps
+// it on every change.
+func checkVersionedData(schema *TableSchema, data map[string]interface{}) error {
+	if schema.VersionColumn == "" {
+		return nil
+	}
+	for col := range data {
+		if strings.EqualFold(col, schema.VersionColumn) {
+			return fmt.Errorf("column '%s' is the version column of table '%s' and is maintained by the server", schema.VersionColumn, schema.Table)
+		}
+	}
+	return nil
+}
+
+// versionBumpSQL is the SET clause that increments the version column when any of the
+// comparisons fails, that is when the row actually changes. MySQL evaluates SET assignments
+// from left to right, so it must come before the assignments it compares against.
+func versionBumpSQL(versionColumn string, comparisons []string) string {
+	v := quoteIdentifier(versionColumn)
+	return fmt.Sprintf("%s = IF(%s, %s, %s + 1)", v, strings.Join(comparisons, " AND "), v, v)
+}
+
+// versionedWhere adds the expected version to the condition of an update or delete.
+func versionedWhere(schema *TableSchema, whereSQL string, whereArgs []interface{}, expectedVersion *int64) (string, []interface{}, error) {
+	if expectedVersion == nil {
+		return whereSQL, whereArgs, nil
+	}
+	if schema.VersionColumn == "" {
+		return "", nil, fmt.Errorf("expectedVersion given, but table '%s' has no version column", schema.Table)
+	}
+	versionSQL := fmt.Sprintf("%s = ?", quoteIdentifier(schema.VersionColumn))
+	whereSQL, whereArgs = andSQL(whereSQL, whereArgs, versionSQL, []interface{}{*expectedVersion})
+	return whereSQL, whereArgs, nil
+}
+
+// checkVersionConflict explains a versioned update or delete that matched no row: if the row
+// still exists with another version, it was changed since the client read it.
+func checkVersionConflict(dbConn sqlExecutor, schema *TableSchema, whereSQL string, whereArgs []interface{}, expectedVersion int64) error {
+	rows, err := executeRead(dbConn, &readPlan{Table: schema.Table, Limit: 1}, whereSQL, whereArgs)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	current := rows[0]
+	if fmt.Sprint(current[schema.VersionColumn]) == fmt.Sprint(expectedVersion) {
+		// The row has the expected version; the write just did not change anything.
+		return nil
+	}
+	log.Printf("Version conflict on '%s.%s': expected %d, found %v", schema.DBName, schema.Table, expectedVersion, current[schema.VersionColumn])
+	return &versionConflictError{Table: schema.Table, Expected: expectedVersion, Current: current[schema.VersionColumn], Row: current}
+}
+
+// enableVersioningHandler opts a table into optimistic concurrency control. The version column
+// is added if it does not exist yet; existing rows start at version 1.
+func enableVersioningHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	if currentRole == RoleSlave {
+		log.Println("Slave node received enableVersioning request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		DBName string `json:"dbName"`
+		Table  string `json:"table"`
+		Column string `json:"column,omitempty"`
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request body: " + err.Error()})
+		return
+	}
+	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request: " + err.Error()})
+		return
+	}
+	if req.DBName == "" || req.Table == "" {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "DB name and table required"})
+		return
+	}
+
+	safeDBName := SanitizeIdentifier(req.DBName)
+	safeTable := SanitizeIdentifier(req.Table)
+	column := SanitizeIdentifier(req.Column)
+	if column == "" {
+		column = defaultVersionColumn
+	}
+
+	schema, err := loadTableSchema(safeDBName, safeTable)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error loading table schema: " + err.Error()})
+		return
+	}
+	if col, ok := schema.Column(column); ok {
+		switch col.DataType {
+		case "tinyint", "smallint", "mediumint", "int", "bigint":
+			column = col.Name
+		default:
+			json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Column '%s' has type %s; a version column must be an integer", col.Name, col.DataType)})
+			return
+		}
+	} else {
+		query := fmt.Sprintf("ALTER TABLE %s.%s ADD COLUMN %s BIGINT UNSIGNED NOT NULL DEFAULT 1",
+			quoteIdentifier(safeDBName), quoteIdentifier(safeTable), quoteIdentifier(column))
+		if err := executeSQL(query); err != nil {
+			log.Printf("Error adding version column '%s' to '%s.%s' on master: %v", column, safeDBName, safeTable, err)
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error adding version column: " + err.Error()})
+			return
+		}
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO cluster.table_versions (db_name, table_name, version_column, created_at)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE version_column = VALUES(version_column)`,
+		safeDBName, safeTable, column, time.Now())
+	if err != nil {
+		log.Printf("Error recording version column of '%s.%s' on master: %v", safeDBName, safeTable, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error recording version column: " + err.Error()})
+		return
+	}
+	log.Printf("Table '%s.%s' uses version column '%s'.", safeDBName, safeTable, column)
+	invalidateTableSchema(safeDBName, safeTable)
+
+	shardID := calculateShardID(safeDBName + "." + safeTable)
+	replicateToNodes(map[string]interface{}{
+		"operation":     "enable_versioning",
+		"dbName":        safeDBName,
+		"table":         safeTable,
+		"versionColumn": column,
+		"shardId":       float64(shardID),
+	})
+
+	json.NewEncoder(w).Encode(Response{Success: true, Message: fmt.Sprintf("Table '%s' is versioned by column '%s'", safeTable, column)})
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhooks POST the replication signal of a committed write to an external URL. The master
+// writes one delivery per matching webhook to cluster.webhook_deliveries, the outbox, in the
+// transaction of the write, and a background loop sends it, retrying failures with
+// exponential backoff. The outbox lives in the cluster database, so a new master resumes the
+// deliveries its predecessor left pending.
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	webhookDeliveryBatch = 20
+)
+
+// webhookOperations are the write operations a webhook can filter on. Transactions are
+// matched by the operations they contain.
+var webhookOperations = []string{"create", "update", "delete", "upsert", "batch", "expire"}
+
+type webhook struct {
+	ID         int64     `json:"id"`
+	DBName     string    `json:"dbName"`
+	Table      string    `json:"table,omitempty"`
+	Operations []string  `json:"operations,omitempty"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type webhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhookId"`
+	Operation      string          `json:"operation"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"nextAttemptAt,omitempty"`
+	LastAttemptAt  *time.Time      `json:"lastAttemptAt,omitempty"`
+	LastStatusCode int             `json:"lastStatusCode,omitempty"`
+	LastError      string          `json:"lastError,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+}
+
+var (
+	// The registered webhooks are cached on the master and reloaded when they change or the
+	// cache is older than webhookCacheTTL, as after a failover.
+	webhookCache       []webhook
+	webhookCacheLoaded time.Time
+	webhookCacheMutex  sync.Mutex
+
+	// webhookWake starts a delivery round without waiting for the next tick.
+	webhookWake = make(chan struct{}, 1)
+)
+
+const webhookCacheTTL = 10 * time.Second
+
+func loadWebhooks(dbName string) ([]webhook, error) {
+	query := "SELECT id, db_name, table_name, operations, url, secret, created_at FROM cluster.webhooks"
+	var args []interface{}
+	if dbName != "" {
+		query += " WHERE db_name = ?"
+		args = append(args, dbName)
+	}
+	query += " ORDER BY id"
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var hooks []webhook
+	for rows.Next() {
+		var h webhook
+		var operations string
+		if err := rows.Scan(&h.ID, &h.DBName, &h.Table, &operations, &h.URL, &h.Secret, &h.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		if operations != "" {
+			h.Operations = strings.Split(operations, ",")
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+func cachedWebhooks() ([]webhook, error) {
+	webhookCacheMutex.Lock()
+	defer webhookCacheMutex.Unlock()
+	if time.Since(webhookCacheLoaded) < webhookCacheTTL {
+		return webhookCache, nil
+	}
+	hooks, err := loadWebhooks("")
+	if err != nil {
+		return nil, err
+	}
+	webhookCache, webhookCacheLoaded = hooks, time.Now()
+	return hooks, nil
+}
+
+func invalidateWebhookCache() {
+	webhookCacheMutex.Lock()
+	webhookCacheLoaded = time.Time{}
+	webhookCacheMutex.Unlock()
+}
+
+// signalWrites returns the table and operation of every write a replication signal reports.
+func signalWrites(signal map[string]interface{}) [][2]string {
+	operation, _ := signal["operation"].(string)
+	switch operation {
+	case "create", "update", "delete", "upsert", "batch", "expire":
+		table, _ := signal["table"].(string)
+		return [][2]string{{table, operation}}
+	case "transaction", "distributed_transaction":
+		var writes [][2]string
+		switch ops := signal["operations"].(type) {
+		case []txOperation:
+			for _, op := range ops {
+				writes = append(writes, [2]string{op.Table, op.Operation})
+			}
+		case []interface{}:
+			for _, op := range ops {
+				if m, ok := op.(map[string]interface{}); ok {
+					table, _ := m["table"].(string)
+					opName, _ := m["operation"].(string)
+					writes = append(writes, [2]string{table, opName})
+				}
+			}
+		}
+		return writes
+	}
+	return nil
+}
+
+func (h *webhook) matches(dbName string, writes [][2]string) bool {
+	if h.DBName != dbName {
+		return false
+	}
+	for _, write := range writes {
+		if h.Table != "" && h.Table != write[0] {
+			continue
+		}
+		if len(h.Operations) > 0 && !containsFold(h.Operations, write[1]) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// matchingWebhooks returns the webhooks a replication signal is delivered to. Deliveries are
+// only queued on the master.
+func matchingWebhooks(signal map[string]interface{}) ([]webhook, error) {
+	if currentRole != RoleMaster || db == nil || signal == nil {
+		return nil, nil
+	}
+	dbName, _ := signal["dbName"].(string)
+	writes := signalWrites(signal)
+	if dbName == "" || len(writes) == 0 {
+		return nil, nil
+	}
+	hooks, err := cachedWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	var matched []webhook
+	for _, h := range hooks {
+		if h.matches(dbName, writes) {
+			matched = append(matched, h)
+		}
+	}
+	return matched, nil
+}
+
+// queueWebhooks writes a delivery of a replication signal to the outbox for every webhook it
+// matches. It runs through exec, the transaction of the write the signal reports, so the
+// deliveries commit if and only if the write does.
+func queueWebhooks(exec sqlExecutor, signal map[string]interface{}) error {
+	hooks, err := matchingWebhooks(signal)
+	if err != nil {
+		return fmt.Errorf("failed to load webhooks: %w", err)
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	dbName, _ := signal["dbName"].(string)
+	operation, _ := signal["operation"].(string)
+	now := time.Now().UTC()
+	placeholders := make([]string, 0, len(hooks))
+	args := make([]interface{}, 0, len(hooks)*6)
+	for _, h := range hooks {
+		payload, err := json.Marshal(map[string]interface{}{
+			"webhookId":  h.ID,
+			"operation":  operation,
+			"dbName":     dbName,
+			"occurredAt": now,
+			"signal":     signal,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode payload for webhook %d: %w", h.ID, err)
+		}
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?)")
+		args = append(args, h.ID, operation, payload, deliveryPending, now, now)
+	}
+	_, err = exec.Exec("INSERT INTO cluster.webhook_deliveries (webhook_id, operation, payload, status, next_attempt_at, created_at) VALUES "+
+		strings.Join(placeholders, ", "), args...)
+	if err != nil {
+		return fmt.Errorf("failed to queue %d webhook deliveries: %w", len(placeholders), err)
+	}
+	return nil
+}
+
+// wakeWebhookDelivery starts a delivery round without waiting for the next tick, once a write
+// that may have queued deliveries has committed.
+func wakeWebhookDelivery() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverWebhooksLoop sends the due deliveries of the outbox on the master, and removes
+// finished deliveries older than webhooks.retention_hours.
+func deliverWebhooksLoop() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	lastPurge := time.Now()
+	for {
+		select {
+		case <-webhookWake:
+		case <-tick.C:
+		}
+		if currentRole != RoleMaster || db == nil {
+			continue
+		}
+		// Drain a backlog in consecutive batches, a bounded number per round.
+		for batch := 0; batch < 50 && deliverDueWebhooks() == webhookDeliveryBatch; batch++ {
+		}
+		if time.Since(lastPurge) > 10*time.Minute {
+			lastPurge = time.Now()
+			purgeWebhookDeliveries()
+		}
+	}
+}
+
+type dueDelivery struct {
+	id        int64
+	webhookID int64
+	operation string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// deliverDueWebhooks sends one batch of due deliveries in parallel and returns its size.
+func deliverDueWebhooks() int {
+	rows, err := db.Query(`
+		SELECT d.id, d.webhook_id, d.operation, d.payload, d.attempts, w.url, w.secret
+		FROM cluster.webhook_deliveries d JOIN cluster.webhooks w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT ?`, deliveryPending, time.Now().UTC(), webhookDeliveryBatch)
+	if err != nil {
+		log.Printf("Error loading due webhook deliveries: %v", err)
+		return 0
+	}
+	var due []dueDelivery
+	for rows.Next() {
+		var d dueDelivery
+		if err := rows.Scan(&d.id, &d.webhookID, &d.operation, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			log.Printf("Error scanning webhook delivery: %v", err)
+			continue
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	for _, d := range due {
+		wg.Add(1)
+		go func(d dueDelivery) {
+			defer wg.Done()
+			statusCode, err := sendWebhook(d)
+			recordWebhookAttempt(d, statusCode, err)
+		}(d)
+	}
+	wg.Wait()
+	return len(due)
+}
+
+// sendWebhook POSTs a delivery. The X-Webhook-Signature header carries the time of the
+// attempt and the hex HMAC-SHA256 of "<time>.<body>" keyed with the webhook secret.
+func sendWebhook(d dueDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(d.secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(d.payload)
+
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", strconv.FormatInt(d.webhookID, 10))
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.id, 10))
+	req.Header.Set("X-Webhook-Event", d.operation)
+	req.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	client := http.Client{Timeout: time.Duration(config.Webhooks.TimeoutSeconds) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordWebhookAttempt stores the outcome of an attempt. A failed delivery is retried after
+// backoff_base_seconds, doubled with every attempt up to backoff_max_seconds, until it has
+// been tried max_attempts times.
+func recordWebhookAttempt(d dueDelivery, statusCode int, sendErr error) {
+	now := time.Now().UTC()
+	attempts := d.attempts + 1
+	status := deliveryDelivered
+	var lastError, nextAttempt, deliveredAt interface{}
+	if sendErr == nil {
+		deliveredAt = now
+	} else {
+		lastError = sendErr.Error()
+		if attempts >= config.Webhooks.MaxAttempts {
+			status = deliveryFailed
+			log.Printf("Webhook delivery %d to webhook %d failed after %d attempts: %v", d.id, d.webhookID, attempts, sendErr)
+		} else {
+			status = deliveryPending
+			nextAttempt = now.Add(webhookBackoff(attempts))
+		}
+	}
+	var code interface{}
+	if statusCode != 0 {
+		code = statusCode
+	}
+	_, err := db.Exec(`
+		UPDATE cluster.webhook_deliveries
+		SET status = ?, attempts = ?, last_attempt_at = ?, last_status_code = ?, last_error = ?,
+			next_attempt_at = COALESCE(?, next_attempt_at), delivered_at = ?
+		WHERE id = ?`, status, attempts, now, code, lastError, nextAttempt, deliveredAt, d.id)
+	if err != nil {
+		log.Printf("Error recording attempt of webhook delivery %d: %v", d.id, err)
+	}
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := time.Duration(config.Webhooks.BackoffBaseSeconds) * time.Second
+	limit := time.Duration(config.Webhooks.BackoffMaxSeconds) * time.Second
+	for i := 1; i < attempts && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff > limit {
+		backoff = limit
+	}
+	// Up to 20% jitter keeps retries of a burst of failed deliveries from arriving together.
+	return backoff + time.Duration(rand.Int64N(int64(backoff)/5+1))
+}
+
+func purgeWebhookDeliveries() {
+	cutoff := time.Now().UTC().Add(-time.Duration(config.Webhooks.RetentionHours) * time.Hour)
+	res, err := db.Exec("DELETE FROM cluster.webhook_deliveries WHERE status <> ? AND created_at < ?", deliveryPending, cutoff)
+	if err != nil {
+		log.Printf("Error purging webhook deliveries: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Purged %d finished webhook deliveries", n)
+	}
+}
+
+// registerWebhookHandler registers a webhook on a database, optionally restricted to one
+// table and to some operations. The secret that signs the deliveries is generated unless one
+// is given; it is only returned by this call.
+func registerWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	if currentRole == RoleSlave {
+		log.Println("Slave node received registerWebhook request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		DBName     string   `json:"dbName"`
+		Table      string   `json:"table"`
+		Operations []string `json:"operations"`
+		URL        string   `json:"url"`
+		Secret     string   `json:"secret"`
+	}
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request body: " + err.Error()})
+		return
+	}
+	if err := json.Unmarshal(bodyBytes, &req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request: " + err.Error()})
+		return
+	}
+	if req.DBName == "" || req.URL == "" {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "DB name and url required"})
+		return
+	}
+	if !strings.HasPrefix(req.URL, "http://") && !strings.HasPrefix(req.URL, "https://") {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "url must start with http:// or https://"})
+		return
+	}
+	operations := make([]string, 0, len(req.Operations))
+	for _, op := range req.Operations {
+		op = strings.ToLower(strings.TrimSpace(op))
+		if !containsFold(webhookOperations, op) {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Invalid operation '%s'; use %s", op, strings.Join(webhookOperations, ", "))})
+			return
+		}
+		operations = append(operations, op)
+	}
+
+	h := webhook{
+		DBName:     SanitizeIdentifier(req.DBName),
+		Operations: operations,
+		URL:        req.URL,
+		Secret:     req.Secret,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if req.Table != "" {
+		h.Table = SanitizeIdentifier(req.Table)
+		if _, err := loadTableSchema(h.DBName, h.Table); err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error loading table schema: " + err.Error()})
+			return
+		}
+	}
+	if h.Secret == "" {
+		h.Secret = strings.TrimPrefix(newIdempotencyKey("whsec"), "whsec-")
+	}
+
+	res, err := db.Exec(`
+		INSERT INTO cluster.webhooks (db_name, table_name, operations, url, secret, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, h.DBName, h.Table, strings.Join(operations, ","), h.URL, h.Secret, h.CreatedAt)
+	if err != nil {
+		log.Printf("Error registering webhook on '%s': %v", h.DBName, err)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error registering webhook: " + err.Error()})
+		return
+	}
+	h.ID, _ = res.LastInsertId()
+	invalidateWebhookCache()
+	log.Printf("Registered webhook %d on '%s' (table %q, operations %v) to %s", h.ID, h.DBName, h.Table, operations, h.URL)
+	json.NewEncoder(w).Encode(Response{Success: true, Message: fmt.Sprintf("Webhook %d registered", h.ID), Result: h})
+}
+
+// removeWebhookHandler removes a webhook. Its pending deliveries are marked failed; its
+// delivery history is kept until it is purged.
+func removeWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	if currentRole == RoleSlave {
+		log.Println("Slave node received removeWebhook request, forwarding to master.")
+		forwardRequestToMaster(w, r)
+		return
+	}
+
+	var req struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid request: " + err.Error()})
+		return
+	}
+	res, err := db.Exec("DELETE FROM cluster.webhooks WHERE id = ?", req.ID)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error removing webhook: " + err.Error()})
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: fmt.Sprintf("Webhook %d not found", req.ID)})
+		return
+	}
+	invalidateWebhookCache()
+	_, err = db.Exec(`
+		UPDATE cluster.webhook_deliveries SET status = ?, last_error = 'webhook removed'
+		WHERE webhook_id = ? AND status = ?`, deliveryFailed, req.ID, deliveryPending)
+	if err != nil {
+		log.Printf("Error cancelling pending deliveries of webhook %d: %v", req.ID, err)
+	}
+	log.Printf("Removed webhook %d", req.ID)
+	json.NewEncoder(w).Encode(Response{Success: true, Message: fmt.Sprintf("Webhook %d removed", req.ID)})
+}
+
+// listWebhooksHandler lists the webhooks, of one database with ?db=, without their secrets.
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	hooks, err := loadWebhooks(SanitizeIdentifier(r.URL.Query().Get("db")))
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: err.Error()})
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	if hooks == nil {
+		hooks = []webhook{}
+	}
+	json.NewEncoder(w).Encode(Response{Success: true, Result: hooks})
+}
+
+// webhookDeliveriesHandler returns the delivery history, newest first: ?id= selects a webhook,
+// ?status= pending, delivered or failed, ?limit= the number of deliveries (default 50, at
+// most 500) and ?payload=true includes the payloads.
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if db == nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Database not connected"})
+		return
+	}
+
+	q := r.URL.Query()
+	query := `
+		SELECT id, webhook_id, operation, status, attempts, next_attempt_at, last_attempt_at,
+			last_status_code, last_error, created_at, delivered_at, payload
+		FROM cluster.webhook_deliveries WHERE 1 = 1`
+	var args []interface{}
+	if id := q.Get("id"); id != "" {
+		webhookID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid webhook id: " + id})
+			return
+		}
+		query += " AND webhook_id = ?"
+		args = append(args, webhookID)
+	}
+	if status := q.Get("status"); status != "" {
+		if status != deliveryPending && status != deliveryDelivered && status != deliveryFailed {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid status: " + status})
+			return
+		}
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	limit := 50
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Invalid limit: " + l})
+			return
+		}
+		limit = min(n, 500)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+	withPayload := q.Get("payload") == "true"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "Error loading deliveries: " + err.Error()})
+		return
+	}
+	defer rows.Close()
+	deliveries := []webhookDelivery{}
+	for rows.Next() {
+		var d webhookDelivery
+		var nextAttempt, lastAttempt, delivered sql.NullTime
+		var statusCode sql.NullInt64
+		var lastError sql.NullString
+		var payload []byte
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Operation, &d.Status, &d.Attempts, &nextAttempt, &lastAttempt,
+			&statusCode, &lastError, &d.CreatedAt, &delivered, &payload); err != nil {
+			json.NewEncoder(w).Encode(Response{Success: false, Message: "Error scanning deliveries: " + err.Error()})
+			return
+		}
+		if d.Status == deliveryPending && nextAttempt.Valid {
+			d.NextAttemptAt = &nextAttempt.Time
+		}
+		if lastAttempt.Valid {
+			d.LastAttemptAt = &lastAttempt.Time
+		}
+		if delivered.Valid {
+			d.DeliveredAt = &delivered.Time
+		}
+		d.LastStatusCode = int(statusCode.Int64)
+		d.LastError = lastError.String
+		if withPayload {
+			d.Payload = payload
+		}
+		deliveries = append(deliveries, d)
+	}
+	json.NewEncoder(w).Encode(Response{Success: true, Result: deliveries})
+}
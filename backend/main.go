@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -25,11 +27,21 @@ const (
 )
 
 type Config struct {
-	SelfURL     string            `json:"self_url"`
-	MasterURL   string            `json:"master_url"`
-	MySQL       MySQLConfig       `json:"mysql"`
-	Replication ReplicationConfig `json:"replication"`
-	ShardCount  int               `json:"shard_count"`
+	SelfURL      string             `json:"self_url"`
+	MasterURL    string             `json:"master_url"`
+	MySQL        MySQLConfig        `json:"mysql"`
+	Replication  ReplicationConfig  `json:"replication"`
+	ShardCount   int                `json:"shard_count"`
+	Forwarding   ForwardingConfig   `json:"forwarding"`
+	Idempotency  IdempotencyConfig  `json:"idempotency"`
+	Protocol     ProtocolConfig     `json:"mysql_protocol"`
+	Pool         PoolConfig         `json:"connection_pool"`
+	ResultCache  ResultCacheConfig  `json:"result_cache"`
+	RowTTL       RowTTLConfig       `json:"row_ttl"`
+	CDC          CDCConfig          `json:"change_data_capture"`
+	Webhooks     WebhookConfig      `json:"webhooks"`
+	RateLimit    RateLimitConfig    `json:"rate_limit"`
+	QueryTimeout QueryTimeoutConfig `json:"query_timeout"`
 }
 
 type MySQLConfig struct {
@@ -44,6 +56,108 @@ type ReplicationConfig struct {
 	Password string `json:"password"`
 }
 
+type ForwardingConfig struct {
+	FailoverWaitSeconds int `json:"failover_wait_seconds"`
+	AttemptTimeoutSecs  int `json:"attempt_timeout_seconds"`
+}
+
+type IdempotencyConfig struct {
+	WindowSeconds int `json:"window_seconds"`
+}
+
+// ProtocolConfig controls the optional MySQL wire-protocol listener. User and Password are the
+// credentials clients log in with; they default to the MySQL credentials of the node.
+type ProtocolConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// MaxPacketBytes bounds a client packet, split packets included.
+	MaxPacketBytes int `json:"max_packet_bytes"`
+	// A client must finish the handshake within HandshakeTimeoutSeconds, and is disconnected
+	// after IdleTimeoutSeconds without a command.
+	HandshakeTimeoutSeconds int `json:"handshake_timeout_seconds"`
+	IdleTimeoutSeconds      int `json:"idle_timeout_seconds"`
+}
+
+// PoolConfig bounds the per-database connection pools. MaxOpenTotal is the node-wide limit:
+// pools are only opened while every pool can reach MaxOpenPerDB connections within it.
+type PoolConfig struct {
+	MaxOpenPerDB        int `json:"max_open_per_db"`
+	MaxIdlePerDB        int `json:"max_idle_per_db"`
+	MaxOpenTotal        int `json:"max_open_total"`
+	IdleTimeoutSeconds  int `json:"idle_timeout_seconds"`
+	HealthCheckSeconds  int `json:"health_check_seconds"`
+	ConnMaxLifetimeSecs int `json:"conn_max_lifetime_seconds"`
+	StatementCacheSize  int `json:"statement_cache_size"`
+}
+
+// ResultCacheConfig bounds the result cache. Tables opt in with their own TTL; list-tables
+// results are cached for ListTablesTTLSeconds, or not at all when it is negative.
+type ResultCacheConfig struct {
+	MaxEntries           int `json:"max_entries"`
+	MaxBytes             int `json:"max_bytes"`
+	ListTablesTTLSeconds int `json:"list_tables_ttl_seconds"`
+}
+
+// RowTTLConfig paces the background expiry of rows: every IntervalSeconds the master deletes
+// expired rows of each table in batches of BatchSize, pausing BatchPauseMillis between
+// batches and stopping after MaxBatchesPerRun.
+type RowTTLConfig struct {
+	IntervalSeconds  int `json:"interval_seconds"`
+	BatchSize        int `json:"batch_size"`
+	BatchPauseMillis int `json:"batch_pause_ms"`
+	MaxBatchesPerRun int `json:"max_batches_per_run"`
+}
+
+// CDCConfig controls change data capture. Streams poll the change log every PollMillis and
+// wait up to GapWaitMillis for a missing position before skipping it.
+type CDCConfig struct {
+	Enabled        bool `json:"enabled"`
+	RetentionHours int  `json:"retention_hours"`
+	PollMillis     int  `json:"poll_ms"`
+	GapWaitMillis  int  `json:"gap_wait_ms"`
+}
+
+// WebhookConfig controls webhook deliveries: each attempt times out after TimeoutSeconds and
+// a failed delivery is retried with exponential backoff until MaxAttempts. Finished
+// deliveries are kept for RetentionHours.
+type WebhookConfig struct {
+	TimeoutSeconds     int `json:"timeout_seconds"`
+	MaxAttempts        int `json:"max_attempts"`
+	BackoffBaseSeconds int `json:"backoff_base_seconds"`
+	BackoffMaxSeconds  int `json:"backoff_max_seconds"`
+	RetentionHours     int `json:"retention_hours"`
+}
+
+// RateLimitConfig controls admission of API requests. Each client, by the API key in
+// APIKeyHeader if Clients configures it or else by its IP, may make RequestsPerSecond requests per route with bursts of
+// Burst; Routes and Clients override that per route template and per key or IP. At most
+// MaxConcurrentDBOps requests run at once; others wait up to QueueWaitMillis for a slot.
+type RateLimitConfig struct {
+	Enabled            bool                 `json:"enabled"`
+	RequestsPerSecond  float64              `json:"requests_per_second"`
+	Burst              int                  `json:"burst"`
+	Routes             map[string]RateLimit `json:"routes,omitempty"`
+	Clients            map[string]RateLimit `json:"clients,omitempty"`
+	APIKeyHeader       string               `json:"api_key_header"`
+	TrustForwardedFor  bool                 `json:"trust_forwarded_for"`
+	MaxConcurrentDBOps int                  `json:"max_concurrent_db_ops"`
+	QueueWaitMillis    int                  `json:"queue_wait_ms"`
+}
+
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// QueryTimeoutConfig bounds how long an API request may run its statements: DefaultSeconds
+// unless the request asks for another timeout, which is capped at MaxSeconds.
+type QueryTimeoutConfig struct {
+	DefaultSeconds int `json:"default_seconds"`
+	MaxSeconds     int `json:"max_seconds"`
+}
+
 type Node struct {
 	ID        string    `json:"id"`
 	Role      string    `json:"role"`
@@ -59,6 +173,14 @@ type SystemState struct {
 	Nodes         []*Node
 }
 
+// sqlExecutor is satisfied by both *sql.DB and *sql.Tx, so CRUD statements can run inside
+// or outside a transaction.
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type Response struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message"`
@@ -109,6 +231,121 @@ func loadConfig() error {
 	if config.Replication.User == "" {
 		config.Replication.User = "replica"
 	}
+	if config.Forwarding.FailoverWaitSeconds == 0 {
+		config.Forwarding.FailoverWaitSeconds = 20
+	}
+	if config.Forwarding.AttemptTimeoutSecs == 0 {
+		config.Forwarding.AttemptTimeoutSecs = 30
+	}
+	if config.Idempotency.WindowSeconds == 0 {
+		config.Idempotency.WindowSeconds = 24 * 60 * 60
+	}
+	if config.Pool.MaxOpenPerDB == 0 {
+		config.Pool.MaxOpenPerDB = 20
+	}
+	if config.Pool.MaxIdlePerDB == 0 {
+		config.Pool.MaxIdlePerDB = 5
+	}
+	if config.Pool.MaxOpenTotal == 0 {
+		config.Pool.MaxOpenTotal = 200
+	}
+	if config.Pool.MaxOpenTotal < config.Pool.MaxOpenPerDB {
+		config.Pool.MaxOpenTotal = config.Pool.MaxOpenPerDB
+	}
+	if config.Pool.IdleTimeoutSeconds == 0 {
+		config.Pool.IdleTimeoutSeconds = 5 * 60
+	}
+	if config.Pool.HealthCheckSeconds == 0 {
+		config.Pool.HealthCheckSeconds = 30
+	}
+	if config.Pool.ConnMaxLifetimeSecs == 0 {
+		config.Pool.ConnMaxLifetimeSecs = 3 * 60
+	}
+	if config.Pool.StatementCacheSize == 0 {
+		config.Pool.StatementCacheSize = 128
+	}
+	if config.ResultCache.MaxEntries == 0 {
+		config.ResultCache.MaxEntries = 10000
+	}
+	if config.ResultCache.MaxBytes == 0 {
+		config.ResultCache.MaxBytes = 64 << 20
+	}
+	if config.ResultCache.ListTablesTTLSeconds == 0 {
+		config.ResultCache.ListTablesTTLSeconds = 10
+	}
+	if config.RowTTL.IntervalSeconds == 0 {
+		config.RowTTL.IntervalSeconds = 60
+	}
+	if config.RowTTL.BatchSize == 0 {
+		config.RowTTL.BatchSize = 1000
+	}
+	if config.RowTTL.BatchPauseMillis == 0 {
+		config.RowTTL.BatchPauseMillis = 200
+	}
+	if config.RowTTL.MaxBatchesPerRun == 0 {
+		config.RowTTL.MaxBatchesPerRun = 50
+	}
+	if config.CDC.RetentionHours == 0 {
+		config.CDC.RetentionHours = 72
+	}
+	if config.CDC.PollMillis == 0 {
+		config.CDC.PollMillis = 500
+	}
+	if config.CDC.GapWaitMillis == 0 {
+		config.CDC.GapWaitMillis = 5000
+	}
+	if config.Webhooks.TimeoutSeconds == 0 {
+		config.Webhooks.TimeoutSeconds = 10
+	}
+	if config.Webhooks.MaxAttempts == 0 {
+		config.Webhooks.MaxAttempts = 10
+	}
+	if config.Webhooks.BackoffBaseSeconds == 0 {
+		config.Webhooks.BackoffBaseSeconds = 5
+	}
+	if config.Webhooks.BackoffMaxSeconds == 0 {
+		config.Webhooks.BackoffMaxSeconds = 3600
+	}
+	if config.Webhooks.RetentionHours == 0 {
+		config.Webhooks.RetentionHours = 168
+	}
+	if config.RateLimit.RequestsPerSecond == 0 {
+		config.RateLimit.RequestsPerSecond = 50
+	}
+	if config.RateLimit.Burst == 0 {
+		config.RateLimit.Burst = 100
+	}
+	if config.RateLimit.APIKeyHeader == "" {
+		config.RateLimit.APIKeyHeader = "X-API-Key"
+	}
+	if config.RateLimit.MaxConcurrentDBOps == 0 {
+		config.RateLimit.MaxConcurrentDBOps = 64
+	}
+	if config.RateLimit.QueueWaitMillis == 0 {
+		config.RateLimit.QueueWaitMillis = 1000
+	}
+	if config.QueryTimeout.DefaultSeconds == 0 {
+		config.QueryTimeout.DefaultSeconds = 30
+	}
+	if config.QueryTimeout.MaxSeconds == 0 {
+		config.QueryTimeout.MaxSeconds = 600
+	}
+	if config.Protocol.Port == 0 {
+		config.Protocol.Port = 3307
+	}
+	if config.Protocol.User == "" {
+		config.Protocol.User = config.MySQL.User
+		config.Protocol.Password = config.MySQL.Password
+	}
+	if config.Protocol.MaxPacketBytes == 0 {
+		config.Protocol.MaxPacketBytes = 64 << 20
+	}
+	if config.Protocol.HandshakeTimeoutSeconds == 0 {
+		config.Protocol.HandshakeTimeoutSeconds = 10
+	}
+	if config.Protocol.IdleTimeoutSeconds == 0 {
+		config.Protocol.IdleTimeoutSeconds = 8 * 60 * 60
+	}
 
 	if !strings.HasPrefix(config.SelfURL, "http://") || !strings.HasPrefix(config.MasterURL, "http://") {
 		return fmt.Errorf("self_url and master_url must start with http://")
@@ -133,9 +370,20 @@ func main() {
 
 	initializeNode()
 	go startHTTPServer()
+	if config.Protocol.Enabled {
+		go startMySQLProtocolServer()
+	}
 	go monitorMaster()
 	go heartbeat()
 	go registerWithMasterRetry()
+	go purgeExpiredIdempotencyKeys()
+	go reapExpiredTransactions()
+	go recoverInDoubtTransactionsLoop()
+	go maintainDBPools()
+	go expireRowsLoop()
+	go purgeChangeLog()
+	go deliverWebhooksLoop()
+	go purgeIdleRateBuckets()
 
 	select {}
 }
@@ -146,7 +394,7 @@ func initializeNode() {
 		config.MySQL.User, config.MySQL.Password, config.MySQL.Host, config.MySQL.Port)
 	log.Printf("Connecting to MySQL with: %s", connStr)
 
-	db, err = sql.Open("mysql", connStr)
+	db, err = openMySQL(connStr)
 	if err != nil {
 		log.Printf("Database connection failed: %v", err)
 	} else {
@@ -198,6 +446,217 @@ func initializeNode() {
 		return
 	}
 
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.idempotency_keys (
+			idem_key VARCHAR(128) PRIMARY KEY,
+			request_hash CHAR(64) NOT NULL,
+			owner VARCHAR(64) NOT NULL,
+			state VARCHAR(20) NOT NULL,
+			status_code INT NOT NULL,
+			content_type VARCHAR(255) NOT NULL,
+			response MEDIUMBLOB NOT NULL,
+			created_at DATETIME NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create idempotency_keys table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.xa_log (
+			gtrid VARCHAR(64) PRIMARY KEY,
+			db_name VARCHAR(255) NOT NULL,
+			branches TEXT NOT NULL,
+			state VARCHAR(20) NOT NULL,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			INDEX idx_xa_log_state (state)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create xa_log table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.table_links (
+			db_name VARCHAR(255) NOT NULL,
+			constraint_name VARCHAR(255) NOT NULL,
+			parent_table VARCHAR(255) NOT NULL,
+			parent_column VARCHAR(255) NOT NULL,
+			child_table VARCHAR(255) NOT NULL,
+			child_column VARCHAR(255) NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (db_name, constraint_name),
+			INDEX idx_table_links_parent (db_name, parent_table),
+			INDEX idx_table_links_child (db_name, child_table)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create table_links table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.table_versions (
+			db_name VARCHAR(255) NOT NULL,
+			table_name VARCHAR(255) NOT NULL,
+			version_column VARCHAR(255) NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (db_name, table_name)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create table_versions table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.table_cache (
+			db_name VARCHAR(255) NOT NULL,
+			table_name VARCHAR(255) NOT NULL,
+			ttl_seconds INT NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (db_name, table_name)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create table_cache table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.table_ttl (
+			db_name VARCHAR(255) NOT NULL,
+			table_name VARCHAR(255) NOT NULL,
+			ttl_column VARCHAR(255) NOT NULL,
+			retention_seconds BIGINT NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_run_at DATETIME NULL,
+			last_deleted BIGINT NOT NULL DEFAULT 0,
+			last_duration_ms BIGINT NOT NULL DEFAULT 0,
+			last_error TEXT NULL,
+			total_deleted BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY (db_name, table_name)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create table_ttl table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.change_log (
+			position BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+			db_name VARCHAR(255) NOT NULL,
+			table_name VARCHAR(255) NOT NULL,
+			operation VARCHAR(10) NOT NULL,
+			row_key JSON NULL,
+			before_image JSON NULL,
+			after_image JSON NULL,
+			created_at DATETIME(6) NOT NULL,
+			INDEX idx_change_log_created (created_at)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create change_log table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.change_log_state (
+			id TINYINT PRIMARY KEY,
+			purged_through BIGINT UNSIGNED NOT NULL
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create change_log_state table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.webhooks (
+			id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+			db_name VARCHAR(255) NOT NULL,
+			table_name VARCHAR(255) NOT NULL DEFAULT '',
+			operations VARCHAR(255) NOT NULL DEFAULT '',
+			url TEXT NOT NULL,
+			secret VARCHAR(255) NOT NULL,
+			created_at DATETIME NOT NULL,
+			INDEX idx_webhooks_db (db_name)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create webhooks table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.webhook_deliveries (
+			id BIGINT UNSIGNED AUTO_INCREMENT PRIMARY KEY,
+			webhook_id BIGINT UNSIGNED NOT NULL,
+			operation VARCHAR(64) NOT NULL,
+			payload MEDIUMBLOB NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME(6) NOT NULL,
+			last_attempt_at DATETIME(6) NULL,
+			last_status_code INT NULL,
+			last_error TEXT NULL,
+			created_at DATETIME(6) NOT NULL,
+			delivered_at DATETIME(6) NULL,
+			INDEX idx_webhook_deliveries_due (status, next_attempt_at),
+			INDEX idx_webhook_deliveries_webhook (webhook_id, id)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create webhook_deliveries table: %v", err)
+		return
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cluster.table_migrations (
+			db_name VARCHAR(255) NOT NULL,
+			table_name VARCHAR(255) NOT NULL,
+			version INT NOT NULL,
+			operation VARCHAR(32) NOT NULL,
+			change_spec JSON NOT NULL,
+			statement TEXT NOT NULL,
+			applied_at DATETIME(6) NOT NULL,
+			state VARCHAR(16) NOT NULL DEFAULT 'applied',
+			PRIMARY KEY (db_name, table_name, version)
+		)
+	`)
+	if err != nil {
+		log.Printf("Failed to create table_migrations table: %v", err)
+		return
+	}
+
+	// shard_of is the SQL twin of calculateShardID; it lets scatter-gather reads select the
+	// rows that belong to one shard.
+	_, err = db.Exec(`
+		CREATE FUNCTION IF NOT EXISTS cluster.shard_of(k VARCHAR(1024) CHARSET utf8mb4, n INT)
+		RETURNS INT DETERMINISTIC NO SQL
+		BEGIN
+			DECLARE h BIGINT DEFAULT 0;
+			DECLARE i INT DEFAULT 1;
+			IF k IS NULL OR n <= 0 THEN
+				RETURN 0;
+			END IF;
+			WHILE i <= CHAR_LENGTH(k) DO
+				SET h = (h * 31 + CONV(HEX(CONVERT(SUBSTRING(k, i, 1) USING utf32)), 16, 10)) % n;
+				SET i = i + 1;
+			END WHILE;
+			RETURN (h & 2147483647) % n;
+		END
+	`)
+	if err != nil {
+		log.Printf("Failed to create shard_of function, scatter-gather reads are disabled: %v", err)
+	} else {
+		scatterReadsEnabled = true
+	}
+
 	log.Printf("Checking role: selfURL=%s, masterURL=%s", config.SelfURL, config.MasterURL)
 	if config.SelfURL == config.MasterURL {
 		currentRole = RoleMaster
@@ -218,6 +677,13 @@ func initializeNode() {
 		log.Println("Initialized as MASTER node")
 		if db != nil {
 			configureMaster(db)
+			recoverInDoubtTransactions(0)
+			backfillTableLinks()
+			migrationMutex.Lock()
+			if err := reconcileMigrations(); err != nil {
+				log.Printf("Error settling unfinished migrations: %v", err)
+			}
+			migrationMutex.Unlock()
 		}
 	} else {
 		currentRole = RoleSlave
@@ -297,42 +763,72 @@ func registerWithMasterRetry() {
 	}
 }
 
+// apiRouter serves the HTTP API. The MySQL protocol front end runs its statements through it
+// too, so they pass the same admission, deadline and idempotency handling.
+var apiRouter = newRouter()
+
 func startHTTPServer() {
+	parts := strings.Split(config.SelfURL, ":")
+	port := "8080"
+	if len(parts) > 2 {
+		port = parts[2]
+	}
+
+	log.Println("Starting server on port", port)
+	log.Fatal(http.ListenAndServe(":"+port, apiRouter))
+}
+
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
 	r.Use(corsMiddleware)
 	r.Use(loggingMiddleware)
+	r.Use(rateLimitMiddleware)
+	r.Use(queryDeadlineMiddleware)
 
 	r.HandleFunc("/api/register", registerHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/nodes", listNodes).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/health", healthCheck).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/connection-pools", connectionPoolsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/rate-limits", rateLimitsHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/election", electionHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/new-master", newMasterHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/node-role", nodeRoleHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/shutdown-slave", shutdownSlaveHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/shutdown", shutdownHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/slave-online", slaveOnlineHandler).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/create-db", createDatabaseHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/create-db", idempotent(createDatabaseHandler)).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/list-databases", listDatabasesHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/drop-db", dropDatabaseHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/create-table", createTableHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/slave-create-table", slaveCreateTableHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/list-tables", listTablesHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/drop-table", dropTableHandler).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/link-tables", linkTablesHandler).Methods("POST", "OPTIONS")
-	r.HandleFunc("/api/crud", crudHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/link-tables", idempotent(linkTablesHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/migrations", listMigrationsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/migrations", idempotent(applyMigrationHandler)).Methods("POST")
+	r.HandleFunc("/api/enable-versioning", idempotent(enableVersioningHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/table-cache", idempotent(tableCacheHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/cache-stats", cacheStatsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/table-ttl", idempotent(tableTTLHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/ttl-policies", listTTLPoliciesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/cdc/stream", cdcStreamHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/webhooks", listWebhooksHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/webhooks", idempotent(registerWebhookHandler)).Methods("POST")
+	r.HandleFunc("/api/webhooks/remove", idempotent(removeWebhookHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/webhooks/deliveries", webhookDeliveriesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/crud", idempotent(crudHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/sql", sqlHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/transaction", idempotent(transactionHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/transaction/distributed", idempotent(distributedTransactionHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/transaction/begin", idempotent(beginTransactionHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/transaction/op", idempotent(transactionOpHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/transaction/commit", idempotent(commitTransactionHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/transaction/rollback", idempotent(rollbackTransactionHandler)).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/replicate", replicationHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/setup-replication", setupReplicationHandler).Methods("POST", "OPTIONS")
 
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./frontend")))
-
-	parts := strings.Split(config.SelfURL, ":")
-	port := "8080"
-	if len(parts) > 2 {
-		port = parts[2]
-	}
-
-	log.Println("Starting server on port", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	return r
 }
 
 func registerNode(url, role string, shardID int) {
@@ -465,6 +961,7 @@ func promoteToMaster() {
 
 	if db != nil {
 		configureMaster(db)
+		recoverInDoubtTransactions(0)
 	}
 
 	loadNodesFromDB()
@@ -586,6 +1083,9 @@ func checkNodeHealth(url string) bool {
 }
 
 func replicateToNodes(operationData map[string]interface{}) {
+	invalidateResultsForSignal(operationData)
+	wakeWebhookDelivery()
+
 	shardIDInterface, shardIdOk := operationData["shardId"]
 	if !shardIdOk {
 		log.Printf("CRITICAL: replicateToNodes called without shardId in operationData: %+v. Skipping replication signal.", operationData)
@@ -668,7 +1168,8 @@ func setNodeHealthStatus(nodeURL string, isHealthy bool) {
 	}
 }
 
-func notifySlaves(endpoint string) {
+// notifySlaves posts body to endpoint on every slave.
+func notifySlaves(endpoint string, body []byte) {
 	stateMutex.Lock()
 	defer stateMutex.Unlock()
 
@@ -676,7 +1177,7 @@ func notifySlaves(endpoint string) {
 		if node.Role == RoleSlave {
 			targetURL := node.URL + endpoint
 			log.Printf("Notifying slave %s: %s", node.URL, targetURL)
-			resp, err := http.Post(targetURL, "application/json", nil)
+			resp, err := http.Post(targetURL, "application/json", bytes.NewReader(body))
 			if err != nil {
 				log.Printf("Error notifying slave %s: %v", node.URL, err)
 				continue
@@ -783,7 +1284,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-API-Key")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -794,7 +1295,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func executeCreate(dbConn *sql.DB, table string, data map[string]interface{}) (interface{}, error) {
+func executeCreate(dbConn sqlExecutor, table string, data map[string]interface{}) (interface{}, error) {
 	log.Printf("Executing CREATE on table %s with data %+v", table, data)
 	if len(data) == 0 {
 		return nil, fmt.Errorf("no data provided for create operation")
@@ -804,10 +1305,13 @@ func executeCreate(dbConn *sql.DB, table string, data map[string]interface{}) (i
 	var placeholders []string
 	var values []interface{}
 
-	for k, v := range data {
+	// Columns are sorted so that requests with the same columns share a cached statement.
+	names := keys(data)
+	sort.Strings(names)
+	for _, k := range names {
 		columns = append(columns, SanitizeIdentifier(k))
 		placeholders = append(placeholders, "?")
-		values = append(values, v)
+		values = append(values, data[k])
 	}
 
 	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
@@ -816,7 +1320,7 @@ func executeCreate(dbConn *sql.DB, table string, data map[string]interface{}) (i
 		strings.Join(placeholders, ", "))
 
 	log.Printf("Executing SQL: %s with values: %v", query, values)
-	res, err := dbConn.Exec(query, values...)
+	res, err := cachedExec(dbConn, table, query, values...)
 	if err != nil {
 		return nil, fmt.Errorf("executeCreate failed: %w", err)
 	}
@@ -824,108 +1328,268 @@ func executeCreate(dbConn *sql.DB, table string, data map[string]interface{}) (i
 	return map[string]interface{}{"id": id}, nil
 }
 
-func executeRead(dbConn *sql.DB, table string, where map[string]interface{}) (interface{}, error) {
-	log.Printf("Executing READ on table %s with where %+v", table, where)
-	query := fmt.Sprintf("SELECT * FROM %s", SanitizeIdentifier(table))
-	var values []interface{}
-	if len(where) > 0 {
-		var conditions []string
-		for k, v := range where {
-			conditions = append(conditions, fmt.Sprintf("%s = ?", SanitizeIdentifier(k)))
-			values = append(values, v)
+// executeUpsert inserts a row or, when it collides with an existing row on conflictColumns,
+// updates updateColumns of that row. conflictColumns must be exactly the columns of a PRIMARY
+// or UNIQUE key, because ON DUPLICATE KEY UPDATE fires on any unique key collision.
+func executeUpsert(dbConn sqlExecutor, schema *TableSchema, data map[string]interface{}, conflictColumns, updateColumns []string) (interface{}, error) {
+	log.Printf("Executing UPSERT on table %s with data %+v conflict %v update %v", schema.Table, data, conflictColumns, updateColumns)
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no data provided for upsert operation")
+	}
+	if len(conflictColumns) == 0 {
+		return nil, fmt.Errorf("conflictColumns required for upsert operation")
+	}
+	if err := checkVersionedData(schema, data); err != nil {
+		return nil, err
+	}
+
+	uniqueKeys, err := loadUniqueKeys(schema.DBName, schema.Table)
+	if err != nil {
+		return nil, err
+	}
+	target := make([]string, len(conflictColumns))
+	for i, c := range conflictColumns {
+		col, ok := schema.Column(c)
+		if !ok {
+			return nil, fmt.Errorf("unknown conflict column '%s'", c)
+		}
+		if _, ok := data[col.Name]; !ok {
+			return nil, fmt.Errorf("conflict column '%s' must be present in data", col.Name)
+		}
+		target[i] = strings.ToLower(col.Name)
+	}
+	sort.Strings(target)
+	matched := false
+	for _, cols := range uniqueKeys {
+		indexCols := make([]string, len(cols))
+		for i, c := range cols {
+			indexCols[i] = strings.ToLower(c)
+		}
+		sort.Strings(indexCols)
+		if strings.Join(indexCols, ",") == strings.Join(target, ",") {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("conflict columns %v do not match a primary or unique key of table '%s'", conflictColumns, schema.Table)
+	}
+
+	columns := keys(data)
+	sort.Strings(columns)
+	quoted := make([]string, len(columns))
+	values := make([]interface{}, len(columns))
+	for i, c := range columns {
+		if !schema.HasColumn(c) {
+			return nil, fmt.Errorf("unknown column '%s'", c)
 		}
-		query += " WHERE " + strings.Join(conditions, " AND ")
+		quoted[i] = quoteIdentifier(c)
+		values[i] = data[c]
 	}
 
+	if len(updateColumns) == 0 {
+		for _, c := range columns {
+			isTarget := false
+			for _, t := range target {
+				if strings.EqualFold(c, t) {
+					isTarget = true
+				}
+			}
+			if !isTarget {
+				updateColumns = append(updateColumns, c)
+			}
+		}
+	}
+	var updates, comparisons []string
+	for _, c := range updateColumns {
+		col, ok := schema.Column(c)
+		if !ok {
+			return nil, fmt.Errorf("unknown update column '%s'", c)
+		}
+		if _, ok := lookupFoldOK(data, col.Name); !ok {
+			return nil, fmt.Errorf("update column '%s' must be present in data", col.Name)
+		}
+		name := quoteIdentifier(col.Name)
+		updates = append(updates, fmt.Sprintf("%s = new.%s", name, name))
+		comparisons = append(comparisons, fmt.Sprintf("%s <=> new.%s", name, name))
+	}
+	if schema.VersionColumn != "" && len(updates) > 0 {
+		updates = append([]string{versionBumpSQL(schema.VersionColumn, comparisons)}, updates...)
+	}
+	if len(updates) == 0 {
+		// Nothing to change on conflict; keep the existing row.
+		updates = append(updates, fmt.Sprintf("%s = %s", quoted[0], quoted[0]))
+	}
+
+	// The row alias names the proposed row; VALUES() in the update list is deprecated.
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) AS new ON DUPLICATE KEY UPDATE %s",
+		quoteIdentifier(schema.Table),
+		strings.Join(quoted, ", "),
+		strings.Join(createPlaceholders(len(columns)), ", "),
+		strings.Join(updates, ", "))
+
 	log.Printf("Executing SQL: %s with values: %v", query, values)
-	rows, err := dbConn.Query(query, values...)
+	res, err := cachedExec(dbConn, schema.Table, query, values...)
+	if err != nil {
+		return nil, fmt.Errorf("executeUpsert failed: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	rowsAffected, _ := res.RowsAffected()
+	action := "unchanged"
+	switch rowsAffected {
+	case 1:
+		action = "inserted"
+	case 2:
+		action = "updated"
+	}
+	return map[string]interface{}{"id": id, "rowsAffected": rowsAffected, "action": action}, nil
+}
+
+func executeRead(dbConn sqlExecutor, plan *readPlan, whereSQL string, whereArgs []interface{}) ([]map[string]interface{}, error) {
+	log.Printf("Executing READ on table %s where %s", plan.Table, whereSQL)
+	query, values := readQuery(plan, whereSQL, whereArgs)
+
+	log.Printf("Executing SQL: %s with values: %v", query, values)
+	rows, err := cachedQuery(dbConn, plan.Table, query, values...)
 	if err != nil {
 		return nil, fmt.Errorf("executeRead query failed: %w", err)
 	}
 	defer rows.Close()
-	columns, _ := rows.Columns()
+	scanner, err := newRowScanner(rows)
+	if err != nil {
+		return nil, fmt.Errorf("executeRead column types failed: %w", err)
+	}
 	var results []map[string]interface{}
 	for rows.Next() {
-		rowValues := make([]interface{}, len(columns))
-		rowScanArgs := make([]interface{}, len(columns))
-		for i := range rowValues {
-			rowScanArgs[i] = &rowValues[i]
-		}
-		if err := rows.Scan(rowScanArgs...); err != nil {
+		entry, err := scanner.scan(rows)
+		if err != nil {
 			return nil, fmt.Errorf("executeRead row scan failed: %w", err)
 		}
-		entry := make(map[string]interface{})
-		for i, col := range columns {
-			if b, ok := rowValues[i].([]byte); ok {
-				entry[col] = string(b)
-			} else {
-				entry[col] = rowValues[i]
-			}
-		}
 		results = append(results, entry)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("executeRead row iteration failed: %w", err)
+	}
 	return results, nil
 }
 
-func executeUpdate(dbConn *sql.DB, table string, data map[string]interface{}, where map[string]interface{}) (interface{}, error) {
-	log.Printf("Executing UPDATE on table %s with data %+v where %+v", table, data, where)
+// readQuery builds the SELECT of a read plan. Joins embed it as a derived table.
+func readQuery(plan *readPlan, whereSQL string, whereArgs []interface{}) (string, []interface{}) {
+	keysetSQL, keysetArgs := plan.keysetSQL()
+	whereSQL, values := andSQL(whereSQL, whereArgs, keysetSQL, keysetArgs)
+
+	query := fmt.Sprintf("SELECT %s FROM %s", plan.selectSQL(), SanitizeIdentifier(plan.Table))
+	if whereSQL != "" {
+		query += " WHERE " + whereSQL
+	}
+	query += plan.orderSQL()
+	if plan.Limit > 0 {
+		// One extra row tells the caller whether another page follows.
+		query += fmt.Sprintf(" LIMIT %d", plan.Limit+1)
+		if plan.Offset > 0 {
+			query += fmt.Sprintf(" OFFSET %d", plan.Offset)
+		}
+	}
+	return query, values
+}
+
+func countRows(dbConn sqlExecutor, table string, whereSQL string, whereArgs []interface{}) (int64, error) {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", SanitizeIdentifier(table))
+	if whereSQL != "" {
+		query += " WHERE " + whereSQL
+	}
+	var total int64
+	if err := dbConn.QueryRow(query, whereArgs...).Scan(&total); err != nil {
+		return 0, fmt.Errorf("countRows failed: %w", err)
+	}
+	return total, nil
+}
+
+func executeUpdate(dbConn sqlExecutor, schema *TableSchema, data map[string]interface{}, whereSQL string, whereArgs []interface{}, expectedVersion *int64) (interface{}, error) {
+	log.Printf("Executing UPDATE on table %s with data %+v where %s", schema.Table, data, whereSQL)
 	if len(data) == 0 {
 		return nil, fmt.Errorf("no data provided for update")
 	}
-	if len(where) == 0 {
+	if whereSQL == "" {
 		return nil, fmt.Errorf("no where clause for update; this would update all rows, which is usually unsafe")
 	}
+	if err := checkVersionedData(schema, data); err != nil {
+		return nil, err
+	}
 
+	columns := keys(data)
+	sort.Strings(columns)
+	for _, k := range columns {
+		if !schema.HasColumn(k) {
+			return nil, fmt.Errorf("unknown column '%s'", k)
+		}
+	}
 	var setClauses []string
 	var values []interface{}
-	for k, v := range data {
+	if schema.VersionColumn != "" {
+		var comparisons []string
+		for _, k := range columns {
+			comparisons = append(comparisons, fmt.Sprintf("%s <=> ?", SanitizeIdentifier(k)))
+			values = append(values, data[k])
+		}
+		setClauses = append(setClauses, versionBumpSQL(schema.VersionColumn, comparisons))
+	}
+	for _, k := range columns {
 		setClauses = append(setClauses, fmt.Sprintf("%s = ?", SanitizeIdentifier(k)))
-		values = append(values, v)
+		values = append(values, data[k])
 	}
-
-	var whereClauses []string
-	for k, v := range where {
-		whereClauses = append(whereClauses, fmt.Sprintf("%s = ?", SanitizeIdentifier(k)))
-		values = append(values, v)
+	rowWhereSQL, rowWhereArgs := whereSQL, whereArgs
+	whereSQL, whereArgs, err := versionedWhere(schema, whereSQL, whereArgs, expectedVersion)
+	if err != nil {
+		return nil, err
 	}
+	values = append(values, whereArgs...)
 
 	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s",
-		SanitizeIdentifier(table),
+		SanitizeIdentifier(schema.Table),
 		strings.Join(setClauses, ", "),
-		strings.Join(whereClauses, " AND "))
+		whereSQL)
 
 	log.Printf("Executing SQL: %s with values: %v", query, values)
-	res, err := dbConn.Exec(query, values...)
+	res, err := cachedExec(dbConn, schema.Table, query, values...)
 	if err != nil {
 		return nil, fmt.Errorf("executeUpdate failed: %w", err)
 	}
 	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 && expectedVersion != nil {
+		if err := checkVersionConflict(dbConn, schema, rowWhereSQL, rowWhereArgs, *expectedVersion); err != nil {
+			return nil, err
+		}
+	}
 	return map[string]interface{}{"rowsAffected": rowsAffected}, nil
 }
 
-func executeDelete(dbConn *sql.DB, table string, where map[string]interface{}) (interface{}, error) {
-	log.Printf("Executing DELETE on table %s where %+v", table, where)
-	if len(where) == 0 {
+func executeDelete(dbConn sqlExecutor, schema *TableSchema, whereSQL string, whereArgs []interface{}, expectedVersion *int64) (interface{}, error) {
+	log.Printf("Executing DELETE on table %s where %s", schema.Table, whereSQL)
+	if whereSQL == "" {
 		return nil, fmt.Errorf("no where clause for delete; this would delete all rows, which is usually unsafe")
 	}
-
-	var whereClauses []string
-	var values []interface{}
-	for k, v := range where {
-		whereClauses = append(whereClauses, fmt.Sprintf("%s = ?", SanitizeIdentifier(k)))
-		values = append(values, v)
+	rowWhereSQL, rowWhereArgs := whereSQL, whereArgs
+	whereSQL, whereArgs, err := versionedWhere(schema, whereSQL, whereArgs, expectedVersion)
+	if err != nil {
+		return nil, err
 	}
 
 	query := fmt.Sprintf("DELETE FROM %s WHERE %s",
-		SanitizeIdentifier(table),
-		strings.Join(whereClauses, " AND "))
+		SanitizeIdentifier(schema.Table),
+		whereSQL)
 
-	log.Printf("Executing SQL: %s with values: %v", query, values)
-	res, err := dbConn.Exec(query, values...)
+	log.Printf("Executing SQL: %s with values: %v", query, whereArgs)
+	res, err := cachedExec(dbConn, schema.Table, query, whereArgs...)
 	if err != nil {
 		return nil, fmt.Errorf("executeDelete failed: %w", err)
 	}
 	rowsAffected, _ := res.RowsAffected()
+	if rowsAffected == 0 && expectedVersion != nil {
+		if err := checkVersionConflict(dbConn, schema, rowWhereSQL, rowWhereArgs, *expectedVersion); err != nil {
+			return nil, err
+		}
+	}
 	return map[string]interface{}{"rowsAffected": rowsAffected}, nil
 }
 
@@ -945,36 +1609,8 @@ func createPlaceholders(n int) []string {
 	return placeholders
 }
 
-func buildSetClause(data map[string]interface{}) (string, []interface{}) {
-	clauses := make([]string, 0, len(data))
-	values := make([]interface{}, 0, len(data))
-
-	for k, v := range data {
-		clauses = append(clauses, fmt.Sprintf("%s = ?", k))
-		values = append(values, v)
-	}
-
-	return strings.Join(clauses, ", "), values
-}
-
-func buildWhereClause(where map[string]interface{}) (string, []interface{}) {
-	if where == nil || len(where) == 0 {
-		return "1=1", []interface{}{}
-	}
-
-	clauses := make([]string, 0, len(where))
-	values := make([]interface{}, 0, len(where))
-
-	for k, v := range where {
-		clauses = append(clauses, fmt.Sprintf("%s = ?", k))
-		values = append(values, v)
-	}
-
-	return strings.Join(clauses, " AND "), values
-}
-
 func rowsToJSON(rows *sql.Rows) ([]map[string]interface{}, error) {
-	columns, err := rows.Columns()
+	scanner, err := newRowScanner(rows)
 	if err != nil {
 		return nil, err
 	}
@@ -982,28 +1618,10 @@ func rowsToJSON(rows *sql.Rows) ([]map[string]interface{}, error) {
 	result := make([]map[string]interface{}, 0)
 
 	for rows.Next() {
-		values := make([]interface{}, len(columns))
-		valuePtrs := make([]interface{}, len(columns))
-
-		for i := range columns {
-			valuePtrs[i] = &values[i]
-		}
-
-		if err := rows.Scan(valuePtrs...); err != nil {
+		entry, err := scanner.scan(rows)
+		if err != nil {
 			return nil, err
 		}
-
-		entry := make(map[string]interface{})
-		for i, col := range columns {
-			val := values[i]
-			b, ok := val.([]byte)
-			if ok {
-				entry[col] = string(b)
-			} else {
-				entry[col] = val
-			}
-		}
-
 		result = append(result, entry)
 	}
 
@@ -1031,18 +1649,80 @@ func forwardRequestToMaster(w http.ResponseWriter, r *http.Request) {
 
 	r.Body = io.NopCloser(bytes.NewBuffer(originalBody))
 
-	targetURL := state.CurrentMaster + r.URL.Path
+	// Every attempt carries the same key so that the master applies the write at most once,
+	// even if an earlier attempt reached it before the connection failed.
+	idempotencyKey := requestIdempotencyKey(r, originalBody)
+	if idempotencyKey == "" {
+		idempotencyKey = newIdempotencyKey("fwd")
+	}
+
+	deadline := time.Now().Add(time.Duration(config.Forwarding.FailoverWaitSeconds) * time.Second)
+	attempt := 0
+	for {
+		attempt++
+		masterURL := state.CurrentMaster
+		if masterURL == "" || (masterURL == config.SelfURL && currentRole != RoleMaster) {
+			if time.Now().After(deadline) {
+				break
+			}
+			waitForMasterChange(masterURL, deadline)
+			continue
+		}
+
+		resp, err := sendToMaster(masterURL, r, originalBody, idempotencyKey)
+		if err == nil && !isMasterUnavailableStatus(resp.StatusCode) {
+			defer resp.Body.Close()
+			for name, headers := range resp.Header {
+				for _, h := range headers {
+					w.Header().Add(name, h)
+				}
+			}
+			w.WriteHeader(resp.StatusCode)
+
+			if _, err := io.Copy(w, resp.Body); err != nil {
+				log.Printf("Error copying response body from master: %v", err)
+			}
+			log.Printf("Successfully forwarded request to master %s on attempt %d and relayed response (status: %d)", masterURL, attempt, resp.StatusCode)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Forward attempt %d to master %s failed: %v", attempt, masterURL, err)
+			if ctxErr := r.Context().Err(); ctxErr != nil {
+				if ctxErr == context.DeadlineExceeded {
+					http.Error(w, "Request timed out while forwarded to the master", http.StatusGatewayTimeout)
+				}
+				return
+			}
+		} else {
+			log.Printf("Forward attempt %d to master %s returned status %d", attempt, masterURL, resp.StatusCode)
+			resp.Body.Close()
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+		waitForMasterChange(masterURL, deadline)
+	}
+
+	log.Printf("Giving up forwarding %s %s after %d attempts: no master became available within %ds",
+		r.Method, r.URL.Path, attempt, config.Forwarding.FailoverWaitSeconds)
+	http.Error(w, "Master node not available; failover did not complete in time", http.StatusServiceUnavailable)
+}
+
+func sendToMaster(masterURL string, r *http.Request, body []byte, idempotencyKey string) (*http.Response, error) {
+	targetURL := masterURL + r.URL.Path
 	if r.URL.RawQuery != "" {
 		targetURL += "?" + r.URL.RawQuery
 	}
 
-	log.Printf("Forwarding request from slave (%s) to master (%s): %s %s", config.SelfURL, state.CurrentMaster, r.Method, targetURL)
+	log.Printf("Forwarding request from slave (%s) to master (%s): %s %s", config.SelfURL, masterURL, r.Method, targetURL)
 
-	masterReq, err := http.NewRequest(r.Method, targetURL, bytes.NewBuffer(originalBody))
+	// The master's statements end with this request: when the client leaves or the deadline
+	// passes, the connection to the master is closed and the master cancels them.
+	masterReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, bytes.NewBuffer(body))
 	if err != nil {
-		log.Printf("Error creating request to master: %v", err)
-		http.Error(w, "Failed to create request for master", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("failed to create request for master: %w", err)
 	}
 
 	for name, headers := range r.Header {
@@ -1050,34 +1730,33 @@ func forwardRequestToMaster(w http.ResponseWriter, r *http.Request) {
 			masterReq.Header.Add(name, h)
 		}
 	}
+	masterReq.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+	masterReq.Header.Set(ForwardedByHeader, config.SelfURL)
+	propagateDeadline(r.Context(), masterReq)
 
-	if len(originalBody) > 0 && masterReq.Header.Get("Content-Type") == "" {
-		originalContentType := r.Header.Get("Content-Type")
-		if originalContentType != "" {
-			masterReq.Header.Set("Content-Type", originalContentType)
-		} else {
-			masterReq.Header.Set("Content-Type", "application/json")
-		}
+	if len(body) > 0 && masterReq.Header.Get("Content-Type") == "" {
+		masterReq.Header.Set("Content-Type", "application/json")
 	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(masterReq)
-	if err != nil {
-		log.Printf("Error forwarding request to master %s: %v", targetURL, err)
-		http.Error(w, fmt.Sprintf("Failed to forward request to master: %v", err), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
+	client := &http.Client{Timeout: time.Duration(config.Forwarding.AttemptTimeoutSecs) * time.Second}
+	return client.Do(masterReq)
+}
 
-	for name, headers := range resp.Header {
-		for _, h := range headers {
-			w.Header().Add(name, h)
-		}
-	}
-	w.WriteHeader(resp.StatusCode)
+func isMasterUnavailableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		log.Printf("Error copying response body from master: %v", err)
+// waitForMasterChange blocks until an election replaces previousMaster, the old master
+// answers health checks again, or the deadline passes.
+func waitForMasterChange(previousMaster string, deadline time.Time) {
+	for time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		if state.CurrentMaster != previousMaster {
+			log.Printf("Master changed from %s to %s while forwarding", previousMaster, state.CurrentMaster)
+			return
+		}
+		if previousMaster != "" && previousMaster != config.SelfURL && checkNodeHealth(previousMaster) {
+			return
+		}
 	}
-	log.Printf("Successfully forwarded request to master and relayed response (status: %d)", resp.StatusCode)
 }
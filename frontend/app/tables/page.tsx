@@ -4,7 +4,7 @@ import { useState, useEffect } from "react"
 import { useSearchParams } from "next/navigation"
 import { Table2, Plus, Trash2, ArrowLeft, LinkIcon } from "lucide-react"
 
-import { apiService, type Table } from "@/lib/api-service"
+import { apiService, type ColumnDefinition, type Table } from "@/lib/api-service"
 import { Button } from "@/components/ui/button"
 import { Card, CardContent, CardDescription, CardHeader, CardTitle } from "@/components/ui/card"
 import { Input } from "@/components/ui/input"
@@ -48,7 +48,7 @@ export default function TablesPage() {
   // New table form state
   const [newTableName, setNewTableName] = useState("")
   const [columns, setColumns] = useState<{ name: string; type: string }[]>([
-    { name: "id", type: "INT AUTO_INCREMENT PRIMARY KEY" },
+    { name: "id", type: "INT" },
   ])
 
   // Link tables form state
@@ -161,11 +161,14 @@ export default function TablesPage() {
       }
     }
 
-    // Convert columns to the format expected by the API
-    const columnsObj: Record<string, string> = {}
-    columns.forEach((col) => {
-      columnsObj[col.name] = col.type
-    })
+    // The first column is the primary key; an integer one is numbered automatically.
+    const columnDefinitions: ColumnDefinition[] = columns.map((col, index) => ({
+      name: col.name,
+      type: col.type,
+      nullable: index > 0,
+      autoIncrement: index === 0 && /INT$/i.test(col.type.trim().split(/[\s(]/)[0]),
+    }))
+    const primaryKey = [columns[0].name]
 
     // Show a loading toast
     toast({
@@ -176,13 +179,14 @@ export default function TablesPage() {
     console.log("Creating table with data:", {
       dbName,
       tableName: newTableName,
-      columns: columnsObj,
+      columns: columnDefinitions,
+      primaryKey,
       shardId: selectedShardId,
     })
 
     try {
       // Use the selected shard ID instead of calculating it
-      const response = await apiService.createTable(dbName, newTableName, columnsObj, selectedShardId)
+      const response = await apiService.createTable(dbName, newTableName, columnDefinitions, selectedShardId, primaryKey)
       console.log("Create table response:", response)
 
       if (response.success) {
@@ -191,7 +195,7 @@ export default function TablesPage() {
           description: response.message || "Table created successfully",
         })
         setNewTableName("")
-        setColumns([{ name: "id", type: "INT AUTO_INCREMENT PRIMARY KEY" }])
+        setColumns([{ name: "id", type: "INT" }])
         setCreateDialogOpen(false)
         fetchTables()
       } else {
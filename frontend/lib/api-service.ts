@@ -33,6 +33,15 @@ export interface Column {
   type: string
 }
 
+// A column of a table to create. type is a MySQL type such as "INT UNSIGNED" or "VARCHAR(255)".
+export interface ColumnDefinition {
+  name: string
+  type: string
+  nullable?: boolean
+  autoIncrement?: boolean
+  default?: string | number | boolean | null
+}
+
 class ApiService {
   private async request<T>(endpoint: string, options?: RequestInit): Promise<ApiResponse<T>> {
     try {
@@ -96,22 +105,18 @@ class ApiService {
     return this.request<Table[]>(`/list-tables?db=${dbName}`)
   }
 
-  // Update the createTable function to handle the column definitions better
+  // The backend generates the DDL from this description; see ColumnDefinition
   async createTable(
     dbName: string,
     tableName: string,
-    columns: Record<string, string>,
+    columns: ColumnDefinition[],
     shardId: number,
+    primaryKey: string[] = [],
   ): Promise<ApiResponse> {
-    // Convert columns object to a comma-separated string of column definitions
-    const columnDefinitions = Object.entries(columns)
-      .map(([name, type]) => `${name} ${type}`)
-      .join(", ")
-
-    // Create URL with query parameters as expected by the backend
-    const url = `${API_BASE_URL}/create-table?db=${encodeURIComponent(dbName)}&name=${encodeURIComponent(tableName)}&shard_id=${shardId}&columns=${encodeURIComponent(columnDefinitions)}`
+    const url = `${API_BASE_URL}/create-table`
+    const body = JSON.stringify({ dbName, tableName, shardId, columns, primaryKey })
 
-    console.log("Creating table with URL:", url) // Debug log
+    console.log("Creating table:", body) // Debug log
 
     try {
       const response = await fetch(url, {
@@ -119,6 +124,7 @@ class ApiService {
         headers: {
           "Content-Type": "application/json",
         },
+        body,
       })
 
       const text = await response.text()